@@ -0,0 +1,327 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessLogFormat selects how access log entries are written.
+type AccessLogFormat string
+
+const (
+	// AccessLogJSON writes one JSON object per line.
+	AccessLogJSON AccessLogFormat = "json"
+	// AccessLogLogfmt writes key=value pairs, one entry per line.
+	AccessLogLogfmt AccessLogFormat = "logfmt"
+)
+
+// QueryAction is what the access log does with a query-string parameter.
+type QueryAction string
+
+const (
+	// QueryKeep logs the parameter with its value.
+	QueryKeep QueryAction = "keep"
+	// QueryRedact logs the parameter name with its value replaced.
+	QueryRedact QueryAction = "redact"
+	// QueryDrop leaves the parameter out.
+	QueryDrop QueryAction = "drop"
+)
+
+// redactedValue replaces the values of redacted query parameters.
+const redactedValue = "<redacted>"
+
+// QueryRedaction decides per parameter how query strings are logged.
+// Parameters not listed get the Default action.
+type QueryRedaction struct {
+	Params  map[string]QueryAction
+	Default QueryAction
+}
+
+// ParseQueryRedaction parses a comma-separated list of name:action entries,
+// where action is keep, redact or drop and the name * sets the default, e.g.
+// "collection:keep,type:keep,*:redact". The default is to redact.
+func ParseQueryRedaction(spec string) (*QueryRedaction, error) {
+	q := &QueryRedaction{Params: make(map[string]QueryAction), Default: QueryRedact}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, action, ok := strings.Cut(entry, ":")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid query redaction %q: want name:action", entry)
+		}
+		switch QueryAction(action) {
+		case QueryKeep, QueryRedact, QueryDrop:
+		default:
+			return nil, fmt.Errorf("invalid query redaction %q: action must be keep, redact or drop", entry)
+		}
+		if name == "*" {
+			q.Default = QueryAction(action)
+		} else {
+			q.Params[name] = QueryAction(action)
+		}
+	}
+	return q, nil
+}
+
+// String formats the redaction for log lines.
+func (q *QueryRedaction) String() string {
+	names := make([]string, 0, len(q.Params))
+	for name := range q.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	entries := make([]string, 0, len(names)+1)
+	for _, name := range names {
+		entries = append(entries, name+":"+string(q.Params[name]))
+	}
+	return strings.Join(append(entries, "*:"+string(q.Default)), ",")
+}
+
+// Apply returns rawQuery as it should be logged, keeping the parameters in
+// their original order.
+func (q *QueryRedaction) Apply(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	var kept []string
+	for _, pair := range strings.Split(rawQuery, "&") {
+		if pair == "" {
+			continue
+		}
+		rawName, _, _ := strings.Cut(pair, "=")
+		name, err := url.QueryUnescape(rawName)
+		if err != nil {
+			name = rawName
+		}
+		action, ok := q.Params[name]
+		if !ok {
+			action = q.Default
+		}
+		switch action {
+		case QueryKeep:
+			kept = append(kept, pair)
+		case QueryRedact:
+			kept = append(kept, rawName+"="+redactedValue)
+		}
+	}
+	return strings.Join(kept, "&")
+}
+
+// AccessLog writes one entry per request, recording who asked, what was
+// asked, and how the proxy decided. It is safe for concurrent use.
+type AccessLog struct {
+	Format AccessLogFormat
+	Query  *QueryRedaction
+
+	mu  sync.Mutex
+	out io.Writer
+	now func() time.Time
+}
+
+// NewAccessLog returns an access log writing to out. A nil query redacts
+// every parameter.
+func NewAccessLog(out io.Writer, format AccessLogFormat, query *QueryRedaction) *AccessLog {
+	if query == nil {
+		query = &QueryRedaction{Default: QueryRedact}
+	}
+	return &AccessLog{Format: format, Query: query, out: out, now: time.Now}
+}
+
+// AccessLogFromEnv builds an access log writing to standard error, with
+// the format from ACCESS_LOG_FORMAT (json or logfmt, default json) and the
+// query redaction from ACCESS_LOG_QUERY.
+func AccessLogFromEnv() (*AccessLog, error) {
+	format := AccessLogFormat(GetEnv("ACCESS_LOG_FORMAT", string(AccessLogJSON)))
+	if format != AccessLogJSON && format != AccessLogLogfmt {
+		return nil, fmt.Errorf("invalid ACCESS_LOG_FORMAT %q: must be json or logfmt", format)
+	}
+	query, err := ParseQueryRedaction(os.Getenv("ACCESS_LOG_QUERY"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ACCESS_LOG_QUERY: %w", err)
+	}
+	return NewAccessLog(os.Stderr, format, query), nil
+}
+
+// String formats the configuration for log lines.
+func (l *AccessLog) String() string {
+	return fmt.Sprintf("format=%s query=%s", l.Format, l.Query)
+}
+
+// Wrap returns a handler logging each request served by handler. The
+// decision fields are filled in when handler is a UnixReverseProxy.
+func (l *AccessLog) Wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := l.now()
+		decision, r := decisionFor(r)
+		var received *countingReader
+		if r.Body != nil && r.Body != http.NoBody {
+			received = &countingReader{ReadCloser: r.Body}
+			r.Body = received
+		}
+		// Captured before handler may rewrite the path.
+		method, path, rawQuery := r.Method, r.URL.Path, r.URL.RawQuery
+		rec := &statusRecorder{ResponseWriter: w}
+
+		handler.ServeHTTP(rec, r)
+
+		entry := accessLogEntry{}
+		entry.add("time", start.UTC().Format(time.RFC3339Nano))
+		if cred, ok := PeerCredFromContext(r.Context()); ok {
+			entry.add("peer_uid", int64(cred.UID))
+			entry.add("peer_gid", int64(cred.GID))
+			entry.add("peer_pid", int64(cred.PID))
+		}
+		entry.add("method", method)
+		if decision.Path != "" {
+			path = decision.Path
+		}
+		entry.add("path", path)
+		if decision.Database != "" {
+			entry.add("database", decision.Database)
+		}
+		if query := l.Query.Apply(rawQuery); query != "" {
+			entry.add("query", query)
+		}
+		entry.add("status", int64(rec.statusCode()))
+		var bytesIn int64
+		if received != nil {
+			bytesIn = received.n.Load()
+		}
+		entry.add("bytes_in", bytesIn)
+		entry.add("bytes_out", rec.written)
+		entry.add("duration_ms", milliseconds(l.now().Sub(start)))
+		if decision.Upstream > 0 {
+			entry.add("upstream_ms", milliseconds(decision.Upstream))
+		}
+		if decision.Category != "" {
+			entry.add("category", string(decision.Category))
+			if decision.Allowed {
+				entry.add("decision", "allowed")
+			} else {
+				entry.add("decision", "denied")
+			}
+		}
+		if decision.Rule != "" {
+			entry.add("rule", decision.Rule)
+		}
+		if decision.Err != nil {
+			entry.add("error", decision.Err.Error())
+		}
+		l.write(entry)
+	})
+}
+
+func (l *AccessLog) write(entry accessLogEntry) {
+	var line []byte
+	if l.Format == AccessLogLogfmt {
+		line = entry.logfmt()
+	} else {
+		line = entry.json()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.out.Write(line)
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// accessLogEntry is an ordered list of fields. Values are strings, int64 or
+// float64.
+type accessLogEntry struct {
+	keys   []string
+	values []any
+}
+
+func (e *accessLogEntry) add(key string, value any) {
+	e.keys = append(e.keys, key)
+	e.values = append(e.values, value)
+}
+
+func (e *accessLogEntry) json() []byte {
+	b := []byte{'{'}
+	for i, key := range e.keys {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = strconv.AppendQuote(b, key)
+		b = append(b, ':')
+		value, err := json.Marshal(e.values[i])
+		if err != nil {
+			value = []byte("null")
+		}
+		b = append(b, value...)
+	}
+	return append(b, '}', '\n')
+}
+
+func (e *accessLogEntry) logfmt() []byte {
+	var b []byte
+	for i, key := range e.keys {
+		if i > 0 {
+			b = append(b, ' ')
+		}
+		b = append(b, key...)
+		b = append(b, '=')
+		switch value := e.values[i].(type) {
+		case string:
+			if value == "" || strings.ContainsAny(value, " =\"\\") || strings.ContainsFunc(value, func(r rune) bool { return r < ' ' }) {
+				b = strconv.AppendQuote(b, value)
+			} else {
+				b = append(b, value...)
+			}
+		case int64:
+			b = strconv.AppendInt(b, value, 10)
+		case float64:
+			b = strconv.AppendFloat(b, value, 'f', -1, 64)
+		}
+	}
+	return append(b, '\n')
+}
+
+// statusRecorder captures the status code and body size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(p)
+	s.written += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+func (s *statusRecorder) statusCode() int {
+	if s.status == 0 {
+		return http.StatusOK
+	}
+	return s.status
+}
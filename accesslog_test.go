@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseQueryRedaction(t *testing.T) {
+	tests := []struct {
+		spec    string
+		query   string
+		want    string
+		wantErr bool
+	}{
+		{"", "collection=users&waitForSync=true", "collection=<redacted>&waitForSync=<redacted>", false},
+		{"collection:keep", "collection=users&waitForSync=true", "collection=users&waitForSync=<redacted>", false},
+		{"collection:keep,*:drop", "collection=users&waitForSync=true", "collection=users", false},
+		{"*:keep,token:drop", "token=s3cret&type=documents", "type=documents", false},
+		{"my key:keep", "my+key=1&my%20key=2", "my+key=1&my%20key=2", false},
+		{"collection", "", "", true},
+		{"collection:hide", "", "", true},
+		{":keep", "", "", true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.spec, func(t *testing.T) {
+			q, err := ParseQueryRedaction(tc.spec)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("ParseQueryRedaction(%q) should fail", tc.spec)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseQueryRedaction(%q) error = %v", tc.spec, err)
+			}
+			if got := q.Apply(tc.query); got != tc.want {
+				t.Errorf("Apply(%q) = %q, want %q", tc.query, got, tc.want)
+			}
+		})
+	}
+}
+
+func newTestAccessLog(format AccessLogFormat, query string) (*AccessLog, *bytes.Buffer) {
+	var out bytes.Buffer
+	redaction, err := ParseQueryRedaction(query)
+	if err != nil {
+		panic(err)
+	}
+	l := NewAccessLog(&out, format, redaction)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	l.now = func() time.Time {
+		now = now.Add(5 * time.Millisecond)
+		return now
+	}
+	return l, &out
+}
+
+func TestAccessLog_JSON(t *testing.T) {
+	socket := startFakeUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"result": []}`))
+	}))
+	proxy := NewUnixReverseProxy(socket, AllowReadOnly)
+	databases, err := ParseDatabaseAccess("", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.SetDatabaseAccess(databases)
+	l, out := newTestAccessLog(AccessLogJSON, "batchSize:keep")
+	handler := l.Wrap(proxy)
+
+	cred := PeerCred{UID: 1000, GID: 100, PID: 42}
+	serve := func(method, target, body string) map[string]any {
+		t.Helper()
+		out.Reset()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req = req.WithContext(WithPeerCred(req.Context(), cred))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		var entry map[string]any
+		if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+			t.Fatalf("invalid JSON entry %q: %v", out.String(), err)
+		}
+		return entry
+	}
+
+	entry := serve(http.MethodPost, "/_api/cursor?batchSize=10&token=x", `{"query": "FOR d IN c RETURN d"}`)
+	want := map[string]any{
+		"time":        "2024-05-01T12:00:00.005Z",
+		"peer_uid":    float64(1000),
+		"peer_gid":    float64(100),
+		"peer_pid":    float64(42),
+		"method":      "POST",
+		"path":        "/_api/cursor",
+		"database":    "app",
+		"query":       "batchSize=10&token=<redacted>",
+		"status":      float64(201),
+		"bytes_in":    float64(32),
+		"bytes_out":   float64(14),
+		"duration_ms": float64(5),
+		"category":    "data-read",
+		"decision":    "allowed",
+		"rule":        "read-only-cursor",
+	}
+	if _, ok := entry["upstream_ms"]; !ok {
+		t.Error("allowed request lacks upstream_ms")
+	}
+	delete(entry, "upstream_ms")
+	for key, value := range want {
+		if entry[key] != value {
+			t.Errorf("%s = %v, want %v", key, entry[key], value)
+		}
+	}
+	if len(entry) != len(want) {
+		t.Errorf("entry = %v, want only %v", entry, want)
+	}
+
+	entry = serve(http.MethodPost, "/_db/app/_api/cursor", `{"query": "FOR d IN c REMOVE d IN c"}`)
+	if entry["status"] != float64(403) || entry["decision"] != "denied" {
+		t.Errorf("denied request logged as %v", entry)
+	}
+	if entry["error"] != `forbidden keyword "REMOVE" detected in AQL` {
+		t.Errorf("error = %v", entry["error"])
+	}
+	if _, ok := entry["upstream_ms"]; ok {
+		t.Error("denied request has upstream_ms")
+	}
+}
+
+func TestAccessLog_Logfmt(t *testing.T) {
+	l, out := newTestAccessLog(AccessLogLogfmt, "")
+	handler := l.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusTeapot)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/a%20b?x=1", nil))
+
+	want := `time=2024-05-01T12:00:00.005Z method=GET path="/a b" query="x=<redacted>" status=418 bytes_in=0 bytes_out=5 duration_ms=5` + "\n"
+	if out.String() != want {
+		t.Errorf("entry = %q, want %q", out.String(), want)
+	}
+}
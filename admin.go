@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// AdminSocketPermissions are the default permissions for admin sockets, so
+// that a monitoring agent in the socket's group can scrape metrics.
+const AdminSocketPermissions = 0o660
+
+// ParseAdminAddress parses an ADMIN_LISTEN value: "unix:/path" or an
+// absolute path for a Unix socket, "tcp:host:port" or "host:port" for TCP.
+func ParseAdminAddress(addr string) (network, address string, err error) {
+	switch {
+	case strings.HasPrefix(addr, "unix:"):
+		network, address = "unix", strings.TrimPrefix(addr, "unix:")
+	case strings.HasPrefix(addr, "tcp:"):
+		network, address = "tcp", strings.TrimPrefix(addr, "tcp:")
+	case strings.HasPrefix(addr, "/"):
+		network, address = "unix", addr
+	default:
+		network, address = "tcp", addr
+	}
+	if address == "" {
+		return "", "", fmt.Errorf("invalid admin address %q", addr)
+	}
+	if network == "unix" && !strings.HasPrefix(address, "/") {
+		return "", "", fmt.Errorf("invalid admin address %q: socket path must be absolute", addr)
+	}
+	if network == "tcp" {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return "", "", fmt.Errorf("invalid admin address %q: %w", addr, err)
+		}
+	}
+	return network, address, nil
+}
+
+// NewAdminHandler returns the handler for the admin listener, serving
+// metrics at /metrics and the upstream's readiness at /readyz. A nil health
+// is always ready.
+func NewAdminHandler(metrics *Metrics, health *HealthChecker) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metrics)
+	mux.Handle("GET /readyz", health)
+	return mux
+}
+
+// ListenAdmin opens the admin listener at addr (see ParseAdminAddress).
+func ListenAdmin(addr string) (net.Listener, error) {
+	network, address, err := ParseAdminAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" {
+		return listenUnix(address, SocketOptions{Mode: AdminSocketPermissions, UID: -1, GID: -1})
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	return listener, nil
+}
+
+// StartAdminFromEnv starts the admin listener, if there is one, and
+// attaches a metrics collector to the proxies, shared by all of them and
+// labelled with each one's listener name. The listener is the activated
+// socket named AdminListenerName or, failing that, the address in
+// ADMIN_LISTEN; its readiness endpoint reports health. It is served in the
+// background; the returned server is nil when there is no admin listener.
+func StartAdminFromEnv(activated []ActivatedListener, health *HealthChecker, proxies ...*UnixReverseProxy) (*http.Server, error) {
+	listener, ok := activatedListener(activated, func(name string) bool { return name == AdminListenerName })
+	if !ok {
+		addr := GetEnv("ADMIN_LISTEN", "")
+		if addr == "" {
+			return nil, nil
+		}
+		var err error
+		if listener, err = ListenAdmin(addr); err != nil {
+			return nil, err
+		}
+	}
+	metrics := NewMetrics()
+	for _, proxy := range proxies {
+		proxy.SetMetrics(metrics.Listener(proxy.name))
+	}
+
+	server := NewServerWithTimeouts(NewAdminHandler(metrics, health))
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("admin server error: %v", err)
+		}
+	}()
+	log.Printf("admin endpoint listening on %s", listener.Addr())
+	return server, nil
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseAdminAddress(t *testing.T) {
+	tests := []struct {
+		addr    string
+		network string
+		address string
+		wantErr bool
+	}{
+		{"unix:/run/arango-proxy/admin.sock", "unix", "/run/arango-proxy/admin.sock", false},
+		{"/run/arango-proxy/admin.sock", "unix", "/run/arango-proxy/admin.sock", false},
+		{"tcp:127.0.0.1:9180", "tcp", "127.0.0.1:9180", false},
+		{"localhost:9180", "tcp", "localhost:9180", false},
+		{":9180", "tcp", ":9180", false},
+		{"unix:", "", "", true},
+		{"unix:admin.sock", "", "", true},
+		{"localhost", "", "", true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.addr, func(t *testing.T) {
+			network, address, err := ParseAdminAddress(tc.addr)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("ParseAdminAddress(%q) should fail", tc.addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseAdminAddress(%q) error = %v", tc.addr, err)
+			}
+			if network != tc.network || address != tc.address {
+				t.Errorf("ParseAdminAddress(%q) = %q, %q, want %q, %q", tc.addr, network, address, tc.network, tc.address)
+			}
+		})
+	}
+}
+
+func TestAdminHandler_Readiness(t *testing.T) {
+	health := NewHealthChecker(DefaultHealthCheckSettings(), http.DefaultClient)
+	tests := []struct {
+		name   string
+		health *HealthChecker
+		want   int
+	}{
+		{name: "no health checker", health: nil, want: http.StatusOK},
+		{name: "not checked yet", health: health, want: http.StatusServiceUnavailable},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			NewAdminHandler(NewMetrics(), tc.health).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if rec.Code != tc.want {
+				t.Errorf("GET /readyz = %d %q, want %d", rec.Code, rec.Body.String(), tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,640 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// aqlReservedKeywords are always keywords in AQL, whatever their context.
+var aqlReservedKeywords = map[string]struct{}{
+	"AGGREGATE": {}, "ALL": {}, "ALL_SHORTEST_PATHS": {}, "AND": {}, "ANY": {},
+	"ASC": {}, "COLLECT": {}, "DESC": {}, "DISTINCT": {}, "FALSE": {},
+	"FILTER": {}, "FOR": {}, "GRAPH": {}, "IN": {}, "INBOUND": {},
+	"INSERT": {}, "INTO": {}, "K_PATHS": {}, "K_SHORTEST_PATHS": {}, "LET": {},
+	"LIKE": {}, "LIMIT": {}, "NONE": {}, "NOT": {}, "NULL": {}, "OR": {},
+	"OUTBOUND": {}, "REMOVE": {}, "REPLACE": {}, "RETURN": {},
+	"SHORTEST_PATH": {}, "SORT": {}, "TRUE": {}, "UPDATE": {}, "UPSERT": {},
+	"WINDOW": {}, "WITH": {},
+}
+
+// aqlStatementKeywords start an AQL operation. The analyser tracks the
+// current one to interpret contextual keywords.
+var aqlStatementKeywords = map[string]struct{}{
+	"FOR": {}, "LET": {}, "FILTER": {}, "SEARCH": {}, "COLLECT": {}, "SORT": {},
+	"LIMIT": {}, "RETURN": {}, "INSERT": {}, "UPDATE": {}, "REPLACE": {},
+	"REMOVE": {}, "UPSERT": {}, "WINDOW": {}, "PRUNE": {},
+}
+
+// aqlCollectionFunctions take a collection name as their first argument,
+// either bare or as a string.
+var aqlCollectionFunctions = map[string]struct{}{
+	"COLLECTION_COUNT": {}, "FULLTEXT": {}, "NEAR": {}, "WITHIN": {}, "WITHIN_RECTANGLE": {},
+}
+
+// aqlPathKeywords select a path search instead of a traversal after the
+// direction of a FOR loop over a graph.
+var aqlPathKeywords = map[string]struct{}{
+	"SHORTEST_PATH": {}, "K_SHORTEST_PATHS": {}, "K_PATHS": {}, "ALL_SHORTEST_PATHS": {},
+}
+
+// aqlArrayComparisonOperators may follow ANY, ALL and NONE when they
+// quantify an array comparison rather than give a traversal direction.
+var aqlArrayComparisonOperators = map[string]struct{}{
+	"==": {}, "!=": {}, "<": {}, "<=": {}, ">": {}, ">=": {},
+}
+
+// aqlDynamicCallFunctions invoke other functions by name, which hides what
+// they access from static analysis.
+var aqlDynamicCallFunctions = map[string]struct{}{
+	"CALL": {}, "APPLY": {},
+}
+
+// AQLAccess lists the collections and named graphs an AQL query refers to.
+type AQLAccess struct {
+	Collections []string
+	Graphs      []string
+}
+
+// aqlScope holds the variables declared inside one pair of parentheses and
+// the operation being parsed there.
+type aqlScope struct {
+	variables    map[string]struct{}
+	statement    string
+	modification bool
+}
+
+type aqlAnalyser struct {
+	tokens      []aqlToken
+	bindVars    map[string]json.RawMessage
+	scopes      []*aqlScope
+	brackets    int
+	collections map[string]struct{}
+	graphs      map[string]struct{}
+}
+
+// ExtractAQLAccess returns the collections and named graphs a query reads
+// or writes: names iterated by FOR ... IN, modified by INSERT/UPDATE/...,
+// listed in WITH, used as traversal edge collections, the collections of
+// literal or bound start and target vertex ids, passed to DOCUMENT() and
+// similar functions, and @@ bind parameters resolved from bindVars.
+//
+// AQL treats any bare name that is not a keyword, variable, attribute or
+// function as a collection, and so does the analyser; it errs towards
+// reporting too much. References it cannot resolve statically — DOCUMENT()
+// on a computed id, CALL()/APPLY(), missing bind parameters — are errors.
+// Vertices reached by a traversal or path search over edge collections live
+// in whatever collections the edges point to, so such queries must declare
+// their vertex collections with WITH, which is reported; without it they are
+// an error. Traversals of a named graph are covered by the graph.
+func ExtractAQLAccess(query string, bindVars map[string]json.RawMessage) (*AQLAccess, error) {
+	tokens, err := lexAQL(query)
+	if err != nil {
+		return nil, err
+	}
+	a := &aqlAnalyser{
+		tokens:      tokens,
+		bindVars:    bindVars,
+		scopes:      []*aqlScope{{variables: map[string]struct{}{}}},
+		collections: map[string]struct{}{},
+		graphs:      map[string]struct{}{},
+	}
+	if err := a.run(); err != nil {
+		return nil, err
+	}
+	return &AQLAccess{Collections: sortedKeys(a.collections), Graphs: sortedKeys(a.graphs)}, nil
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (a *aqlAnalyser) scope() *aqlScope {
+	return a.scopes[len(a.scopes)-1]
+}
+
+func (a *aqlAnalyser) declared(name string) bool {
+	for _, scope := range a.scopes {
+		if _, ok := scope.variables[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *aqlAnalyser) modificationSeen() bool {
+	for _, scope := range a.scopes {
+		if scope.modification {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenAt returns the token at i, or a zero token past either end.
+func (a *aqlAnalyser) tokenAt(i int) aqlToken {
+	if i < 0 || i >= len(a.tokens) {
+		return aqlToken{kind: -1}
+	}
+	return a.tokens[i]
+}
+
+func (a *aqlAnalyser) isOperator(i int, ops ...string) bool {
+	token := a.tokenAt(i)
+	if token.kind != aqlOperator {
+		return false
+	}
+	for _, op := range ops {
+		if token.text == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *aqlAnalyser) isKeyword(i int, keyword string) bool {
+	token := a.tokenAt(i)
+	return token.kind == aqlIdentifier && strings.EqualFold(token.text, keyword)
+}
+
+func (a *aqlAnalyser) run() error {
+	for i := 0; i < len(a.tokens); i++ {
+		token := a.tokens[i]
+		switch token.kind {
+		case aqlOperator:
+			switch token.text {
+			case "(":
+				a.scopes = append(a.scopes, &aqlScope{variables: map[string]struct{}{}})
+			case ")":
+				if len(a.scopes) > 1 {
+					a.scopes = a.scopes[:len(a.scopes)-1]
+				}
+			case "[":
+				a.brackets++
+			case "]":
+				if a.brackets > 0 {
+					a.brackets--
+				}
+			}
+
+		case aqlBindParameter:
+			if strings.HasPrefix(token.text, "@@") {
+				name, err := a.bindString(token.text[1:])
+				if err != nil {
+					return err
+				}
+				a.collections[name] = struct{}{}
+			}
+
+		case aqlIdentifier:
+			next, err := a.identifier(i)
+			if err != nil {
+				return err
+			}
+			i = next
+
+		case aqlQuotedName:
+			// A quoted name is never a keyword, but otherwise resolves
+			// like a bare one: `users` is the users collection.
+			if !a.isNameContext(i) {
+				a.reference(i)
+			}
+		}
+	}
+	return nil
+}
+
+// isNameContext reports whether the name at i is an attribute, an object
+// key or part of a namespaced function name.
+func (a *aqlAnalyser) isNameContext(i int) bool {
+	if a.isOperator(i-1, ".", "?.", "::") || a.isOperator(i+1, "::") {
+		return true
+	}
+	return a.isOperator(i+1, ":") && a.isOperator(i-1, "{", ",")
+}
+
+// reference resolves a name that is not a keyword: a variable being
+// assigned, a variable in scope, or otherwise a collection.
+func (a *aqlAnalyser) reference(i int) {
+	name := a.tokens[i].text
+	if a.isOperator(i+1, "=") {
+		a.scope().variables[name] = struct{}{}
+		return
+	}
+	if !a.declared(name) {
+		a.collections[name] = struct{}{}
+	}
+}
+
+// identifier interprets the identifier at i and returns the index of the
+// last token it consumed.
+func (a *aqlAnalyser) identifier(i int) (int, error) {
+	upper := strings.ToUpper(a.tokens[i].text)
+
+	if a.isNameContext(i) {
+		return i, nil
+	}
+
+	if _, ok := aqlStatementKeywords[upper]; ok && !a.isContextualName(i, upper) {
+		scope := a.scope()
+		scope.statement = upper
+		switch upper {
+		case "INSERT", "UPDATE", "REPLACE", "REMOVE", "UPSERT":
+			scope.modification = true
+		case "FOR":
+			return a.forDeclarations(i)
+		}
+		return i, nil
+	}
+	switch {
+	case upper == "GRAPH":
+		return a.graph(i)
+	case (upper == "OUTBOUND" || upper == "INBOUND" || upper == "ANY") && a.isTraversal(i):
+		return i, a.traversal(i)
+	case upper == "INTO" && a.scope().statement == "COLLECT":
+		return a.declare(i + 1)
+	}
+	if _, ok := aqlReservedKeywords[upper]; ok {
+		return i, nil
+	}
+	if a.isContextualKeyword(i, upper) {
+		return i, nil
+	}
+
+	if a.isOperator(i+1, "(") {
+		return a.functionCall(i, upper)
+	}
+	a.reference(i)
+	return i, nil
+}
+
+// followsExpression reports whether the token before i ends an operand, so
+// that a contextual keyword at i continues the current operation rather
+// than naming something.
+func (a *aqlAnalyser) followsExpression(i int) bool {
+	prev := a.tokenAt(i - 1)
+	switch prev.kind {
+	case aqlString, aqlQuotedName, aqlNumber, aqlBindParameter:
+		return true
+	case aqlIdentifier:
+		_, reserved := aqlReservedKeywords[strings.ToUpper(prev.text)]
+		return !reserved
+	case aqlOperator:
+		return prev.text == ")" || prev.text == "]" || prev.text == "}"
+	}
+	return false
+}
+
+// isContextualKeyword reports whether a word that is a keyword only in
+// certain contexts is one at i. Elsewhere such words are ordinary names.
+func (a *aqlAnalyser) isContextualKeyword(i int, upper string) bool {
+	statement := a.scope().statement
+	switch upper {
+	case "COUNT":
+		return a.isKeyword(i-1, "WITH") && a.isKeyword(i+1, "INTO")
+	case "KEEP":
+		return statement == "COLLECT" && a.followsExpression(i)
+	case "OPTIONS":
+		return a.isOperator(i+1, "{") || a.tokenAt(i+1).kind == aqlBindParameter
+	case "TO":
+		return statement == "FOR" && a.followsExpression(i)
+	case "CURRENT":
+		return a.brackets > 0
+	case "NEW", "OLD":
+		return a.modificationSeen()
+	case "AT":
+		return a.isKeyword(i+1, "LEAST")
+	case "LEAST":
+		return a.isKeyword(i-1, "AT")
+	}
+	return false
+}
+
+// isContextualName reports whether a statement keyword that is only
+// contextual (SEARCH, PRUNE) is being used as a plain name at i: they
+// continue a FOR operation and always follow an operand.
+func (a *aqlAnalyser) isContextualName(i int, upper string) bool {
+	switch upper {
+	case "SEARCH", "PRUNE":
+		return a.scope().statement != "FOR" || !a.followsExpression(i)
+	}
+	return false
+}
+
+// forDeclarations declares the loop variables of FOR v[, e[, p]] IN and
+// returns the index of the token before IN.
+func (a *aqlAnalyser) forDeclarations(i int) (int, error) {
+	j := i + 1
+	for ; j < len(a.tokens); j++ {
+		token := a.tokens[j]
+		if token.kind == aqlIdentifier && strings.EqualFold(token.text, "IN") {
+			return j - 1, nil
+		}
+		switch {
+		case token.kind == aqlIdentifier || token.kind == aqlQuotedName:
+			a.scope().variables[token.text] = struct{}{}
+		case token.kind == aqlOperator && token.text == ",":
+		default:
+			return 0, fmt.Errorf("unexpected %q in FOR declaration", token.text)
+		}
+	}
+	return 0, fmt.Errorf("FOR without IN")
+}
+
+// isTraversal reports whether the direction keyword at i starts a traversal
+// or path search: it must be in a FOR operation, must not give the direction
+// of one of several edge collections, and ANY must not quantify an array
+// comparison.
+func (a *aqlAnalyser) isTraversal(i int) bool {
+	if a.scope().statement != "FOR" || a.isOperator(i-1, ",") {
+		return false
+	}
+	next := a.tokenAt(i + 1)
+	if next.kind == aqlOperator {
+		_, comparison := aqlArrayComparisonOperators[next.text]
+		return !comparison
+	}
+	return !a.isKeyword(i+1, "IN") && !a.isKeyword(i+1, "NOT")
+}
+
+// traversal resolves the start vertex, and for path searches the target
+// vertex, of the traversal whose direction is at i, and refuses traversals
+// over edge collections whose vertex collections are not declared with
+// WITH. The tokens themselves are left to the main scan.
+func (a *aqlAnalyser) traversal(i int) error {
+	start := i + 1
+	_, path := aqlPathKeywords[strings.ToUpper(a.tokenAt(start).text)]
+	if path && a.tokenAt(start).kind == aqlIdentifier {
+		start++
+	}
+	if err := a.vertex(start); err != nil {
+		return err
+	}
+	named := false
+	depth := 0
+	for j := start; j < len(a.tokens); j++ {
+		token := a.tokens[j]
+		if token.kind == aqlOperator {
+			switch token.text {
+			case "(", "[", "{":
+				depth++
+			case ")", "]", "}":
+				depth--
+			}
+			if depth < 0 {
+				break
+			}
+			continue
+		}
+		if depth > 0 || token.kind != aqlIdentifier {
+			continue
+		}
+		upper := strings.ToUpper(token.text)
+		if upper == "GRAPH" {
+			named = true
+			break
+		}
+		if upper == "TO" && path {
+			if err := a.vertex(j + 1); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, ok := aqlStatementKeywords[upper]; ok && upper != "PRUNE" {
+			break
+		}
+	}
+	if !named && !a.isKeyword(0, "WITH") {
+		return fmt.Errorf("traversals over edge collections must declare their vertex collections with WITH")
+	}
+	return nil
+}
+
+// vertex records the collection of a start or target vertex at i given as
+// a literal or bound document id. Other expressions are left to WITH or
+// the named graph.
+func (a *aqlAnalyser) vertex(i int) error {
+	token := a.tokenAt(i)
+	if next := a.tokenAt(i + 1); next.kind == aqlOperator {
+		// An expression such as d._id or CONCAT(...).
+		return nil
+	}
+	var id string
+	switch {
+	case token.kind == aqlString:
+		id = token.text
+	case token.kind == aqlBindParameter && !strings.HasPrefix(token.text, "@@"):
+		raw, ok := a.bindVars[token.text[1:]]
+		if !ok {
+			return fmt.Errorf("missing bind parameter %s", token.text)
+		}
+		if err := json.Unmarshal(raw, &id); err != nil {
+			return fmt.Errorf("bind parameter %s is not a document id", token.text)
+		}
+	default:
+		return nil
+	}
+	collection, _, ok := strings.Cut(id, "/")
+	if !ok || collection == "" {
+		return fmt.Errorf("traversal: %q is not a document id", id)
+	}
+	a.collections[collection] = struct{}{}
+	return nil
+}
+
+// declare declares the variable at i, if there is one.
+func (a *aqlAnalyser) declare(i int) (int, error) {
+	token := a.tokenAt(i)
+	if token.kind != aqlIdentifier && token.kind != aqlQuotedName {
+		return i - 1, nil
+	}
+	a.scope().variables[token.text] = struct{}{}
+	return i, nil
+}
+
+// graph records the named graph following GRAPH at i.
+func (a *aqlAnalyser) graph(i int) (int, error) {
+	token := a.tokenAt(i + 1)
+	switch token.kind {
+	case aqlString:
+		a.graphs[token.text] = struct{}{}
+	case aqlBindParameter:
+		if strings.HasPrefix(token.text, "@@") {
+			return 0, fmt.Errorf("unexpected collection parameter %s after GRAPH", token.text)
+		}
+		name, err := a.bindString(token.text[1:])
+		if err != nil {
+			return 0, err
+		}
+		a.graphs[name] = struct{}{}
+	default:
+		return 0, fmt.Errorf("unable to determine graph name")
+	}
+	return i + 1, nil
+}
+
+// functionCall handles the call of the function at i. Functions that
+// address collections by string are resolved; the arguments themselves are
+// then scanned like any other tokens.
+func (a *aqlAnalyser) functionCall(i int, upper string) (int, error) {
+	if _, ok := aqlDynamicCallFunctions[upper]; ok {
+		return 0, fmt.Errorf("%s() hides the collections a query accesses", upper)
+	}
+	args := a.callArguments(i + 1)
+	switch {
+	case upper == "DOCUMENT":
+		if err := a.documentCall(args); err != nil {
+			return 0, err
+		}
+	case len(args) > 0:
+		if _, ok := aqlCollectionFunctions[upper]; ok {
+			if err := a.collectionArgument(upper, args[0]); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return i, nil
+}
+
+// callArguments splits the arguments of the call whose "(" is at open into
+// token slices, without consuming them.
+func (a *aqlAnalyser) callArguments(open int) [][]aqlToken {
+	var args [][]aqlToken
+	depth := 0
+	start := open + 1
+	for j := open; j < len(a.tokens); j++ {
+		token := a.tokens[j]
+		if token.kind != aqlOperator {
+			continue
+		}
+		switch token.text {
+		case "(", "[", "{":
+			depth++
+		case ")", "]", "}":
+			depth--
+			if depth == 0 {
+				if j > start {
+					args = append(args, a.tokens[start:j])
+				}
+				return args
+			}
+		case ",":
+			if depth == 1 {
+				args = append(args, a.tokens[start:j])
+				start = j + 1
+			}
+		}
+	}
+	return args
+}
+
+// documentCall resolves DOCUMENT(id), DOCUMENT([ids]) and
+// DOCUMENT(collection, key) calls whose arguments are literal or bound.
+func (a *aqlAnalyser) documentCall(args [][]aqlToken) error {
+	switch len(args) {
+	case 1:
+		ids, err := a.literalStrings(args[0])
+		if err != nil {
+			return fmt.Errorf("DOCUMENT(): %w", err)
+		}
+		for _, id := range ids {
+			collection, _, ok := strings.Cut(id, "/")
+			if !ok || collection == "" {
+				return fmt.Errorf("DOCUMENT(): %q is not a document id", id)
+			}
+			a.collections[collection] = struct{}{}
+		}
+		return nil
+	case 2:
+		return a.collectionArgument("DOCUMENT", args[0])
+	}
+	return fmt.Errorf("DOCUMENT() takes one or two arguments")
+}
+
+// collectionArgument resolves a function's collection argument. Bare names
+// and @@ parameters are picked up by the main scan.
+func (a *aqlAnalyser) collectionArgument(function string, arg []aqlToken) error {
+	if len(arg) == 1 {
+		switch arg[0].kind {
+		case aqlIdentifier, aqlQuotedName:
+			if !a.declared(arg[0].text) {
+				return nil
+			}
+		case aqlString:
+			a.collections[arg[0].text] = struct{}{}
+			return nil
+		case aqlBindParameter:
+			if strings.HasPrefix(arg[0].text, "@@") {
+				return nil
+			}
+			name, err := a.bindString(arg[0].text[1:])
+			if err != nil {
+				return err
+			}
+			a.collections[name] = struct{}{}
+			return nil
+		}
+	}
+	return fmt.Errorf("%s(): unable to determine collection", function)
+}
+
+// literalStrings evaluates an argument that is a string, an array of
+// strings, or a bind parameter holding either.
+func (a *aqlAnalyser) literalStrings(arg []aqlToken) ([]string, error) {
+	if len(arg) == 1 {
+		switch arg[0].kind {
+		case aqlString:
+			return []string{arg[0].text}, nil
+		case aqlBindParameter:
+			if strings.HasPrefix(arg[0].text, "@@") {
+				break
+			}
+			raw, ok := a.bindVars[arg[0].text[1:]]
+			if !ok {
+				return nil, fmt.Errorf("missing bind parameter %s", arg[0].text)
+			}
+			var one string
+			if err := json.Unmarshal(raw, &one); err == nil {
+				return []string{one}, nil
+			}
+			var many []string
+			if err := json.Unmarshal(raw, &many); err == nil {
+				return many, nil
+			}
+			return nil, fmt.Errorf("bind parameter %s is not a document id", arg[0].text)
+		}
+	}
+	if len(arg) >= 2 && arg[0].text == "[" && arg[len(arg)-1].text == "]" {
+		var values []string
+		for k, token := range arg[1 : len(arg)-1] {
+			switch {
+			case k%2 == 0 && token.kind == aqlString:
+				values = append(values, token.text)
+			case k%2 == 1 && token.kind == aqlOperator && token.text == ",":
+			default:
+				return nil, fmt.Errorf("unable to determine document ids")
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("unable to determine document ids")
+}
+
+// bindString returns the string value of bind parameter name.
+func (a *aqlAnalyser) bindString(name string) (string, error) {
+	raw, ok := a.bindVars[name]
+	if !ok {
+		return "", fmt.Errorf("missing bind parameter @%s", name)
+	}
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil || value == "" {
+		return "", fmt.Errorf("bind parameter @%s is not a name", name)
+	}
+	return value, nil
+}
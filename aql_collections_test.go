@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExtractAQLAccess(t *testing.T) {
+	tests := []struct {
+		name        string
+		query       string
+		bindVars    string
+		collections []string
+		graphs      []string
+	}{
+		{"for return", "FOR d IN chunks RETURN d", "", []string{"chunks"}, nil},
+		{"lower case", "for d in chunks filter d.x == 1 return d", "", []string{"chunks"}, nil},
+		{"attributes ignored", "FOR d IN chunks RETURN {users: d.users, x: d.embeddings}", "", []string{"chunks"}, nil},
+		{"let variable", "LET ids = ['a'] FOR d IN chunks FILTER d._key IN ids RETURN d", "", []string{"chunks"}, nil},
+		{"nested loop", "FOR a IN chunks FOR b IN embeddings FILTER a._key == b.chunk RETURN [a, b]", "", []string{"chunks", "embeddings"}, nil},
+		{"subquery", "LET x = (FOR u IN users RETURN u) FOR c IN chunks RETURN c", "", []string{"chunks", "users"}, nil},
+		{"subquery variable scope", "LET x = (FOR users IN chunks RETURN users) RETURN users", "", []string{"chunks", "users"}, nil},
+		{"quoted collection", "FOR d IN `users` RETURN d", "", []string{"users"}, nil},
+		{"forward quoted collection", "FOR d IN ´users´ RETURN d", "", []string{"users"}, nil},
+		{"insert", "INSERT {a: 1} INTO chunks", "", []string{"chunks"}, nil},
+		{"update with", "FOR d IN chunks UPDATE d WITH {x: 1} IN embeddings OPTIONS {waitForSync: true}", "", []string{"chunks", "embeddings"}, nil},
+		{"remove old", "FOR d IN chunks REMOVE d IN chunks RETURN OLD", "", []string{"chunks"}, nil},
+		{"upsert", "UPSERT {k: 1} INSERT {k: 1} UPDATE {} IN chunks", "", []string{"chunks"}, nil},
+		{"with clause", "WITH users, groups FOR v IN 1..2 OUTBOUND 'chunks/1' edges RETURN v", "", []string{"chunks", "edges", "groups", "users"}, nil},
+		{"traversal edge collections", "WITH a FOR v, e, p IN 1..3 ANY 'a/1' knows, OUTBOUND likes PRUNE v.x == 1 RETURN p", "", []string{"a", "knows", "likes"}, nil},
+		{"traversal start variable", "WITH a FOR d IN a FOR v IN 1 OUTBOUND d._id knows RETURN v", "", []string{"a", "knows"}, nil},
+		{"bound start vertex", "WITH a FOR v IN 1 OUTBOUND @start knows RETURN v", `{"start": "secret/123"}`, []string{"a", "knows", "secret"}, nil},
+		{"named graph", "FOR v IN 1..2 OUTBOUND 'a/1' GRAPH 'social' RETURN v", "", []string{"a"}, []string{"social"}},
+		{"named graph start variable", "FOR d IN a FOR v IN 1..2 OUTBOUND d GRAPH 'social' RETURN v", "", []string{"a"}, []string{"social"}},
+		{"bound graph", "FOR v IN 1 ANY 'a/1' GRAPH @g RETURN v", `{"g": "social"}`, []string{"a"}, []string{"social"}},
+		{"shortest path", "WITH a FOR v IN OUTBOUND SHORTEST_PATH 'a/1' TO 'b/2' edges RETURN v", "", []string{"a", "b", "edges"}, nil},
+		{"array comparison", "FOR d IN chunks LET hit = d.tags ANY == 'x' RETURN hit", "", []string{"chunks"}, nil},
+		{"collection bind parameter", "FOR d IN @@coll RETURN d", `{"@coll": "chunks"}`, []string{"chunks"}, nil},
+		{"value bind parameter", "FOR d IN chunks FILTER d.x == @x RETURN d", `{"x": "users"}`, []string{"chunks"}, nil},
+		{"document id", "RETURN DOCUMENT('users/1')", "", []string{"users"}, nil},
+		{"document ids", "RETURN DOCUMENT(['users/1', \"groups/2\"])", "", []string{"groups", "users"}, nil},
+		{"document bound ids", "RETURN DOCUMENT(@ids)", `{"ids": ["users/1", "chunks/2"]}`, []string{"chunks", "users"}, nil},
+		{"document collection and key", "RETURN DOCUMENT(users, '1')", "", []string{"users"}, nil},
+		{"document collection string", "RETURN DOCUMENT('users', '1')", "", []string{"users"}, nil},
+		{"collection function", "RETURN COLLECTION_COUNT('users')", "", []string{"users"}, nil},
+		{"ordinary functions", "FOR d IN chunks RETURN LENGTH(d.text) + CONCAT('a', d.b)", "", []string{"chunks"}, nil},
+		{"namespaced function", "RETURN MYFUNCS::users(1)", "", nil, nil},
+		{"collect into", "FOR d IN chunks COLLECT k = d.k INTO groups KEEP d RETURN groups", "", []string{"chunks"}, nil},
+		{"collect with count", "FOR d IN chunks COLLECT WITH COUNT INTO n RETURN n", "", []string{"chunks"}, nil},
+		{"contextual names", "FOR search IN keep RETURN search", "", []string{"keep"}, nil},
+		{"search clause", "FOR d IN view SEARCH d.x == 1 RETURN d", "", []string{"view"}, nil},
+		{"inline filter current", "FOR d IN chunks RETURN d.tags[* FILTER CURRENT.x == 1]", "", []string{"chunks"}, nil},
+		{"strings and comments", "FOR d IN chunks /* users */ RETURN 'users' // users", "", []string{"chunks"}, nil},
+		{"range", "FOR i IN 1..10 RETURN i", "", nil, nil},
+		{"unknown names are collections", "FOR d IN chunks RETURN secrets", "", []string{"chunks", "secrets"}, nil},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var bindVars map[string]json.RawMessage
+			if tc.bindVars != "" {
+				if err := json.Unmarshal([]byte(tc.bindVars), &bindVars); err != nil {
+					t.Fatal(err)
+				}
+			}
+			access, err := ExtractAQLAccess(tc.query, bindVars)
+			if err != nil {
+				t.Fatalf("ExtractAQLAccess() error = %v", err)
+			}
+			if want := nonNil(tc.collections); !reflect.DeepEqual(access.Collections, want) {
+				t.Errorf("Collections = %q, want %q", access.Collections, want)
+			}
+			if want := nonNil(tc.graphs); !reflect.DeepEqual(access.Graphs, want) {
+				t.Errorf("Graphs = %q, want %q", access.Graphs, want)
+			}
+		})
+	}
+}
+
+func TestExtractAQLAccess_Unresolvable(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		bindVars string
+		wantErr  string
+	}{
+		{"computed document id", "FOR d IN chunks RETURN DOCUMENT(d.ref)", "", "DOCUMENT()"},
+		{"document key only", "RETURN DOCUMENT('1')", "", "not a document id"},
+		{"call", "RETURN CALL('DOCUMENT', 'users/1')", "", "CALL()"},
+		{"apply", "RETURN APPLY('DOCUMENT', ['users/1'])", "", "APPLY()"},
+		{"missing collection bind parameter", "FOR d IN @@coll RETURN d", "", "missing bind parameter"},
+		{"non-string collection bind parameter", "FOR d IN @@coll RETURN d", `{"@coll": 1}`, "not a name"},
+		{"computed graph", "FOR v IN 1 ANY 'a/1' GRAPH CONCAT('s', 'ocial') RETURN v", "", "graph name"},
+		{"computed collection function argument", "RETURN COLLECTION_COUNT(CONCAT('us', 'ers'))", "", "COLLECTION_COUNT()"},
+		{"unterminated string", "FOR d IN chunks RETURN 'x", "", "unterminated"},
+		{"traversal without WITH", "FOR v IN 1..2 OUTBOUND 'chunks/1' edges RETURN v", "", "WITH"},
+		{"computed start without WITH", "FOR d IN chunks FOR v IN 1 ANY d._id edges RETURN v", "", "WITH"},
+		{"path search without WITH", "FOR p IN OUTBOUND K_PATHS 'a/1' TO 'a/2' edges RETURN p", "", "WITH"},
+		{"start vertex key only", "WITH a FOR v IN 1 OUTBOUND 'k' edges RETURN v", "", "not a document id"},
+		{"missing start bind parameter", "FOR v IN 1 OUTBOUND @start GRAPH 'g' RETURN v", "", "missing bind parameter"},
+		{"non-string start bind parameter", "FOR v IN 1 OUTBOUND @start GRAPH 'g' RETURN v", `{"start": {"_id": "a/1"}}`, "not a document id"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var bindVars map[string]json.RawMessage
+			if tc.bindVars != "" {
+				if err := json.Unmarshal([]byte(tc.bindVars), &bindVars); err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, err := ExtractAQLAccess(tc.query, bindVars)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("ExtractAQLAccess() error = %v, want error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func nonNil(items []string) []string {
+	if items == nil {
+		return []string{}
+	}
+	return items
+}
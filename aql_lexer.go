@@ -0,0 +1,228 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// aqlTokenKind classifies a lexical token of an AQL query.
+type aqlTokenKind int
+
+const (
+	aqlIdentifier aqlTokenKind = iota // unquoted name or keyword
+	aqlQuotedName                     // `name` or ´name´
+	aqlString                         // 'text' or "text"
+	aqlNumber
+	aqlBindParameter // @value or @@collection
+	aqlOperator      // punctuation and operators
+)
+
+// aqlToken is a single token of an AQL query. For strings and quoted names,
+// text is the unescaped content without the delimiters.
+type aqlToken struct {
+	kind aqlTokenKind
+	text string
+	pos  int
+}
+
+// forwardTick is the acute accent AQL accepts as an alternative to backticks
+// for quoting names.
+const forwardTick = '´'
+
+// multiCharOperators are matched before single characters, longest first.
+var multiCharOperators = []string{"::", "?.", "..", "==", "!=", "<=", ">=", "&&", "||", "=~", "!~"}
+
+// lexAQL splits an AQL query into tokens, discarding whitespace and
+// comments. It understands single- and double-quoted strings, backtick and
+// forward-tick quoted names, // and /* */ comments, and bind parameters. An
+// unterminated string, name or comment is an error: the caller cannot know
+// where ArangoDB would consider the literal to end.
+func lexAQL(query string) ([]aqlToken, error) {
+	var tokens []aqlToken
+	i := 0
+	for i < len(query) {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v':
+			i++
+
+		case strings.HasPrefix(query[i:], "//"):
+			end := strings.IndexAny(query[i:], "\r\n")
+			if end < 0 {
+				return tokens, nil
+			}
+			i += end
+
+		case strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated comment at offset %d", i)
+			}
+			i += 2 + end + 2
+
+		case c == '\'' || c == '"' || c == '`':
+			kind := aqlString
+			if c == '`' {
+				kind = aqlQuotedName
+			}
+			text, next, err := lexQuoted(query, i, rune(c), 1)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, aqlToken{kind: kind, text: text, pos: i})
+			i = next
+
+		case strings.HasPrefix(query[i:], string(forwardTick)):
+			text, next, err := lexQuoted(query, i, forwardTick, utf8.RuneLen(forwardTick))
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, aqlToken{kind: aqlQuotedName, text: text, pos: i})
+			i = next
+
+		case c == '@':
+			start := i
+			i++
+			if i < len(query) && query[i] == '@' {
+				i++
+			}
+			nameStart := i
+			for i < len(query) && isAQLNameByte(query[i]) {
+				i++
+			}
+			if i == nameStart {
+				return nil, fmt.Errorf("empty bind parameter name at offset %d", start)
+			}
+			tokens = append(tokens, aqlToken{kind: aqlBindParameter, text: query[start:i], pos: start})
+
+		case isAQLNameStart(c):
+			start := i
+			for i < len(query) && isAQLNameByte(query[i]) {
+				i++
+			}
+			tokens = append(tokens, aqlToken{kind: aqlIdentifier, text: query[start:i], pos: start})
+
+		case c >= '0' && c <= '9':
+			start := i
+			i = lexNumber(query, i)
+			tokens = append(tokens, aqlToken{kind: aqlNumber, text: query[start:i], pos: start})
+
+		default:
+			op := ""
+			for _, candidate := range multiCharOperators {
+				if strings.HasPrefix(query[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				_, size := utf8.DecodeRuneInString(query[i:])
+				op = query[i : i+size]
+			}
+			tokens = append(tokens, aqlToken{kind: aqlOperator, text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return tokens, nil
+}
+
+// lexQuoted reads a quoted literal starting at query[start], whose opening
+// delimiter is width bytes long. A backslash escapes the following character.
+func lexQuoted(query string, start int, quote rune, width int) (text string, next int, err error) {
+	var b strings.Builder
+	i := start + width
+	for i < len(query) {
+		r, size := utf8.DecodeRuneInString(query[i:])
+		switch {
+		case r == '\\':
+			if i+size >= len(query) {
+				return "", 0, fmt.Errorf("unterminated literal at offset %d", start)
+			}
+			escaped, escSize := utf8.DecodeRuneInString(query[i+size:])
+			b.WriteRune(escaped)
+			i += size + escSize
+		case r == quote:
+			return b.String(), i + size, nil
+		default:
+			b.WriteRune(r)
+			i += size
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated literal at offset %d", start)
+}
+
+// lexNumber returns the end of the numeric literal starting at query[i]. A
+// trailing "." followed by another "." is left alone so ranges like 1..10
+// lex as number, "..", number.
+func lexNumber(query string, i int) int {
+	digits := func() {
+		for i < len(query) && (query[i] >= '0' && query[i] <= '9' || query[i] == '_') {
+			i++
+		}
+	}
+	if strings.HasPrefix(query[i:], "0x") || strings.HasPrefix(query[i:], "0b") {
+		i += 2
+		for i < len(query) && isAQLNameByte(query[i]) {
+			i++
+		}
+		return i
+	}
+	digits()
+	if i+1 < len(query) && query[i] == '.' && query[i+1] >= '0' && query[i+1] <= '9' {
+		i++
+		digits()
+	}
+	if i < len(query) && (query[i] == 'e' || query[i] == 'E') {
+		j := i + 1
+		if j < len(query) && (query[j] == '+' || query[j] == '-') {
+			j++
+		}
+		if j < len(query) && query[j] >= '0' && query[j] <= '9' {
+			i = j
+			digits()
+		}
+	}
+	return i
+}
+
+func isAQLNameStart(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_' || c == '$'
+}
+
+func isAQLNameByte(c byte) bool {
+	return isAQLNameStart(c) || (c >= '0' && c <= '9')
+}
+
+// findAQLKeyword returns the first of the given (upper-case) keywords that
+// appears in keyword position in query, or "" if there is none. Identifiers
+// used as attribute names — after ".", "?." or "::", or as an object key
+// followed by ":" — are not in keyword position; strings, quoted names and
+// comments never are. Lexing errors are returned so that callers can refuse
+// queries they cannot analyse.
+func findAQLKeyword(query string, keywords map[string]struct{}) (string, error) {
+	tokens, err := lexAQL(query)
+	if err != nil {
+		return "", err
+	}
+	for i, token := range tokens {
+		if token.kind != aqlIdentifier {
+			continue
+		}
+		upper := strings.ToUpper(token.text)
+		if _, ok := keywords[upper]; !ok {
+			continue
+		}
+		if i > 0 && tokens[i-1].kind == aqlOperator {
+			switch tokens[i-1].text {
+			case ".", "?.", "::":
+				continue
+			}
+		}
+		if i+1 < len(tokens) && tokens[i+1].kind == aqlOperator && tokens[i+1].text == ":" {
+			continue
+		}
+		return upper, nil
+	}
+	return "", nil
+}
@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLexAQL_Tokens(t *testing.T) {
+	query := "FOR d IN @@coll FILTER d.`remove` == 'it\\'s' /* c */ && d.n IN 1..10 // tail\nRETURN ´x´"
+	tokens, err := lexAQL(query)
+	if err != nil {
+		t.Fatalf("lexAQL() error = %v", err)
+	}
+
+	want := []struct {
+		kind aqlTokenKind
+		text string
+	}{
+		{aqlIdentifier, "FOR"},
+		{aqlIdentifier, "d"},
+		{aqlIdentifier, "IN"},
+		{aqlBindParameter, "@@coll"},
+		{aqlIdentifier, "FILTER"},
+		{aqlIdentifier, "d"},
+		{aqlOperator, "."},
+		{aqlQuotedName, "remove"},
+		{aqlOperator, "=="},
+		{aqlString, "it's"},
+		{aqlOperator, "&&"},
+		{aqlIdentifier, "d"},
+		{aqlOperator, "."},
+		{aqlIdentifier, "n"},
+		{aqlIdentifier, "IN"},
+		{aqlNumber, "1"},
+		{aqlOperator, ".."},
+		{aqlNumber, "10"},
+		{aqlIdentifier, "RETURN"},
+		{aqlQuotedName, "x"},
+	}
+	if len(tokens) != len(want) {
+		t.Fatalf("got %d tokens, want %d: %+v", len(tokens), len(want), tokens)
+	}
+	for i, w := range want {
+		if tokens[i].kind != w.kind || tokens[i].text != w.text {
+			t.Errorf("token %d = (%d, %q), want (%d, %q)", i, tokens[i].kind, tokens[i].text, w.kind, w.text)
+		}
+	}
+}
+
+func TestLexAQL_Unterminated(t *testing.T) {
+	queries := []string{
+		`RETURN "open`,
+		`RETURN 'open`,
+		"RETURN `open",
+		"RETURN ´open",
+		`RETURN "escape at end\`,
+		`RETURN 1 /* open comment`,
+		`RETURN @`,
+	}
+
+	for _, query := range queries {
+		t.Run(query, func(t *testing.T) {
+			if _, err := lexAQL(query); err == nil {
+				t.Error("lexAQL() should fail")
+			}
+		})
+	}
+}
+
+func TestFindAQLKeyword(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		// Genuine writes
+		{"INSERT {a: 1} INTO c", "INSERT"},
+		{"FOR d IN c UPDATE d WITH {x: 1} IN c", "UPDATE"},
+		{"for d in c remove d in c", "REMOVE"},
+		{"FOR d IN c REMOVE (d._key) IN c", "REMOVE"},
+		{"RETURN 1 // comment\nINSERT {} INTO c", "INSERT"},
+		{"RETURN 1 /* a */ REPLACE d WITH {} IN c", "REPLACE"},
+		{"RETURN 'a'UPSERT {} INSERT {} UPDATE {} IN c", "UPSERT"},
+		{"RETURN 1\tREMOVE\n'k' IN c", "REMOVE"},
+
+		// Keywords that are not in keyword position
+		{`FOR d IN c FILTER d.status == "update" RETURN d`, ""},
+		{`FOR d IN c FILTER d.status == 'remove' RETURN d`, ""},
+		{"FOR d IN c RETURN d.`remove`", ""},
+		{"FOR d IN c RETURN d.´insert´", ""},
+		{"FOR d IN c RETURN d.update", ""},
+		{"FOR d IN c RETURN d?.replace", ""},
+		{"RETURN {update: 1, insert: 2}", ""},
+		{"RETURN MY::REMOVE(1)", ""},
+		{"FOR d IN c /* REMOVE d IN c */ RETURN d", ""},
+		{"FOR d IN c // REMOVE d IN c\nRETURN d", ""},
+		{"FOR d IN @@update RETURN @insert", ""},
+		{"FOR d IN c RETURN d.updatedAt", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			got, err := findAQLKeyword(tt.query, ForbiddenAQLKeywords)
+			if err != nil {
+				t.Fatalf("findAQLKeyword() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("findAQLKeyword() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// memberAccessEnd reports whether a query's last token makes the next
+// identifier an attribute or function name rather than a statement.
+func memberAccessEnd(tokens []aqlToken) bool {
+	if len(tokens) == 0 {
+		return false
+	}
+	last := tokens[len(tokens)-1]
+	return last.kind == aqlOperator && (last.text == "." || last.text == "?." || last.text == "::")
+}
+
+// FuzzFindAQLKeyword_AppendedWrite checks that no prefix can hide a write
+// statement that follows it. Whatever the prefix contains — open strings,
+// quoted names, comments, stray escapes — the combined query is either
+// refused by the lexer or the write keyword is reported. The only exception
+// is a prefix ending in member access, where ArangoDB itself parses the
+// keyword as an attribute name and the query is not a write.
+func FuzzFindAQLKeyword_AppendedWrite(f *testing.F) {
+	seeds := []string{
+		"",
+		"FOR d IN c RETURN d",
+		`RETURN "unterminated`,
+		"RETURN 'a\\",
+		"RETURN `x",
+		"RETURN ´x",
+		"RETURN 1 /* open",
+		"RETURN 1 // line",
+		"RETURN {a:",
+		"RETURN d.",
+		"RETURN @",
+		"LET x = '\\'' RETURN x",
+	}
+	for _, seed := range seeds {
+		for i := range aqlWriteStatements {
+			f.Add(seed, uint8(i))
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, prefix string, which uint8) {
+		statement := aqlWriteStatements[int(which)%len(aqlWriteStatements)]
+		query := prefix + "\n" + statement.query
+
+		keyword, err := findAQLKeyword(query, ForbiddenAQLKeywords)
+		if err != nil {
+			return // refused: safe
+		}
+		if prefixTokens, err := lexAQL(prefix); err == nil && memberAccessEnd(prefixTokens) {
+			return
+		}
+		if keyword == "" {
+			t.Fatalf("write statement hidden by prefix %q: %q", prefix, query)
+		}
+		if !strings.Contains(strings.ToUpper(query), keyword) {
+			t.Fatalf("reported keyword %q does not occur in %q", keyword, query)
+		}
+	})
+}
+
+var aqlWriteStatements = []struct{ query string }{
+	{"INSERT {a: 1} INTO c"},
+	{"UPDATE 'k' WITH {a: 1} IN c"},
+	{"REPLACE 'k' WITH {a: 1} IN c"},
+	{"REMOVE 'k' IN c"},
+	{"UPSERT {a: 1} INSERT {a: 1} UPDATE {} IN c"},
+}
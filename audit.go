@@ -0,0 +1,450 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// auditGenesisHash is the prev hash of the first record in a log.
+	auditGenesisHash = "0000000000000000000000000000000000000000000000000000000000000000"
+
+	// auditResponseLimit bounds how much of a document API response is kept
+	// to extract document keys from. Keys of larger responses are not
+	// recorded.
+	auditResponseLimit = 1024 * 1024
+
+	// auditTailChunk is how much of the log is read at a time when looking
+	// for its last record.
+	auditTailChunk = 64 * 1024
+
+	// minAuditKeySize is the shortest key an audit log is chained with.
+	minAuditKeySize = 16
+)
+
+// auditHashSuffix matches the hash field every record ends with.
+var auditHashSuffix = regexp.MustCompile(`,"hash":"([0-9a-f]{64})"}$`)
+
+// AuditRecord is one entry of the audit log: a change a client made, or
+// tried to make, through the proxy.
+type AuditRecord struct {
+	// Seq numbers records from 1.
+	Seq uint64 `json:"seq"`
+	// Prev is the hash of the previous record, or all zeros for the first.
+	Prev        string     `json:"prev"`
+	Time        string     `json:"time"`
+	Peer        *AuditPeer `json:"peer,omitempty"`
+	Method      string     `json:"method"`
+	Path        string     `json:"path"`
+	Database    string     `json:"database"`
+	Collections []string   `json:"collections,omitempty"`
+	// Keys are the document keys from the request path and from ArangoDB's
+	// response.
+	Keys  []string `json:"keys,omitempty"`
+	Query string   `json:"query,omitempty"`
+	// QueryTruncated reports that the cursor request body was larger than
+	// the proxy inspects, so Query and BindVars were not recorded.
+	QueryTruncated bool `json:"query_truncated,omitempty"`
+	// BindVars names the query's bind parameters. Their values are only
+	// recorded as hashes, and only when enabled.
+	BindVars        []string          `json:"bind_vars,omitempty"`
+	BindValueHashes map[string]string `json:"bind_value_hashes,omitempty"`
+	Rule            string            `json:"rule,omitempty"`
+	// Status is ArangoDB's response status, 403 if the proxy aborted the
+	// request while streaming it, or 0 if no response was received, in
+	// which case the change may or may not have been applied.
+	Status int `json:"status"`
+
+	captureKeys bool
+}
+
+// AuditPeer identifies the process that made a change.
+type AuditPeer struct {
+	UID uint32 `json:"uid"`
+	GID uint32 `json:"gid"`
+	PID int32  `json:"pid"`
+}
+
+// AuditLog appends a record of every allowed mutating request, and every
+// AQL cursor created, to a file.
+// Each record carries the hash of the previous one and ends with its own,
+// an HMAC-SHA256 under a secret key, so editing, removing or reordering
+// records breaks the chain, and without the key the chain cannot be
+// recomputed over edited records; see VerifyAuditLog. It is safe for
+// concurrent use.
+type AuditLog struct {
+	// HashBindValues records a SHA-256 hash of each bind parameter value.
+	HashBindValues bool
+
+	mu   sync.Mutex
+	file *os.File
+	key  []byte
+	seq  uint64
+	prev string
+	now  func() time.Time
+}
+
+// LoadAuditKey reads the key an audit log is chained with from path,
+// without surrounding whitespace.
+func LoadAuditKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit log key: %w", err)
+	}
+	key := []byte(strings.TrimSpace(string(data)))
+	if len(key) < minAuditKeySize {
+		return nil, fmt.Errorf("%s: audit log key must be at least %d bytes", path, minAuditKeySize)
+	}
+	return key, nil
+}
+
+// OpenAuditLog opens, or creates, the audit log at path and continues its
+// hash chain under key, which must be the key the log was written with.
+func OpenAuditLog(path string, key []byte) (*AuditLog, error) {
+	if len(key) < minAuditKeySize {
+		return nil, fmt.Errorf("audit log key must be at least %d bytes", minAuditKeySize)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	l := &AuditLog{file: file, key: key, prev: auditGenesisHash, now: time.Now}
+	last, err := lastLine(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("audit log %s: %w", path, err)
+	}
+	if last != nil {
+		record, hash, err := parseAuditLine(last, key)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("audit log %s: last record: %w", path, err)
+		}
+		l.seq, l.prev = record.Seq, hash
+	}
+	return l, nil
+}
+
+// AuditLogFromEnv opens the audit log named by AUDIT_LOG, if set, chained
+// with the key in AUDIT_LOG_KEY_FILE and hashing bind parameter values when
+// AUDIT_HASH_BIND_VALUES is true. It returns nil when AUDIT_LOG is unset.
+func AuditLogFromEnv() (*AuditLog, error) {
+	path := os.Getenv("AUDIT_LOG")
+	if path == "" {
+		return nil, nil
+	}
+	hashValues, err := GetEnvBool("AUDIT_HASH_BIND_VALUES", false)
+	if err != nil {
+		return nil, err
+	}
+	keyFile := os.Getenv("AUDIT_LOG_KEY_FILE")
+	if keyFile == "" {
+		return nil, fmt.Errorf("AUDIT_LOG requires AUDIT_LOG_KEY_FILE")
+	}
+	key, err := LoadAuditKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	l, err := OpenAuditLog(path, key)
+	if err != nil {
+		return nil, err
+	}
+	l.HashBindValues = hashValues
+	return l, nil
+}
+
+// Head returns the number of records in the log and the hash of the last.
+// Recording it elsewhere lets truncation of the log be detected too.
+func (l *AuditLog) Head() (uint64, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.seq, l.prev
+}
+
+// Close closes the log file.
+func (l *AuditLog) Close() error {
+	return l.file.Close()
+}
+
+// prepare starts the record for r, or returns nil if r does not change
+// anything. It runs after r was allowed and before it is forwarded.
+func (l *AuditLog) prepare(r *http.Request, body *RequestBody, decision *Decision) *AuditRecord {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return nil
+	}
+	reqPath, ok := parseRequestPath(r.URL.Path)
+	if !ok {
+		return nil
+	}
+	record := &AuditRecord{
+		Time:     l.now().UTC().Format(time.RFC3339Nano),
+		Method:   r.Method,
+		Path:     decision.Path,
+		Database: reqPath.database(),
+		Rule:     decision.Rule,
+	}
+	if cred, ok := PeerCredFromContext(r.Context()); ok {
+		record.Peer = &AuditPeer{UID: cred.UID, GID: cred.GID, PID: cred.PID}
+	}
+
+	if r.Method == http.MethodPost && reqPath.isCursorCreate() {
+		// Every query is recorded: whether it writes is for ArangoDB to
+		// decide, not a keyword scan.
+		l.prepareQuery(record, body)
+		return record
+	}
+	if decision.Category == CategoryDataRead {
+		// Explain, query parsing, cursor batches and the like.
+		return nil
+	}
+	if target, _, err := requestCollections(r, reqPath, body.Peek); err == nil {
+		for _, collection := range target.collections {
+			if collection != "" {
+				record.Collections = append(record.Collections, collection)
+			}
+		}
+	}
+	if len(reqPath.segments) >= 2 && reqPath.segments[0] == "_api" && reqPath.segments[1] == "document" {
+		if len(reqPath.segments) == 4 {
+			record.Keys = []string{reqPath.segments[3]}
+		}
+		record.captureKeys = true
+	}
+	return record
+}
+
+// prepareQuery fills in the AQL of a cursor request. Only the first
+// cursorBodyPeekLimit bytes of the body, which the policy's AQL checks read
+// anyway, are examined.
+func (l *AuditLog) prepareQuery(record *AuditRecord, body *RequestBody) {
+	data, err := body.Peek(cursorBodyPeekLimit)
+	if err != nil {
+		record.QueryTruncated = body.err == nil
+		return
+	}
+	var payload struct {
+		Query    string                     `json:"query"`
+		BindVars map[string]json.RawMessage `json:"bindVars"`
+	}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return
+	}
+	record.Query = payload.Query
+	for name, value := range payload.BindVars {
+		record.BindVars = append(record.BindVars, name)
+		if l.HashBindValues {
+			if record.BindValueHashes == nil {
+				record.BindValueHashes = make(map[string]string, len(payload.BindVars))
+			}
+			var compact bytes.Buffer
+			if json.Compact(&compact, value) != nil {
+				compact.Reset()
+				compact.Write(value)
+			}
+			sum := sha256.Sum256(compact.Bytes())
+			record.BindValueHashes[name] = hex.EncodeToString(sum[:])
+		}
+	}
+	sort.Strings(record.BindVars)
+	if access, err := ExtractAQLAccess(payload.Query, payload.BindVars); err == nil {
+		record.Collections = access.Collections
+	}
+}
+
+// finish completes record with ArangoDB's response and appends it.
+// response holds the response body if record.captureKeys and it fit in
+// auditResponseLimit.
+func (l *AuditLog) finish(record *AuditRecord, status int, response []byte) error {
+	record.Status = status
+	if record.captureKeys && status < 300 {
+		for _, key := range responseDocumentKeys(response) {
+			if len(record.Keys) == 0 || record.Keys[0] != key {
+				record.Keys = append(record.Keys, key)
+			}
+		}
+	}
+	return l.append(record)
+}
+
+func (l *AuditLog) append(record *AuditRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	record.Seq = l.seq + 1
+	record.Prev = l.prev
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit record: %w", err)
+	}
+	hash := auditHash(l.key, data)
+	line := append(data[:len(data)-1], `,"hash":"`+hash+"\"}\n"...)
+	if _, err := l.file.Write(line); err != nil {
+		return fmt.Errorf("failed to write audit record %d: %w", record.Seq, err)
+	}
+	l.seq, l.prev = record.Seq, hash
+	return nil
+}
+
+// responseDocumentKeys returns the _key attributes of a document API
+// response: one document, or an array of documents and errors.
+func responseDocumentKeys(response []byte) []string {
+	type document struct {
+		Key string `json:"_key"`
+	}
+	response = bytes.TrimSpace(response)
+	var docs []document
+	if bytes.HasPrefix(response, []byte("[")) {
+		if json.Unmarshal(response, &docs) != nil {
+			return nil
+		}
+	} else {
+		var doc document
+		if json.Unmarshal(response, &doc) != nil {
+			return nil
+		}
+		docs = append(docs, doc)
+	}
+	var keys []string
+	for _, doc := range docs {
+		if doc.Key != "" {
+			keys = append(keys, doc.Key)
+		}
+	}
+	return keys
+}
+
+// auditHash returns the HMAC-SHA256 of a record under key.
+func auditHash(key, data []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// parseAuditLine checks that line hashes under key to the hash it ends
+// with and returns the record and hash.
+func parseAuditLine(line, key []byte) (*AuditRecord, string, error) {
+	match := auditHashSuffix.FindSubmatchIndex(line)
+	if match == nil {
+		return nil, "", errors.New("record does not end with a hash")
+	}
+	data := append(line[:match[0]:match[0]], '}')
+	hash := string(line[match[2]:match[3]])
+	if !hmac.Equal([]byte(auditHash(key, data)), []byte(hash)) {
+		return nil, "", errors.New("record does not match its hash")
+	}
+	var record AuditRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, "", fmt.Errorf("invalid record: %w", err)
+	}
+	return &record, hash, nil
+}
+
+// AuditSummary describes a verified audit log.
+type AuditSummary struct {
+	Records uint64
+	// Head is the hash of the last record.
+	Head string
+}
+
+// VerifyAuditLog reads an audit log and checks that every record matches
+// its hash under key, names the previous record's hash and is numbered in
+// sequence. The error reports the line of the first record that fails.
+func VerifyAuditLog(r io.Reader, key []byte) (AuditSummary, error) {
+	summary := AuditSummary{Head: auditGenesisHash}
+	reader := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(data) == 0 {
+			return summary, nil
+		}
+		if err == io.EOF {
+			return summary, fmt.Errorf("line %d: truncated record", line)
+		}
+		if err != nil {
+			return summary, err
+		}
+		record, hash, err := parseAuditLine(bytes.TrimSuffix(data, []byte("\n")), key)
+		if err != nil {
+			return summary, fmt.Errorf("line %d: %w", line, err)
+		}
+		if record.Prev != summary.Head {
+			return summary, fmt.Errorf("line %d: chain broken: record follows %s, previous record is %s", line, record.Prev, summary.Head)
+		}
+		if record.Seq != summary.Records+1 {
+			return summary, fmt.Errorf("line %d: record %d out of sequence, want %d", line, record.Seq, summary.Records+1)
+		}
+		summary.Records, summary.Head = record.Seq, hash
+	}
+}
+
+// lastLine returns the last line of f without its newline, or nil if f is
+// empty. A file not ending in a newline holds a partial record.
+func lastLine(f *os.File) ([]byte, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	end := info.Size()
+	if end == 0 {
+		return nil, nil
+	}
+	var tail []byte
+	for offset := end; offset > 0; {
+		n := min(int64(auditTailChunk), offset)
+		offset -= n
+		chunk := make([]byte, n)
+		if _, err := f.ReadAt(chunk, offset); err != nil {
+			return nil, err
+		}
+		tail = append(chunk, tail...)
+		if len(tail) > 0 && tail[len(tail)-1] != '\n' {
+			return nil, errors.New("ends with a partial record")
+		}
+		if i := bytes.LastIndexByte(tail[:len(tail)-1], '\n'); i >= 0 {
+			return tail[i+1 : len(tail)-1], nil
+		}
+	}
+	return tail[:len(tail)-1], nil
+}
+
+// cappedBuffer keeps the first limit bytes written to it, and nothing if
+// more are written.
+type cappedBuffer struct {
+	buf      bytes.Buffer
+	limit    int
+	overflow bool
+}
+
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	if !c.overflow {
+		if c.buf.Len()+len(p) > c.limit {
+			c.overflow = true
+			c.buf = bytes.Buffer{}
+		} else {
+			c.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// Bytes returns what was written, or nil if it exceeded the limit.
+func (c *cappedBuffer) Bytes() []byte {
+	if c == nil || c.overflow {
+		return nil
+	}
+	return c.buf.Bytes()
+}
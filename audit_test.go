@@ -0,0 +1,360 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testAuditKey is the key test audit logs are chained with.
+var testAuditKey = []byte("0123456789abcdef0123456789abcdef")
+
+func readAuditRecords(t *testing.T, path string) []AuditRecord {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []AuditRecord
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		var record AuditRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("invalid record %q: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestUnixReverseProxy_Audit(t *testing.T) {
+	socket := startFakeUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/_api/document/people"):
+			w.WriteHeader(http.StatusAccepted)
+			w.Write([]byte(`[{"_id": "people/a", "_key": "a"}, {"error": true, "errorNum": 1210}, {"_key": "b"}]`))
+		default:
+			w.Write([]byte(`{"result": []}`))
+		}
+	}))
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := OpenAuditLog(path, testAuditKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit.HashBindValues = true
+	proxy := NewUnixReverseProxy(socket, AllowReadWrite)
+	proxy.SetAuditLog(audit)
+
+	serve := func(method, target, body string) {
+		t.Helper()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req = req.WithContext(WithPeerCred(req.Context(), PeerCred{UID: 1000, GID: 100, PID: 7}))
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, req)
+		if rec.Code >= 300 {
+			t.Fatalf("%s %s: status = %d, body = %s", method, target, rec.Code, rec.Body.String())
+		}
+	}
+	serve(http.MethodGet, "/_api/document/people/a", "")
+	serve(http.MethodPost, "/_api/cursor", `{"query": "FOR p IN people RETURN p"}`)
+	serve(http.MethodPost, "/_db/kg/_api/document/people", `[{"_key": "a"}, {"_key": "a"}, {"_key": "b"}]`)
+	serve(http.MethodPost, "/_api/cursor", `{"query": "FOR p IN @@c UPDATE p WITH {seen: @now} IN @@c", "bindVars": {"@c": "people", "now": 1 }}`)
+	serve(http.MethodDelete, "/_api/document/people/c", "")
+	audit.Close()
+
+	records := readAuditRecords(t, path)
+	if len(records) != 4 {
+		t.Fatalf("got %d records, want 4: %+v", len(records), records)
+	}
+	// A query is recorded whether or not it writes.
+	query := records[0]
+	if query.Seq != 1 || query.Prev != auditGenesisHash || query.Query != "FOR p IN people RETURN p" ||
+		strings.Join(query.Collections, ",") != "people" {
+		t.Errorf("read query record = %+v", query)
+	}
+	insert := records[1]
+	if insert.Seq != 2 || insert.Method != http.MethodPost ||
+		insert.Path != "/_api/document/people" || insert.Database != "kg" || insert.Status != http.StatusAccepted {
+		t.Errorf("insert record = %+v", insert)
+	}
+	if insert.Peer == nil || *insert.Peer != (AuditPeer{UID: 1000, GID: 100, PID: 7}) {
+		t.Errorf("insert peer = %+v", insert.Peer)
+	}
+	if strings.Join(insert.Collections, ",") != "people" || strings.Join(insert.Keys, ",") != "a,b" {
+		t.Errorf("insert collections = %q, keys = %q", insert.Collections, insert.Keys)
+	}
+
+	update := records[2]
+	if !strings.HasPrefix(update.Query, "FOR p IN @@c UPDATE") || strings.Join(update.BindVars, ",") != "@c,now" {
+		t.Errorf("update query = %q, bind vars = %q", update.Query, update.BindVars)
+	}
+	if strings.Join(update.Collections, ",") != "people" {
+		t.Errorf("update collections = %q", update.Collections)
+	}
+	// sha256("1")
+	if update.BindValueHashes["now"] != "6b86b273ff34fce19d6b804eff5a3f5747ada4eaa22f1d49c01e52ddb7875b4b" {
+		t.Errorf("bind value hashes = %v", update.BindValueHashes)
+	}
+
+	remove := records[3]
+	if remove.Method != http.MethodDelete || strings.Join(remove.Keys, ",") != "c" || remove.Seq != 4 {
+		t.Errorf("remove record = %+v", remove)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	summary, err := VerifyAuditLog(f, testAuditKey)
+	if err != nil || summary.Records != 4 {
+		t.Fatalf("VerifyAuditLog() = %+v, %v", summary, err)
+	}
+
+	// Reopening continues the chain.
+	audit, err = OpenAuditLog(path, testAuditKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+	if seq, head := audit.Head(); seq != 4 || head != summary.Head {
+		t.Errorf("Head() after reopen = %d, %s, want 4, %s", seq, head, summary.Head)
+	}
+}
+
+func TestUnixReverseProxy_AuditLargeQuery(t *testing.T) {
+	socket := startFakeUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Write([]byte(`{"result": []}`))
+	}))
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := OpenAuditLog(path, testAuditKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewUnixReverseProxy(socket, AllowReadWrite)
+	proxy.SetAuditLog(audit)
+
+	body := `{"query": "FOR p IN people UPDATE p WITH {note: @note} IN people", "bindVars": {"note": "` +
+		strings.Repeat("x", cursorBodyPeekLimit) + `"}}`
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/_api/cursor", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	audit.Close()
+
+	records := readAuditRecords(t, path)
+	if len(records) != 1 {
+		t.Fatalf("got %d records, want 1: %+v", len(records), records)
+	}
+	if r := records[0]; !r.QueryTruncated || r.Query != "" || len(r.BindVars) != 0 {
+		t.Errorf("record = %+v, want a truncated query", r)
+	}
+}
+
+func TestUnixReverseProxy_AuditWithoutResponse(t *testing.T) {
+	socket := startFakeUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Apply the change, then lose the response.
+		io.Copy(io.Discard, r.Body)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.Close()
+	}))
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := OpenAuditLog(path, testAuditKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewUnixReverseProxy(socket, mustCompilePolicy(t, `
+rules:
+  - methods: [POST]
+    paths: ["/_api/document/**"]
+  - methods: [POST]
+    paths: [/_api/import]
+    import:
+      deny_attributes: [_key]
+`, "yaml"))
+	proxy.SetAuditLog(audit)
+
+	serve := func(target, body string, want int) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, target, strings.NewReader(body)))
+		if rec.Code != want {
+			t.Fatalf("POST %s: status = %d, want %d", target, rec.Code, want)
+		}
+	}
+	serve("/_api/document/people", `{"_key": "a"}`, http.StatusBadGateway)
+	serve("/_api/import?type=documents&collection=people", "{\"name\": \"b\"}\n{\"_key\": \"c\"}\n", http.StatusForbidden)
+	audit.Close()
+
+	records := readAuditRecords(t, path)
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2: %+v", len(records), records)
+	}
+	if records[0].Path != "/_api/document/people" || records[0].Status != 0 {
+		t.Errorf("lost response record = %+v, want status 0", records[0])
+	}
+	if records[1].Path != "/_api/import" || records[1].Status != http.StatusForbidden {
+		t.Errorf("aborted import record = %+v, want status 403", records[1])
+	}
+}
+
+func TestUnixReverseProxy_AuditWriteFailure(t *testing.T) {
+	socket := startFakeUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	audit, err := OpenAuditLog(filepath.Join(t.TempDir(), "audit.log"), testAuditKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every write now fails.
+	audit.Close()
+	metrics := NewMetrics()
+	proxy := NewUnixReverseProxy(socket, AllowReadWrite)
+	proxy.SetAuditLog(audit)
+	proxy.SetMetrics(metrics)
+
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/_api/document/people/a", nil))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("status = %d", rec.Code)
+	}
+	var b strings.Builder
+	metrics.WriteTo(&b)
+	if want := `arango_proxy_audit_write_failures_total{listener=""} 1`; !strings.Contains(b.String(), want+"\n") {
+		t.Errorf("metrics lack %q:\n%s", want, b.String())
+	}
+}
+
+func TestVerifyAuditLog_DetectsTampering(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := OpenAuditLog(path, testAuditKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if err := audit.append(&AuditRecord{Method: http.MethodDelete, Path: "/_api/document/c/" + key, Keys: []string{key}, Status: 200}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	audit.Close()
+	original, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(original), "\n")[:3]
+
+	// Rewrite record 2 and recompute the chain from there, as someone
+	// who can write the file but does not hold the key would.
+	forged := lines[0]
+	prev := auditHashSuffix.FindStringSubmatch(strings.TrimSuffix(lines[0], "\n"))[1]
+	for _, line := range lines[1:] {
+		record, _, err := parseAuditLine([]byte(strings.TrimSuffix(line, "\n")), testAuditKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		record.Prev = prev
+		if record.Seq == 2 {
+			record.Keys = []string{"x"}
+		}
+		data, _ := json.Marshal(record)
+		prev = auditHash([]byte("not the key, but long enough"), data)
+		forged += string(data[:len(data)-1]) + `,"hash":"` + prev + "\"}\n"
+	}
+
+	tests := []struct {
+		name   string
+		log    string
+		errMsg string
+	}{
+		{"intact", string(original), ""},
+		{"edited", strings.Replace(string(original), `"keys":["b"]`, `"keys":["x"]`, 1), "line 2: record does not match its hash"},
+		{"removed", lines[0] + lines[2], "line 2: chain broken"},
+		{"reordered", lines[1] + lines[0] + lines[2], "line 1: chain broken"},
+		{"truncated", string(original[:len(original)-10]), "line 3: truncated record"},
+		{"no hash", `{"seq":1}` + "\n", "line 1: record does not end with a hash"},
+		{"rehashed", forged, "line 2: record does not match its hash"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			summary, err := VerifyAuditLog(strings.NewReader(tc.log), testAuditKey)
+			if tc.errMsg == "" {
+				if err != nil || summary.Records != 3 {
+					t.Errorf("VerifyAuditLog() = %+v, %v", summary, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.errMsg) {
+				t.Errorf("VerifyAuditLog() error = %v, want %q", err, tc.errMsg)
+			}
+		})
+	}
+}
+
+func TestVerifyAuditLog_RequiresKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := OpenAuditLog(path, testAuditKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := audit.append(&AuditRecord{Method: http.MethodDelete, Path: "/_api/document/c/a", Status: 200}); err != nil {
+		t.Fatal(err)
+	}
+	audit.Close()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyAuditLog(bytes.NewReader(data), []byte("another key of sufficient length")); err == nil {
+		t.Error("VerifyAuditLog() accepted a log under the wrong key")
+	}
+	if _, err := OpenAuditLog(path, []byte("another key of sufficient length")); err == nil {
+		t.Error("OpenAuditLog() continued a log under the wrong key")
+	}
+	if _, err := OpenAuditLog(filepath.Join(t.TempDir(), "new.log"), []byte("short")); err == nil {
+		t.Error("OpenAuditLog() accepted a short key")
+	}
+}
+
+func TestOpenAuditLog_RejectsPartialRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	if err := os.WriteFile(path, []byte(`{"seq":1,"prev":"`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenAuditLog(path, testAuditKey); err == nil {
+		t.Error("OpenAuditLog() should refuse a log ending in a partial record")
+	}
+}
+
+func TestLastLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lines")
+	long := bytes.Repeat([]byte("x"), auditTailChunk+10)
+	content := append(append([]byte("first\n"), long...), '\n')
+	if err := os.WriteFile(path, content, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	last, err := lastLine(f)
+	if err != nil || !bytes.Equal(last, long) {
+		t.Errorf("lastLine() = %d bytes, %v", len(last), err)
+	}
+}
@@ -0,0 +1,395 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BalancePolicy chooses among several upstream endpoints.
+type BalancePolicy string
+
+const (
+	// BalanceRoundRobin sends requests to the endpoints in turn.
+	BalanceRoundRobin BalancePolicy = "round-robin"
+	// BalanceLeastInFlight sends each request to the endpoint with the
+	// fewest requests in progress.
+	BalanceLeastInFlight BalancePolicy = "least-in-flight"
+	// BalanceActiveFailover sends requests to the leader of an active
+	// failover deployment, and dirty reads to its followers in turn.
+	BalanceActiveFailover BalancePolicy = "active-failover"
+)
+
+const (
+	// failedEndpointBackoff is how long an endpoint that could not be
+	// dialled is tried only after the others.
+	failedEndpointBackoff = 5 * time.Second
+
+	// upstreamPinIdleTimeout is how long a cursor or stream transaction
+	// stays pinned to its coordinator after it was last used.
+	upstreamPinIdleTimeout = DefaultTransactionIdleTimeout
+)
+
+// ParseBalancePolicy parses an UPSTREAM_BALANCE value; empty means
+// BalanceRoundRobin.
+func ParseBalancePolicy(s string) (BalancePolicy, error) {
+	switch policy := BalancePolicy(strings.TrimSpace(s)); policy {
+	case "":
+		return BalanceRoundRobin, nil
+	case BalanceRoundRobin, BalanceLeastInFlight, BalanceActiveFailover:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid upstream balance %q: must be %s, %s or %s", s,
+			BalanceRoundRobin, BalanceLeastInFlight, BalanceActiveFailover)
+	}
+}
+
+// upstreamTarget is one endpoint of a balancer.
+type upstreamTarget struct {
+	endpoint  UpstreamEndpoint
+	transport http.RoundTripper
+	inFlight  atomic.Int64
+	// failedAt is when dialling the endpoint last failed, in Unix
+	// nanoseconds, or 0.
+	failedAt atomic.Int64
+}
+
+// balancer spreads requests over several endpoints, typically the
+// coordinators of a cluster. A request that fails to connect is retried on
+// the next endpoint, since it cannot have reached ArangoDB. Cursors and
+// stream transactions live on the coordinator that created them, so
+// requests continuing one are pinned to that coordinator.
+type balancer struct {
+	targets []*upstreamTarget
+	policy  BalancePolicy
+	next    atomic.Uint64
+	pins    *pinTable
+	now     func() time.Time
+	// leader is set for BalanceActiveFailover.
+	leader *leaderTracker
+}
+
+func newBalancer(targets []*upstreamTarget, policy BalancePolicy) *balancer {
+	b := &balancer{targets: targets, policy: policy, pins: newPinTable(), now: time.Now}
+	if policy == BalanceActiveFailover {
+		b.leader = newLeaderTracker(targets)
+	}
+	return b
+}
+
+func (b *balancer) RoundTrip(req *http.Request) (*http.Response, error) {
+	if b.leader != nil && isDirtyRead(req) {
+		dirty := *req
+		dirty.Header = req.Header.Clone()
+		dirty.Header.Set(DirtyReadHeader, "true")
+		req = &dirty
+	}
+	reqPath, ok := parseRequestPath(req.URL.Path)
+	if ok {
+		if key := pinKey(req, reqPath); key != "" {
+			if target, ok := b.pins.get(key); ok {
+				resp, err := b.send(target, req)
+				if err == nil {
+					b.observe(req, reqPath, target, resp)
+				}
+				return resp, err
+			}
+		}
+	}
+
+	var candidates []*upstreamTarget
+	if b.leader != nil {
+		candidates = b.leaderOrder(req)
+	} else {
+		candidates = b.order()
+	}
+	body := req.Body
+	var lastErr error
+	for i, target := range candidates {
+		attempt := req
+		var guard *replayBody
+		if i < len(candidates)-1 && body != nil && body != http.NoBody {
+			guard = &replayBody{body: body, hold: true}
+			held := *req
+			held.Body = guard
+			attempt = &held
+		}
+		resp, err := b.send(target, attempt)
+		if err == nil {
+			target.failedAt.Store(0)
+			if guard != nil {
+				guard.release()
+			}
+			if b.leader != nil {
+				if target, resp, err = b.followLeader(req, target, resp); err != nil {
+					return nil, err
+				}
+			}
+			if ok {
+				b.observe(req, reqPath, target, resp)
+			}
+			return resp, nil
+		}
+		lastErr = err
+		if !isDialError(err) {
+			if guard != nil {
+				guard.release()
+			}
+			return nil, err
+		}
+		target.failedAt.Store(b.now().UnixNano())
+		if b.leader != nil {
+			b.leader.lost(target)
+		}
+		if guard != nil && guard.read.Load() {
+			guard.release()
+			return nil, err
+		}
+	}
+	return nil, lastErr
+}
+
+// order returns the targets in the order to try them: the one chosen by
+// the policy first, endpoints that recently failed to connect last.
+func (b *balancer) order() []*upstreamTarget {
+	n := len(b.targets)
+	start := int(b.next.Add(1)-1) % n
+	if b.policy == BalanceLeastInFlight {
+		least := int64(-1)
+		for i := range n {
+			j := (start + i) % n
+			if inFlight := b.targets[j].inFlight.Load(); least < 0 || inFlight < least {
+				least = inFlight
+				start = j
+			}
+		}
+	}
+	ordered := make([]*upstreamTarget, 0, n)
+	var failed []*upstreamTarget
+	for i := range n {
+		target := b.targets[(start+i)%n]
+		if b.recentlyFailed(target) {
+			failed = append(failed, target)
+			continue
+		}
+		ordered = append(ordered, target)
+	}
+	return append(ordered, failed...)
+}
+
+// recentlyFailed reports whether dialling target failed within
+// failedEndpointBackoff.
+func (b *balancer) recentlyFailed(target *upstreamTarget) bool {
+	return target.failedAt.Load() > b.now().Add(-failedEndpointBackoff).UnixNano()
+}
+
+// send forwards req to target, counting it in flight until its response
+// body is closed.
+func (b *balancer) send(target *upstreamTarget, req *http.Request) (*http.Response, error) {
+	target.inFlight.Add(1)
+	resp, err := target.transport.RoundTrip(req)
+	if err != nil {
+		target.inFlight.Add(-1)
+		return nil, err
+	}
+	resp.Body = &doneBody{ReadCloser: resp.Body, done: func() { target.inFlight.Add(-1) }}
+	return resp, nil
+}
+
+// observe pins cursors and stream transactions created by req to target
+// and unpins those that have ended.
+func (b *balancer) observe(req *http.Request, reqPath requestPath, target *upstreamTarget, resp *http.Response) {
+	created := resp.StatusCode == http.StatusCreated || resp.StatusCode == http.StatusOK
+	gone := resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone
+	switch {
+	case req.Method == http.MethodPost && reqPath.isCursorCreate():
+		if created {
+			b.scan(resp, func(id string) { b.pins.set("cursor/"+id, target) }, "id")
+		}
+	case req.Method == http.MethodPost && reqPath.isTransactionBegin():
+		if created {
+			b.scan(resp, func(id string) { b.pins.set("transaction/"+id, target) }, "result", "id")
+		}
+	default:
+		if id, ok := reqPath.cursorID(); ok {
+			key := "cursor/" + id
+			switch {
+			case gone || req.Method == http.MethodDelete:
+				b.pins.remove(key)
+			case created:
+				b.scan(resp, func(hasMore string) {
+					if hasMore == "false" {
+						b.pins.remove(key)
+					}
+				}, "hasMore")
+			}
+		} else if id, ok := reqPath.transactionID(); ok {
+			if gone || (created && (req.Method == http.MethodPut || req.Method == http.MethodDelete)) {
+				b.pins.remove("transaction/" + id)
+			}
+		}
+	}
+}
+
+// scan calls found with the value of the field at path of the response
+// body as the client reads it.
+func (b *balancer) scan(resp *http.Response, found func(value string), path ...string) {
+	scanner := newJSONFieldScanner(found, path...)
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(resp.Body, scanner), resp.Body}
+}
+
+// CloseIdleConnections closes the idle connections of every endpoint.
+func (b *balancer) CloseIdleConnections() {
+	for _, target := range b.targets {
+		if closer, ok := target.transport.(interface{ CloseIdleConnections() }); ok {
+			closer.CloseIdleConnections()
+		}
+	}
+}
+
+// pinKey returns the key of the cursor or stream transaction a request
+// continues, or "".
+func pinKey(req *http.Request, reqPath requestPath) string {
+	if id, ok := reqPath.cursorID(); ok {
+		return "cursor/" + id
+	}
+	if id, ok := reqPath.transactionID(); ok {
+		return "transaction/" + id
+	}
+	if id := req.Header.Get(TransactionIDHeader); id != "" {
+		return "transaction/" + id
+	}
+	return ""
+}
+
+// cursorID returns the cursor id addressed by /_api/cursor/<id> and the
+// batch endpoints below it, if the path is one.
+func (p requestPath) cursorID() (string, bool) {
+	if len(p.segments) < 3 || len(p.segments) > 4 || p.segments[0] != "_api" || p.segments[1] != "cursor" ||
+		p.segments[2] == "" {
+		return "", false
+	}
+	return p.segments[2], true
+}
+
+// replayBody passes a request body to an attempt that may fail to
+// connect, keeping the body open for the next attempt. A dial error occurs
+// before any of the body is read.
+type replayBody struct {
+	body io.ReadCloser
+	read atomic.Bool
+
+	mu     sync.Mutex
+	hold   bool
+	closed bool
+}
+
+func (r *replayBody) Read(p []byte) (int, error) {
+	r.read.Store(true)
+	return r.body.Read(p)
+}
+
+// Close closes the body unless it is held for another attempt.
+func (r *replayBody) Close() error {
+	r.mu.Lock()
+	r.closed = true
+	hold := r.hold
+	r.mu.Unlock()
+	if hold {
+		return nil
+	}
+	return r.body.Close()
+}
+
+// release stops holding the body, closing it if the attempt already did.
+func (r *replayBody) release() {
+	r.mu.Lock()
+	r.hold = false
+	closed := r.closed
+	r.mu.Unlock()
+	if closed {
+		r.body.Close()
+	}
+}
+
+// doneBody calls done once when it is closed.
+type doneBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (d *doneBody) Close() error {
+	err := d.ReadCloser.Close()
+	d.once.Do(d.done)
+	return err
+}
+
+// pinTable maps cursors and stream transactions to the endpoint holding
+// them.
+type pinTable struct {
+	mu        sync.Mutex
+	pins      map[string]*upstreamPin
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+type upstreamPin struct {
+	target   *upstreamTarget
+	lastUsed time.Time
+}
+
+func newPinTable() *pinTable {
+	return &pinTable{pins: make(map[string]*upstreamPin), now: time.Now}
+}
+
+func (t *pinTable) get(key string) (*upstreamTarget, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	pin, ok := t.pins[key]
+	if !ok {
+		return nil, false
+	}
+	now := t.now()
+	if now.Sub(pin.lastUsed) > upstreamPinIdleTimeout {
+		delete(t.pins, key)
+		return nil, false
+	}
+	pin.lastUsed = now
+	return pin.target, true
+}
+
+func (t *pinTable) set(key string, target *upstreamTarget) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	if now.Sub(t.lastPrune) > time.Minute {
+		for key, pin := range t.pins {
+			if now.Sub(pin.lastUsed) > upstreamPinIdleTimeout {
+				delete(t.pins, key)
+			}
+		}
+		t.lastPrune = now
+	}
+	t.pins[key] = &upstreamPin{target: target, lastUsed: now}
+}
+
+func (t *pinTable) remove(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.pins, key)
+}
+
+// Len returns the number of pinned cursors and transactions.
+func (t *pinTable) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.pins)
+}
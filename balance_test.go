@@ -0,0 +1,251 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseBalancePolicy(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    BalancePolicy
+		wantErr bool
+	}{
+		{in: "", want: BalanceRoundRobin},
+		{in: "round-robin", want: BalanceRoundRobin},
+		{in: " least-in-flight ", want: BalanceLeastInFlight},
+		{in: "random", wantErr: true},
+	}
+	for _, tc := range tests {
+		got, err := ParseBalancePolicy(tc.in)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("ParseBalancePolicy(%q) = %q, %v, want %q, wantErr %v", tc.in, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+// fakeCoordinator serves cursors and stream transactions whose ids start
+// with name, and knows only its own.
+func fakeCoordinator(name string, requests *atomic.Int32) http.Handler {
+	var next atomic.Int32
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		reqPath, _ := parseRequestPath(r.URL.Path)
+		own := func(id string) bool { return strings.HasPrefix(id, name+"-") }
+		switch {
+		case r.Method == http.MethodPost && reqPath.isCursorCreate():
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, `{"result":[{"id":"other"}],"hasMore":true,"id":"%s-%d","error":false}`, name, next.Add(1))
+		case r.Method == http.MethodPost && reqPath.isTransactionBegin():
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, `{"code":201,"result":{"id":"%s-%d","status":"running"}}`, name, next.Add(1))
+		default:
+			if id, ok := reqPath.cursorID(); ok && !own(id) {
+				http.Error(w, `{"error":true,"errorNum":1600}`, http.StatusNotFound)
+				return
+			}
+			if id, ok := reqPath.transactionID(); ok && !own(id) {
+				http.Error(w, `{"error":true,"errorNum":1655}`, http.StatusNotFound)
+				return
+			}
+			if id := r.Header.Get(TransactionIDHeader); id != "" && !own(id) {
+				http.Error(w, `{"error":true,"errorNum":1655}`, http.StatusNotFound)
+				return
+			}
+			if _, ok := reqPath.cursorID(); ok && r.Method != http.MethodDelete {
+				fmt.Fprintf(w, `{"result":[],"hasMore":false}`)
+				return
+			}
+			body, _ := io.ReadAll(r.Body)
+			fmt.Fprintf(w, "%s %s", name, body)
+		}
+	})
+}
+
+// startCoordinators serves n fake coordinators and returns their Unix
+// endpoints and request counters.
+func startCoordinators(t *testing.T, n int) ([]string, []*atomic.Int32) {
+	t.Helper()
+	endpoints := make([]string, n)
+	counts := make([]*atomic.Int32, n)
+	for i := range n {
+		counts[i] = &atomic.Int32{}
+		endpoints[i] = "unix://" + startFakeUpstream(t, fakeCoordinator(fmt.Sprintf("c%d", i), counts[i]))
+	}
+	return endpoints, counts
+}
+
+func balancedClient(t *testing.T, settings UpstreamSettings) (*http.Client, *balancer) {
+	t.Helper()
+	settings.DialTimeout = time.Second
+	client, err := settings.newClient()
+	if err != nil {
+		t.Fatalf("newClient() error = %v", err)
+	}
+	b, ok := client.Transport.(*balancer)
+	if !ok {
+		t.Fatalf("transport is %T, want a balancer", client.Transport)
+	}
+	return client, b
+}
+
+// do sends a request through client and returns the status and body.
+func do(t *testing.T, client *http.Client, method, path, trx string) (int, string) {
+	t.Helper()
+	req, _ := http.NewRequest(method, upstreamBaseURL+path, strings.NewReader("body"))
+	if trx != "" {
+		req.Header.Set(TransactionIDHeader, trx)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestBalancer_RoundRobin(t *testing.T) {
+	endpoints, counts := startCoordinators(t, 3)
+	client, _ := balancedClient(t, UpstreamSettings{Endpoints: endpoints})
+	for range 6 {
+		do(t, client, http.MethodGet, "/_api/version", "")
+	}
+	for i, count := range counts {
+		if n := count.Load(); n != 2 {
+			t.Errorf("coordinator %d served %d requests, want 2", i, n)
+		}
+	}
+}
+
+func TestBalancer_LeastInFlight(t *testing.T) {
+	release := make(chan struct{})
+	var slow, fast atomic.Int32
+	slowSocket := startFakeUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slow.Add(1)
+		<-release
+	}))
+	fastSocket := startFakeUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fast.Add(1)
+	}))
+	client, b := balancedClient(t, UpstreamSettings{
+		Endpoints: []string{"unix://" + slowSocket, "unix://" + fastSocket},
+		Balance:   BalanceLeastInFlight,
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		do(t, client, http.MethodGet, "/_api/version", "")
+	}()
+	waitFor(t, "the slow request", func() bool { return b.targets[0].inFlight.Load() == 1 })
+	for range 4 {
+		do(t, client, http.MethodGet, "/_api/version", "")
+	}
+	close(release)
+	<-done
+	if slow.Load() != 1 || fast.Load() != 4 {
+		t.Errorf("slow served %d, fast %d; want 1 and 4", slow.Load(), fast.Load())
+	}
+	if n := b.targets[0].inFlight.Load() + b.targets[1].inFlight.Load(); n != 0 {
+		t.Errorf("%d requests still counted in flight", n)
+	}
+}
+
+func TestBalancer_Failover(t *testing.T) {
+	endpoints, counts := startCoordinators(t, 1)
+	missing := "unix://" + filepath.Join(t.TempDir(), "down.sock")
+	proxy := proxyTo(t, UpstreamSettings{Endpoints: []string{missing, endpoints[0]}, DialTimeout: time.Second})
+	proxy.SetAllowFunc(AllowReadWrite)
+	for range 4 {
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/_api/document/docs", strings.NewReader(`{"a":1}`)))
+		if rec.Code != http.StatusOK || rec.Body.String() != `c0 {"a":1}` {
+			t.Fatalf("response = %d %q, want the body forwarded to c0", rec.Code, rec.Body.String())
+		}
+	}
+	if n := counts[0].Load(); n != 4 {
+		t.Errorf("c0 served %d requests, want 4", n)
+	}
+	b := proxy.Client().Transport.(*balancer)
+	if b.targets[0].failedAt.Load() == 0 {
+		t.Error("failed endpoint not marked")
+	}
+	if order := b.order(); order[0] != b.targets[1] {
+		t.Error("failed endpoint not tried last")
+	}
+}
+
+func TestBalancer_PinsCursors(t *testing.T) {
+	endpoints, _ := startCoordinators(t, 3)
+	client, b := balancedClient(t, UpstreamSettings{Endpoints: endpoints})
+
+	var ids []string
+	for range 3 {
+		status, body := do(t, client, http.MethodPost, "/_db/kg/_api/cursor", "")
+		if status != http.StatusCreated {
+			t.Fatalf("create cursor: %d %s", status, body)
+		}
+		id := body[strings.LastIndex(body, `"id":"`)+6:]
+		ids = append(ids, id[:strings.Index(id, `"`)])
+	}
+	if b.pins.Len() != 3 {
+		t.Fatalf("%d cursors pinned, want 3", b.pins.Len())
+	}
+	// Shift the rotation, so that round-robin alone would send each
+	// continuation to another coordinator.
+	do(t, client, http.MethodGet, "/_api/version", "")
+	for _, id := range ids[:2] {
+		if status, body := do(t, client, http.MethodPut, "/_db/kg/_api/cursor/"+id, ""); status != http.StatusOK {
+			t.Errorf("next batch of %s: %d %s", id, status, body)
+		}
+	}
+	if status, _ := do(t, client, http.MethodDelete, "/_db/kg/_api/cursor/"+ids[2], ""); status != http.StatusOK {
+		t.Errorf("delete %s: %d", ids[2], status)
+	}
+	if n := b.pins.Len(); n != 0 {
+		t.Errorf("%d cursors still pinned after exhausting or deleting them", n)
+	}
+}
+
+func TestBalancer_PinsTransactions(t *testing.T) {
+	endpoints, _ := startCoordinators(t, 2)
+	client, b := balancedClient(t, UpstreamSettings{Endpoints: endpoints, Balance: BalanceLeastInFlight})
+
+	_, body := do(t, client, http.MethodPost, "/_api/transaction/begin", "")
+	id := body[strings.Index(body, `"id":"`)+6:]
+	id = id[:strings.Index(id, `"`)]
+	for range 4 {
+		if status, body := do(t, client, http.MethodPost, "/_api/document/docs", id); status != http.StatusOK {
+			t.Fatalf("request in transaction %s: %d %s", id, status, body)
+		}
+	}
+	if status, _ := do(t, client, http.MethodPut, "/_api/transaction/"+id, ""); status != http.StatusOK {
+		t.Errorf("commit %s: %d", id, status)
+	}
+	if n := b.pins.Len(); n != 0 {
+		t.Errorf("%d transactions still pinned after commit", n)
+	}
+}
+
+func TestPinTable_Expires(t *testing.T) {
+	pins := newPinTable()
+	now := time.Now()
+	pins.now = func() time.Time { return now }
+	target := &upstreamTarget{}
+	pins.set("cursor/1", target)
+	now = now.Add(upstreamPinIdleTimeout / 2)
+	if got, ok := pins.get("cursor/1"); !ok || got != target {
+		t.Fatal("pin lost before the idle timeout")
+	}
+	now = now.Add(upstreamPinIdleTimeout + time.Second)
+	if _, ok := pins.get("cursor/1"); ok {
+		t.Error("pin kept after the idle timeout")
+	}
+}
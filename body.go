@@ -0,0 +1,241 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// RequestBody is the body of a request being authorized and forwarded.
+// Allow functions can read all of a small body (Peek), or a bounded prefix
+// of a large one (Prefix), and can register checks that run on each line as
+// the body streams to the upstream (CheckLines). Only what has been read is
+// held in memory; the rest of the body is never buffered.
+type RequestBody struct {
+	body   io.ReadCloser
+	buf    []byte
+	eof    bool
+	err    error
+	checks []*lineCheck
+
+	// streamErr is the first error a line check reported while streaming.
+	// The transport reads the body on its own goroutine.
+	mu        sync.Mutex
+	streamErr error
+}
+
+type requestBodyKey struct{}
+
+// newRequestBody wraps a request body, which may be nil.
+func newRequestBody(body io.ReadCloser) *RequestBody {
+	if body == nil || body == http.NoBody {
+		return &RequestBody{eof: true}
+	}
+	return &RequestBody{body: body}
+}
+
+// withRequestBody returns a copy of ctx carrying body.
+func withRequestBody(ctx context.Context, body *RequestBody) context.Context {
+	return context.WithValue(ctx, requestBodyKey{}, body)
+}
+
+// RequestBodyFromContext returns the body of the request being served. It
+// is only available to allow functions run by UnixReverseProxy.
+func RequestBodyFromContext(ctx context.Context) (*RequestBody, bool) {
+	body, ok := ctx.Value(requestBodyKey{}).(*RequestBody)
+	return body, ok
+}
+
+// fill reads until at least n bytes are buffered or the body ends.
+func (b *RequestBody) fill(n int64) error {
+	if b.err != nil {
+		return b.err
+	}
+	if b.eof || int64(len(b.buf)) >= n {
+		return nil
+	}
+	buf := bytes.NewBuffer(b.buf)
+	_, err := buf.ReadFrom(io.LimitReader(b.body, n-int64(len(b.buf))))
+	b.buf = buf.Bytes()
+	if err != nil {
+		b.err = err
+		return err
+	}
+	if int64(len(b.buf)) < n {
+		b.eof = true
+	}
+	return nil
+}
+
+// Peek returns the whole body, reading at most limit bytes (capped at
+// MaxBodyPeekSize). A larger body is an error. Peek implements BodyPeeker.
+func (b *RequestBody) Peek(limit int64) ([]byte, error) {
+	if limit <= 0 || limit > MaxBodyPeekSize {
+		limit = MaxBodyPeekSize
+	}
+	if err := b.fill(limit + 1); err != nil {
+		return nil, err
+	}
+	if int64(len(b.buf)) > limit {
+		return nil, fmt.Errorf("request body exceeds inspection limit (%d bytes)", limit)
+	}
+	return b.buf, nil
+}
+
+// Prefix returns up to n bytes from the start of the body (capped at
+// MaxBodyPeekSize). Unlike Peek, a longer body is not an error: the part not
+// read is streamed to the upstream unexamined.
+func (b *RequestBody) Prefix(n int64) ([]byte, error) {
+	if n <= 0 || n > MaxBodyPeekSize {
+		n = MaxBodyPeekSize
+	}
+	if err := b.fill(n); err != nil {
+		return nil, err
+	}
+	if int64(len(b.buf)) > n {
+		return b.buf[:n], nil
+	}
+	return b.buf, nil
+}
+
+// CheckLines registers check to run on every line of the body, without its
+// line terminator, as the body is forwarded. Lines longer than maxLine bytes
+// fail. When a check fails the upstream request is aborted before the body
+// is complete, so ArangoDB, which reads a request in full before acting on
+// it, never processes it; the client receives the check's error. check must
+// not retain line.
+func (b *RequestBody) CheckLines(maxLine int64, check func(line []byte) error) {
+	b.checks = append(b.checks, &lineCheck{max: maxLine, check: check})
+}
+
+// reader returns the bytes read so far followed by the unread rest of the
+// body, with any line checks applied, and the body's length if known.
+func (b *RequestBody) reader(contentLength int64) (io.ReadCloser, int64) {
+	if b.body == nil {
+		return http.NoBody, 0
+	}
+	var r io.Reader = io.MultiReader(bytes.NewReader(b.buf), b.body)
+	length := contentLength
+	if b.eof {
+		r = bytes.NewReader(b.buf)
+		length = int64(len(b.buf))
+	}
+	if len(b.checks) > 0 {
+		r = &lineCheckReader{src: r, body: b}
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, b.body}, length
+}
+
+// replay returns a function reopening the body for another attempt, or nil
+// unless the whole body has been read and no line checks apply.
+func (b *RequestBody) replay() func() (io.ReadCloser, error) {
+	if b.body == nil || !b.eof || len(b.checks) > 0 {
+		return nil
+	}
+	buf := b.buf
+	return func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf)), nil
+	}
+}
+
+// StreamErr returns the error a line check reported while the body was
+// being forwarded, if any.
+func (b *RequestBody) StreamErr() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.streamErr
+}
+
+func (b *RequestBody) setStreamErr(err error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.streamErr == nil {
+		b.streamErr = err
+	}
+	return b.streamErr
+}
+
+// close closes the underlying body.
+func (b *RequestBody) close() {
+	if b.body != nil {
+		_ = b.body.Close()
+	}
+}
+
+type lineCheck struct {
+	max   int64
+	check func(line []byte) error
+}
+
+// lineCheckReader passes the body through while splitting it into lines
+// for the registered checks. Only the current partial line is buffered.
+type lineCheckReader struct {
+	src     io.Reader
+	body    *RequestBody
+	partial []byte
+	done    bool
+}
+
+var errLineTooLong = errors.New("line exceeds inspection limit")
+
+func (l *lineCheckReader) Read(p []byte) (int, error) {
+	if err := l.body.StreamErr(); err != nil {
+		return 0, err
+	}
+	n, err := l.src.Read(p)
+	data := p[:n]
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			l.partial = append(l.partial, data...)
+			if checkErr := l.checkLength(); checkErr != nil {
+				return 0, checkErr
+			}
+			break
+		}
+		l.partial = append(l.partial, data[:i]...)
+		if checkErr := l.finishLine(); checkErr != nil {
+			return 0, checkErr
+		}
+		data = data[i+1:]
+	}
+	if err == io.EOF && !l.done {
+		l.done = true
+		if len(l.partial) > 0 {
+			if checkErr := l.finishLine(); checkErr != nil {
+				return 0, checkErr
+			}
+		}
+	}
+	return n, err
+}
+
+func (l *lineCheckReader) checkLength() error {
+	for _, c := range l.body.checks {
+		if c.max > 0 && int64(len(l.partial)) > c.max {
+			return l.body.setStreamErr(fmt.Errorf("%w (%d bytes)", errLineTooLong, c.max))
+		}
+	}
+	return nil
+}
+
+func (l *lineCheckReader) finishLine() error {
+	if err := l.checkLength(); err != nil {
+		return err
+	}
+	line := bytes.TrimSuffix(l.partial, []byte("\r"))
+	for _, c := range l.body.checks {
+		if err := c.check(line); err != nil {
+			return l.body.setStreamErr(err)
+		}
+	}
+	l.partial = l.partial[:0]
+	return nil
+}
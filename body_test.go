@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestBody_PrefixThenPeek(t *testing.T) {
+	body := newRequestBody(io.NopCloser(strings.NewReader("0123456789")))
+
+	prefix, err := body.Prefix(4)
+	if err != nil || string(prefix) != "0123" {
+		t.Fatalf("Prefix(4) = %q, %v", prefix, err)
+	}
+	if _, err := body.Peek(5); err == nil {
+		t.Error("Peek(5) of a 10 byte body should fail")
+	}
+	data, err := body.Peek(10)
+	if err != nil || string(data) != "0123456789" {
+		t.Fatalf("Peek(10) = %q, %v", data, err)
+	}
+	prefix, err = body.Prefix(4)
+	if err != nil || string(prefix) != "0123" {
+		t.Errorf("Prefix(4) after Peek = %q, %v", prefix, err)
+	}
+}
+
+func TestRequestBody_ReaderStreamsUnreadRest(t *testing.T) {
+	body := newRequestBody(io.NopCloser(strings.NewReader("header\nrest of a long body")))
+	if _, err := body.Prefix(6); err != nil {
+		t.Fatal(err)
+	}
+	r, length := body.reader(25)
+	if length != 25 {
+		t.Errorf("length = %d, want the original content length", length)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil || string(data) != "header\nrest of a long body" {
+		t.Errorf("forwarded body = %q, %v", data, err)
+	}
+
+	empty := newRequestBody(http.NoBody)
+	if r, length := empty.reader(0); r != http.NoBody || length != 0 {
+		t.Errorf("empty body reader = %v, %d", r, length)
+	}
+}
+
+func TestRequestBody_Replay(t *testing.T) {
+	body := newRequestBody(io.NopCloser(strings.NewReader(`{"query":"RETURN 1"}`)))
+	if body.replay() != nil {
+		t.Error("body not read yet is replayable")
+	}
+	if _, err := body.Prefix(4); err != nil {
+		t.Fatal(err)
+	}
+	if body.replay() != nil {
+		t.Error("partly read body is replayable")
+	}
+	if _, err := body.Peek(0); err != nil {
+		t.Fatal(err)
+	}
+	replay := body.replay()
+	if replay == nil {
+		t.Fatal("fully read body is not replayable")
+	}
+	for range 2 {
+		r, _ := replay()
+		if data, _ := io.ReadAll(r); string(data) != `{"query":"RETURN 1"}` {
+			t.Errorf("replayed body = %q", data)
+		}
+	}
+	body.CheckLines(0, func([]byte) error { return nil })
+	if body.replay() != nil {
+		t.Error("body with line checks is replayable")
+	}
+}
+
+func TestRequestBody_CheckLines(t *testing.T) {
+	errBad := errors.New("bad line")
+	run := func(input string, maxLine int64) ([]string, error) {
+		body := newRequestBody(io.NopCloser(strings.NewReader(input)))
+		var lines []string
+		body.CheckLines(maxLine, func(line []byte) error {
+			if string(line) == "bad" {
+				return errBad
+			}
+			lines = append(lines, string(line))
+			return nil
+		})
+		r, _ := body.reader(-1)
+		_, err := io.Copy(io.Discard, iotestOneByteReader{r})
+		if err == nil && body.StreamErr() != nil {
+			t.Error("stream error recorded but not returned")
+		}
+		return lines, err
+	}
+
+	lines, err := run("a\r\nbb\n\nccc", 0)
+	if err != nil || strings.Join(lines, "|") != "a|bb||ccc" {
+		t.Errorf("lines = %q, err = %v", lines, err)
+	}
+	if _, err := run("a\nbad\nc\n", 0); !errors.Is(err, errBad) {
+		t.Errorf("bad line: err = %v", err)
+	}
+	if _, err := run("short\nmuch too long\n", 8); !errors.Is(err, errLineTooLong) {
+		t.Errorf("long line: err = %v", err)
+	}
+}
+
+// iotestOneByteReader reads one byte at a time, so that lines straddle
+// reads.
+type iotestOneByteReader struct{ r io.Reader }
+
+func (o iotestOneByteReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return o.r.Read(p[:1])
+}
+
+func TestUnixReverseProxy_StreamsLargeBodies(t *testing.T) {
+	var received int64
+	socket := startFakeUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, err := io.Copy(io.Discard, r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received = n
+		w.WriteHeader(http.StatusCreated)
+	}))
+	allow := mustCompilePolicy(t, `
+rules:
+  - methods: [POST]
+    paths: [/_api/import]
+    import:
+      deny_attributes: [_key]
+      max_line_bytes: 1024
+`, "yaml")
+	proxy := NewUnixReverseProxy(socket, allow)
+
+	// Larger than MaxBodyPeekSize: inspected line by line, never buffered.
+	line := `{"text": "` + strings.Repeat("x", 100) + `"}` + "\n"
+	lines := MaxBodyPeekSize/len(line) + 1000
+	good := strings.Repeat(line, lines)
+
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/_api/import?type=documents&collection=c", strings.NewReader(good)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("large import: status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	if received != int64(len(good)) {
+		t.Errorf("upstream received %d bytes, want %d", received, len(good))
+	}
+
+	received = 0
+	bad := good + `{"_key": "chosen"}` + "\n" + line
+	rec = httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/_api/import?type=documents&collection=c", strings.NewReader(bad)))
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "_key") {
+		t.Errorf("denied attribute: status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	if received != 0 {
+		t.Errorf("upstream processed an aborted import")
+	}
+}
@@ -0,0 +1,41 @@
+// Command arango-proxy serves several proxy sockets from one process. Each
+// listener has its own socket path, mode, owner, group and policy; all of
+// them share one pool of upstream connections to ArangoDB.
+//
+// Usage:
+//
+//	arango-proxy [-config <file>]
+//
+// The configuration file (YAML, or JSON if it ends in .json) lists the
+// upstream and the listeners; see examples/arango-proxy.yaml. It is re-read
+// on SIGHUP.
+//
+// Environment variables:
+//   - PROXY_CONFIG: Configuration file (default: /etc/arango-proxy/config.yaml)
+//   - PROXY_CLIENT_TIMEOUT_SECONDS: HTTP client timeout unless configured (default: 120, 0 to disable)
+//   - PROXY_DIAL_TIMEOUT_SECONDS: Socket dial timeout unless configured (default: 10)
+//   - HEALTH_CHECK_PATH: Upstream path checked with GET (default: /_api/version)
+//   - HEALTH_CHECK_INTERVAL_SECONDS: Time between health checks (default: 5, 0 to disable)
+//   - HEALTH_CHECK_TIMEOUT_SECONDS: Health check timeout (default: 2)
+//   - HEALTH_CHECK_FAILURES: Consecutive failures that open the circuit (default: 3)
+//   - ACCESS_LOG_FORMAT: Access log format, json or logfmt (default: json)
+//   - ACCESS_LOG_QUERY: Query parameter logging, name:keep|redact|drop,... (default: *:redact)
+//   - PROXY_ENV_FILE: KEY=VALUE settings file, re-read on SIGHUP (default: none)
+//   - SHUTDOWN_TIMEOUT_SECONDS: Drain deadline on SIGTERM/SIGINT (default: 30)
+//   - ADMIN_LISTEN: Admin socket path or host:port serving /metrics and /readyz (default: disabled)
+package main
+
+import (
+	"flag"
+	"log"
+
+	proxy "github.com/toddwbucy/arango-unix-proxy"
+)
+
+func main() {
+	config := flag.String("config", proxy.GetEnv("PROXY_CONFIG", proxy.DefaultDaemonConfig), "configuration file")
+	flag.Parse()
+	if err := proxy.RunDaemon(*config); err != nil {
+		log.Fatal(err)
+	}
+}
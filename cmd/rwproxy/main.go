@@ -5,9 +5,41 @@
 //
 // Environment variables:
 //   - LISTEN_SOCKET: Path for the proxy socket (default: /run/arango-proxy/readwrite.sock)
+//   - SOCKET_MODE: Octal permissions of the proxy socket (default: 0600)
+//   - SOCKET_OWNER: Owner of the proxy socket, name or uid (default: process user)
+//   - SOCKET_GROUP: Group of the proxy socket, name or gid (default: process group)
 //   - UPSTREAM_SOCKET: Path to ArangoDB socket (default: /run/arangodb3/arangodb.sock)
+//   - UPSTREAM: ArangoDB endpoints, unix://, tcp://, ssl://, http:// or https://, separated by commas (default: UPSTREAM_SOCKET)
+//   - UPSTREAM_BALANCE: round-robin, least-in-flight or active-failover over several endpoints (default: round-robin)
+//   - UPSTREAM_CA_FILE: PEM CA bundle for a TLS upstream (default: system roots)
+//   - UPSTREAM_CERT_FILE, UPSTREAM_KEY_FILE: PEM client certificate and key for a TLS upstream (default: none)
+//   - UPSTREAM_SERVER_NAME: TLS server name of the upstream (default: endpoint host)
 //   - PROXY_CLIENT_TIMEOUT_SECONDS: HTTP client timeout (default: 120, 0 to disable)
 //   - PROXY_DIAL_TIMEOUT_SECONDS: Socket dial timeout (default: 10)
+//   - HEALTH_CHECK_PATH: Upstream path checked with GET (default: /_api/version)
+//   - HEALTH_CHECK_INTERVAL_SECONDS: Time between health checks (default: 5, 0 to disable)
+//   - HEALTH_CHECK_TIMEOUT_SECONDS: Health check timeout (default: 2)
+//   - HEALTH_CHECK_FAILURES: Consecutive failures that open the circuit (default: 3)
+//   - ALLOWED_DATABASES: Database allowlist, name[:ro|:rw],... (default: all)
+//   - DEFAULT_DATABASE: Database for requests without /_db/<name> (default: _system)
+//   - ALLOWED_COLLECTIONS: Collection patterns the socket may use (default: all)
+//   - DENIED_COLLECTIONS: Collection patterns the socket may never use
+//   - ALLOWED_GRAPHS: Named graph patterns queries may traverse (default: none)
+//   - AUTH_BASIC_FILE: username:password file sent instead of client credentials (default: none)
+//   - AUTH_JWT_SECRET_FILE: ArangoDB JWT secret file for minting tokens sent instead of client credentials (default: none)
+//   - AUTH_JWT_USERNAME: preferred_username of minted tokens (default: superuser token)
+//   - AUTH_JWT_USERS: local:arango user pairs; each client gets tokens for its mapped user (default: none)
+//   - AUTH_JWT_GROUPS: local:arango pairs mapping local groups to ArangoDB users (default: none)
+//   - ENDPOINT_CATEGORIES: Endpoint categories, or all (default: data-read,data-write,schema)
+//   - ACCESS_LOG_FORMAT: Access log format, json or logfmt (default: json)
+//   - ACCESS_LOG_QUERY: Query parameter logging, name:keep|redact|drop,... (default: *:redact)
+//   - PROXY_ENV_FILE: KEY=VALUE settings file, re-read on SIGHUP (default: none)
+//   - SHUTDOWN_TIMEOUT_SECONDS: Drain deadline on SIGTERM/SIGINT (default: 30)
+//   - ADMIN_LISTEN: Admin socket path or host:port serving /metrics and /readyz (default: disabled)
+//   - AUDIT_LOG: Hash-chained audit log of mutating requests (default: disabled)
+//   - AUDIT_LOG_KEY_FILE: Key the audit log is chained with (required with AUDIT_LOG)
+//   - AUDIT_HASH_BIND_VALUES: Record SHA-256 hashes of AQL bind values (default: false)
+//   - POLICY_FILE: Policy file or builtin:<name> (default: builtin:read-write)
 package main
 
 import (
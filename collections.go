@@ -0,0 +1,472 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// collectionBodyPeekLimit bounds the body read to find the name of a
+// collection being created.
+const collectionBodyPeekLimit = 64 * 1024
+
+// CollectionAccess restricts which collections a socket may address through
+// the document, edges, collection, index, import, export, simple query and
+// graph APIs and in cursor queries. It is enforced by UnixReverseProxy after
+// DatabaseAccess and before the socket's AllowFunc.
+type CollectionAccess struct {
+	// Allow lists collection name patterns (path.Match syntax) the socket
+	// may use. Empty allows every collection not denied.
+	Allow []string
+	// Deny lists collection name patterns the socket may never use. It
+	// takes precedence over Allow.
+	Deny []string
+	// Graphs lists named graph patterns queries may traverse and the graph
+	// API may address. A named graph's edge collections are not visible in
+	// the query, so graphs are only permitted when listed here.
+	Graphs []string
+}
+
+// ParseCollectionAccess builds a CollectionAccess from comma-separated
+// allow, deny and graph pattern lists. It returns nil when all are empty.
+func ParseCollectionAccess(allow, deny, graphs string) (*CollectionAccess, error) {
+	access := &CollectionAccess{
+		Allow:  splitList(allow),
+		Deny:   splitList(deny),
+		Graphs: splitList(graphs),
+	}
+	if len(access.Allow) == 0 && len(access.Deny) == 0 && len(access.Graphs) == 0 {
+		return nil, nil
+	}
+	for _, pattern := range append(append([]string(nil), access.Allow...), access.Deny...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid collection pattern %q: %w", pattern, err)
+		}
+	}
+	for _, pattern := range access.Graphs {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid graph pattern %q: %w", pattern, err)
+		}
+	}
+	return access, nil
+}
+
+// CollectionAccessFromEnv reads ALLOWED_COLLECTIONS, DENIED_COLLECTIONS and
+// ALLOWED_GRAPHS.
+func CollectionAccessFromEnv() (*CollectionAccess, error) {
+	return ParseCollectionAccess(
+		GetEnv("ALLOWED_COLLECTIONS", ""),
+		GetEnv("DENIED_COLLECTIONS", ""),
+		GetEnv("ALLOWED_GRAPHS", ""),
+	)
+}
+
+// String summarizes the configuration for startup logs.
+func (c *CollectionAccess) String() string {
+	allow := "*"
+	if len(c.Allow) > 0 {
+		allow = strings.Join(c.Allow, ",")
+	}
+	return fmt.Sprintf("allow=%s deny=%s graphs=%s", allow, strings.Join(c.Deny, ","), strings.Join(c.Graphs, ","))
+}
+
+// Permits reports whether the collection may be used.
+func (c *CollectionAccess) Permits(name string) bool {
+	if matchAny(c.Deny, name) {
+		return false
+	}
+	return len(c.Allow) == 0 || matchAny(c.Allow, name)
+}
+
+// check rejects requests that address a collection the socket may not use.
+// Requests to other APIs are left to the AllowFunc.
+func (c *CollectionAccess) check(r *http.Request, peek BodyPeeker) error {
+	reqPath, ok := parseRequestPath(r.URL.Path)
+	if !ok {
+		return nil
+	}
+	if r.Method == http.MethodPost && reqPath.isCursorCreate() {
+		return c.checkQuery(peek)
+	}
+	if r.Method == http.MethodPost && reqPath.isTransactionBegin() {
+		return c.checkTransaction(peek)
+	}
+	target, addressed, err := requestCollections(r, reqPath, peek)
+	if err != nil {
+		return err
+	}
+	if !addressed {
+		return nil
+	}
+	for _, graph := range target.graphs {
+		if graph == "" {
+			return fmt.Errorf("%s %s does not name a graph", r.Method, r.URL.Path)
+		}
+		if !matchAny(c.Graphs, graph) {
+			return fmt.Errorf("graph %s is not permitted", graph)
+		}
+	}
+	for _, collection := range target.collections {
+		if collection == "" {
+			return fmt.Errorf("%s %s does not name a collection", r.Method, r.URL.Path)
+		}
+		if !c.Permits(collection) {
+			return fmt.Errorf("collection %s is not permitted", collection)
+		}
+	}
+	return nil
+}
+
+// checkQuery rejects cursor queries that refer to a collection or named
+// graph the socket may not use. Queries the analyser cannot resolve are
+// rejected as well: with collection restrictions in place, not knowing what
+// a query touches is not good enough.
+func (c *CollectionAccess) checkQuery(peek BodyPeeker) error {
+	body, err := peek(cursorBodyPeekLimit)
+	if err != nil {
+		return err
+	}
+	// ArangoDB and encoding/json may disagree on which of several
+	// "query" or "bindVars" keys counts, so refuse to guess.
+	for _, key := range []string{"query", "bindVars"} {
+		if n, ok := countTopLevelKeys(body, key); ok && n > 1 {
+			return fmt.Errorf("ambiguous request: multiple %q fields", key)
+		}
+	}
+	var cursor struct {
+		Query    string          `json:"query"`
+		BindVars json.RawMessage `json:"bindVars"`
+	}
+	if err := json.Unmarshal(body, &cursor); err != nil {
+		return fmt.Errorf("unable to determine collections accessed by query: %w", err)
+	}
+	var bindVars map[string]json.RawMessage
+	if len(cursor.BindVars) > 0 && string(cursor.BindVars) != "null" {
+		duplicate, err := hasDuplicateKeys(cursor.BindVars)
+		if err != nil {
+			return fmt.Errorf("unable to determine collections accessed by query: %w", err)
+		}
+		if duplicate {
+			return fmt.Errorf("ambiguous request: repeated bind parameters")
+		}
+		if err := json.Unmarshal(cursor.BindVars, &bindVars); err != nil {
+			return fmt.Errorf("unable to determine collections accessed by query: %w", err)
+		}
+	}
+	access, err := ExtractAQLAccess(cursor.Query, bindVars)
+	if err != nil {
+		return fmt.Errorf("unable to determine collections accessed by query: %w", err)
+	}
+	for _, collection := range access.Collections {
+		if !c.Permits(collection) {
+			return fmt.Errorf("collection %s is not permitted", collection)
+		}
+	}
+	for _, graph := range access.Graphs {
+		if !matchAny(c.Graphs, graph) {
+			return fmt.Errorf("graph %s is not permitted", graph)
+		}
+	}
+	return nil
+}
+
+// checkTransaction rejects stream transactions that declare a collection
+// the socket may not use.
+func (c *CollectionAccess) checkTransaction(peek BodyPeeker) error {
+	body, err := peek(transactionBodyPeekLimit)
+	if err != nil {
+		return err
+	}
+	declared, err := parseTransactionCollections(body)
+	if err != nil {
+		return err
+	}
+	for _, collection := range declared.All() {
+		if !c.Permits(collection) {
+			return fmt.Errorf("collection %s is not permitted", collection)
+		}
+	}
+	return nil
+}
+
+// hasDuplicateKeys reports whether the JSON object in data repeats a
+// top-level key. Bind parameter names are case-sensitive, so unlike
+// countTopLevelKeys this compares keys exactly.
+func hasDuplicateKeys(data []byte) (bool, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return false, fmt.Errorf("bindVars is not an object")
+	}
+	seen := make(map[string]struct{})
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return false, err
+		}
+		key, _ := tok.(string)
+		if _, ok := seen[key]; ok {
+			return true, nil
+		}
+		seen[key] = struct{}{}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// collectionTarget is what a request addresses: collections by name, and
+// named graphs. An empty name means an API that needs one was not given it.
+type collectionTarget struct {
+	collections []string
+	graphs      []string
+}
+
+func targetCollection(name string) collectionTarget {
+	return collectionTarget{collections: []string{name}}
+}
+
+// requestCollections extracts the collections a request to the document,
+// edges, collection, index, import, export, simple query or graph API
+// operates on. addressed is false for other APIs and for listing all
+// collections or graphs.
+func requestCollections(r *http.Request, reqPath requestPath, peek BodyPeeker) (target collectionTarget, addressed bool, err error) {
+	segments := reqPath.segments
+	if len(segments) < 2 || segments[0] != "_api" {
+		return collectionTarget{}, false, nil
+	}
+	pathCollection := ""
+	if len(segments) > 2 {
+		pathCollection = segments[2]
+	}
+
+	switch segments[1] {
+	case "document", "edges":
+		return targetCollection(pathCollection), true, nil
+
+	case "collection":
+		if pathCollection != "" {
+			if r.Method == http.MethodPut && len(segments) == 4 && segments[3] == "rename" {
+				// Both the collection and its new name must be permitted.
+				name, err := bodyString(peek, collectionBodyPeekLimit, "name")
+				return collectionTarget{collections: []string{pathCollection, name}}, true, err
+			}
+			return targetCollection(pathCollection), true, nil
+		}
+		if r.Method != http.MethodPost {
+			// GET /_api/collection lists collections.
+			return collectionTarget{}, false, nil
+		}
+		name, err := bodyString(peek, collectionBodyPeekLimit, "name")
+		return targetCollection(name), true, err
+
+	case "index":
+		// Index ids in paths are "<collection>/<id>".
+		if pathCollection != "" {
+			return targetCollection(pathCollection), true, nil
+		}
+		name, err := queryCollection(r)
+		return targetCollection(name), true, err
+
+	case "import", "export":
+		name, err := queryCollection(r)
+		return targetCollection(name), true, err
+
+	case "simple":
+		// Simple queries name their collection in the body.
+		name, err := bodyString(peek, cursorBodyPeekLimit, "collection")
+		return targetCollection(name), true, err
+
+	case "gharial":
+		return graphRequest(r, segments, peek)
+	}
+	return collectionTarget{}, false, nil
+}
+
+// edgeDefinition is an edge collection of a named graph with the vertex
+// collections it connects.
+type edgeDefinition struct {
+	Collection string   `json:"collection"`
+	From       []string `json:"from"`
+	To         []string `json:"to"`
+}
+
+func (t *collectionTarget) addEdgeDefinition(def edgeDefinition) {
+	t.collections = append(t.collections, def.Collection)
+	t.collections = append(t.collections, def.From...)
+	t.collections = append(t.collections, def.To...)
+}
+
+// graphRequest extracts the graph and collections a request to the graph
+// API (/_api/gharial) addresses: the graph in the path, a vertex or edge
+// collection following it, and the collections named by a graph, vertex
+// collection or edge definition being created or replaced.
+func graphRequest(r *http.Request, segments []string, peek BodyPeeker) (collectionTarget, bool, error) {
+	if len(segments) == 2 {
+		if r.Method != http.MethodPost {
+			// GET /_api/gharial lists graphs.
+			return collectionTarget{}, false, nil
+		}
+		var graph struct {
+			Name              string           `json:"name"`
+			EdgeDefinitions   []edgeDefinition `json:"edgeDefinitions"`
+			OrphanCollections []string         `json:"orphanCollections"`
+		}
+		if err := decodeGraphBody(peek, &graph); err != nil {
+			return collectionTarget{}, true, err
+		}
+		target := collectionTarget{graphs: []string{graph.Name}, collections: graph.OrphanCollections}
+		for _, def := range graph.EdgeDefinitions {
+			target.addEdgeDefinition(def)
+		}
+		return target, true, nil
+	}
+
+	target := collectionTarget{graphs: []string{segments[2]}}
+	if len(segments) > 4 {
+		target.collections = append(target.collections, segments[4])
+	}
+	if len(segments) < 4 {
+		return target, true, nil
+	}
+	kind := segments[3]
+	switch {
+	case r.Method == http.MethodPost && len(segments) == 4 && kind == "vertex":
+		// Adding a vertex collection.
+		name, err := bodyString(peek, collectionBodyPeekLimit, "collection")
+		target.collections = append(target.collections, name)
+		return target, true, err
+	case r.Method == http.MethodPost && len(segments) == 4 && kind == "edge",
+		r.Method == http.MethodPut && len(segments) == 5 && kind == "edge":
+		// Adding or replacing an edge definition.
+		var def edgeDefinition
+		if err := decodeGraphBody(peek, &def); err != nil {
+			return target, true, err
+		}
+		target.addEdgeDefinition(def)
+	}
+	return target, true, nil
+}
+
+// decodeGraphBody decodes a graph or edge definition from the request body.
+// encoding/json matches keys case-insensitively while ArangoDB does not, so
+// bodies with keys differing only in case are refused.
+func decodeGraphBody(peek BodyPeeker, v any) error {
+	body, err := peek(collectionBodyPeekLimit)
+	if err != nil {
+		return err
+	}
+	ambiguous, err := hasFoldedDuplicateKeys(body)
+	if err == nil && ambiguous {
+		err = fmt.Errorf("ambiguous request: repeated keys in graph definition")
+	}
+	if err == nil {
+		err = json.Unmarshal(body, v)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to determine graph collections: %w", err)
+	}
+	return nil
+}
+
+// bodyString returns the string field key of the JSON object in the request
+// body, reading at most limit bytes. A repeated key is refused, as for
+// cursor queries.
+func bodyString(peek BodyPeeker, limit int64, key string) (string, error) {
+	body, err := peek(limit)
+	if err != nil {
+		return "", err
+	}
+	if n, ok := countTopLevelKeys(body, key); ok && n > 1 {
+		return "", fmt.Errorf("ambiguous request: multiple %q fields", key)
+	}
+	var payload map[string]json.RawMessage
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return "", fmt.Errorf("unable to determine collection name: %w", err)
+	}
+	var value string
+	if raw, ok := payload[key]; ok {
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return "", fmt.Errorf("unable to determine collection name: %w", err)
+		}
+	}
+	return value, nil
+}
+
+// hasFoldedDuplicateKeys reports whether any JSON object in data, at any
+// depth, has two keys that are equal ignoring case.
+func hasFoldedDuplicateKeys(data []byte) (bool, error) {
+	type frame struct {
+		object    bool
+		expectKey bool
+		seen      map[string]struct{}
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var stack []*frame
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		var top *frame
+		if len(stack) > 0 {
+			top = stack[len(stack)-1]
+		}
+		if top != nil && top.object && top.expectKey {
+			if key, ok := tok.(string); ok {
+				folded := strings.ToLower(key)
+				if _, dup := top.seen[folded]; dup {
+					return true, nil
+				}
+				top.seen[folded] = struct{}{}
+				top.expectKey = false
+				continue
+			}
+		}
+		if top != nil && top.object {
+			// The value completes a member; a key or '}' follows.
+			top.expectKey = true
+		}
+		switch tok {
+		case json.Delim('{'):
+			stack = append(stack, &frame{object: true, expectKey: true, seen: make(map[string]struct{})})
+		case json.Delim('['):
+			stack = append(stack, &frame{})
+		case json.Delim('}'), json.Delim(']'):
+			stack = stack[:len(stack)-1]
+		}
+	}
+}
+
+// queryCollection returns the collection query parameter. More than one
+// value is refused: which one ArangoDB honours is not something the proxy
+// should guess at.
+func queryCollection(r *http.Request) (string, error) {
+	values := r.URL.Query()["collection"]
+	if len(values) > 1 {
+		return "", fmt.Errorf("ambiguous request: multiple %q parameters", "collection")
+	}
+	if len(values) == 0 {
+		return "", nil
+	}
+	return values[0], nil
+}
+
+// splitList splits a comma-separated list, dropping empty entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
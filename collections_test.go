@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseCollectionAccess(t *testing.T) {
+	access, err := ParseCollectionAccess(" , ", "", "")
+	if err != nil || access != nil {
+		t.Errorf("empty config = %v, %v; want nil, nil", access, err)
+	}
+
+	access, err = ParseCollectionAccess("chunks, embeddings", "users", "kg")
+	if err != nil {
+		t.Fatalf("ParseCollectionAccess() error = %v", err)
+	}
+	if got := access.String(); got != "allow=chunks,embeddings deny=users graphs=kg" {
+		t.Errorf("String() = %q", got)
+	}
+
+	if _, err := ParseCollectionAccess("[", "", ""); err == nil {
+		t.Error("invalid pattern should fail")
+	}
+	if _, err := ParseCollectionAccess("", "", "["); err == nil {
+		t.Error("invalid graph pattern should fail")
+	}
+}
+
+func TestCollectionAccess_Permits(t *testing.T) {
+	access := &CollectionAccess{Allow: []string{"chunks", "embed*"}, Deny: []string{"embeddings_private"}}
+
+	for name, want := range map[string]bool{
+		"chunks":             true,
+		"embeddings":         true,
+		"embeddings_private": false,
+		"users":              false,
+	} {
+		if got := access.Permits(name); got != want {
+			t.Errorf("Permits(%q) = %v, want %v", name, got, want)
+		}
+	}
+
+	denyOnly := &CollectionAccess{Deny: []string{"_*"}}
+	if !denyOnly.Permits("chunks") || denyOnly.Permits("_users") {
+		t.Error("deny-only access should permit everything except denied patterns")
+	}
+}
+
+func TestCollectionAccess_Check(t *testing.T) {
+	access := &CollectionAccess{Allow: []string{"chunks", "embeddings"}}
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		allow  bool
+	}{
+		{http.MethodPost, "/_api/document/chunks", "", true},
+		{http.MethodPatch, "/_db/kb/_api/document/embeddings/key", "", true},
+		{http.MethodPost, "/_api/document/users", "", false},
+		{http.MethodGet, "/_api/document/users/key", "", false},
+		{http.MethodPost, "/_api/document", "", false},
+		{http.MethodGet, "/_api/collection", "", true},
+		{http.MethodPut, "/_api/collection/chunks/truncate", "", true},
+		{http.MethodDelete, "/_api/collection/users", "", false},
+		{http.MethodPost, "/_api/collection", `{"name": "chunks"}`, true},
+		{http.MethodPost, "/_api/collection", `{"name": "users"}`, false},
+		{http.MethodPost, "/_api/collection", `not json`, false},
+		{http.MethodPost, "/_api/collection", `{"name": "chunks", "NAME": "users"}`, false},
+		{http.MethodPut, "/_api/collection/chunks/rename", `{"name": "embeddings"}`, true},
+		{http.MethodPut, "/_api/collection/chunks/rename", `{"name": "users"}`, false},
+		{http.MethodPut, "/_api/collection/chunks/rename", `{}`, false},
+		{http.MethodGet, "/_api/edges/chunks?vertex=chunks/1", "", true},
+		{http.MethodGet, "/_api/edges/users?vertex=chunks/1", "", false},
+		{http.MethodPut, "/_api/simple/all", `{"collection": "chunks"}`, true},
+		{http.MethodPut, "/_api/simple/by-example", `{"collection": "users", "example": {}}`, false},
+		{http.MethodPut, "/_api/simple/lookup-by-keys", `{"keys": ["1"]}`, false},
+		{http.MethodPut, "/_api/simple/all", `{"collection": "chunks", "collection": "users"}`, false},
+		{http.MethodPost, "/_api/export?collection=users", "", false},
+		{http.MethodPost, "/_api/index?collection=chunks&type=persistent", "", true},
+		{http.MethodPost, "/_api/index?collection=users", "", false},
+		{http.MethodDelete, "/_api/index/chunks/12345", "", true},
+		{http.MethodDelete, "/_api/index/users/12345", "", false},
+		{http.MethodPost, "/_api/import?collection=embeddings", "", true},
+		{http.MethodPost, "/_api/import?collection=users", "", false},
+		{http.MethodPost, "/_api/import", "", false},
+		{http.MethodPost, "/_api/import?collection=chunks&collection=users", "", false},
+		{http.MethodGet, "/_api/version", "", true},
+		{http.MethodPut, "/_api/cursor/12345", "", true},
+		{http.MethodPost, "/_api/cursor", `{"query": "FOR c IN chunks RETURN c"}`, true},
+		{http.MethodPost, "/_api/cursor", `{"query": "FOR u IN users RETURN u"}`, false},
+		{http.MethodPost, "/_api/cursor", `{"query": "FOR c IN @@coll RETURN c", "bindVars": {"@coll": "chunks"}}`, true},
+		{http.MethodPost, "/_api/cursor", `{"query": "FOR c IN @@coll RETURN c", "bindVars": {"@coll": "users"}}`, false},
+		{http.MethodPost, "/_api/cursor", `{"query": "FOR c IN @@coll RETURN c", "bindVars": {"@coll": "chunks", "@coll": "users"}}`, false},
+		{http.MethodPost, "/_api/cursor", `{"query": "FOR c IN chunks RETURN c", "QUERY": "FOR u IN users RETURN u"}`, false},
+		{http.MethodPost, "/_api/cursor", `{"query": "RETURN DOCUMENT('users/1')"}`, false},
+		{http.MethodPost, "/_api/cursor", `{"query": "FOR v IN 1..2 OUTBOUND 'chunks/1' GRAPH 'kg' RETURN v"}`, false},
+		{http.MethodPost, "/_api/cursor", `{"query": "RETURN CALL('DOCUMENT', 'chunks/1')"}`, false},
+		{http.MethodPost, "/_api/cursor", `{"query": "WITH chunks FOR v IN 1 OUTBOUND 'chunks/1' embeddings RETURN v"}`, true},
+		{http.MethodPost, "/_api/cursor", `{"query": "WITH chunks FOR v IN 1 OUTBOUND 'users/1' embeddings RETURN v"}`, false},
+		{http.MethodPost, "/_api/cursor", `{"query": "WITH chunks FOR v IN 1 OUTBOUND @s embeddings RETURN v", "bindVars": {"s": "users/1"}}`, false},
+		{http.MethodPost, "/_api/cursor", `{"query": "WITH users FOR v IN 1 OUTBOUND 'chunks/1' embeddings RETURN v"}`, false},
+		{http.MethodPost, "/_api/cursor", `{"query": "FOR v IN 1 OUTBOUND 'chunks/1' embeddings RETURN v"}`, false},
+		{http.MethodPost, "/_api/cursor", `not json`, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.method+" "+tc.path, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, nil)
+			err := access.check(req, mockBodyPeeker(tc.body))
+			if tc.allow && err != nil {
+				t.Errorf("should be allowed, got error: %v", err)
+			}
+			if !tc.allow && err == nil {
+				t.Error("should be denied")
+			}
+		})
+	}
+}
+
+func TestCollectionAccess_CheckGraphs(t *testing.T) {
+	access := &CollectionAccess{Deny: []string{"_*"}, Graphs: []string{"kg"}}
+	query := func(q string) BodyPeeker {
+		return mockBodyPeeker(`{"query": "` + q + `"}`)
+	}
+	req := func() *http.Request { return httptest.NewRequest(http.MethodPost, "/_api/cursor", nil) }
+
+	if err := access.check(req(), query("FOR v IN 1..2 ANY 'a/1' GRAPH 'kg' RETURN v")); err != nil {
+		t.Errorf("listed graph should be allowed, got %v", err)
+	}
+	if err := access.check(req(), query("FOR v IN 1..2 ANY 'a/1' GRAPH 'social' RETURN v")); err == nil {
+		t.Error("unlisted graph should be denied")
+	}
+	if err := access.check(req(), query("FOR u IN _users RETURN u")); err == nil {
+		t.Error("denied collection should be denied in queries")
+	}
+}
+
+func TestCollectionAccess_CheckGraphAPI(t *testing.T) {
+	access := &CollectionAccess{Allow: []string{"chunks", "links"}, Graphs: []string{"kg"}}
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		allow  bool
+	}{
+		{http.MethodGet, "/_api/gharial", "", true},
+		{http.MethodGet, "/_api/gharial/kg", "", true},
+		{http.MethodGet, "/_api/gharial/social", "", false},
+		{http.MethodGet, "/_api/gharial/kg/vertex/chunks/1", "", true},
+		{http.MethodGet, "/_api/gharial/kg/vertex/users/1", "", false},
+		{http.MethodPost, "/_api/gharial/kg/edge/links", `{"_from": "chunks/1", "_to": "chunks/2"}`, true},
+		{http.MethodPost, "/_api/gharial/kg/edge/users", `{}`, false},
+		{http.MethodPost, "/_api/gharial/kg/vertex", `{"collection": "users"}`, false},
+		{http.MethodPost, "/_api/gharial/kg/edge", `{"collection": "links", "from": ["chunks"], "to": ["chunks"]}`, true},
+		{http.MethodPut, "/_api/gharial/kg/edge/links", `{"collection": "links", "from": ["chunks"], "to": ["users"]}`, false},
+		{http.MethodPost, "/_api/gharial", `{"name": "kg", "edgeDefinitions": [{"collection": "links", "from": ["chunks"], "to": ["chunks"]}]}`, true},
+		{http.MethodPost, "/_api/gharial", `{"name": "kg", "orphanCollections": ["users"]}`, false},
+		{http.MethodPost, "/_api/gharial", `{"name": "social"}`, false},
+		{http.MethodPost, "/_api/gharial", `{"name": "kg", "edgeDefinitions": [{"collection": "links", "Collection": "users"}]}`, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.method+" "+tc.path, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, nil)
+			err := access.check(req, mockBodyPeeker(tc.body))
+			if tc.allow && err != nil {
+				t.Errorf("should be allowed, got error: %v", err)
+			}
+			if !tc.allow && err == nil {
+				t.Error("should be denied")
+			}
+		})
+	}
+}
+
+func TestUnixReverseProxy_CollectionAccess(t *testing.T) {
+	socket := startFakeUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	proxy := NewUnixReverseProxy(socket, AllowReadWrite)
+	proxy.SetCollectionAccess(&CollectionAccess{Allow: []string{"chunks"}})
+
+	for path, want := range map[string]int{
+		"/_api/document/chunks": http.StatusAccepted,
+		"/_api/document/users":  http.StatusForbidden,
+	} {
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, strings.NewReader("{}")))
+		if rec.Code != want {
+			t.Errorf("POST %s: status = %d, want %d", path, rec.Code, want)
+		}
+	}
+}
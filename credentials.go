@@ -0,0 +1,316 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// userGroupsTTL is how long the groups a user belongs to are cached before
+// they are looked up again.
+const userGroupsTTL = time.Minute
+
+// CredentialSettings configure the credentials a listener sends to
+// ArangoDB in place of those of its clients, so that clients need only be
+// allowed to connect to the socket. The zero value forwards the clients'
+// own Authorization header.
+type CredentialSettings struct {
+	// BasicFile holds username:password for HTTP basic authentication.
+	BasicFile string
+	// JWTSecretFile holds ArangoDB's JWT secret, as given to
+	// --server.jwt-secret-keyfile, with which tokens are minted.
+	JWTSecretFile string
+	// JWTUsername is the preferred_username of minted tokens. Empty mints
+	// superuser tokens.
+	JWTUsername string
+	// JWTUsers and JWTGroups map local users and groups, names or numeric
+	// ids, to the ArangoDB users tokens are minted for, so that each
+	// client acts as its own ArangoDB user. The connecting process's user
+	// is looked up first, then its effective group (see PeerCred), then
+	// the other groups its user belongs to in ascending order of group id
+	// (see LookupUserGroupIDs). A process matching none gets tokens for
+	// JWTUsername, or is refused if it is empty.
+	JWTUsers  map[string]string
+	JWTGroups map[string]string
+}
+
+// CredentialSettingsFromEnv reads AUTH_BASIC_FILE, AUTH_JWT_SECRET_FILE,
+// AUTH_JWT_USERNAME, and AUTH_JWT_USERS and AUTH_JWT_GROUPS, each a list
+// of local:arango pairs separated by commas.
+func CredentialSettingsFromEnv() (CredentialSettings, error) {
+	settings := CredentialSettings{
+		BasicFile:     GetEnv("AUTH_BASIC_FILE", ""),
+		JWTSecretFile: GetEnv("AUTH_JWT_SECRET_FILE", ""),
+		JWTUsername:   GetEnv("AUTH_JWT_USERNAME", ""),
+	}
+	var err error
+	if settings.JWTUsers, err = parseUserMap("AUTH_JWT_USERS", GetEnv("AUTH_JWT_USERS", "")); err != nil {
+		return settings, err
+	}
+	settings.JWTGroups, err = parseUserMap("AUTH_JWT_GROUPS", GetEnv("AUTH_JWT_GROUPS", ""))
+	return settings, err
+}
+
+// parseUserMap parses local:arango pairs separated by commas.
+func parseUserMap(name, value string) (map[string]string, error) {
+	var users map[string]string
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		local, arango, ok := strings.Cut(pair, ":")
+		local, arango = strings.TrimSpace(local), strings.TrimSpace(arango)
+		if !ok || local == "" || arango == "" {
+			return nil, fmt.Errorf("invalid %s entry %q: want local:arango", name, pair)
+		}
+		if users == nil {
+			users = make(map[string]string)
+		}
+		users[local] = arango
+	}
+	return users, nil
+}
+
+// IsZero reports whether no credentials are configured.
+func (c CredentialSettings) IsZero() bool {
+	return c.BasicFile == "" && c.JWTSecretFile == "" && c.JWTUsername == "" &&
+		len(c.JWTUsers) == 0 && len(c.JWTGroups) == 0
+}
+
+// Load reads the credential files. It returns nil when no credentials are
+// configured.
+func (c CredentialSettings) Load() (*Credentials, error) {
+	switch {
+	case c.IsZero():
+		return nil, nil
+	case c.BasicFile != "" && c.JWTSecretFile != "":
+		return nil, errors.New("set basic auth or a JWT secret, not both")
+	case c.JWTSecretFile == "" && (c.JWTUsername != "" || len(c.JWTUsers) > 0 || len(c.JWTGroups) > 0):
+		return nil, errors.New("JWT users require a JWT secret")
+	case c.BasicFile != "":
+		data, err := os.ReadFile(c.BasicFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read basic auth credentials: %w", err)
+		}
+		user, password, ok := strings.Cut(strings.TrimRight(string(data), "\r\n"), ":")
+		if !ok || user == "" || strings.ContainsAny(user, "\r\n") {
+			return nil, fmt.Errorf("%s: want username:password", c.BasicFile)
+		}
+		auth := base64.StdEncoding.EncodeToString([]byte(user + ":" + password))
+		return &Credentials{
+			basic:       "Basic " + auth,
+			description: "basic auth from " + describeSecret(c.BasicFile, data),
+		}, nil
+	}
+	data, err := os.ReadFile(c.JWTSecretFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWT secret: %w", err)
+	}
+	// ArangoDB uses the secret without surrounding whitespace.
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return nil, fmt.Errorf("%s: JWT secret is empty", c.JWTSecretFile)
+	}
+	credentials := &Credentials{minter: newTokenMinter([]byte(secret)), username: c.JWTUsername}
+	if len(c.JWTUsers) > 0 || len(c.JWTGroups) > 0 {
+		if credentials.uids, err = mapUsers(c.JWTUsers, LookupUserID); err != nil {
+			return nil, err
+		}
+		if credentials.gids, err = mapUsers(c.JWTGroups, LookupGroupID); err != nil {
+			return nil, err
+		}
+		if len(credentials.gids) > 0 {
+			credentials.groups = newUserGroups(LookupUserGroupIDs)
+		}
+		credentials.mapped = true
+	}
+	credentials.description = credentials.describeUsers(c) + " from " + describeSecret(c.JWTSecretFile, data)
+	return credentials, nil
+}
+
+// mapUsers resolves the local users or groups of users with lookup.
+func mapUsers(users map[string]string, lookup func(string) (uint32, error)) (map[uint32]string, error) {
+	ids := make(map[uint32]string, len(users))
+	for local, arango := range users {
+		id, err := lookup(local)
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := ids[id]; ok && other != arango {
+			return nil, fmt.Errorf("%s is mapped to both %s and %s", local, other, arango)
+		}
+		ids[id] = arango
+	}
+	return ids, nil
+}
+
+// describeUsers describes whom tokens are minted for.
+func (c *Credentials) describeUsers(settings CredentialSettings) string {
+	fallback := "superuser JWT"
+	if c.username != "" {
+		fallback = "JWT for " + c.username
+	}
+	if !c.mapped {
+		return fallback
+	}
+	if c.username == "" {
+		fallback = "refused"
+	}
+	return fmt.Sprintf("JWT for mapped users (users %s; groups %s; others %s)",
+		describeUserMap(settings.JWTUsers), describeUserMap(settings.JWTGroups), fallback)
+}
+
+// describeUserMap lists a user map as sorted local=arango pairs.
+func describeUserMap(users map[string]string) string {
+	if len(users) == 0 {
+		return "none"
+	}
+	pairs := make([]string, 0, len(users))
+	for local, arango := range users {
+		pairs = append(pairs, local+"="+arango)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// secretDigestKey keys the digests of secret files, so that a logged
+// digest cannot be used to test guesses of the secret. Digests only need
+// to be comparable within one process.
+var secretDigestKey = func() []byte {
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	return key
+}()
+
+// describeSecret names the secret file at path, read as data, by a digest
+// that changes with its contents but reveals nothing about them.
+func describeSecret(path string, data []byte) string {
+	mac := hmac.New(sha256.New, secretDigestKey)
+	mac.Write(data)
+	return path + " (digest:" + hex.EncodeToString(mac.Sum(nil)[:6]) + ")"
+}
+
+// Credentials authenticate a listener's requests to ArangoDB. Create them
+// with CredentialSettings.Load.
+type Credentials struct {
+	// basic is the Authorization header for basic auth; otherwise minter
+	// mints bearer tokens.
+	basic  string
+	minter *tokenMinter
+	// username receives the tokens of clients that are not mapped by
+	// uids or gids; empty means superuser tokens, or, if mapped is set,
+	// refusing them.
+	username   string
+	mapped     bool
+	uids, gids map[uint32]string
+	// groups resolves the groups of a client's user for gids.
+	groups *userGroups
+	// description identifies the credentials as they were loaded.
+	description string
+}
+
+// errUnmappedPeer refuses a client that no ArangoDB user is mapped to.
+var errUnmappedPeer = errors.New("no ArangoDB user is mapped to this client")
+
+// String describes the credentials for logs, identifying the contents of
+// their file by a digest.
+func (c *Credentials) String() string {
+	if c == nil {
+		return "forwarded from clients"
+	}
+	return c.description
+}
+
+// authorization returns the Authorization header to send for r.
+func (c *Credentials) authorization(r *http.Request) (string, error) {
+	if c.minter == nil {
+		return c.basic, nil
+	}
+	username, err := c.user(r)
+	if err != nil {
+		return "", err
+	}
+	token, err := c.minter.token(username)
+	if err != nil {
+		return "", err
+	}
+	return "Bearer " + token, nil
+}
+
+// user returns the ArangoDB user that r is sent as.
+func (c *Credentials) user(r *http.Request) (string, error) {
+	if !c.mapped {
+		return c.username, nil
+	}
+	cred, ok := PeerCredFromContext(r.Context())
+	if ok {
+		if username, found := c.uids[cred.UID]; found {
+			return username, nil
+		}
+		if username, found := c.gids[cred.GID]; found {
+			return username, nil
+		}
+		if c.groups != nil {
+			for _, gid := range c.groups.get(cred.UID) {
+				if username, found := c.gids[gid]; found {
+					return username, nil
+				}
+			}
+		}
+	}
+	if c.username != "" {
+		return c.username, nil
+	}
+	if !ok {
+		return "", fmt.Errorf("%w: peer credentials unknown", errUnmappedPeer)
+	}
+	return "", fmt.Errorf("%w (%s)", errUnmappedPeer, cred)
+}
+
+// userGroups caches the groups users belong to, by uid. A user whose
+// groups cannot be looked up is treated as belonging to none.
+type userGroups struct {
+	lookup func(uid uint32) ([]uint32, error)
+	now    func() time.Time
+
+	mu      sync.Mutex
+	entries map[uint32]userGroupsEntry
+}
+
+type userGroupsEntry struct {
+	gids    []uint32
+	expires time.Time
+}
+
+func newUserGroups(lookup func(uint32) ([]uint32, error)) *userGroups {
+	return &userGroups{lookup: lookup, now: time.Now, entries: make(map[uint32]userGroupsEntry)}
+}
+
+// get returns the ids of the groups of uid in ascending order.
+func (g *userGroups) get(uid uint32) []uint32 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := g.now()
+	if entry, ok := g.entries[uid]; ok && now.Before(entry.expires) {
+		return entry.gids
+	}
+	gids, err := g.lookup(uid)
+	if err != nil {
+		gids = nil
+	}
+	gids = slices.Clone(gids)
+	slices.Sort(gids)
+	g.entries[uid] = userGroupsEntry{gids: gids, expires: now.Add(userGroupsTTL)}
+	return gids
+}
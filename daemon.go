@@ -0,0 +1,385 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultDaemonConfig is where arango-proxy looks for its configuration
+// when PROXY_CONFIG is unset.
+const DefaultDaemonConfig = "/etc/arango-proxy/config.yaml"
+
+// DaemonConfig is the configuration file of the arango-proxy daemon: one
+// upstream, shared by every listener, and the listeners.
+type DaemonConfig struct {
+	Upstream  UpstreamConfig   `json:"upstream" yaml:"upstream"`
+	Listeners []ListenerConfig `json:"listeners" yaml:"listeners"`
+}
+
+// UpstreamConfig describes how the daemon reaches ArangoDB: Socket,
+// Endpoint, or several Endpoints balanced according to Balance (see
+// ParseUpstreamEndpoint and ParseBalancePolicy), with TLS options for
+// ssl:// and https:// endpoints. Unset fields take the defaults of
+// UPSTREAM_SOCKET, PROXY_CLIENT_TIMEOUT_SECONDS, PROXY_DIAL_TIMEOUT_SECONDS
+// and the HEALTH_CHECK_* variables.
+type UpstreamConfig struct {
+	Socket               string             `json:"socket,omitempty" yaml:"socket,omitempty"`
+	Endpoint             string             `json:"endpoint,omitempty" yaml:"endpoint,omitempty"`
+	Endpoints            []string           `json:"endpoints,omitempty" yaml:"endpoints,omitempty"`
+	Balance              string             `json:"balance,omitempty" yaml:"balance,omitempty"`
+	CAFile               string             `json:"ca_file,omitempty" yaml:"ca_file,omitempty"`
+	CertFile             string             `json:"cert_file,omitempty" yaml:"cert_file,omitempty"`
+	KeyFile              string             `json:"key_file,omitempty" yaml:"key_file,omitempty"`
+	ServerName           string             `json:"server_name,omitempty" yaml:"server_name,omitempty"`
+	ClientTimeoutSeconds *int               `json:"client_timeout_seconds,omitempty" yaml:"client_timeout_seconds,omitempty"`
+	DialTimeoutSeconds   *int               `json:"dial_timeout_seconds,omitempty" yaml:"dial_timeout_seconds,omitempty"`
+	HealthCheck          *HealthCheckConfig `json:"health_check,omitempty" yaml:"health_check,omitempty"`
+}
+
+// HealthCheckConfig configures the upstream health check (see
+// HealthCheckSettings). An interval of 0 disables it.
+type HealthCheckConfig struct {
+	Path            string `json:"path,omitempty" yaml:"path,omitempty"`
+	IntervalSeconds *int   `json:"interval_seconds,omitempty" yaml:"interval_seconds,omitempty"`
+	TimeoutSeconds  *int   `json:"timeout_seconds,omitempty" yaml:"timeout_seconds,omitempty"`
+	Failures        *int   `json:"failures,omitempty" yaml:"failures,omitempty"`
+}
+
+// ListenerConfig is one socket of the daemon and the access it grants.
+// Databases, collections and categories take the values of the matching
+// environment variables of roproxy and rwproxy (ALLOWED_DATABASES and so
+// on), one per list entry.
+type ListenerConfig struct {
+	// Name identifies the listener in logs and is the FileDescriptorName=
+	// of its socket under systemd socket activation.
+	Name   string `json:"name" yaml:"name"`
+	Socket string `json:"socket" yaml:"socket"`
+	// Mode is the octal permission of the socket, "0600" if unset. Owner
+	// and Group, names or numeric ids, are given the socket (see
+	// ParseSocketOptions).
+	Mode  string `json:"mode,omitempty" yaml:"mode,omitempty"`
+	Owner string `json:"owner,omitempty" yaml:"owner,omitempty"`
+	Group string `json:"group,omitempty" yaml:"group,omitempty"`
+	// Policy is a policy file or builtin:<name>.
+	Policy            string   `json:"policy" yaml:"policy"`
+	Databases         []string `json:"databases,omitempty" yaml:"databases,omitempty"`
+	DefaultDatabase   string   `json:"default_database,omitempty" yaml:"default_database,omitempty"`
+	Collections       []string `json:"collections,omitempty" yaml:"collections,omitempty"`
+	DeniedCollections []string `json:"denied_collections,omitempty" yaml:"denied_collections,omitempty"`
+	Graphs            []string `json:"graphs,omitempty" yaml:"graphs,omitempty"`
+	Categories        []string `json:"categories,omitempty" yaml:"categories,omitempty"`
+	VerifyQueryPlan   bool     `json:"verify_query_plan,omitempty" yaml:"verify_query_plan,omitempty"`
+	// DirtyReads lets followers serve the listener's reads when the
+	// upstream balance is active-failover (see
+	// UnixReverseProxy.SetDirtyReads).
+	DirtyReads bool `json:"dirty_reads,omitempty" yaml:"dirty_reads,omitempty"`
+	// AuthBasicFile, or AuthJWTSecretFile with AuthJWTUsername and the
+	// AuthJWTUsers and AuthJWTGroups maps, are the credentials sent to
+	// ArangoDB instead of the clients' (see CredentialSettings).
+	AuthBasicFile     string            `json:"auth_basic_file,omitempty" yaml:"auth_basic_file,omitempty"`
+	AuthJWTSecretFile string            `json:"auth_jwt_secret_file,omitempty" yaml:"auth_jwt_secret_file,omitempty"`
+	AuthJWTUsername   string            `json:"auth_jwt_username,omitempty" yaml:"auth_jwt_username,omitempty"`
+	AuthJWTUsers      map[string]string `json:"auth_jwt_users,omitempty" yaml:"auth_jwt_users,omitempty"`
+	AuthJWTGroups     map[string]string `json:"auth_jwt_groups,omitempty" yaml:"auth_jwt_groups,omitempty"`
+	// AuditLogKeyFile holds the key the audit log is chained with; it is
+	// required with AuditLog.
+	AuditLog            string `json:"audit_log,omitempty" yaml:"audit_log,omitempty"`
+	AuditLogKeyFile     string `json:"audit_log_key_file,omitempty" yaml:"audit_log_key_file,omitempty"`
+	AuditHashBindValues bool   `json:"audit_hash_bind_values,omitempty" yaml:"audit_hash_bind_values,omitempty"`
+}
+
+// LoadDaemonConfig reads a daemon configuration file. Files ending in .json
+// are decoded as JSON; anything else is decoded as YAML. Unknown fields are
+// rejected.
+func LoadDaemonConfig(path string) (*DaemonConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config %s: %w", path, err)
+	}
+	var cfg DaemonConfig
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&cfg)
+	} else {
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(&cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// daemonConfig is a validated configuration: listeners sharing one
+// upstream.
+type daemonConfig struct {
+	upstream  UpstreamSettings
+	listeners []*listenerConfig
+}
+
+// listenerConfig is a validated listener. Its socket settings are read at
+// startup only; proxy is reloadable.
+type listenerConfig struct {
+	// name is empty for the single listener of roproxy and rwproxy.
+	name           string
+	socket         string
+	options        SocketOptions
+	audit          string
+	auditKey       string
+	hashBindValues bool
+	proxy          *proxyConfig
+}
+
+// loadDaemonConfig reads and validates the daemon configuration at path.
+func loadDaemonConfig(path string) (*daemonConfig, error) {
+	file, err := LoadDaemonConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := file.compile()
+	if err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// compile validates the configuration.
+func (c *DaemonConfig) compile() (*daemonConfig, error) {
+	env := UpstreamSettingsFromEnv(DefaultUpstreamSocket)
+	cfg := &daemonConfig{upstream: UpstreamSettings{
+		Socket:        DefaultUpstreamSocket,
+		Endpoints:     c.Upstream.Endpoints,
+		Balance:       BalancePolicy(c.Upstream.Balance),
+		ClientTimeout: env.ClientTimeout,
+		DialTimeout:   env.DialTimeout,
+		TLS: UpstreamTLS{
+			CAFile:     c.Upstream.CAFile,
+			CertFile:   c.Upstream.CertFile,
+			KeyFile:    c.Upstream.KeyFile,
+			ServerName: c.Upstream.ServerName,
+		},
+	}}
+	if c.Upstream.Endpoint != "" {
+		if len(c.Upstream.Endpoints) > 0 {
+			return nil, fmt.Errorf("upstream: set endpoint or endpoints, not both")
+		}
+		cfg.upstream.Endpoints = []string{c.Upstream.Endpoint}
+	}
+	if c.Upstream.Socket != "" {
+		if len(cfg.upstream.Endpoints) > 0 {
+			return nil, fmt.Errorf("upstream: set socket or endpoints, not both")
+		}
+		cfg.upstream.Socket = c.Upstream.Socket
+	}
+	if s := c.Upstream.ClientTimeoutSeconds; s != nil {
+		if *s < 0 {
+			return nil, fmt.Errorf("upstream: client_timeout_seconds must not be negative")
+		}
+		cfg.upstream.ClientTimeout = time.Duration(*s) * time.Second
+	}
+	if s := c.Upstream.DialTimeoutSeconds; s != nil {
+		if *s < 0 {
+			return nil, fmt.Errorf("upstream: dial_timeout_seconds must not be negative")
+		}
+		cfg.upstream.DialTimeout = time.Duration(*s) * time.Second
+	}
+	health, err := HealthCheckSettingsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.upstream.HealthCheck, err = c.Upstream.HealthCheck.compile(health); err != nil {
+		return nil, fmt.Errorf("upstream: %w", err)
+	}
+	if err := cfg.upstream.load(); err != nil {
+		return nil, fmt.Errorf("upstream: %w", err)
+	}
+
+	if len(c.Listeners) == 0 {
+		return nil, fmt.Errorf("no listeners configured")
+	}
+	names := make(map[string]bool)
+	sockets := make(map[string]bool)
+	audits := make(map[string]bool)
+	for i := range c.Listeners {
+		l := &c.Listeners[i]
+		if l.Name == "" {
+			return nil, fmt.Errorf("listener %d: name is required", i+1)
+		}
+		if l.Name == AdminListenerName || strings.ContainsAny(l.Name, ": \t") {
+			return nil, fmt.Errorf("listener %d: invalid name %q", i+1, l.Name)
+		}
+		if names[l.Name] {
+			return nil, fmt.Errorf("listener %q: duplicate name", l.Name)
+		}
+		names[l.Name] = true
+		listener, err := l.compile()
+		if err != nil {
+			return nil, fmt.Errorf("listener %q: %w", l.Name, err)
+		}
+		if sockets[listener.socket] {
+			return nil, fmt.Errorf("listener %q: socket %s is used by another listener", l.Name, l.Socket)
+		}
+		sockets[listener.socket] = true
+		if listener.audit != "" {
+			if audits[listener.audit] {
+				return nil, fmt.Errorf("listener %q: audit log %s is used by another listener", l.Name, l.AuditLog)
+			}
+			audits[listener.audit] = true
+		}
+		cfg.listeners = append(cfg.listeners, listener)
+	}
+	return cfg, nil
+}
+
+// compile applies the configured fields to settings.
+func (h *HealthCheckConfig) compile(settings HealthCheckSettings) (HealthCheckSettings, error) {
+	if h == nil {
+		return settings, nil
+	}
+	if h.Path != "" {
+		settings.Path = h.Path
+	}
+	if s := h.IntervalSeconds; s != nil {
+		if *s < 0 {
+			return settings, fmt.Errorf("health_check: interval_seconds must not be negative")
+		}
+		settings.Interval = time.Duration(*s) * time.Second
+	}
+	if s := h.TimeoutSeconds; s != nil {
+		settings.Timeout = time.Duration(*s) * time.Second
+	}
+	if h.Failures != nil {
+		settings.Failures = *h.Failures
+	}
+	return settings, nil
+}
+
+func (l *ListenerConfig) compile() (*listenerConfig, error) {
+	if !filepath.IsAbs(l.Socket) {
+		return nil, fmt.Errorf("socket must be an absolute path, got %q", l.Socket)
+	}
+	if l.Policy == "" {
+		return nil, fmt.Errorf("policy is required")
+	}
+	options, err := ParseSocketOptions(l.Mode, l.Owner, l.Group, RWSocketPermissions)
+	if err != nil {
+		return nil, err
+	}
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	listener := &listenerConfig{
+		name:           l.Name,
+		socket:         filepath.Clean(l.Socket),
+		options:        options,
+		audit:          l.AuditLog,
+		auditKey:       l.AuditLogKeyFile,
+		hashBindValues: l.AuditHashBindValues,
+	}
+	if err := listener.checkAudit(); err != nil {
+		return nil, err
+	}
+
+	proxy := &proxyConfig{verifyQueryPlan: l.VerifyQueryPlan, dirtyReads: l.DirtyReads}
+	if err = proxy.loadPolicy(l.Policy, nil); err != nil {
+		return nil, err
+	}
+	if err = proxy.loadCredentials(CredentialSettings{
+		BasicFile:     l.AuthBasicFile,
+		JWTSecretFile: l.AuthJWTSecretFile,
+		JWTUsername:   l.AuthJWTUsername,
+		JWTUsers:      l.AuthJWTUsers,
+		JWTGroups:     l.AuthJWTGroups,
+	}); err != nil {
+		return nil, err
+	}
+	if proxy.databases, err = ParseDatabaseAccess(strings.Join(l.Databases, ","), l.DefaultDatabase); err != nil {
+		return nil, err
+	}
+	if proxy.categories, err = ParseCategoryAccess(strings.Join(l.Categories, ",")); err != nil {
+		return nil, err
+	}
+	if proxy.collections, err = ParseCollectionAccess(
+		strings.Join(l.Collections, ","),
+		strings.Join(l.DeniedCollections, ","),
+		strings.Join(l.Graphs, ","),
+	); err != nil {
+		return nil, err
+	}
+	listener.proxy = proxy
+	return listener, nil
+}
+
+// listener returns the listener named name, or nil.
+func (c *daemonConfig) listener(name string) *listenerConfig {
+	for _, l := range c.listeners {
+		if l.name == name {
+			return l
+		}
+	}
+	return nil
+}
+
+// settings describes the reloadable configuration as named values. The
+// settings of a named listener are prefixed with its name.
+func (c *daemonConfig) settings() map[string]string {
+	settings := c.upstream.settings()
+	for _, l := range c.listeners {
+		for name, value := range l.proxy.settings() {
+			if l.name != "" {
+				name = l.name + " " + name
+			}
+			settings[name] = value
+		}
+	}
+	return settings
+}
+
+// endpoint describes the listener's startup-only settings, which a reload
+// cannot change.
+func (l *listenerConfig) endpoint() string {
+	return fmt.Sprintf("socket=%s (%s) audit=%q audit_key=%q hash_bind_values=%t",
+		l.socket, l.options, l.audit, l.auditKey, l.hashBindValues)
+}
+
+// checkAudit requires a key for the audit log, if there is one.
+func (l *listenerConfig) checkAudit() error {
+	if l.audit != "" && l.auditKey == "" {
+		return fmt.Errorf("audit log %s requires a key file", l.audit)
+	}
+	return nil
+}
+
+// openAudit opens the listener's audit log, or returns nil if it has none.
+func (l *listenerConfig) openAudit() (*AuditLog, error) {
+	if l.audit == "" {
+		return nil, nil
+	}
+	key, err := LoadAuditKey(l.auditKey)
+	if err != nil {
+		return nil, err
+	}
+	audit, err := OpenAuditLog(l.audit, key)
+	if err != nil {
+		return nil, err
+	}
+	audit.HashBindValues = l.hashBindValues
+	return audit, nil
+}
+
+// label names the listener in log lines.
+func (l *listenerConfig) label(fallback string) string {
+	if l.name == "" {
+		return fallback
+	}
+	return "listener " + l.name
+}
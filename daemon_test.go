@@ -0,0 +1,298 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLoadDaemonConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		config  string
+		wantErr string
+	}{
+		{
+			name: "valid",
+			file: "config.yaml",
+			config: `upstream:
+  socket: /run/arangodb3/arangodb.sock
+  client_timeout_seconds: 0
+listeners:
+  - name: ro
+    socket: /run/arango-proxy/readonly.sock
+    mode: "0640"
+    policy: builtin:read-only
+    databases: [kg:ro]
+  - name: rw
+    socket: /run/arango-proxy/readwrite.sock
+    policy: builtin:read-write
+    categories: [data-read, data-write]
+`,
+		},
+		{
+			name:   "json",
+			file:   "config.json",
+			config: `{"listeners": [{"name": "ro", "socket": "/tmp/ro.sock", "policy": "builtin:read-only"}]}`,
+		},
+		{name: "no listeners", file: "config.yaml", config: "upstream: {}\n", wantErr: "no listeners"},
+		{name: "unknown field", file: "config.yaml", config: "listeners: []\nlisten: x\n", wantErr: "not found"},
+		{
+			name:    "missing name",
+			file:    "config.yaml",
+			config:  "listeners:\n  - socket: /tmp/a.sock\n    policy: builtin:read-only\n",
+			wantErr: "name is required",
+		},
+		{
+			name:    "admin name",
+			file:    "config.yaml",
+			config:  "listeners:\n  - name: admin\n    socket: /tmp/a.sock\n    policy: builtin:read-only\n",
+			wantErr: "invalid name",
+		},
+		{
+			name:    "duplicate name",
+			file:    "config.yaml",
+			config:  "listeners:\n  - {name: a, socket: /tmp/a.sock, policy: builtin:read-only}\n  - {name: a, socket: /tmp/b.sock, policy: builtin:read-only}\n",
+			wantErr: "duplicate name",
+		},
+		{
+			name:    "shared socket",
+			file:    "config.yaml",
+			config:  "listeners:\n  - {name: a, socket: /tmp/a.sock, policy: builtin:read-only}\n  - {name: b, socket: /tmp/./a.sock, policy: builtin:read-write}\n",
+			wantErr: "used by another listener",
+		},
+		{
+			name:    "shared audit log",
+			file:    "config.yaml",
+			config:  "listeners:\n  - {name: a, socket: /tmp/a.sock, policy: builtin:read-write, audit_log: /tmp/audit, audit_log_key_file: /tmp/key}\n  - {name: b, socket: /tmp/b.sock, policy: builtin:read-write, audit_log: /tmp/audit, audit_log_key_file: /tmp/key}\n",
+			wantErr: "used by another listener",
+		},
+		{
+			name:    "audit log without key",
+			file:    "config.yaml",
+			config:  "listeners:\n  - {name: a, socket: /tmp/a.sock, policy: builtin:read-write, audit_log: /tmp/audit}\n",
+			wantErr: "requires a key file",
+		},
+		{
+			name:    "relative socket",
+			file:    "config.yaml",
+			config:  "listeners:\n  - {name: a, socket: a.sock, policy: builtin:read-only}\n",
+			wantErr: "absolute path",
+		},
+		{
+			name:    "missing policy",
+			file:    "config.yaml",
+			config:  "listeners:\n  - {name: a, socket: /tmp/a.sock}\n",
+			wantErr: "policy is required",
+		},
+		{
+			name:    "invalid mode",
+			file:    "config.yaml",
+			config:  "listeners:\n  - {name: a, socket: /tmp/a.sock, mode: \"4755\", policy: builtin:read-only}\n",
+			wantErr: "invalid socket mode",
+		},
+		{
+			name:    "unknown category",
+			file:    "config.yaml",
+			config:  "listeners:\n  - {name: a, socket: /tmp/a.sock, policy: builtin:read-only, categories: [bogus]}\n",
+			wantErr: "unknown endpoint category",
+		},
+		{
+			name:    "negative timeout",
+			file:    "config.yaml",
+			config:  "upstream: {dial_timeout_seconds: -1}\nlisteners:\n  - {name: a, socket: /tmp/a.sock, policy: builtin:read-only}\n",
+			wantErr: "must not be negative",
+		},
+		{
+			name:   "coordinators",
+			file:   "config.yaml",
+			config: "upstream:\n  endpoints: [tcp://c1:8529, tcp://c2:8529]\n  balance: least-in-flight\nlisteners:\n  - {name: a, socket: /tmp/a.sock, policy: builtin:read-only}\n",
+		},
+		{
+			name:   "active failover",
+			file:   "config.yaml",
+			config: "upstream:\n  endpoints: [tcp://db1:8529, tcp://db2:8529]\n  balance: active-failover\nlisteners:\n  - {name: a, socket: /tmp/a.sock, policy: builtin:read-only, dirty_reads: true}\n",
+		},
+		{
+			name:    "endpoint and endpoints",
+			file:    "config.yaml",
+			config:  "upstream:\n  endpoint: tcp://c1:8529\n  endpoints: [tcp://c2:8529]\nlisteners:\n  - {name: a, socket: /tmp/a.sock, policy: builtin:read-only}\n",
+			wantErr: "not both",
+		},
+		{
+			name:    "duplicate endpoint",
+			file:    "config.yaml",
+			config:  "upstream:\n  endpoints: [tcp://c1:8529, http://c1:8529]\nlisteners:\n  - {name: a, socket: /tmp/a.sock, policy: builtin:read-only}\n",
+			wantErr: "duplicate upstream",
+		},
+		{
+			name:    "unknown balance",
+			file:    "config.yaml",
+			config:  "upstream:\n  endpoints: [tcp://c1:8529, tcp://c2:8529]\n  balance: random\nlisteners:\n  - {name: a, socket: /tmp/a.sock, policy: builtin:read-only}\n",
+			wantErr: "invalid upstream balance",
+		},
+		{
+			name:   "health check",
+			file:   "config.yaml",
+			config: "upstream:\n  health_check: {path: /_admin/server/availability, interval_seconds: 0}\nlisteners:\n  - {name: a, socket: /tmp/a.sock, policy: builtin:read-only}\n",
+		},
+		{
+			name:    "invalid health check",
+			file:    "config.yaml",
+			config:  "upstream:\n  health_check: {timeout_seconds: 0}\nlisteners:\n  - {name: a, socket: /tmp/a.sock, policy: builtin:read-only}\n",
+			wantErr: "health check timeout",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tc.file)
+			if err := os.WriteFile(path, []byte(tc.config), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := loadDaemonConfig(path)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("loadDaemonConfig() error = %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadDaemonConfig() error = %v", err)
+			}
+			if len(cfg.listeners) == 0 {
+				t.Fatal("no listeners")
+			}
+		})
+	}
+}
+
+func TestDaemonConfig_Settings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	config := "listeners:\n  - {name: ro, socket: /tmp/ro.sock, mode: \"0640\", policy: builtin:read-only, dirty_reads: true}\n"
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadDaemonConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cfg.listeners[0].options, (SocketOptions{Mode: 0o640, UID: -1, GID: -1}); got != want {
+		t.Errorf("listener socket options = %+v, want %+v", got, want)
+	}
+	settings := cfg.settings()
+	if got := settings["ro policy"]; got != "builtin:read-only" {
+		t.Errorf(`settings["ro policy"] = %q`, got)
+	}
+	if got := settings["ro dirty reads"]; got != "true" {
+		t.Errorf(`settings["ro dirty reads"] = %q`, got)
+	}
+	if got := settings["upstream"]; got != "unix://"+DefaultUpstreamSocket {
+		t.Errorf(`settings["upstream"] = %q`, got)
+	}
+}
+
+func TestServeListeners_SharesUpstream(t *testing.T) {
+	for _, name := range []string{"PROXY_ENV_FILE", "LISTEN_FDS", "ADMIN_LISTEN", "ACCESS_LOG_FORMAT", "ACCESS_LOG_QUERY", "SHUTDOWN_TIMEOUT_SECONDS"} {
+		t.Setenv(name, "")
+	}
+
+	var connections atomic.Int32
+	upstreamSocket := filepath.Join(t.TempDir(), "upstream.sock")
+	upstreamListener, err := net.Listen("unix", upstreamSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"result": []}`))
+	}))
+	upstream.Listener = upstreamListener
+	upstream.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connections.Add(1)
+		}
+	}
+	upstream.Start()
+	defer upstream.Close()
+
+	dir := t.TempDir()
+	roSocket := filepath.Join(dir, "ro.sock")
+	rwSocket := filepath.Join(dir, "rw.sock")
+	configPath := filepath.Join(dir, "config.yaml")
+	config := "upstream:\n  socket: " + upstreamSocket + "\n" +
+		"listeners:\n" +
+		"  - {name: ro, socket: " + roSocket + ", mode: \"0640\", policy: builtin:read-only}\n" +
+		"  - {name: rw, socket: " + rwSocket + ", policy: builtin:read-write}\n"
+	if err := os.WriteFile(configPath, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- serveListeners(ctx, "test", func() (*daemonConfig, error) { return loadDaemonConfig(configPath) })
+	}()
+	for _, socket := range []string{roSocket, rwSocket} {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if _, err := os.Stat(socket); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s not created", socket)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	for socket, want := range map[string]os.FileMode{roSocket: 0o640, rwSocket: RWSocketPermissions} {
+		if info, err := os.Stat(socket); err != nil || info.Mode().Perm() != want {
+			t.Errorf("%s mode = %v, %v; want %v", socket, info.Mode().Perm(), err, want)
+		}
+	}
+
+	write := func(socket string) int {
+		t.Helper()
+		resp, err := unixClient(socket).Post("http://proxy/_api/cursor", "application/json",
+			strings.NewReader(`{"query": "INSERT {a: 1} INTO docs"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := write(roSocket); code != http.StatusForbidden {
+		t.Errorf("write on ro listener: status %d, want 403", code)
+	}
+	if code := write(rwSocket); code != http.StatusOK {
+		t.Errorf("write on rw listener: status %d, want 200", code)
+	}
+	resp, err := unixClient(roSocket).Get("http://proxy/_api/version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("read on ro listener: status %d", resp.StatusCode)
+	}
+	if n := connections.Load(); n != 1 {
+		t.Errorf("listeners opened %d upstream connections, want 1 shared connection", n)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("serveListeners() = %v", err)
+	}
+	for _, socket := range []string{roSocket, rwSocket} {
+		if _, err := os.Stat(socket); !os.IsNotExist(err) {
+			t.Errorf("%s not removed on shutdown: %v", socket, err)
+		}
+	}
+}
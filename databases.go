@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// DatabaseMode restricts what a socket may do in a particular database.
+type DatabaseMode string
+
+const (
+	// DatabaseReadWrite applies the socket's policy unchanged.
+	DatabaseReadWrite DatabaseMode = "rw"
+	// DatabaseReadOnly additionally requires AllowReadOnly to admit the
+	// request, so a read-write socket can be read-only in some databases.
+	DatabaseReadOnly DatabaseMode = "ro"
+)
+
+// systemDatabase is where ArangoDB serves requests without a /_db/ prefix.
+const systemDatabase = "_system"
+
+// DatabaseAccess restricts which databases a socket can reach. It is
+// enforced by UnixReverseProxy before the socket's AllowFunc runs.
+type DatabaseAccess struct {
+	// Default is the database for requests without a /_db/<name> prefix.
+	// Such requests are rewritten to carry the prefix explicitly, so the
+	// policy and the upstream both see the real target. Empty leaves them
+	// on _system, which must then be allowed like any other database.
+	Default string
+	// Allowed maps database names to their mode. A nil map allows every
+	// database in read-write mode.
+	Allowed map[string]DatabaseMode
+}
+
+// ParseDatabaseAccess builds a DatabaseAccess from a comma-separated list
+// of database names, each optionally suffixed with ":ro" or ":rw" (the
+// default), and a default database name. It returns nil when both are empty.
+func ParseDatabaseAccess(allowed, defaultDB string) (*DatabaseAccess, error) {
+	allowed = strings.TrimSpace(allowed)
+	defaultDB = strings.TrimSpace(defaultDB)
+	if allowed == "" && defaultDB == "" {
+		return nil, nil
+	}
+
+	access := &DatabaseAccess{Default: defaultDB}
+	if defaultDB != "" && !isValidDatabaseName(defaultDB) {
+		return nil, fmt.Errorf("invalid default database name %q", defaultDB)
+	}
+	if allowed != "" {
+		access.Allowed = make(map[string]DatabaseMode)
+		for _, entry := range strings.Split(allowed, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			name, mode, hasMode := strings.Cut(entry, ":")
+			if !isValidDatabaseName(name) {
+				return nil, fmt.Errorf("invalid database name %q", name)
+			}
+			dbMode := DatabaseReadWrite
+			if hasMode {
+				dbMode = DatabaseMode(strings.ToLower(mode))
+				if dbMode != DatabaseReadOnly && dbMode != DatabaseReadWrite {
+					return nil, fmt.Errorf("invalid mode %q for database %s (want ro or rw)", mode, name)
+				}
+			}
+			access.Allowed[name] = dbMode
+		}
+		if len(access.Allowed) == 0 {
+			return nil, fmt.Errorf("database allowlist is empty")
+		}
+		if defaultDB != "" {
+			if _, ok := access.Allowed[defaultDB]; !ok {
+				return nil, fmt.Errorf("default database %q is not in the allowlist", defaultDB)
+			}
+		}
+	}
+	return access, nil
+}
+
+// DatabaseAccessFromEnv reads ALLOWED_DATABASES and DEFAULT_DATABASE.
+func DatabaseAccessFromEnv() (*DatabaseAccess, error) {
+	return ParseDatabaseAccess(GetEnv("ALLOWED_DATABASES", ""), GetEnv("DEFAULT_DATABASE", ""))
+}
+
+// String summarizes the configuration for startup logs.
+func (d *DatabaseAccess) String() string {
+	var parts []string
+	if d.Default != "" {
+		parts = append(parts, "default="+d.Default)
+	}
+	if d.Allowed == nil {
+		parts = append(parts, "allowed=*")
+	} else {
+		names := make([]string, 0, len(d.Allowed))
+		for name, mode := range d.Allowed {
+			names = append(names, name+":"+string(mode))
+		}
+		sort.Strings(names)
+		parts = append(parts, "allowed="+strings.Join(names, ","))
+	}
+	return strings.Join(parts, " ")
+}
+
+// resolve applies the default database to r, rewriting its path in place,
+// and checks the target against the allowlist. It returns the mode that
+// applies to the target database.
+func (d *DatabaseAccess) resolve(r *http.Request) (DatabaseMode, error) {
+	reqPath, ok := parseRequestPath(r.URL.Path)
+	if !ok {
+		return "", fmt.Errorf("invalid database in path %s", r.URL.Path)
+	}
+	if reqPath.db == "" && d.Default != "" {
+		r.URL.Path = "/_db/" + d.Default + r.URL.Path
+		r.URL.RawPath = ""
+		reqPath.db = d.Default
+	}
+	if d.Allowed == nil {
+		return DatabaseReadWrite, nil
+	}
+	db := reqPath.database()
+	mode, ok := d.Allowed[db]
+	if !ok {
+		return "", fmt.Errorf("database %s is not permitted", db)
+	}
+	return mode, nil
+}
@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseDatabaseAccess(t *testing.T) {
+	access, err := ParseDatabaseAccess("", "")
+	if err != nil || access != nil {
+		t.Errorf("empty config = %v, %v; want nil, nil", access, err)
+	}
+
+	access, err = ParseDatabaseAccess(" kb , analytics:ro,staging:RW ", "kb")
+	if err != nil {
+		t.Fatalf("ParseDatabaseAccess() error = %v", err)
+	}
+	want := map[string]DatabaseMode{"kb": DatabaseReadWrite, "analytics": DatabaseReadOnly, "staging": DatabaseReadWrite}
+	if len(access.Allowed) != len(want) {
+		t.Fatalf("Allowed = %v, want %v", access.Allowed, want)
+	}
+	for name, mode := range want {
+		if access.Allowed[name] != mode {
+			t.Errorf("Allowed[%s] = %q, want %q", name, access.Allowed[name], mode)
+		}
+	}
+	if got := access.String(); got != "default=kb allowed=analytics:ro,kb:rw,staging:rw" {
+		t.Errorf("String() = %q", got)
+	}
+
+	access, err = ParseDatabaseAccess("", "kb")
+	if err != nil || access.Allowed != nil || access.Default != "kb" {
+		t.Errorf("default only = %+v, %v", access, err)
+	}
+
+	invalid := []struct{ allowed, defaultDB string }{
+		{"my.db", ""},
+		{"kb:admin", ""},
+		{",,", ""},
+		{"kb", "other"},
+		{"", "bad/name"},
+	}
+	for _, tc := range invalid {
+		if _, err := ParseDatabaseAccess(tc.allowed, tc.defaultDB); err == nil {
+			t.Errorf("ParseDatabaseAccess(%q, %q) should fail", tc.allowed, tc.defaultDB)
+		}
+	}
+}
+
+func TestDatabaseAccess_Resolve(t *testing.T) {
+	access, err := ParseDatabaseAccess("kb,analytics:ro", "kb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path     string
+		wantPath string
+		wantMode DatabaseMode
+		wantErr  bool
+	}{
+		{"/_api/version", "/_db/kb/_api/version", DatabaseReadWrite, false},
+		{"/_db/kb/_api/cursor", "/_db/kb/_api/cursor", DatabaseReadWrite, false},
+		{"/_db/analytics/_api/cursor", "/_db/analytics/_api/cursor", DatabaseReadOnly, false},
+		{"/_db/_system/_api/database", "", "", true},
+		{"/_db/other/_api/cursor", "", "", true},
+		{"/_db/my.db/_api/cursor", "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			mode, err := access.resolve(req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolve() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if req.URL.Path != tt.wantPath {
+				t.Errorf("path = %q, want %q", req.URL.Path, tt.wantPath)
+			}
+			if mode != tt.wantMode {
+				t.Errorf("mode = %q, want %q", mode, tt.wantMode)
+			}
+		})
+	}
+}
+
+func TestDatabaseAccess_NoDefaultTargetsSystem(t *testing.T) {
+	access, err := ParseDatabaseAccess("kb", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/_api/version", nil)
+	if _, err := access.resolve(req); err == nil || !strings.Contains(err.Error(), "_system") {
+		t.Errorf("unprefixed request without a default should be checked as _system, got: %v", err)
+	}
+}
+
+func TestUnixReverseProxy_DatabaseAccess(t *testing.T) {
+	var upstreamPath string
+	socket := startFakeUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamPath = r.URL.Path
+		io.WriteString(w, "ok")
+	}))
+	proxy := NewUnixReverseProxy(socket, AllowReadWrite)
+	access, err := ParseDatabaseAccess("kb,analytics:ro", "kb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.SetDatabaseAccess(access)
+
+	tests := []struct {
+		method   string
+		path     string
+		wantCode int
+		wantPath string
+	}{
+		{http.MethodGet, "/_api/version", http.StatusOK, "/_db/kb/_api/version"},
+		{http.MethodPost, "/_api/document/c", http.StatusOK, "/_db/kb/_api/document/c"},
+		{http.MethodGet, "/_db/analytics/_api/document/c/k", http.StatusOK, "/_db/analytics/_api/document/c/k"},
+		{http.MethodPost, "/_db/analytics/_api/document/c", http.StatusForbidden, ""},
+		{http.MethodGet, "/_db/_system/_api/database", http.StatusForbidden, ""},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.method+" "+tc.path, func(t *testing.T) {
+			upstreamPath = ""
+			rec := httptest.NewRecorder()
+			proxy.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.path, strings.NewReader("{}")))
+			if rec.Code != tc.wantCode {
+				t.Errorf("status = %d, want %d (%s)", rec.Code, tc.wantCode, rec.Body.String())
+			}
+			if upstreamPath != tc.wantPath {
+				t.Errorf("upstream path = %q, want %q", upstreamPath, tc.wantPath)
+			}
+		})
+	}
+}
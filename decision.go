@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Decision records how the proxy ruled on a request, for metrics and logs.
+type Decision struct {
+	// Allowed reports whether the request was forwarded.
+	Allowed bool
+	// Rule names what decided: the policy rule that admitted or denied the
+	// request, or the restriction that denied it ("database", "category",
+	// "collection", "read-only-database", "transaction"). It is empty when
+	// no named rule applied, e.g. a request no policy rule matched.
+	Rule string
+	// Category is the endpoint category of the request.
+	Category EndpointCategory
+	// Database is the database the request targets, after the default
+	// database was applied.
+	Database string
+	// Path is the request path without its /_db/<name> prefix.
+	Path string
+	// Upstream is how long ArangoDB took to respond with headers; zero if
+	// the request was not forwarded.
+	Upstream time.Duration
+	// Err is the reason a request was denied.
+	Err error
+
+	// readOnlyQuery is set when the policy rule that admitted the request
+	// checked its AQL for every write keyword.
+	readOnlyQuery bool
+}
+
+type decisionKey struct{}
+
+func withDecision(ctx context.Context, decision *Decision) context.Context {
+	return context.WithValue(ctx, decisionKey{}, decision)
+}
+
+// DecisionFromContext returns the decision being made about the request
+// served with ctx. It is only available within UnixReverseProxy.
+func DecisionFromContext(ctx context.Context) (*Decision, bool) {
+	decision, ok := ctx.Value(decisionKey{}).(*Decision)
+	return decision, ok
+}
+
+// decisionFor returns the decision attached to r by a wrapping handler such
+// as AccessLog, or attaches a new one.
+func decisionFor(r *http.Request) (*Decision, *http.Request) {
+	if decision, ok := DecisionFromContext(r.Context()); ok {
+		return decision, r
+	}
+	decision := &Decision{}
+	return decision, r.WithContext(withDecision(r.Context(), decision))
+}
+
+// noteTarget records the endpoint r addresses once its database has been
+// resolved.
+func (d *Decision) noteTarget(r *http.Request) {
+	d.Category = ClassifyEndpoint(r)
+	if reqPath, ok := parseRequestPath(r.URL.Path); ok {
+		d.Database = reqPath.database()
+		d.Path = "/" + strings.Join(reqPath.segments, "/")
+	}
+}
+
+// noteRule records the rule deciding about r, unless one has been recorded
+// already: the first rule to rule on a request is the one reported.
+func noteRule(r *http.Request, rule string) {
+	if decision, ok := DecisionFromContext(r.Context()); ok && decision.Rule == "" {
+		decision.Rule = rule
+	}
+}
+
+// noteReadOnlyQuery records that the policy found no write keyword in the
+// AQL of r.
+func noteReadOnlyQuery(r *http.Request) {
+	if decision, ok := DecisionFromContext(r.Context()); ok {
+		decision.readOnlyQuery = true
+	}
+}
+
+// ForbiddenKeywordError reports an AQL keyword a policy does not permit.
+type ForbiddenKeywordError struct {
+	Keyword string
+	// Where is "AQL" when the query was lexed, or "request body" when the
+	// raw body was scanned.
+	Where string
+}
+
+func (e *ForbiddenKeywordError) Error() string {
+	return fmt.Sprintf("forbidden keyword %q detected in %s", e.Keyword, e.Where)
+}
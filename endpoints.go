@@ -0,0 +1,267 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// EndpointCategory classifies ArangoDB endpoints by what they expose.
+type EndpointCategory string
+
+const (
+	// CategoryDataRead covers reading documents and metadata, and running
+	// AQL cursors. Whether a query may write is left to the policy's AQL
+	// checks.
+	CategoryDataRead EndpointCategory = "data-read"
+	// CategoryDataWrite covers document writes, imports, truncation and
+	// stream transactions.
+	CategoryDataWrite EndpointCategory = "data-write"
+	// CategorySchema covers creating, changing and dropping collections,
+	// indexes, views, analyzers and graphs.
+	CategorySchema EndpointCategory = "schema"
+	// CategoryAdmin covers server administration and introspection: /_admin,
+	// database management, cluster, statistics, running queries, hot
+	// backups and Pregel, batch requests and async job results, which can
+	// carry requests of any category, and any endpoint not otherwise
+	// classified.
+	CategoryAdmin EndpointCategory = "admin"
+	// CategoryCodeExecution covers endpoints that run server-side JavaScript:
+	// JavaScript transactions, /_admin/execute, Foxx, tasks, user-defined
+	// AQL functions and Foxx service mount points.
+	CategoryCodeExecution EndpointCategory = "code-execution"
+	// CategoryReplication covers the replication, WAL and dump APIs, which
+	// stream raw data past any collection-level checks.
+	CategoryReplication EndpointCategory = "replication"
+	// CategoryUserManagement covers /_api/user.
+	CategoryUserManagement EndpointCategory = "user-management"
+)
+
+// EndpointCategories lists every category.
+var EndpointCategories = []EndpointCategory{
+	CategoryDataRead,
+	CategoryDataWrite,
+	CategorySchema,
+	CategoryAdmin,
+	CategoryCodeExecution,
+	CategoryReplication,
+	CategoryUserManagement,
+}
+
+// DefaultEndpointCategories are the categories enabled unless a socket is
+// configured otherwise. Everything else is denied whatever the policy says.
+var DefaultEndpointCategories = []EndpointCategory{
+	CategoryDataRead,
+	CategoryDataWrite,
+	CategorySchema,
+}
+
+// defaultCategoryAccess enables DefaultEndpointCategories. AllowReadOnly and
+// AllowReadWrite apply it.
+var defaultCategoryAccess = newCategoryAccess(DefaultEndpointCategories)
+
+// ClassifyEndpoint returns the category of the endpoint r addresses.
+func ClassifyEndpoint(r *http.Request) EndpointCategory {
+	reqPath, ok := parseRequestPath(r.URL.Path)
+	if !ok {
+		return CategoryAdmin
+	}
+	return classifyEndpoint(r.Method, reqPath)
+}
+
+func classifyEndpoint(method string, reqPath requestPath) EndpointCategory {
+	segments := reqPath.segments
+	read := method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+	sub := func(i int) string {
+		if i < len(segments) {
+			return segments[i]
+		}
+		return ""
+	}
+
+	switch segments[0] {
+	case "_admin":
+		switch sub(1) {
+		case "execute", "routing":
+			return CategoryCodeExecution
+		}
+		return CategoryAdmin
+
+	case "_open":
+		// /_open/auth issues tokens for credentials the client already has.
+		return CategoryDataRead
+
+	case "_api":
+		// Handled below.
+
+	case "":
+		// The root redirects to the web interface.
+		return CategoryAdmin
+
+	default:
+		// Anything outside /_api and /_admin is a Foxx service mount point.
+		return CategoryCodeExecution
+	}
+
+	switch sub(1) {
+	case "foxx", "tasks":
+		return CategoryCodeExecution
+	case "aqlfunction":
+		if read {
+			return CategoryDataRead
+		}
+		return CategoryCodeExecution
+	case "transaction":
+		if len(segments) == 2 {
+			// POST runs a JavaScript transaction; GET lists every
+			// running transaction on the server.
+			if method == http.MethodPost {
+				return CategoryCodeExecution
+			}
+			return CategoryAdmin
+		}
+		if read {
+			return CategoryDataRead
+		}
+		return CategoryDataWrite
+	case "user":
+		return CategoryUserManagement
+	case "replication", "wal", "dump":
+		return CategoryReplication
+	case "database":
+		if read && (sub(2) == "current" || sub(2) == "user") {
+			return CategoryDataRead
+		}
+		return CategoryAdmin
+	case "cluster", "endpoint", "server", "statistics", "query-cache", "system":
+		return CategoryAdmin
+	case "backup", "control_pregel", "pregel":
+		// Hot backups restore whole servers; Pregel jobs run over entire
+		// graphs and can write their results back.
+		return CategoryAdmin
+	case "batch", "job":
+		// A batch's multipart body holds arbitrary sub-requests, and a
+		// job's result is the response to whatever request, from any
+		// client, was run asynchronously. Neither can be checked here.
+		return CategoryAdmin
+	case "simple":
+		// Simple queries are all PUT; the by-example and by-keys
+		// modifications write, the rest read.
+		switch sub(2) {
+		case "remove-by-example", "replace-by-example", "update-by-example", "remove-by-keys":
+			return CategoryDataWrite
+		}
+		return CategoryDataRead
+	case "query":
+		if method == http.MethodPost && len(segments) == 2 {
+			// Parsing a query.
+			return CategoryDataRead
+		}
+		// Current and slow queries, killing queries, tracking properties.
+		return CategoryAdmin
+	case "cursor", "explain", "version", "engine":
+		return CategoryDataRead
+	case "collection":
+		switch {
+		case read:
+			return CategoryDataRead
+		case sub(3) == "truncate":
+			return CategoryDataWrite
+		}
+		return CategorySchema
+	case "index", "view", "analyzer", "gharial":
+		if read {
+			return CategoryDataRead
+		}
+		return CategorySchema
+	case "document", "edges", "edge", "import", "export":
+		if read {
+			return CategoryDataRead
+		}
+		return CategoryDataWrite
+	case "key-generators":
+		return CategoryDataRead
+	}
+	// An API not listed here, including one added by a later ArangoDB
+	// release, is not exposed until it has been classified.
+	return CategoryAdmin
+}
+
+// CategoryAccess restricts a socket to endpoints of the enabled categories.
+// It is enforced by UnixReverseProxy after DatabaseAccess and before the
+// socket's AllowFunc, which still decides within the enabled categories.
+type CategoryAccess struct {
+	// Enabled holds the permitted categories.
+	Enabled map[EndpointCategory]struct{}
+}
+
+func newCategoryAccess(categories []EndpointCategory) *CategoryAccess {
+	access := &CategoryAccess{Enabled: make(map[EndpointCategory]struct{}, len(categories))}
+	for _, category := range categories {
+		access.Enabled[category] = struct{}{}
+	}
+	return access
+}
+
+// ParseCategoryAccess builds a CategoryAccess from a comma-separated list of
+// category names, or "all". An empty list enables
+// DefaultEndpointCategories.
+func ParseCategoryAccess(list string) (*CategoryAccess, error) {
+	names := splitList(list)
+	if len(names) == 0 {
+		return newCategoryAccess(DefaultEndpointCategories), nil
+	}
+	if len(names) == 1 && strings.EqualFold(names[0], "all") {
+		return newCategoryAccess(EndpointCategories), nil
+	}
+	categories := make([]EndpointCategory, 0, len(names))
+	for _, name := range names {
+		category, err := parseEndpointCategory(name)
+		if err != nil {
+			return nil, err
+		}
+		categories = append(categories, category)
+	}
+	return newCategoryAccess(categories), nil
+}
+
+func parseEndpointCategory(name string) (EndpointCategory, error) {
+	category := EndpointCategory(strings.ToLower(strings.TrimSpace(name)))
+	for _, known := range EndpointCategories {
+		if category == known {
+			return category, nil
+		}
+	}
+	return "", fmt.Errorf("unknown endpoint category %q", name)
+}
+
+// CategoryAccessFromEnv reads ENDPOINT_CATEGORIES.
+func CategoryAccessFromEnv() (*CategoryAccess, error) {
+	return ParseCategoryAccess(GetEnv("ENDPOINT_CATEGORIES", ""))
+}
+
+// String summarizes the configuration for startup logs.
+func (c *CategoryAccess) String() string {
+	names := make([]string, 0, len(c.Enabled))
+	for category := range c.Enabled {
+		names = append(names, string(category))
+	}
+	sort.Strings(names)
+	return "enabled=" + strings.Join(names, ",")
+}
+
+// Permits reports whether endpoints of the category may be used.
+func (c *CategoryAccess) Permits(category EndpointCategory) bool {
+	_, ok := c.Enabled[category]
+	return ok
+}
+
+// check rejects requests to endpoints of a disabled category.
+func (c *CategoryAccess) check(r *http.Request) error {
+	category := ClassifyEndpoint(r)
+	if !c.Permits(category) {
+		return fmt.Errorf("%s %s denied: %s endpoints are disabled", r.Method, r.URL.Path, category)
+	}
+	return nil
+}
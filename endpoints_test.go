@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClassifyEndpoint(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		want   EndpointCategory
+	}{
+		{http.MethodGet, "/_api/version", CategoryDataRead},
+		{http.MethodGet, "/_db/kb/_api/document/chunks/key", CategoryDataRead},
+		{http.MethodPost, "/_db/kb/_api/document/chunks", CategoryDataWrite},
+		{http.MethodPost, "/_api/cursor", CategoryDataRead},
+		{http.MethodDelete, "/_api/cursor/123", CategoryDataRead},
+		{http.MethodPost, "/_api/import?collection=chunks", CategoryDataWrite},
+		{http.MethodPost, "/_api/transaction/begin", CategoryDataWrite},
+		{http.MethodGet, "/_api/transaction/123", CategoryDataRead},
+		{http.MethodPut, "/_api/collection/chunks/truncate", CategoryDataWrite},
+		{http.MethodGet, "/_api/collection", CategoryDataRead},
+		{http.MethodPost, "/_api/collection", CategorySchema},
+		{http.MethodDelete, "/_api/collection/chunks", CategorySchema},
+		{http.MethodPost, "/_api/index?collection=chunks", CategorySchema},
+		{http.MethodPost, "/_api/gharial", CategorySchema},
+		{http.MethodGet, "/_api/database/current", CategoryDataRead},
+		{http.MethodGet, "/_api/database", CategoryAdmin},
+		{http.MethodPost, "/_api/database", CategoryAdmin},
+		{http.MethodGet, "/_admin/log", CategoryAdmin},
+		{http.MethodGet, "/_admin/server/availability", CategoryAdmin},
+		{http.MethodGet, "/_api/query/current", CategoryAdmin},
+		{http.MethodPost, "/_api/query", CategoryDataRead},
+		{http.MethodGet, "/_api/transaction", CategoryAdmin},
+		{http.MethodPost, "/_api/transaction", CategoryCodeExecution},
+		{http.MethodPost, "/_admin/execute", CategoryCodeExecution},
+		{http.MethodPost, "/_admin/routing/reload", CategoryCodeExecution},
+		{http.MethodGet, "/_api/foxx", CategoryCodeExecution},
+		{http.MethodPost, "/_api/tasks", CategoryCodeExecution},
+		{http.MethodPost, "/_api/aqlfunction", CategoryCodeExecution},
+		{http.MethodGet, "/_api/aqlfunction", CategoryDataRead},
+		{http.MethodGet, "/_db/kb/my-service/items", CategoryCodeExecution},
+		{http.MethodGet, "/_api/user", CategoryUserManagement},
+		{http.MethodPut, "/_api/user/alice/database/kb", CategoryUserManagement},
+		{http.MethodGet, "/_api/replication/dump", CategoryReplication},
+		{http.MethodGet, "/_api/wal/tail", CategoryReplication},
+		{http.MethodPost, "/_api/batch", CategoryAdmin},
+		{http.MethodPost, "/_db/kb/_api/batch", CategoryAdmin},
+		{http.MethodGet, "/_api/job/done", CategoryAdmin},
+		{http.MethodPut, "/_api/job/123", CategoryAdmin},
+		{http.MethodPut, "/_api/simple/all", CategoryDataRead},
+		{http.MethodPut, "/_api/simple/lookup-by-keys", CategoryDataRead},
+		{http.MethodPut, "/_api/simple/remove-by-example", CategoryDataWrite},
+		{http.MethodPut, "/_api/simple/update-by-example", CategoryDataWrite},
+		{http.MethodPost, "/_api/backup/create", CategoryAdmin},
+		{http.MethodPost, "/_api/backup/restore", CategoryAdmin},
+		{http.MethodGet, "/_api/backup/list", CategoryAdmin},
+		{http.MethodPost, "/_api/control_pregel", CategoryAdmin},
+		{http.MethodGet, "/_api/control_pregel/123", CategoryAdmin},
+		{http.MethodGet, "/_api/edges/knows?vertex=people/a", CategoryDataRead},
+		{http.MethodPost, "/_api/export?collection=chunks", CategoryDataWrite},
+		{http.MethodGet, "/_api/key-generators", CategoryDataRead},
+		{http.MethodGet, "/_api/some-future-api", CategoryAdmin},
+		{http.MethodPost, "/_db/kb/_api/some-future-api", CategoryAdmin},
+		{http.MethodGet, "/_api", CategoryAdmin},
+		{http.MethodGet, "/_api/../_admin/log", CategoryAdmin},
+		{http.MethodGet, "/", CategoryAdmin},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.method+" "+tc.path, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, nil)
+			if got := ClassifyEndpoint(req); got != tc.want {
+				t.Errorf("ClassifyEndpoint() = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseCategoryAccess(t *testing.T) {
+	access, err := ParseCategoryAccess("")
+	if err != nil {
+		t.Fatalf("ParseCategoryAccess() error = %v", err)
+	}
+	if got := access.String(); got != "enabled=data-read,data-write,schema" {
+		t.Errorf("default String() = %q", got)
+	}
+
+	access, err = ParseCategoryAccess("data-read, Admin")
+	if err != nil {
+		t.Fatalf("ParseCategoryAccess() error = %v", err)
+	}
+	if !access.Permits(CategoryAdmin) || access.Permits(CategoryDataWrite) {
+		t.Errorf("unexpected categories: %s", access)
+	}
+
+	access, err = ParseCategoryAccess("all")
+	if err != nil {
+		t.Fatalf("ParseCategoryAccess() error = %v", err)
+	}
+	for _, category := range EndpointCategories {
+		if !access.Permits(category) {
+			t.Errorf("all should permit %s", category)
+		}
+	}
+
+	if _, err := ParseCategoryAccess("data-read,foxx"); err == nil {
+		t.Error("unknown category should fail")
+	}
+}
+
+func TestAllowReadOnly_SensitiveGETsDenied(t *testing.T) {
+	paths := []string{
+		"/_admin/log",
+		"/_admin/status",
+		"/_api/user",
+		"/_api/replication/dump",
+		"/_api/wal/tail",
+		"/_api/foxx",
+		"/_db/kb/_api/database",
+	}
+	for _, path := range paths {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if err := AllowReadOnly(req, emptyBodyPeeker()); err == nil {
+			t.Errorf("GET %s should be denied", path)
+		}
+	}
+}
+
+func TestUnixReverseProxy_CategoryAccess(t *testing.T) {
+	socket := startFakeUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	proxy := NewUnixReverseProxy(socket, builtinReadOnly)
+
+	get := func(path string) int {
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code
+	}
+
+	if code := get("/_admin/log"); code != http.StatusForbidden {
+		t.Errorf("admin endpoint with default categories: status = %d, want 403", code)
+	}
+
+	proxy.SetCategoryAccess(newCategoryAccess([]EndpointCategory{CategoryDataRead, CategoryAdmin}))
+	if code := get("/_admin/log"); code != http.StatusOK {
+		t.Errorf("admin endpoint with admin enabled: status = %d, want 200", code)
+	}
+	if code := get("/_api/user"); code != http.StatusForbidden {
+		t.Errorf("user management with admin enabled: status = %d, want 403", code)
+	}
+
+	// Enabling a category never widens the policy.
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/_admin/execute", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("POST /_admin/execute: status = %d, want 403", rec.Code)
+	}
+}
@@ -0,0 +1,219 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// ModificationPlanNodes are the ArangoDB execution plan node types that
+// modify data. A read-only query plan contains none of them. On a cluster
+// the optimizer replaces single-document writes with a
+// SingleRemoteOperationNode and batched ones with a
+// MultipleRemoteModificationNode.
+var ModificationPlanNodes = map[string]struct{}{
+	"InsertNode":                     {},
+	"UpdateNode":                     {},
+	"ReplaceNode":                    {},
+	"RemoveNode":                     {},
+	"UpsertNode":                     {},
+	"SingleRemoteOperationNode":      {},
+	"MultipleRemoteModificationNode": {},
+}
+
+// ReadPlanNodes are the ArangoDB execution plan node types known not to
+// modify data. A plan node of any other type is treated as a possible
+// write, so that node types added by later ArangoDB releases are refused
+// until they are known.
+var ReadPlanNodes = map[string]struct{}{
+	"SingletonNode":             {},
+	"EnumerateCollectionNode":   {},
+	"EnumerateListNode":         {},
+	"EnumerateViewNode":         {},
+	"EnumerateNearVectorNode":   {},
+	"IndexNode":                 {},
+	"JoinNode":                  {},
+	"LimitNode":                 {},
+	"CalculationNode":           {},
+	"SubqueryNode":              {},
+	"SubqueryStartNode":         {},
+	"SubqueryEndNode":           {},
+	"FilterNode":                {},
+	"SortNode":                  {},
+	"CollectNode":               {},
+	"IndexCollectNode":          {},
+	"WindowNode":                {},
+	"ReturnNode":                {},
+	"NoResultsNode":             {},
+	"TraversalNode":             {},
+	"ShortestPathNode":          {},
+	"KShortestPathsNode":        {},
+	"EnumeratePathsNode":        {},
+	"MaterializeNode":           {},
+	"OffsetInfoMaterializeNode": {},
+	"RemoteNode":                {},
+	"ScatterNode":               {},
+	"GatherNode":                {},
+	"DistributeNode":            {},
+	"DistributeConsumerNode":    {},
+	"AsyncNode":                 {},
+	"MutexNode":                 {},
+}
+
+// maxExplainResponseSize bounds how much of an explain response is read.
+const maxExplainResponseSize = 4 * 1024 * 1024
+
+// ExplainVerifier asks ArangoDB to plan cursor queries via /_api/explain
+// and rejects any whose plan modifies data. Unlike keyword scanning this is
+// authoritative: it is the server's own interpretation of the query.
+type ExplainVerifier struct {
+	client *http.Client
+}
+
+// NewExplainVerifier returns a verifier that sends explain requests through
+// client, normally the proxy's own upstream client (see
+// UnixReverseProxy.Client).
+func NewExplainVerifier(client *http.Client) *ExplainVerifier {
+	return &ExplainVerifier{client: client}
+}
+
+// Wrap returns an AllowFunc that applies next and then, for requests that
+// create a cursor, verifies the query plan. Requests next rejects are never
+// sent to the upstream.
+func (v *ExplainVerifier) Wrap(next AllowFunc) AllowFunc {
+	return func(r *http.Request, peek BodyPeeker) error {
+		if err := next(r, peek); err != nil {
+			return err
+		}
+		reqPath, ok := parseRequestPath(r.URL.Path)
+		if r.Method != http.MethodPost || !ok || !reqPath.isCursorCreate() {
+			return nil
+		}
+		body, err := peek(cursorBodyPeekLimit)
+		if err != nil {
+			return err
+		}
+		return v.verify(r, reqPath, body)
+	}
+}
+
+func (v *ExplainVerifier) verify(r *http.Request, reqPath requestPath, body []byte) error {
+	// encoding/json keeps the last of duplicate keys and matches them
+	// case-insensitively, so the plan could be verified for a different
+	// query than ArangoDB executes. Refuse such bodies here too, so the
+	// verifier does not depend on the policy it wraps to catch them.
+	for _, key := range []string{"query", "bindVars"} {
+		if count, ok := countTopLevelKeys(body, key); ok && count > 1 {
+			return fmt.Errorf("ambiguous request: multiple %q fields in cursor body", key)
+		}
+	}
+	var cursor struct {
+		Query    string          `json:"query"`
+		BindVars json.RawMessage `json:"bindVars,omitempty"`
+	}
+	if err := json.Unmarshal(body, &cursor); err != nil || cursor.Query == "" {
+		return fmt.Errorf("query plan verification requires a JSON body with a query")
+	}
+	explainBody, err := json.Marshal(cursor)
+	if err != nil {
+		return err
+	}
+
+	explainURL := upstreamBaseURL
+	if reqPath.db != "" {
+		explainURL += "/_db/" + reqPath.db
+	}
+	explainURL += "/_api/explain"
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, explainURL, bytes.NewReader(explainBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("query plan verification failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Error        bool            `json:"error"`
+		ErrorMessage string          `json:"errorMessage"`
+		Plan         json.RawMessage `json:"plan"`
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxExplainResponseSize))
+	if err != nil {
+		return fmt.Errorf("query plan verification failed: %w", err)
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return fmt.Errorf("query plan verification failed: invalid explain response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || result.Error {
+		return fmt.Errorf("query plan verification failed: %s (status %d)", result.ErrorMessage, resp.StatusCode)
+	}
+	if len(result.Plan) == 0 {
+		return fmt.Errorf("query plan verification failed: explain response has no plan")
+	}
+	nodeType, err := findModificationNode(result.Plan)
+	if err != nil {
+		return fmt.Errorf("query plan verification failed: %w", err)
+	}
+	if nodeType != "" {
+		if _, ok := ModificationPlanNodes[nodeType]; !ok {
+			return fmt.Errorf("query plan contains unrecognised node %s", nodeType)
+		}
+		return fmt.Errorf("query plan contains modification node %s", nodeType)
+	}
+	return nil
+}
+
+// planNode is the part of an execution plan node the verifier inspects.
+// Older ArangoDB versions nest subqueries instead of splicing them into the
+// main node list, so SubqueryNode bodies are walked as well. Mode is the
+// operation of a SingleRemoteOperationNode: a document lookup is an
+// IndexNode, anything else a write.
+type planNode struct {
+	Type     string `json:"type"`
+	Mode     string `json:"mode,omitempty"`
+	Subquery *struct {
+		Nodes []planNode `json:"nodes"`
+	} `json:"subquery,omitempty"`
+}
+
+// findModificationNode returns the type of the first node in an explain
+// plan that modifies data or is not one of ReadPlanNodes, or "" if the plan
+// is read-only.
+func findModificationNode(plan json.RawMessage) (string, error) {
+	var parsed struct {
+		Nodes []planNode `json:"nodes"`
+	}
+	if err := json.Unmarshal(plan, &parsed); err != nil {
+		return "", fmt.Errorf("invalid plan: %w", err)
+	}
+	if len(parsed.Nodes) == 0 {
+		return "", fmt.Errorf("plan has no nodes")
+	}
+	return walkPlanNodes(parsed.Nodes), nil
+}
+
+func walkPlanNodes(nodes []planNode) string {
+	for _, node := range nodes {
+		if node.Type == "SingleRemoteOperationNode" && node.Mode == "IndexNode" {
+			continue
+		}
+		if _, ok := ReadPlanNodes[node.Type]; !ok {
+			return node.Type
+		}
+		if node.Subquery != nil {
+			if found := walkPlanNodes(node.Subquery.Nodes); found != "" {
+				return found
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeExplainUpstream answers /_api/explain with a plan whose node types are
+// chosen by the query text: a query containing "WRITE" yields an InsertNode,
+// "SUBWRITE" a RemoveNode nested in a SubqueryNode, "CLUSTERWRITE" and
+// "CLUSTERREAD" the plans a coordinator makes for a batched write and a
+// document lookup, and "BAD" an error.
+func fakeExplainUpstream(t *testing.T, calls *atomic.Int32, lastPath *atomic.Value) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/_api/explain") {
+			w.WriteHeader(http.StatusCreated)
+			io.WriteString(w, `{"result": [], "hasMore": false}`)
+			return
+		}
+		calls.Add(1)
+		lastPath.Store(r.URL.Path)
+		if r.Header.Get("Authorization") != "Basic dGVzdA==" {
+			t.Errorf("Authorization was not forwarded to explain")
+		}
+		var req struct {
+			Query    string         `json:"query"`
+			BindVars map[string]any `json:"bindVars"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("explain body: %v", err)
+		}
+		switch {
+		case strings.Contains(req.Query, "BAD"):
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"error": true, "errorMessage": "syntax error"}`)
+		case strings.Contains(req.Query, "CLUSTERWRITE"):
+			io.WriteString(w, `{"plan": {"nodes": [{"type": "SingletonNode"},
+				{"type": "CalculationNode"}, {"type": "EnumerateListNode"},
+				{"type": "MultipleRemoteModificationNode"}, {"type": "ReturnNode"}]}}`)
+		case strings.Contains(req.Query, "CLUSTERREAD"):
+			io.WriteString(w, `{"plan": {"nodes": [{"type": "SingletonNode"},
+				{"type": "SingleRemoteOperationNode", "mode": "IndexNode"}, {"type": "ReturnNode"}]}}`)
+		case strings.Contains(req.Query, "SUBWRITE"):
+			io.WriteString(w, `{"plan": {"nodes": [{"type": "SingletonNode"},
+				{"type": "SubqueryNode", "subquery": {"nodes": [{"type": "RemoveNode"}]}}]}}`)
+		case strings.Contains(req.Query, "WRITE"):
+			io.WriteString(w, `{"plan": {"nodes": [{"type": "SingletonNode"}, {"type": "InsertNode"}]}}`)
+		default:
+			io.WriteString(w, `{"plan": {"nodes": [{"type": "SingletonNode"},
+				{"type": "EnumerateCollectionNode"}, {"type": "ReturnNode"}]}}`)
+		}
+	})
+}
+
+func TestExplainVerifier(t *testing.T) {
+	var calls atomic.Int32
+	var lastPath atomic.Value
+	socket := startFakeUpstream(t, fakeExplainUpstream(t, &calls, &lastPath))
+	proxy := NewUnixReverseProxy(socket, AllowReadOnly)
+	allow := NewExplainVerifier(proxy.Client()).Wrap(AllowReadOnly)
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		body    string
+		allow   bool
+		explain bool
+	}{
+		{"read plan", http.MethodPost, "/_api/cursor", `{"query": "FOR d IN c RETURN d"}`, true, true},
+		{"write plan", http.MethodPost, "/_api/cursor", `{"query": "FOR d IN c RETURN WRITE(d)"}`, false, true},
+		{"nested write plan", http.MethodPost, "/_db/kb/_api/cursor", `{"query": "RETURN SUBWRITE()"}`, false, true},
+		{"cluster write plan", http.MethodPost, "/_api/cursor", `{"query": "FOR d IN @docs RETURN CLUSTERWRITE(d)"}`, false, true},
+		{"cluster read plan", http.MethodPost, "/_api/cursor", `{"query": "RETURN DOCUMENT('c/CLUSTERREAD')"}`, true, true},
+		{"explain error", http.MethodPost, "/_api/cursor", `{"query": "BAD"}`, false, true},
+		{"keyword rejected first", http.MethodPost, "/_api/cursor", `{"query": "INSERT {} INTO c"}`, false, false},
+		{"not json", http.MethodPost, "/_api/cursor", `not json`, false, false},
+		{"cursor batch", http.MethodPost, "/_api/cursor/123", ``, true, false},
+		{"get", http.MethodGet, "/_api/version", ``, true, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			before := calls.Load()
+			req := httptest.NewRequest(tc.method, tc.path, nil)
+			req.Header.Set("Authorization", "Basic dGVzdA==")
+			err := allow(req, mockBodyPeeker(tc.body))
+			if tc.allow && err != nil {
+				t.Errorf("should be allowed, got error: %v", err)
+			}
+			if !tc.allow && err == nil {
+				t.Error("should be denied")
+			}
+			if explained := calls.Load() > before; explained != tc.explain {
+				t.Errorf("explain called = %v, want %v", explained, tc.explain)
+			}
+			if tc.explain {
+				want := strings.TrimSuffix(tc.path, "/cursor") + "/explain"
+				if got := lastPath.Load(); got != want {
+					t.Errorf("explain went to %v, want %s", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestExplainVerifier_AmbiguousBody(t *testing.T) {
+	var calls atomic.Int32
+	var lastPath atomic.Value
+	socket := startFakeUpstream(t, fakeExplainUpstream(t, &calls, &lastPath))
+	proxy := NewUnixReverseProxy(socket, AllowReadOnly)
+	// The wrapped policy allows everything, so only the verifier can
+	// refuse the body.
+	allow := NewExplainVerifier(proxy.Client()).Wrap(func(*http.Request, BodyPeeker) error { return nil })
+
+	for _, body := range []string{
+		`{"query": "FOR d IN a RETURN d", "Query": "FOR d IN a RETURN WRITE(d)"}`,
+		`{"query": "FOR d IN a RETURN WRITE(d)", "query": "FOR d IN a RETURN d"}`,
+		`{"query": "FOR d IN @@c RETURN d", "bindVars": {"@c": "a"}, "BINDVARS": {"@c": "b"}}`,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/_api/cursor", nil)
+		req.Header.Set("Authorization", "Basic dGVzdA==")
+		if err := allow(req, mockBodyPeeker(body)); err == nil || !strings.Contains(err.Error(), "ambiguous") {
+			t.Errorf("%s: error = %v, want ambiguous request", body, err)
+		}
+	}
+	if calls.Load() != 0 {
+		t.Error("ambiguous body was explained")
+	}
+}
+
+func TestExplainVerifier_ThroughProxy(t *testing.T) {
+	var calls atomic.Int32
+	var lastPath atomic.Value
+	socket := startFakeUpstream(t, fakeExplainUpstream(t, &calls, &lastPath))
+	proxy := NewUnixReverseProxy(socket, AllowReadOnly)
+	proxy.SetAllowFunc(NewExplainVerifier(proxy.Client()).Wrap(AllowReadOnly))
+
+	for body, want := range map[string]int{
+		`{"query": "FOR d IN c RETURN d"}`:        http.StatusCreated,
+		`{"query": "FOR d IN c RETURN WRITE(d)"}`: http.StatusForbidden,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/_api/cursor", strings.NewReader(body))
+		req.Header.Set("Authorization", "Basic dGVzdA==")
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("%s: status = %d, want %d (%s)", body, rec.Code, want, rec.Body.String())
+		}
+	}
+}
+
+func TestFindModificationNode(t *testing.T) {
+	tests := []struct {
+		plan    string
+		want    string
+		wantErr bool
+	}{
+		{`{"nodes": [{"type": "SingletonNode"}, {"type": "ReturnNode"}]}`, "", false},
+		{`{"nodes": [{"type": "UpsertNode"}]}`, "UpsertNode", false},
+		{`{"nodes": [{"type": "SubqueryNode", "subquery": {"nodes": [{"type": "UpdateNode"}]}}]}`, "UpdateNode", false},
+		{`{"nodes": [{"type": "SingletonNode"}, {"type": "SingleRemoteOperationNode", "mode": "UpdateNode"}]}`, "SingleRemoteOperationNode", false},
+		{`{"nodes": [{"type": "SingletonNode"}, {"type": "SingleRemoteOperationNode", "mode": "IndexNode"}]}`, "", false},
+		{`{"nodes": [{"type": "SingletonNode"}, {"type": "FutureNode"}, {"type": "ReturnNode"}]}`, "FutureNode", false},
+		{`{"nodes": []}`, "", true},
+		{`[]`, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.plan, func(t *testing.T) {
+			got, err := findModificationNode(json.RawMessage(tt.plan))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("findModificationNode() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("findModificationNode() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// LeaderEndpointHeader is set by a follower of an active failover
+	// deployment on the 503 it answers requests it does not serve with,
+	// naming the leader.
+	LeaderEndpointHeader = "X-Arango-Endpoint"
+	// DirtyReadHeader lets a follower of an active failover deployment
+	// serve a read, possibly behind the leader.
+	DirtyReadHeader = "X-Arango-Allow-Dirty-Read"
+
+	// clusterEndpointsPath lists the servers of a deployment, the leader
+	// first.
+	clusterEndpointsPath = "/_api/cluster/endpoints"
+	// leaderDiscoveryTimeout bounds asking one server for the leader.
+	leaderDiscoveryTimeout = 2 * time.Second
+)
+
+type dirtyReadKey struct{}
+
+// withDirtyRead marks a request as a read that a follower may serve.
+func withDirtyRead(ctx context.Context) context.Context {
+	return context.WithValue(ctx, dirtyReadKey{}, true)
+}
+
+func isDirtyRead(req *http.Request) bool {
+	dirty, _ := req.Context().Value(dirtyReadKey{}).(bool)
+	return dirty
+}
+
+// mayReadDirty reports whether r, admitted as decision, only reads data.
+// The data-read category alone is not enough: it covers cursors whatever
+// their query does.
+func mayReadDirty(r *http.Request, decision *Decision) bool {
+	if decision.Category != CategoryDataRead {
+		return false
+	}
+	return r.Method == http.MethodGet || r.Method == http.MethodHead || decision.readOnlyQuery
+}
+
+// leaderTracker knows which endpoint of an active failover deployment is
+// the leader. It asks the servers with GET /_api/cluster/endpoints when
+// the leader is unknown, and learns of a new leader from the
+// X-Arango-Endpoint header of a follower's 503.
+type leaderTracker struct {
+	targets []*upstreamTarget
+	current atomic.Pointer[upstreamTarget]
+
+	// mu serialises discovery; discoveredAt is when it last ran, so that
+	// servers refusing it are not asked on every request.
+	mu           sync.Mutex
+	discoveredAt time.Time
+	// unknown is the last advertised leader that matched no endpoint,
+	// logged once.
+	unknown string
+}
+
+func newLeaderTracker(targets []*upstreamTarget) *leaderTracker {
+	return &leaderTracker{targets: targets}
+}
+
+// get returns the leader, discovering it with the credentials of req if
+// it is unknown, or nil if discovery failed recently.
+func (l *leaderTracker) get(req *http.Request, now time.Time) *upstreamTarget {
+	if leader := l.current.Load(); leader != nil {
+		return leader
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if leader := l.current.Load(); leader != nil {
+		return leader
+	}
+	if now.Sub(l.discoveredAt) < failedEndpointBackoff {
+		return nil
+	}
+	l.discoveredAt = now
+	for _, target := range l.targets {
+		if leader := l.ask(req, target); leader != nil {
+			l.set(leader)
+			return leader
+		}
+	}
+	return nil
+}
+
+// ask requests the cluster endpoints from target. Servers requiring
+// authentication answer only if req carries credentials.
+func (l *leaderTracker) ask(req *http.Request, target *upstreamTarget) *upstreamTarget {
+	ctx, cancel := context.WithTimeout(req.Context(), leaderDiscoveryTimeout)
+	defer cancel()
+	discovery, err := http.NewRequestWithContext(ctx, http.MethodGet, upstreamBaseURL+clusterEndpointsPath, nil)
+	if err != nil {
+		return nil
+	}
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		discovery.Header.Set("Authorization", auth)
+	}
+	resp, err := target.transport.RoundTrip(discovery)
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		return l.lookup(resp.Header.Get(LeaderEndpointHeader))
+	}
+	var endpoints struct {
+		Endpoints []struct {
+			Endpoint string `json:"endpoint"`
+		} `json:"endpoints"`
+	}
+	if resp.StatusCode != http.StatusOK ||
+		json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&endpoints) != nil ||
+		len(endpoints.Endpoints) == 0 {
+		return nil
+	}
+	return l.lookup(endpoints.Endpoints[0].Endpoint)
+}
+
+// lookup returns the endpoint a server advertises as advertised, matching
+// its address whatever the scheme.
+func (l *leaderTracker) lookup(advertised string) *upstreamTarget {
+	if advertised == "" {
+		return nil
+	}
+	endpoint, err := ParseUpstreamEndpoint(advertised)
+	if err == nil {
+		for _, target := range l.targets {
+			if target.endpoint.Network == endpoint.Network && target.endpoint.Address == endpoint.Address {
+				return target
+			}
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.unknown != advertised {
+		l.unknown = advertised
+		log.Printf("warning: leader %s is not among the upstream endpoints", advertised)
+	}
+	return nil
+}
+
+// set makes target the leader.
+func (l *leaderTracker) set(target *upstreamTarget) {
+	if old := l.current.Swap(target); old != target {
+		log.Printf("upstream leader is %s", target.endpoint)
+	}
+}
+
+// lost forgets target as the leader after it could not be reached.
+func (l *leaderTracker) lost(target *upstreamTarget) {
+	l.current.CompareAndSwap(target, nil)
+}
+
+// leaderOrder returns the targets in the order to try them with
+// BalanceActiveFailover: the leader first, or for a dirty read the
+// reachable followers in turn and then the leader. Followers that recently
+// failed to connect come last.
+func (b *balancer) leaderOrder(req *http.Request) []*upstreamTarget {
+	leader := b.leader.get(req, b.now())
+	if leader == nil {
+		return b.order()
+	}
+	var followers, failed []*upstreamTarget
+	for _, target := range b.targets {
+		switch {
+		case target == leader:
+		case b.recentlyFailed(target):
+			failed = append(failed, target)
+		default:
+			followers = append(followers, target)
+		}
+	}
+	if !isDirtyRead(req) {
+		return slices.Concat([]*upstreamTarget{leader}, followers, failed)
+	}
+	if n := len(followers); n > 1 {
+		start := int(b.next.Add(1)-1) % n
+		followers = append(followers[start:], followers[:start]...)
+	}
+	return slices.Concat(followers, []*upstreamTarget{leader}, failed)
+}
+
+// followLeader handles a follower's refusal of req: it notes the leader
+// the follower names and, if the request can be sent again, retries it
+// there.
+func (b *balancer) followLeader(req *http.Request, target *upstreamTarget, resp *http.Response) (*upstreamTarget, *http.Response, error) {
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		return target, resp, nil
+	}
+	leader := b.leader.lookup(resp.Header.Get(LeaderEndpointHeader))
+	if leader == nil || leader == target {
+		return target, resp, nil
+	}
+	b.leader.set(leader)
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		// The follower consumed the body; the client has to retry.
+		return target, resp, nil
+	}
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return target, resp, nil
+		}
+		retry.Body = body
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	resp, err := b.send(leader, retry)
+	if err != nil {
+		if isDialError(err) {
+			leader.failedAt.Store(b.now().UnixNano())
+			b.leader.lost(leader)
+		}
+		return nil, nil, err
+	}
+	return leader, resp, nil
+}
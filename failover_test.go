@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeFailover is an active failover deployment of fake servers. The
+// leader serves every request; followers serve only requests marked as
+// dirty reads and refuse everything else with 503, naming the leader.
+type fakeFailover struct {
+	endpoints []string
+	// discovery, when set, is how servers answer /_api/cluster/endpoints
+	// instead of listing the endpoints.
+	discovery int
+
+	mu     sync.Mutex
+	leader int
+	served []*atomic.Int32
+	dirty  []*atomic.Int32
+	bodies []string
+}
+
+func startFailover(t *testing.T, n int) *fakeFailover {
+	t.Helper()
+	f := &fakeFailover{}
+	for i := range n {
+		f.served = append(f.served, &atomic.Int32{})
+		f.dirty = append(f.dirty, &atomic.Int32{})
+		f.endpoints = append(f.endpoints, "unix://"+startFakeUpstream(t, f.server(i)))
+	}
+	return f
+}
+
+func (f *fakeFailover) setLeader(i int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.leader = i
+}
+
+func (f *fakeFailover) server(i int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		f.mu.Lock()
+		leader := f.leader
+		f.mu.Unlock()
+		if r.URL.Path == clusterEndpointsPath {
+			if f.discovery != 0 {
+				w.WriteHeader(f.discovery)
+				return
+			}
+			fmt.Fprintf(w, `{"error":false,"code":200,"endpoints":[{"endpoint":"%s"}`, f.endpoints[leader])
+			for j, endpoint := range f.endpoints {
+				if j != leader {
+					fmt.Fprintf(w, `,{"endpoint":"%s"}`, endpoint)
+				}
+			}
+			fmt.Fprint(w, "]}")
+			return
+		}
+		dirty := r.Header.Get(DirtyReadHeader) == "true"
+		if i != leader && !dirty {
+			w.Header().Set(LeaderEndpointHeader, f.endpoints[leader])
+			http.Error(w, `{"error":true,"errorNum":1496}`, http.StatusServiceUnavailable)
+			return
+		}
+		f.served[i].Add(1)
+		if dirty {
+			f.dirty[i].Add(1)
+		}
+		f.mu.Lock()
+		f.bodies = append(f.bodies, string(body))
+		f.mu.Unlock()
+		fmt.Fprintf(w, "s%d", i)
+	})
+}
+
+func failoverClient(t *testing.T, endpoints []string) (*http.Client, *balancer) {
+	t.Helper()
+	return balancedClient(t, UpstreamSettings{Endpoints: endpoints, Balance: BalanceActiveFailover})
+}
+
+func TestFailover_DiscoversLeader(t *testing.T) {
+	f := startFailover(t, 3)
+	f.setLeader(2)
+	client, b := failoverClient(t, f.endpoints)
+	for range 4 {
+		if status, body := do(t, client, http.MethodPost, "/_api/document/docs", ""); status != http.StatusOK || body != "s2" {
+			t.Fatalf("response = %d %q, want s2", status, body)
+		}
+	}
+	if leader := b.leader.current.Load(); leader != b.targets[2] {
+		t.Errorf("leader = %v, want the third endpoint", leader)
+	}
+}
+
+func TestFailover_FollowsRedirect(t *testing.T) {
+	f := startFailover(t, 2)
+	f.discovery = http.StatusUnauthorized
+	f.setLeader(1)
+	client, b := failoverClient(t, f.endpoints)
+
+	// Discovery is refused, so the first request may reach the follower,
+	// which names the leader; the request is sent there with its body.
+	for range 3 {
+		if status, body := do(t, client, http.MethodPost, "/_api/document/docs", ""); status != http.StatusOK || body != "s1" {
+			t.Fatalf("response = %d %q, want s1", status, body)
+		}
+	}
+	for _, body := range f.bodies {
+		if body != "body" {
+			t.Errorf("leader received body %q, want %q", body, "body")
+		}
+	}
+
+	// The follower is promoted.
+	f.setLeader(0)
+	if status, body := do(t, client, http.MethodGet, "/_api/version", ""); status != http.StatusOK || body != "s0" {
+		t.Fatalf("after failover: %d %q, want s0", status, body)
+	}
+	if leader := b.leader.current.Load(); leader != b.targets[0] {
+		t.Errorf("leader = %v, want the first endpoint", leader)
+	}
+}
+
+func TestFailover_BodyNotReplayable(t *testing.T) {
+	f := startFailover(t, 2)
+	f.discovery = http.StatusUnauthorized
+	f.setLeader(1)
+	client, b := failoverClient(t, f.endpoints)
+	b.next.Store(0)
+
+	req, _ := http.NewRequest(http.MethodPost, upstreamBaseURL+"/_api/document/docs", io.NopCloser(strings.NewReader("body")))
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want the follower's 503 passed on", resp.StatusCode)
+	}
+	if leader := b.leader.current.Load(); leader != b.targets[1] {
+		t.Error("leader not learned from the refusal")
+	}
+}
+
+func TestFailover_LeaderDown(t *testing.T) {
+	f := startFailover(t, 2)
+	f.setLeader(1)
+	missing := "unix://" + t.TempDir() + "/down.sock"
+	client, b := failoverClient(t, []string{missing, f.endpoints[0], f.endpoints[1]})
+	b.leader.set(b.targets[0])
+
+	if status, body := do(t, client, http.MethodGet, "/_api/version", ""); status != http.StatusOK || body != "s1" {
+		t.Fatalf("response = %d %q, want s1", status, body)
+	}
+	if leader := b.leader.current.Load(); leader != b.targets[2] {
+		t.Errorf("leader = %v, want the last endpoint", leader)
+	}
+}
+
+func TestFailover_DirtyReads(t *testing.T) {
+	tests := []struct {
+		name       string
+		dirtyReads bool
+	}{
+		{name: "read-write listener", dirtyReads: false},
+		{name: "dirty reads", dirtyReads: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			f := startFailover(t, 3)
+			proxy := proxyTo(t, UpstreamSettings{Endpoints: f.endpoints, Balance: BalanceActiveFailover, DialTimeout: time.Second})
+			proxy.SetAllowFunc(AllowReadWrite)
+			proxy.SetDirtyReads(tc.dirtyReads)
+
+			for range 4 {
+				rec := httptest.NewRecorder()
+				req := httptest.NewRequest(http.MethodGet, "/_api/document/docs/1", nil)
+				// A client asking for dirty reads itself is not enough.
+				req.Header.Set(DirtyReadHeader, "true")
+				proxy.ServeHTTP(rec, req)
+				if rec.Code != http.StatusOK {
+					t.Fatalf("read: %d %s", rec.Code, rec.Body.String())
+				}
+			}
+			rec := httptest.NewRecorder()
+			proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/_api/document/docs", strings.NewReader(`{"a":1}`)))
+			if rec.Code != http.StatusOK || rec.Body.String() != "s0" {
+				t.Errorf("write: %d %q, want it sent to the leader s0", rec.Code, rec.Body.String())
+			}
+
+			followerReads := f.served[1].Load() + f.served[2].Load()
+			switch {
+			case tc.dirtyReads && (f.dirty[1].Load() != 2 || f.dirty[2].Load() != 2):
+				t.Errorf("followers served %d and %d dirty reads, want 2 each", f.dirty[1].Load(), f.dirty[2].Load())
+			case !tc.dirtyReads && followerReads != 0:
+				t.Errorf("followers served %d reads without dirty reads enabled", followerReads)
+			}
+		})
+	}
+}
+
+func TestFailover_DirtyReadCursors(t *testing.T) {
+	tests := []struct {
+		name   string
+		allow  AllowFunc
+		query  string
+		leader bool
+	}{
+		{name: "checked read", allow: AllowReadOnly, query: "FOR d IN docs RETURN d"},
+		{name: "unchecked read", allow: AllowReadWrite, query: "FOR d IN docs RETURN d", leader: true},
+		{name: "write", allow: AllowReadWrite, query: "FOR d IN docs UPDATE d WITH {seen: true} IN docs", leader: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			f := startFailover(t, 2)
+			proxy := proxyTo(t, UpstreamSettings{Endpoints: f.endpoints, Balance: BalanceActiveFailover, DialTimeout: time.Second})
+			proxy.SetAllowFunc(tc.allow)
+			proxy.SetDirtyReads(true)
+
+			rec := httptest.NewRecorder()
+			body := fmt.Sprintf(`{"query": %q}`, tc.query)
+			proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/_api/cursor", strings.NewReader(body)))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("cursor: %d %s", rec.Code, rec.Body.String())
+			}
+			want := "s1"
+			if tc.leader {
+				want = "s0"
+			}
+			if rec.Body.String() != want {
+				t.Errorf("cursor served by %s, want %s", rec.Body.String(), want)
+			}
+			if tc.leader && f.dirty[0].Load()+f.dirty[1].Load() != 0 {
+				t.Errorf("cursor sent as a dirty read")
+			}
+		})
+	}
+}
@@ -4,6 +4,9 @@ go 1.23.0
 
 toolchain go1.23.4
 
-require golang.org/x/net v0.41.0
+require (
+	golang.org/x/net v0.41.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require golang.org/x/text v0.26.0 // indirect
@@ -0,0 +1,311 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Health check defaults.
+const (
+	DefaultHealthCheckPath     = "/_api/version"
+	DefaultHealthCheckInterval = 5 * time.Second
+	DefaultHealthCheckTimeout  = 2 * time.Second
+	DefaultHealthCheckFailures = 3
+)
+
+// HealthCheckSettings configure the upstream health check and the circuit
+// breaker it drives.
+type HealthCheckSettings struct {
+	// Path is requested with GET, e.g. /_api/version or
+	// /_admin/server/availability. Any response below 500 counts as
+	// healthy: without credentials /_api/version answers 401 on servers
+	// requiring authentication, and /_admin/server/availability answers
+	// 503 while the server cannot serve requests.
+	Path string
+	// Interval is the time between checks. Zero disables checking and the
+	// circuit breaker.
+	Interval time.Duration
+	// Timeout bounds each check.
+	Timeout time.Duration
+	// Failures is the number of consecutive failed checks or upstream
+	// connection errors that open the circuit.
+	Failures int
+}
+
+// DefaultHealthCheckSettings returns the settings used unless configured
+// otherwise.
+func DefaultHealthCheckSettings() HealthCheckSettings {
+	return HealthCheckSettings{
+		Path:     DefaultHealthCheckPath,
+		Interval: DefaultHealthCheckInterval,
+		Timeout:  DefaultHealthCheckTimeout,
+		Failures: DefaultHealthCheckFailures,
+	}
+}
+
+// HealthCheckSettingsFromEnv reads HEALTH_CHECK_PATH,
+// HEALTH_CHECK_INTERVAL_SECONDS (0 disables checking),
+// HEALTH_CHECK_TIMEOUT_SECONDS and HEALTH_CHECK_FAILURES.
+func HealthCheckSettingsFromEnv() (HealthCheckSettings, error) {
+	settings := DefaultHealthCheckSettings()
+	settings.Path = GetEnv("HEALTH_CHECK_PATH", settings.Path)
+	var err error
+	if settings.Interval, err = secondsFromEnv("HEALTH_CHECK_INTERVAL_SECONDS", settings.Interval); err != nil {
+		return settings, err
+	}
+	if settings.Timeout, err = secondsFromEnv("HEALTH_CHECK_TIMEOUT_SECONDS", settings.Timeout); err != nil {
+		return settings, err
+	}
+	if value := os.Getenv("HEALTH_CHECK_FAILURES"); value != "" {
+		if settings.Failures, err = strconv.Atoi(value); err != nil || settings.Failures < 1 {
+			return settings, fmt.Errorf("invalid HEALTH_CHECK_FAILURES %q: must be a positive integer", value)
+		}
+	}
+	return settings, nil
+}
+
+// secondsFromEnv reads a non-negative number of seconds from the variable
+// name.
+func secondsFromEnv(name string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be a non-negative integer", name, value)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// validate checks enabled settings.
+func (h HealthCheckSettings) validate() error {
+	switch {
+	case h.Interval == 0:
+		return nil
+	case h.Interval < 0:
+		return errors.New("health check interval must not be negative")
+	case !strings.HasPrefix(h.Path, "/"):
+		return fmt.Errorf("health check path %q must start with /", h.Path)
+	case h.Timeout <= 0:
+		return errors.New("health check timeout must be positive")
+	case h.Failures < 1:
+		return errors.New("health check failures must be at least 1")
+	}
+	return nil
+}
+
+// String describes the settings for logs.
+func (h HealthCheckSettings) String() string {
+	if h.Interval == 0 {
+		return "disabled"
+	}
+	return fmt.Sprintf("GET %s every %s, timeout %s, circuit opens after %d failures", h.Path, h.Interval, h.Timeout, h.Failures)
+}
+
+// HealthChecker checks the upstream in the background and opens a circuit
+// while it is down, so that requests fail fast with 503 and Retry-After
+// instead of each waiting for the dial timeout. Connection errors of
+// proxied requests count as failed checks; only a successful check closes
+// the circuit again. It is safe for concurrent use.
+type HealthChecker struct {
+	open    atomic.Bool
+	updates chan struct{}
+	// logger receives state changes; nil means log.Default().
+	logger *log.Logger
+
+	mu       sync.Mutex
+	settings HealthCheckSettings
+	client   *http.Client
+	// generation counts SetUpstream calls, so that a check of a replaced
+	// upstream is ignored.
+	generation uint64
+	checked    bool
+	failures   int
+	lastErr    error
+}
+
+// NewHealthChecker returns a checker of the upstream reached through
+// client. It does not check until Run is called.
+func NewHealthChecker(settings HealthCheckSettings, client *http.Client) *HealthChecker {
+	return &HealthChecker{settings: settings, client: client, updates: make(chan struct{}, 1)}
+}
+
+// SetUpstream replaces the settings and the client, e.g. after a reload,
+// and checks the new upstream at once. The circuit is closed until then.
+func (h *HealthChecker) SetUpstream(settings HealthCheckSettings, client *http.Client) {
+	h.mu.Lock()
+	h.settings, h.client = settings, client
+	h.generation++
+	h.checked, h.failures, h.lastErr = false, 0, nil
+	h.open.Store(false)
+	h.mu.Unlock()
+	select {
+	case h.updates <- struct{}{}:
+	default:
+	}
+}
+
+// Run checks the upstream until ctx is cancelled.
+func (h *HealthChecker) Run(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-h.updates:
+		case <-timer.C:
+		}
+		h.mu.Lock()
+		settings, client, generation := h.settings, h.client, h.generation
+		h.mu.Unlock()
+		if settings.Interval == 0 {
+			timer.Stop()
+			continue
+		}
+		err := h.check(ctx, settings, client)
+		if ctx.Err() != nil {
+			return
+		}
+		h.record(generation, err)
+		timer.Reset(settings.Interval)
+	}
+}
+
+// check requests the health check path once.
+func (h *HealthChecker) check(ctx context.Context, settings HealthCheckSettings, client *http.Client) error {
+	ctx, cancel := context.WithTimeout(ctx, settings.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, upstreamBaseURL+settings.Path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("GET %s: %s", settings.Path, resp.Status)
+	}
+	return nil
+}
+
+// record updates the circuit with the result of a check.
+func (h *HealthChecker) record(generation uint64, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if generation != h.generation {
+		return
+	}
+	h.checked = true
+	if err != nil {
+		h.fail(err)
+		return
+	}
+	h.failures, h.lastErr = 0, nil
+	if h.open.Swap(false) {
+		h.logf("upstream is back up, closing the circuit")
+	}
+}
+
+// fail counts a failure, opening the circuit once there are enough in a
+// row. h.mu must be held.
+func (h *HealthChecker) fail(err error) {
+	h.failures++
+	h.lastErr = err
+	if h.failures >= h.settings.Failures && !h.open.Load() {
+		h.open.Store(true)
+		h.logf("upstream down after %d failures, failing requests fast: %v", h.failures, err)
+	}
+}
+
+// observe counts the error of a request proxied with client if it failed
+// to connect to the upstream.
+func (h *HealthChecker) observe(client *http.Client, err error) {
+	if h == nil || !isDialError(err) {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.settings.Interval == 0 || client != h.client {
+		return
+	}
+	h.fail(err)
+}
+
+// isDialError reports whether err is a failure to connect, which happens
+// before any of a request is sent.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// retryAfter returns, while the circuit is open, how long clients should
+// wait before retrying.
+func (h *HealthChecker) retryAfter() (time.Duration, bool) {
+	if h == nil || !h.open.Load() {
+		return 0, false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.settings.Interval, true
+}
+
+// Ready returns nil once the upstream has been checked and while its
+// circuit is closed, or if health checking is disabled, and the reason the
+// proxy is not ready otherwise.
+func (h *HealthChecker) Ready() error {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch {
+	case h.settings.Interval == 0:
+		return nil
+	case h.open.Load():
+		return fmt.Errorf("upstream unavailable: %v", h.lastErr)
+	case !h.checked:
+		return errors.New("upstream not checked yet")
+	}
+	return nil
+}
+
+// ServeHTTP answers readiness probes: 200 when Ready returns nil, 503 with
+// the reason otherwise.
+func (h *HealthChecker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := h.Ready(); err != nil {
+		http.Error(w, "not ready: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = io.WriteString(w, "ready\n")
+}
+
+// logf logs to the checker's logger.
+func (h *HealthChecker) logf(format string, args ...any) {
+	logger := h.logger
+	if logger == nil {
+		logger = log.Default()
+	}
+	logger.Printf(format, args...)
+}
+
+// retryAfterSeconds formats d for the Retry-After header.
+func retryAfterSeconds(d time.Duration) string {
+	return strconv.Itoa(max(1, int(math.Ceil(d.Seconds()))))
+}
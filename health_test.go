@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthCheckSettingsFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    HealthCheckSettings
+		wantErr bool
+	}{
+		{name: "defaults", want: DefaultHealthCheckSettings()},
+		{
+			name: "configured",
+			env: map[string]string{
+				"HEALTH_CHECK_PATH":             "/_admin/server/availability",
+				"HEALTH_CHECK_INTERVAL_SECONDS": "10",
+				"HEALTH_CHECK_TIMEOUT_SECONDS":  "1",
+				"HEALTH_CHECK_FAILURES":         "5",
+			},
+			want: HealthCheckSettings{Path: "/_admin/server/availability", Interval: 10 * time.Second, Timeout: time.Second, Failures: 5},
+		},
+		{
+			name: "disabled",
+			env:  map[string]string{"HEALTH_CHECK_INTERVAL_SECONDS": "0"},
+			want: HealthCheckSettings{Path: DefaultHealthCheckPath, Timeout: DefaultHealthCheckTimeout, Failures: DefaultHealthCheckFailures},
+		},
+		{name: "bad interval", env: map[string]string{"HEALTH_CHECK_INTERVAL_SECONDS": "-1"}, wantErr: true},
+		{name: "bad timeout", env: map[string]string{"HEALTH_CHECK_TIMEOUT_SECONDS": "2s"}, wantErr: true},
+		{name: "bad failures", env: map[string]string{"HEALTH_CHECK_FAILURES": "0"}, wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, name := range []string{"HEALTH_CHECK_PATH", "HEALTH_CHECK_INTERVAL_SECONDS", "HEALTH_CHECK_TIMEOUT_SECONDS", "HEALTH_CHECK_FAILURES"} {
+				t.Setenv(name, tc.env[name])
+			}
+			got, err := HealthCheckSettingsFromEnv()
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("HealthCheckSettingsFromEnv() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if !tc.wantErr && got != tc.want {
+				t.Errorf("HealthCheckSettingsFromEnv() = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHealthCheckSettings_Validate(t *testing.T) {
+	valid := DefaultHealthCheckSettings()
+	tests := []struct {
+		name    string
+		change  func(*HealthCheckSettings)
+		wantErr bool
+	}{
+		{name: "defaults", change: func(*HealthCheckSettings) {}},
+		{name: "disabled ignores the rest", change: func(h *HealthCheckSettings) { *h = HealthCheckSettings{} }},
+		{name: "relative path", change: func(h *HealthCheckSettings) { h.Path = "_api/version" }, wantErr: true},
+		{name: "no timeout", change: func(h *HealthCheckSettings) { h.Timeout = 0 }, wantErr: true},
+		{name: "no failures", change: func(h *HealthCheckSettings) { h.Failures = 0 }, wantErr: true},
+		{name: "negative interval", change: func(h *HealthCheckSettings) { h.Interval = -time.Second }, wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			settings := valid
+			tc.change(&settings)
+			if err := settings.validate(); (err != nil) != tc.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// waitFor polls cond until it holds or a second has passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHealthChecker_Circuit(t *testing.T) {
+	var down atomic.Bool
+	var forwarded atomic.Int32
+	socket := startFakeUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_admin/server/availability" {
+			if down.Load() {
+				http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			}
+			return
+		}
+		forwarded.Add(1)
+	}))
+	proxy := NewUnixReverseProxy(socket, AllowReadOnly)
+	health := NewHealthChecker(HealthCheckSettings{
+		Path:     "/_admin/server/availability",
+		Interval: 10 * time.Millisecond,
+		Timeout:  time.Second,
+		Failures: 2,
+	}, proxy.Client())
+	proxy.SetHealthChecker(health)
+	if err := health.Ready(); err == nil || !strings.Contains(err.Error(), "not checked") {
+		t.Errorf("Ready() before the first check = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go health.Run(ctx)
+
+	get := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/_api/version", nil))
+		return rec
+	}
+	waitFor(t, "ready", func() bool { return health.Ready() == nil })
+	if rec := get(); rec.Code != http.StatusOK {
+		t.Fatalf("healthy upstream: status = %d", rec.Code)
+	}
+
+	down.Store(true)
+	waitFor(t, "circuit to open", func() bool { return health.Ready() != nil })
+	rec := get()
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "1" {
+		t.Errorf("open circuit: status = %d, Retry-After = %q, want 503 and 1", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if n := forwarded.Load(); n != 1 {
+		t.Errorf("forwarded %d requests, want 1: the open circuit must not forward", n)
+	}
+	if err := health.Ready(); !strings.Contains(err.Error(), "503") {
+		t.Errorf("Ready() = %v, want the failed check", err)
+	}
+
+	down.Store(false)
+	waitFor(t, "circuit to close", func() bool { return health.Ready() == nil })
+	if rec := get(); rec.Code != http.StatusOK {
+		t.Errorf("recovered upstream: status = %d", rec.Code)
+	}
+}
+
+func TestHealthChecker_ConnectionErrors(t *testing.T) {
+	proxy := NewUnixReverseProxy(filepath.Join(t.TempDir(), "missing.sock"), AllowReadOnly)
+	metrics := NewMetrics()
+	proxy.SetMetrics(metrics)
+	// Not running: only the proxied requests' errors count.
+	health := NewHealthChecker(HealthCheckSettings{
+		Path:     DefaultHealthCheckPath,
+		Interval: 3 * time.Second,
+		Timeout:  time.Second,
+		Failures: 2,
+	}, proxy.Client())
+	proxy.SetHealthChecker(health)
+
+	var codes []int
+	for range 3 {
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/_api/version", nil))
+		codes = append(codes, rec.Code)
+		if rec.Code == http.StatusServiceUnavailable && rec.Header().Get("Retry-After") != "3" {
+			t.Errorf("Retry-After = %q, want 3", rec.Header().Get("Retry-After"))
+		}
+	}
+	if want := []int{502, 502, 503}; codes[0] != want[0] || codes[1] != want[1] || codes[2] != want[2] {
+		t.Errorf("statuses = %v, want %v", codes, want)
+	}
+	var out strings.Builder
+	metrics.WriteTo(&out)
+	if !strings.Contains(out.String(), "arango_proxy_upstream_unavailable_total{listener=\"\"} 1\n") {
+		t.Errorf("metrics missing the fast-failed request:\n%s", out.String())
+	}
+
+	// A new upstream starts with a closed circuit.
+	health.SetUpstream(DefaultHealthCheckSettings(), proxy.Client())
+	if _, open := health.retryAfter(); open {
+		t.Error("circuit still open after SetUpstream")
+	}
+}
+
+func TestHealthChecker_Disabled(t *testing.T) {
+	proxy := NewUnixReverseProxy(filepath.Join(t.TempDir(), "missing.sock"), AllowReadOnly)
+	health := NewHealthChecker(HealthCheckSettings{}, proxy.Client())
+	proxy.SetHealthChecker(health)
+	for range 5 {
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/_api/version", nil))
+		if rec.Code != http.StatusBadGateway {
+			t.Fatalf("status = %d, want 502", rec.Code)
+		}
+	}
+	if err := health.Ready(); err != nil {
+		t.Errorf("Ready() = %v, want nil when disabled", err)
+	}
+}
@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// importSniffLimit is how much of an import body is read to tell JSONL
+// documents from a JSON list when the import type is "auto".
+const importSniffLimit = 4 * 1024
+
+// ImportRule inspects the documents of an /_api/import request line by line
+// as the body streams to ArangoDB, so imports of any size can be checked
+// without buffering them. JSONL imports (type=documents, or type=auto with
+// an object on the first line) are checked document by document; for the
+// header-and-values format (no type) the header line names the attributes.
+// A JSON list (type=list) cannot be split into lines and is rejected.
+type ImportRule struct {
+	// DenyAttributes rejects imports setting any of these top-level
+	// attributes, e.g. _key to stop clients choosing document keys.
+	DenyAttributes []string `json:"deny_attributes,omitempty" yaml:"deny_attributes,omitempty"`
+	// MaxLineBytes bounds the length of a line, and so the memory used to
+	// inspect it. Defaults to MaxBodyPeekSize.
+	MaxLineBytes int64 `json:"max_line_bytes,omitempty" yaml:"max_line_bytes,omitempty"`
+}
+
+type compiledImportRule struct {
+	denied  map[string]struct{}
+	maxLine int64
+}
+
+func compileImportRule(rule *ImportRule) (*compiledImportRule, error) {
+	compiled := &compiledImportRule{
+		denied:  make(map[string]struct{}, len(rule.DenyAttributes)),
+		maxLine: rule.MaxLineBytes,
+	}
+	if compiled.maxLine <= 0 {
+		compiled.maxLine = MaxBodyPeekSize
+	}
+	if compiled.maxLine > MaxBodyPeekSize {
+		return nil, fmt.Errorf("max_line_bytes %d exceeds %d", compiled.maxLine, MaxBodyPeekSize)
+	}
+	for _, attribute := range rule.DenyAttributes {
+		compiled.denied[attribute] = struct{}{}
+	}
+	return compiled, nil
+}
+
+// check arranges for the import body to be inspected. Through the proxy
+// the lines are checked as they are forwarded; elsewhere (for example when
+// an AllowFunc is called directly) the body is peeked and checked at once.
+func (c *compiledImportRule) check(r *http.Request, peek BodyPeeker) error {
+	types := r.URL.Query()["type"]
+	if len(types) > 1 {
+		return fmt.Errorf("ambiguous request: multiple %q parameters", "type")
+	}
+	importType := ""
+	if len(types) == 1 {
+		importType = types[0]
+	}
+
+	body, streaming := RequestBodyFromContext(r.Context())
+	if importType == "auto" {
+		var prefix []byte
+		var err error
+		if streaming {
+			prefix, err = body.Prefix(importSniffLimit)
+		} else {
+			prefix, err = peek(MaxBodyPeekSize)
+		}
+		if err != nil {
+			return err
+		}
+		trimmed := bytes.TrimLeft(prefix, " \t\r\n")
+		if len(trimmed) == 0 || trimmed[0] != '{' {
+			return fmt.Errorf("import of type auto must be JSONL documents to be inspected")
+		}
+		importType = "documents"
+	}
+
+	var check func(line []byte) error
+	switch importType {
+	case "documents":
+		check = c.checkDocument
+	case "":
+		check = c.headerChecker()
+	default:
+		return fmt.Errorf("import type %q cannot be inspected line by line", importType)
+	}
+
+	if streaming {
+		body.CheckLines(c.maxLine, check)
+		return nil
+	}
+	data, err := peek(MaxBodyPeekSize)
+	if err != nil {
+		return err
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if int64(len(line)) > c.maxLine {
+			return fmt.Errorf("%w (%d bytes)", errLineTooLong, c.maxLine)
+		}
+		if err := check(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkDocument checks one JSONL document.
+func (c *compiledImportRule) checkDocument(line []byte) error {
+	if len(bytes.TrimSpace(line)) == 0 {
+		return nil
+	}
+	keys, err := topLevelKeys(line)
+	if err != nil {
+		return fmt.Errorf("invalid import document: %w", err)
+	}
+	return c.checkAttributes(keys)
+}
+
+// headerChecker returns a check for the header-and-values format: the
+// first non-empty line is an array of attribute names; the values that
+// follow are left to ArangoDB.
+func (c *compiledImportRule) headerChecker() func(line []byte) error {
+	seenHeader := false
+	return func(line []byte) error {
+		if seenHeader || len(bytes.TrimSpace(line)) == 0 {
+			return nil
+		}
+		seenHeader = true
+		var names []string
+		if err := json.Unmarshal(line, &names); err != nil {
+			return fmt.Errorf("invalid import header: %w", err)
+		}
+		return c.checkAttributes(names)
+	}
+}
+
+func (c *compiledImportRule) checkAttributes(names []string) error {
+	for _, name := range names {
+		if _, ok := c.denied[name]; ok {
+			return fmt.Errorf("import sets denied attribute %q", name)
+		}
+	}
+	return nil
+}
+
+// topLevelKeys returns every top-level key of a JSON object, including
+// repeated ones, so a denied attribute cannot hide behind a duplicate.
+func topLevelKeys(data []byte) ([]string, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, fmt.Errorf("not a JSON object")
+	}
+	var keys []string
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, _ := tok.(string)
+		keys = append(keys, key)
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("trailing data after object")
+	}
+	return keys, nil
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPolicy_ImportRule(t *testing.T) {
+	allow := mustCompilePolicy(t, `{"rules": [
+		{"methods": ["POST"], "paths": ["/_api/import"], "import": {"deny_attributes": ["_key", "owner"], "max_line_bytes": 64}}
+	]}`, "json")
+
+	tests := []struct {
+		name  string
+		query string
+		body  string
+		allow bool
+	}{
+		{"documents", "type=documents", "{\"a\": 1}\n{\"b\": {\"_key\": 1}}\n", true},
+		{"documents crlf", "type=documents", "{\"a\": 1}\r\n\r\n{\"b\": 2}", true},
+		{"denied attribute", "type=documents", "{\"a\": 1}\n{\"_key\": \"x\"}\n", false},
+		{"duplicate hides denied attribute", "type=documents", `{"owner": "me", "owner": "me"}`, false},
+		{"not an object", "type=documents", "[1, 2]\n", false},
+		{"line too long", "type=documents", `{"a": "` + strings.Repeat("x", 80) + `"}`, false},
+		{"auto documents", "type=auto", " {\"a\": 1}\n", true},
+		{"auto list", "type=auto", "[{\"a\": 1}]", false},
+		{"list", "type=list", "[{\"a\": 1}]", false},
+		{"header", "", "[\"a\", \"b\"]\n[1, 2]\n[\"_key\", 3]\n", true},
+		{"denied header", "", "[\"_key\", \"b\"]\n[1, 2]\n", false},
+		{"ambiguous type", "type=list&type=documents", "{}", false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/_api/import?collection=c&"+tc.query, nil)
+			err := allow(req, mockBodyPeeker(tc.body))
+			if tc.allow && err != nil {
+				t.Errorf("should be allowed, got error: %v", err)
+			}
+			if !tc.allow && err == nil {
+				t.Error("should be denied")
+			}
+		})
+	}
+}
+
+func TestTopLevelKeys(t *testing.T) {
+	keys, err := topLevelKeys([]byte(`{"a": {"b": 1}, "c": [1, {"d": 2}], "a": null}`))
+	if err != nil {
+		t.Fatalf("topLevelKeys() error = %v", err)
+	}
+	if want := []string{"a", "c", "a"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("topLevelKeys() = %q, want %q", keys, want)
+	}
+	for _, bad := range []string{`[]`, `{"a": 1`, `{"a": 1} {"b": 2}`, `"x"`} {
+		if _, err := topLevelKeys([]byte(bad)); err == nil {
+			t.Errorf("topLevelKeys(%s) should fail", bad)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package proxy
+
+// maxScannedValue bounds the length of a value a jsonFieldScanner returns.
+const maxScannedValue = 256
+
+// jsonFieldScanner finds the value of one field of a JSON document, such
+// as the id of a cursor after its first batch of results, while the
+// document streams past, without buffering or decoding the rest of it.
+// It assumes well-formed JSON; on anything else it may miss the field but
+// never fails.
+type jsonFieldScanner struct {
+	// path are the keys leading to the field, e.g. ["result", "id"].
+	path []string
+	// found is called once with the field's value: a string's contents
+	// without quotes, or a number or literal as written.
+	found func(value string)
+	done  bool
+
+	stack             []scanFrame
+	inString, escaped bool
+	inScalar          bool
+	// isKey is set while scanning an object key; capture while the string
+	// or scalar being scanned is kept in buf.
+	isKey   bool
+	capture bool
+	buf     []byte
+}
+
+// scanFrame is an object or array enclosing the scanned position.
+type scanFrame struct {
+	object bool
+	// expectKey is set in an object where the next string is a key; key is
+	// the last key, kept only at depths within the path.
+	expectKey bool
+	key       string
+}
+
+func newJSONFieldScanner(found func(value string), path ...string) *jsonFieldScanner {
+	return &jsonFieldScanner{path: path, found: found}
+}
+
+// Write scans p. It never fails.
+func (s *jsonFieldScanner) Write(p []byte) (int, error) {
+	for _, c := range p {
+		if s.done {
+			break
+		}
+		s.scan(c)
+	}
+	return len(p), nil
+}
+
+func (s *jsonFieldScanner) scan(c byte) {
+	if s.inString {
+		switch {
+		case s.escaped:
+			s.escaped = false
+		case c == '\\':
+			s.escaped = true
+		case c == '"':
+			s.inString = false
+			s.endString()
+			return
+		}
+		s.keep(c)
+		return
+	}
+	if s.inScalar {
+		if isScalarByte(c) {
+			s.keep(c)
+			return
+		}
+		s.inScalar = false
+		if s.capture {
+			s.finish()
+			return
+		}
+	}
+	switch c {
+	case '{', '[':
+		s.stack = append(s.stack, scanFrame{object: c == '{', expectKey: c == '{'})
+	case '}', ']':
+		if len(s.stack) <= 1 {
+			s.done = true
+			return
+		}
+		s.stack = s.stack[:len(s.stack)-1]
+	case ',':
+		if top := s.top(); top != nil && top.object {
+			top.expectKey = true
+		}
+	case '"':
+		s.inString = true
+		if top := s.top(); top != nil && top.object && top.expectKey {
+			s.isKey = true
+			s.capture = len(s.stack) <= len(s.path)
+		} else {
+			s.isKey = false
+			s.capture = s.atPath()
+		}
+		s.buf = s.buf[:0]
+	case ' ', '\t', '\n', '\r', ':':
+	default:
+		s.inScalar = true
+		s.capture = s.atPath()
+		s.buf = s.buf[:0]
+		s.keep(c)
+	}
+}
+
+func (s *jsonFieldScanner) keep(c byte) {
+	if s.capture && len(s.buf) < maxScannedValue {
+		s.buf = append(s.buf, c)
+	}
+}
+
+func (s *jsonFieldScanner) endString() {
+	if !s.isKey {
+		if s.capture {
+			s.finish()
+		}
+		return
+	}
+	top := s.top()
+	top.expectKey = false
+	top.key = ""
+	if s.capture {
+		top.key = string(s.buf)
+	}
+}
+
+func (s *jsonFieldScanner) finish() {
+	s.done = true
+	s.found(string(s.buf))
+}
+
+func (s *jsonFieldScanner) top() *scanFrame {
+	if len(s.stack) == 0 {
+		return nil
+	}
+	return &s.stack[len(s.stack)-1]
+}
+
+// atPath reports whether the next value is the field.
+func (s *jsonFieldScanner) atPath() bool {
+	if len(s.stack) != len(s.path) {
+		return false
+	}
+	for i, frame := range s.stack {
+		if !frame.object || frame.expectKey || frame.key != s.path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func isScalarByte(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '-' || c == '+' || c == '.'
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestJSONFieldScanner(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		path []string
+		want string
+		ok   bool
+	}{
+		{
+			name: "cursor id after results",
+			doc:  `{"result":[{"id":"a","_key":"1"},{"nested":{"id":"b"}},"id",1.5e3,null],"hasMore":true,"id":"12345","count":4}`,
+			path: []string{"id"},
+			want: "12345",
+			ok:   true,
+		},
+		{
+			name: "keys inside strings",
+			doc:  `{"result":["\"id\":\"x\"", "\\"], "id" : "67"}`,
+			path: []string{"id"},
+			want: "67",
+			ok:   true,
+		},
+		{
+			name: "literal",
+			doc:  "{\n  \"result\": [],\n  \"hasMore\": false\n}",
+			path: []string{"hasMore"},
+			want: "false",
+			ok:   true,
+		},
+		{
+			name: "nested",
+			doc:  `{"code":201,"result":{"id":"987","status":"running"}}`,
+			path: []string{"result", "id"},
+			want: "987",
+			ok:   true,
+		},
+		{
+			name: "numeric id",
+			doc:  `{"id":42}`,
+			path: []string{"id"},
+			want: "42",
+			ok:   true,
+		},
+		{
+			name: "not an object",
+			doc:  `{"result":["id"],"id":{"x":1}}`,
+			path: []string{"id"},
+		},
+		{
+			name: "missing",
+			doc:  `{"result":[{"id":"1"}],"hasMore":false}`,
+			path: []string{"id"},
+		},
+		{
+			name: "nested key at top level",
+			doc:  `{"id":"1","result":[]}`,
+			path: []string{"result", "id"},
+		},
+	}
+	for _, tc := range tests {
+		for _, chunk := range []int{1, 7, len(tc.doc)} {
+			var got []string
+			scanner := newJSONFieldScanner(func(value string) { got = append(got, value) }, tc.path...)
+			for doc := tc.doc; doc != ""; {
+				n := min(chunk, len(doc))
+				scanner.Write([]byte(doc[:n]))
+				doc = doc[n:]
+			}
+			if tc.ok && (len(got) != 1 || got[0] != tc.want) {
+				t.Errorf("%s (chunks of %d): found %q, want %q", tc.name, chunk, got, tc.want)
+			}
+			if !tc.ok && len(got) != 0 {
+				t.Errorf("%s (chunks of %d): found %q, want nothing", tc.name, chunk, got)
+			}
+		}
+	}
+}
+
+func TestJSONFieldScanner_LongValue(t *testing.T) {
+	var got string
+	scanner := newJSONFieldScanner(func(value string) { got = value }, "id")
+	scanner.Write([]byte(`{"id":"` + strings.Repeat("9", 1000) + `"}`))
+	if len(got) != maxScannedValue {
+		t.Errorf("value of length %d, want it cut at %d", len(got), maxScannedValue)
+	}
+}
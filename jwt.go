@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+const (
+	// mintedTokenLifetime is how long a token minted by the proxy is
+	// valid.
+	mintedTokenLifetime = 10 * time.Minute
+	// mintedTokenRenewal is how long before it expires a token is
+	// replaced, so that a request never carries one about to expire.
+	mintedTokenRenewal = time.Minute
+
+	// jwtIssuer is the issuer ArangoDB requires.
+	jwtIssuer = "arangodb"
+	// jwtServerID names the proxy in superuser tokens.
+	jwtServerID = "arango-proxy"
+)
+
+// jwtHeader is the encoded header of every minted token.
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// jwtClaims are the claims ArangoDB reads from a token. A token with a
+// server_id is a superuser token; one with a preferred_username
+// authenticates as that user.
+type jwtClaims struct {
+	Issuer            string `json:"iss"`
+	ServerID          string `json:"server_id,omitempty"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+	IssuedAt          int64  `json:"iat"`
+	Expires           int64  `json:"exp"`
+}
+
+// signJWT returns claims as a JSON Web Token signed with secret using
+// HS256, as ArangoDB verifies tokens with its JWT secret.
+func signJWT(secret []byte, claims jwtClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// tokenMinter mints tokens for users, or superuser tokens, and reuses each
+// until shortly before it expires. It is safe for concurrent use.
+type tokenMinter struct {
+	secret []byte
+	now    func() time.Time
+
+	mu     sync.Mutex
+	tokens map[string]mintedToken
+}
+
+type mintedToken struct {
+	token   string
+	expires time.Time
+}
+
+func newTokenMinter(secret []byte) *tokenMinter {
+	return &tokenMinter{secret: secret, now: time.Now, tokens: make(map[string]mintedToken)}
+}
+
+// token returns a valid token for username, the preferred_username of the
+// token; empty means a superuser token.
+func (m *tokenMinter) token(username string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	if cached, ok := m.tokens[username]; ok && now.Before(cached.expires.Add(-mintedTokenRenewal)) {
+		return cached.token, nil
+	}
+	claims := jwtClaims{
+		Issuer:   jwtIssuer,
+		IssuedAt: now.Unix(),
+		Expires:  now.Add(mintedTokenLifetime).Unix(),
+	}
+	if username == "" {
+		claims.ServerID = jwtServerID
+	} else {
+		claims.PreferredUsername = username
+	}
+	token, err := signJWT(m.secret, claims)
+	if err != nil {
+		return "", err
+	}
+	m.tokens[username] = mintedToken{token: token, expires: now.Add(mintedTokenLifetime)}
+	return token, nil
+}
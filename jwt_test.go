@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// verifyJWT checks token's HS256 signature with secret and returns its
+// claims.
+func verifyJWT(t *testing.T, secret, token string) jwtClaims {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("token %q does not have three parts", token)
+	}
+	header, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	if string(header) != `{"alg":"HS256","typ":"JWT"}` {
+		t.Errorf("header = %s", header)
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if signature, _ := base64.RawURLEncoding.DecodeString(parts[2]); !hmac.Equal(signature, mac.Sum(nil)) {
+		t.Fatal("signature does not verify")
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	var claims jwtClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatalf("payload %s: %v", payload, err)
+	}
+	return claims
+}
+
+func TestTokenMinter(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		want     jwtClaims
+	}{
+		{name: "superuser", want: jwtClaims{Issuer: "arangodb", ServerID: "arango-proxy"}},
+		{name: "user", username: "agent", want: jwtClaims{Issuer: "arangodb", PreferredUsername: "agent"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			now := time.Unix(1_800_000_000, 0)
+			minter := newTokenMinter([]byte("secret"))
+			minter.now = func() time.Time { return now }
+			token, err := minter.token(tc.username)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tc.want
+			want.IssuedAt = now.Unix()
+			want.Expires = now.Add(mintedTokenLifetime).Unix()
+			if claims := verifyJWT(t, "secret", token); claims != want {
+				t.Errorf("claims = %+v, want %+v", claims, want)
+			}
+
+			now = now.Add(mintedTokenLifetime - mintedTokenRenewal - time.Second)
+			if again, _ := minter.token(tc.username); again != token {
+				t.Error("token not reused before renewal")
+			}
+			if other, _ := minter.token(tc.username + "-other"); other == token {
+				t.Error("token reused for another user")
+			}
+			now = now.Add(time.Second)
+			renewed, _ := minter.token(tc.username)
+			if renewed == token {
+				t.Error("token not renewed before it expires")
+			}
+			if claims := verifyJWT(t, "secret", renewed); claims.Expires != now.Add(mintedTokenLifetime).Unix() {
+				t.Errorf("renewed token expires at %d", claims.Expires)
+			}
+		})
+	}
+}
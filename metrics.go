@@ -0,0 +1,332 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metricsPrefix is prepended to every metric name.
+const metricsPrefix = "arango_proxy_"
+
+// upstreamDurationBuckets are the upper bounds, in seconds, of the upstream
+// latency histogram.
+var upstreamDurationBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+
+// metricsMethods are the HTTP methods reported as themselves; others are
+// reported as "OTHER" to bound label cardinality.
+var metricsMethods = map[string]struct{}{
+	http.MethodGet: {}, http.MethodHead: {}, http.MethodOptions: {}, http.MethodPost: {},
+	http.MethodPut: {}, http.MethodPatch: {}, http.MethodDelete: {},
+}
+
+// Metrics collects request, upstream and policy statistics for a proxy and
+// serves them in the Prometheus text exposition format. Every sample is
+// labelled with a listener name, empty unless the collector was obtained
+// with Listener. It is safe for concurrent use.
+type Metrics struct {
+	*metricsStore
+	listener string
+}
+
+// metricsStore holds the statistics of every listener sharing a collector.
+type metricsStore struct {
+	mu               sync.Mutex
+	listeners        map[string]*listenerMetrics
+	requests         map[requestMetricKey]uint64
+	upstreamDuration map[categoryMetricKey]*histogram
+	deniedKeywords   map[keywordMetricKey]uint64
+}
+
+// listenerMetrics are the unlabelled statistics of one listener.
+type listenerMetrics struct {
+	inFlight       int64
+	upstreamErrors uint64
+	unavailable    uint64
+	auditFailures  uint64
+	bytesIn        uint64
+	bytesOut       uint64
+}
+
+type requestMetricKey struct {
+	listener string
+	method   string
+	category EndpointCategory
+	decision string
+	rule     string
+}
+
+type categoryMetricKey struct {
+	listener string
+	category EndpointCategory
+}
+
+type keywordMetricKey struct {
+	listener string
+	keyword  string
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// NewMetrics returns an empty collector.
+func NewMetrics() *Metrics {
+	return &Metrics{metricsStore: &metricsStore{
+		listeners:        make(map[string]*listenerMetrics),
+		requests:         make(map[requestMetricKey]uint64),
+		upstreamDuration: make(map[categoryMetricKey]*histogram),
+		deniedKeywords:   make(map[keywordMetricKey]uint64),
+	}}
+}
+
+// Listener returns a collector that shares m's statistics but records its
+// own with the listener label set to name, so that several listeners can
+// be told apart on one metrics endpoint.
+func (m *Metrics) Listener(name string) *Metrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.listenerLocked(name)
+	return &Metrics{metricsStore: m.metricsStore, listener: name}
+}
+
+// listenerLocked returns the statistics of listener name, creating them
+// if needed. m.mu must be held.
+func (m *metricsStore) listenerLocked(name string) *listenerMetrics {
+	l, ok := m.listeners[name]
+	if !ok {
+		l = &listenerMetrics{}
+		m.listeners[name] = l
+	}
+	return l
+}
+
+func (m *Metrics) requestStarted() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.listenerLocked(m.listener).inFlight++
+}
+
+// requestFinished records a request once it has been answered.
+func (m *Metrics) requestFinished(method string, decision *Decision, bytesIn, bytesOut int64) {
+	if _, ok := metricsMethods[method]; !ok {
+		method = "OTHER"
+	}
+	key := requestMetricKey{listener: m.listener, method: method, category: decision.Category, decision: "denied", rule: decision.Rule}
+	if decision.Allowed {
+		key.decision = "allowed"
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l := m.listenerLocked(m.listener)
+	l.inFlight--
+	m.requests[key]++
+	l.bytesIn += uint64(max(bytesIn, 0))
+	l.bytesOut += uint64(max(bytesOut, 0))
+	if keyword, ok := decision.Err.(*ForbiddenKeywordError); ok {
+		m.deniedKeywords[keywordMetricKey{listener: m.listener, keyword: keyword.Keyword}]++
+	}
+}
+
+func (m *Metrics) observeUpstream(category EndpointCategory, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := categoryMetricKey{listener: m.listener, category: category}
+	h, ok := m.upstreamDuration[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(upstreamDurationBuckets))}
+		m.upstreamDuration[key] = h
+	}
+	seconds := d.Seconds()
+	for i, bound := range upstreamDurationBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+func (m *Metrics) upstreamError() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.listenerLocked(m.listener).upstreamErrors++
+}
+
+func (m *Metrics) upstreamUnavailable() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.listenerLocked(m.listener).unavailable++
+}
+
+func (m *Metrics) auditWriteFailed() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.listenerLocked(m.listener).auditFailures++
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = m.WriteTo(w)
+}
+
+// WriteTo writes the metrics of every listener sharing m in the Prometheus
+// text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+
+	m.mu.Lock()
+	writeHeader(&b, "requests_total", "counter", "Requests handled, by listener, method, endpoint category, decision and deciding rule.")
+	keys := make([]requestMetricKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.listener != b.listener {
+			return a.listener < b.listener
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		if a.category != b.category {
+			return a.category < b.category
+		}
+		if a.decision != b.decision {
+			return a.decision < b.decision
+		}
+		return a.rule < b.rule
+	})
+	for _, key := range keys {
+		writeSample(&b, "requests_total", formatUint(m.requests[key]), "listener", key.listener,
+			"method", key.method, "category", string(key.category), "decision", key.decision, "rule", key.rule)
+	}
+
+	writeHeader(&b, "upstream_duration_seconds", "histogram", "Time until the upstream responded with headers, by listener and endpoint category.")
+	durations := make([]categoryMetricKey, 0, len(m.upstreamDuration))
+	for key := range m.upstreamDuration {
+		durations = append(durations, key)
+	}
+	sort.Slice(durations, func(i, j int) bool {
+		a, b := durations[i], durations[j]
+		if a.listener != b.listener {
+			return a.listener < b.listener
+		}
+		return a.category < b.category
+	})
+	for _, key := range durations {
+		h := m.upstreamDuration[key]
+		labels := []string{"listener", key.listener, "category", string(key.category)}
+		var cumulative uint64
+		for i, bound := range upstreamDurationBuckets {
+			cumulative += h.counts[i]
+			writeSample(&b, "upstream_duration_seconds_bucket", formatUint(cumulative),
+				append(labels, "le", strconv.FormatFloat(bound, 'g', -1, 64))...)
+		}
+		writeSample(&b, "upstream_duration_seconds_bucket", formatUint(h.count), append(labels, "le", "+Inf")...)
+		writeSample(&b, "upstream_duration_seconds_sum", strconv.FormatFloat(h.sum, 'g', -1, 64), labels...)
+		writeSample(&b, "upstream_duration_seconds_count", formatUint(h.count), labels...)
+	}
+
+	listeners := make([]string, 0, len(m.listeners))
+	for name := range m.listeners {
+		listeners = append(listeners, name)
+	}
+	sort.Strings(listeners)
+	perListener := func(name, kind, help string, value func(*listenerMetrics) string) {
+		writeHeader(&b, name, kind, help)
+		for _, listener := range listeners {
+			writeSample(&b, name, value(m.listeners[listener]), "listener", listener)
+		}
+	}
+	perListener("upstream_errors_total", "counter", "Requests answered with 502 because the upstream could not be reached.",
+		func(l *listenerMetrics) string { return formatUint(l.upstreamErrors) })
+	perListener("upstream_unavailable_total", "counter", "Requests answered with 503 because the upstream circuit was open.",
+		func(l *listenerMetrics) string { return formatUint(l.unavailable) })
+	perListener("audit_write_failures_total", "counter", "Forwarded requests whose audit record could not be written.",
+		func(l *listenerMetrics) string { return formatUint(l.auditFailures) })
+	perListener("request_bytes_total", "counter", "Request body bytes forwarded to the upstream.",
+		func(l *listenerMetrics) string { return formatUint(l.bytesIn) })
+	perListener("response_bytes_total", "counter", "Response body bytes returned to clients.",
+		func(l *listenerMetrics) string { return formatUint(l.bytesOut) })
+
+	writeHeader(&b, "denied_keywords_total", "counter", "Requests denied for a forbidden AQL keyword, by listener and keyword.")
+	keywords := make([]keywordMetricKey, 0, len(m.deniedKeywords))
+	for key := range m.deniedKeywords {
+		keywords = append(keywords, key)
+	}
+	sort.Slice(keywords, func(i, j int) bool {
+		a, b := keywords[i], keywords[j]
+		if a.listener != b.listener {
+			return a.listener < b.listener
+		}
+		return a.keyword < b.keyword
+	})
+	for _, key := range keywords {
+		writeSample(&b, "denied_keywords_total", formatUint(m.deniedKeywords[key]), "listener", key.listener, "keyword", key.keyword)
+	}
+
+	perListener("in_flight_requests", "gauge", "Requests currently being handled.",
+		func(l *listenerMetrics) string { return strconv.FormatInt(l.inFlight, 10) })
+	m.mu.Unlock()
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func writeHeader(b *strings.Builder, name, kind, help string) {
+	fmt.Fprintf(b, "# HELP %s%s %s\n# TYPE %s%s %s\n", metricsPrefix, name, help, metricsPrefix, name, kind)
+}
+
+// writeSample writes one sample; labels are name/value pairs.
+func writeSample(b *strings.Builder, name, value string, labels ...string) {
+	b.WriteString(metricsPrefix)
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(b, "%s=\"%s\"", labels[i], escapeLabelValue(labels[i+1]))
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+func formatUint(v uint64) string {
+	return strconv.FormatUint(v, 10)
+}
+
+// countingReader counts the bytes read through it. The transport reads
+// request bodies on its own goroutine, hence the atomic.
+type countingReader struct {
+	io.ReadCloser
+	n atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
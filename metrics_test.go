@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics_WriteTo(t *testing.T) {
+	m := NewMetrics()
+	m.requestStarted()
+	m.requestFinished(http.MethodGet, &Decision{Allowed: true, Rule: "read", Category: CategoryDataRead}, 0, 42)
+	m.requestStarted()
+	m.requestFinished("PROPFIND", &Decision{Rule: "deny \"x\"", Category: CategoryAdmin}, 0, 0)
+	m.requestStarted()
+	m.requestFinished(http.MethodPost, &Decision{Category: CategoryDataRead, Err: &ForbiddenKeywordError{Keyword: "INSERT", Where: "AQL"}}, 0, 0)
+	m.requestStarted()
+	m.observeUpstream(CategoryDataRead, 20*time.Millisecond)
+	m.upstreamError()
+
+	var b strings.Builder
+	if _, err := m.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	for _, want := range []string{
+		`arango_proxy_requests_total{listener="",method="GET",category="data-read",decision="allowed",rule="read"} 1`,
+		`arango_proxy_requests_total{listener="",method="OTHER",category="admin",decision="denied",rule="deny \"x\""} 1`,
+		`arango_proxy_requests_total{listener="",method="POST",category="data-read",decision="denied",rule=""} 1`,
+		`arango_proxy_upstream_duration_seconds_bucket{listener="",category="data-read",le="0.01"} 0`,
+		`arango_proxy_upstream_duration_seconds_bucket{listener="",category="data-read",le="0.025"} 1`,
+		`arango_proxy_upstream_duration_seconds_bucket{listener="",category="data-read",le="+Inf"} 1`,
+		`arango_proxy_upstream_duration_seconds_count{listener="",category="data-read"} 1`,
+		`arango_proxy_upstream_errors_total{listener=""} 1`,
+		`arango_proxy_response_bytes_total{listener=""} 42`,
+		`arango_proxy_denied_keywords_total{listener="",keyword="INSERT"} 1`,
+		`arango_proxy_in_flight_requests{listener=""} 1`,
+		"# TYPE arango_proxy_upstream_duration_seconds histogram",
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Errorf("output lacks %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestMetrics_Listener(t *testing.T) {
+	m := NewMetrics()
+	readonly, readwrite := m.Listener("readonly"), m.Listener("readwrite")
+	readonly.requestStarted()
+	readonly.requestFinished(http.MethodPost, &Decision{Category: CategoryDataRead, Err: &ForbiddenKeywordError{Keyword: "INSERT", Where: "AQL"}}, 10, 0)
+	readwrite.requestStarted()
+	readwrite.observeUpstream(CategoryDataWrite, time.Millisecond)
+	readwrite.upstreamError()
+
+	var b strings.Builder
+	if _, err := m.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	for _, want := range []string{
+		`arango_proxy_requests_total{listener="readonly",method="POST",category="data-read",decision="denied",rule=""} 1`,
+		`arango_proxy_denied_keywords_total{listener="readonly",keyword="INSERT"} 1`,
+		`arango_proxy_upstream_duration_seconds_count{listener="readwrite",category="data-write"} 1`,
+		`arango_proxy_upstream_errors_total{listener="readonly"} 0`,
+		`arango_proxy_upstream_errors_total{listener="readwrite"} 1`,
+		`arango_proxy_request_bytes_total{listener="readonly"} 10`,
+		`arango_proxy_in_flight_requests{listener="readonly"} 0`,
+		`arango_proxy_in_flight_requests{listener="readwrite"} 1`,
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Errorf("output lacks %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, `listener=""`) {
+		t.Errorf("output has samples of an unnamed listener:\n%s", out)
+	}
+}
+
+func TestUnixReverseProxy_Metrics(t *testing.T) {
+	socket := startFakeUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"result": []}`))
+	}))
+	proxy := NewUnixReverseProxy(socket, AllowReadOnly)
+	metrics := NewMetrics()
+	proxy.SetMetrics(metrics)
+
+	serve := func(method, path, body string) int {
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec.Code
+	}
+	if code := serve(http.MethodPost, "/_api/cursor", `{"query": "FOR d IN c RETURN d"}`); code != http.StatusOK {
+		t.Fatalf("read query: status = %d", code)
+	}
+	if code := serve(http.MethodPost, "/_api/cursor", `{"query": "INSERT {} INTO c"}`); code != http.StatusForbidden {
+		t.Fatalf("write query: status = %d", code)
+	}
+	if code := serve(http.MethodGet, "/_admin/status", ""); code != http.StatusForbidden {
+		t.Fatalf("admin endpoint: status = %d", code)
+	}
+
+	unreachable := NewUnixReverseProxy(filepath.Join(t.TempDir(), "missing.sock"), AllowReadOnly)
+	unreachable.SetMetrics(metrics)
+	rec := httptest.NewRecorder()
+	unreachable.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/_api/version", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("unreachable upstream: status = %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	NewAdminHandler(metrics, nil).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	out := rec.Body.String()
+	for _, want := range []string{
+		`arango_proxy_requests_total{listener="",method="POST",category="data-read",decision="allowed",rule="read-only-cursor"} 1`,
+		`arango_proxy_requests_total{listener="",method="POST",category="data-read",decision="denied",rule="read-only-cursor"} 1`,
+		`arango_proxy_requests_total{listener="",method="GET",category="admin",decision="denied",rule="category"} 1`,
+		`arango_proxy_requests_total{listener="",method="GET",category="data-read",decision="allowed",rule="reads"} 1`,
+		`arango_proxy_denied_keywords_total{listener="",keyword="INSERT"} 1`,
+		`arango_proxy_upstream_errors_total{listener=""} 1`,
+		`arango_proxy_upstream_duration_seconds_count{listener="",category="data-read"} 1`,
+		`arango_proxy_request_bytes_total{listener=""} 32`,
+		`arango_proxy_response_bytes_total{listener=""} 14`,
+		`arango_proxy_in_flight_requests{listener=""} 0`,
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Errorf("output lacks %q:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// PeerCred identifies the process on the other end of a Unix socket
+// connection, as reported by the kernel when the connection was accepted.
+type PeerCred struct {
+	UID uint32
+	GID uint32
+	PID int32
+}
+
+// String formats the credentials for log lines.
+func (c PeerCred) String() string {
+	return fmt.Sprintf("uid=%d gid=%d pid=%d", c.UID, c.GID, c.PID)
+}
+
+type peerCredKey struct{}
+
+// PeerCredConnContext is an http.Server ConnContext hook that captures the
+// connecting process's credentials and stores them in the connection's
+// context. Connections whose credentials cannot be read (for example non-Unix
+// listeners) are served without them.
+func PeerCredConnContext(ctx context.Context, c net.Conn) context.Context {
+	cred, err := peerCredFromConn(c)
+	if err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, peerCredKey{}, cred)
+}
+
+// PeerCredFromContext returns the peer credentials captured for the
+// connection a request arrived on.
+func PeerCredFromContext(ctx context.Context) (PeerCred, bool) {
+	cred, ok := ctx.Value(peerCredKey{}).(PeerCred)
+	return cred, ok
+}
+
+// WithPeerCred returns a copy of ctx carrying cred. It is mainly useful for
+// exercising policies outside a live server.
+func WithPeerCred(ctx context.Context, cred PeerCred) context.Context {
+	return context.WithValue(ctx, peerCredKey{}, cred)
+}
@@ -0,0 +1,32 @@
+//go:build linux
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// peerCredFromConn reads SO_PEERCRED from a Unix socket connection.
+func peerCredFromConn(c net.Conn) (PeerCred, error) {
+	unixConn, ok := c.(*net.UnixConn)
+	if !ok {
+		return PeerCred{}, fmt.Errorf("peer credentials require a Unix socket, got %T", c)
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return PeerCred{}, err
+	}
+	var ucred *syscall.Ucred
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		ucred, sockErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return PeerCred{}, err
+	}
+	if sockErr != nil {
+		return PeerCred{}, fmt.Errorf("SO_PEERCRED: %w", sockErr)
+	}
+	return PeerCred{UID: ucred.Uid, GID: ucred.Gid, PID: ucred.Pid}, nil
+}
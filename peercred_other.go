@@ -0,0 +1,13 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+// peerCredFromConn is only implemented on Linux, where SO_PEERCRED exists.
+func peerCredFromConn(net.Conn) (PeerCred, error) {
+	return PeerCred{}, errors.New("peer credentials are not supported on this platform")
+}
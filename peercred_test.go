@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestPeerCredConnContext_UnixSocket(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_PEERCRED is Linux-only")
+	}
+
+	socketPath := filepath.Join(t.TempDir(), "peer.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+
+	server := NewServerWithTimeouts(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cred, ok := PeerCredFromContext(r.Context())
+		if !ok {
+			http.Error(w, "no credentials", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "%d %d", cred.UID, cred.PID)
+	}))
+	go server.Serve(listener)
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+		},
+	}}
+	resp, err := client.Get("http://proxy/")
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var uid, pid int
+	if _, err := fmt.Fscanf(resp.Body, "%d %d", &uid, &pid); err != nil {
+		t.Fatalf("status %d, unreadable body: %v", resp.StatusCode, err)
+	}
+	if uid != os.Getuid() {
+		t.Errorf("uid = %d, want %d", uid, os.Getuid())
+	}
+	if pid != os.Getpid() {
+		t.Errorf("pid = %d, want %d", pid, os.Getpid())
+	}
+}
+
+func TestPeerCredConnContext_NonUnixConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	ctx := PeerCredConnContext(context.Background(), server)
+	if _, ok := PeerCredFromContext(ctx); ok {
+		t.Error("a non-Unix connection should not carry peer credentials")
+	}
+}
+
+func TestPolicy_PeerRule(t *testing.T) {
+	allow := mustCompilePolicy(t, `{"rules": [
+		{"methods": ["POST"], "paths": ["/_api/document/**"], "peer": {"users": ["1001"]}},
+		{"methods": ["GET"], "peer": {"users": ["1001", "1002"], "groups": ["2000"]}}
+	]}`, "json")
+
+	tests := []struct {
+		name   string
+		method string
+		cred   *PeerCred
+		allow  bool
+	}{
+		{"ingest writes", http.MethodPost, &PeerCred{UID: 1001, GID: 2000}, true},
+		{"agent cannot write", http.MethodPost, &PeerCred{UID: 1002, GID: 2000}, false},
+		{"agent reads", http.MethodGet, &PeerCred{UID: 1002, GID: 2000}, true},
+		{"wrong group", http.MethodGet, &PeerCred{UID: 1002, GID: 3000}, false},
+		{"unknown peer", http.MethodGet, nil, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, "/_api/document/c", nil)
+			if tc.cred != nil {
+				req = req.WithContext(WithPeerCred(req.Context(), *tc.cred))
+			}
+			err := allow(req, emptyBodyPeeker())
+			if tc.allow && err != nil {
+				t.Errorf("should be allowed, got error: %v", err)
+			}
+			if !tc.allow && err == nil {
+				t.Error("should be denied")
+			}
+		})
+	}
+}
+
+func TestPolicy_PeerDenyRule(t *testing.T) {
+	allow := mustCompilePolicy(t, `{"rules": [
+		{"effect": "deny", "methods": ["DELETE"], "peer": {"users": ["1002"]}},
+		{"methods": ["GET", "DELETE"]}
+	]}`, "json")
+
+	tests := []struct {
+		name  string
+		cred  *PeerCred
+		allow bool
+	}{
+		{"denied peer", &PeerCred{UID: 1002}, false},
+		{"other peer", &PeerCred{UID: 1001}, true},
+		// Without credentials the deny rule cannot rule the client out,
+		// so it applies.
+		{"unknown peer", nil, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodDelete, "/_api/document/c/k", nil)
+			if tc.cred != nil {
+				req = req.WithContext(WithPeerCred(req.Context(), *tc.cred))
+			}
+			err := allow(req, emptyBodyPeeker())
+			if tc.allow && err != nil {
+				t.Errorf("should be allowed, got error: %v", err)
+			}
+			if !tc.allow && err == nil {
+				t.Error("should be denied")
+			}
+		})
+	}
+
+	// Requests the deny rule does not select are unaffected.
+	if err := allow(httptest.NewRequest(http.MethodGet, "/_api/document/c/k", nil), emptyBodyPeeker()); err != nil {
+		t.Errorf("GET without credentials: %v", err)
+	}
+}
+
+func TestLookupUserAndGroupID(t *testing.T) {
+	if uid, err := LookupUserID("1234"); err != nil || uid != 1234 {
+		t.Errorf("LookupUserID(\"1234\") = %d, %v", uid, err)
+	}
+	if gid, err := LookupGroupID("4321"); err != nil || gid != 4321 {
+		t.Errorf("LookupGroupID(\"4321\") = %d, %v", gid, err)
+	}
+	if _, err := LookupUserID("no-such-user-for-proxy-tests"); err == nil {
+		t.Error("unknown user should fail")
+	}
+	if _, err := LookupGroupID("no-such-group-for-proxy-tests"); err == nil {
+		t.Error("unknown group should fail")
+	}
+	if _, err := LookupUserGroupIDs(4294967000); err == nil {
+		t.Error("groups of an unknown uid should fail")
+	}
+}
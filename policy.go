@@ -0,0 +1,716 @@
+package proxy
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// builtinPolicyFS holds the policy files shipped with the proxy. They
+// reproduce the historical hard-coded read-only and read-write behavior.
+//
+//go:embed policies/*.yaml
+var builtinPolicyFS embed.FS
+
+// BuiltinPolicyPrefix selects a bundled policy instead of a file on disk,
+// e.g. POLICY_FILE=builtin:read-only.
+const BuiltinPolicyPrefix = "builtin:"
+
+// cursorBodyPeekLimit is the body inspection limit used when an AQL rule does
+// not set max_body_bytes.
+const cursorBodyPeekLimit = 128 * 1024
+
+// Policy is a declarative access control policy. A request is allowed when
+// an allow rule matches it and all of that rule's checks pass. Rules are
+// evaluated in order; a matching deny rule rejects the request immediately.
+type Policy struct {
+	Name  string       `json:"name" yaml:"name"`
+	Rules []PolicyRule `json:"rules" yaml:"rules"`
+}
+
+// PolicyRule selects requests by method, path, database and collection, and
+// optionally constrains the AQL, stream transaction declaration or import
+// documents carried in the request body.
+//
+// Paths are written relative to the database, so "/_api/cursor" also matches
+// "/_db/<name>/_api/cursor". A path segment may be a literal, "*" (any single
+// segment), "{id}" (a numeric segment such as a cursor id), or "{collection}"
+// (any single segment, captured as the collection name). A final "**" matches
+// zero or more trailing segments, the same boundary rule HasAPIPathPrefix uses.
+// Databases and collections are shell-style patterns as understood by
+// path.Match. Categories match the endpoint's EndpointCategory. Peer
+// restricts the rule to particular connecting users or groups (see
+// PeerCred). An empty selector matches everything.
+type PolicyRule struct {
+	Name        string           `json:"name,omitempty" yaml:"name,omitempty"`
+	Effect      string           `json:"effect,omitempty" yaml:"effect,omitempty"`
+	Methods     []string         `json:"methods,omitempty" yaml:"methods,omitempty"`
+	Paths       []string         `json:"paths,omitempty" yaml:"paths,omitempty"`
+	Databases   []string         `json:"databases,omitempty" yaml:"databases,omitempty"`
+	Collections []string         `json:"collections,omitempty" yaml:"collections,omitempty"`
+	Categories  []string         `json:"categories,omitempty" yaml:"categories,omitempty"`
+	Peer        *PeerRule        `json:"peer,omitempty" yaml:"peer,omitempty"`
+	AQL         *AQLRule         `json:"aql,omitempty" yaml:"aql,omitempty"`
+	Transaction *TransactionRule `json:"transaction,omitempty" yaml:"transaction,omitempty"`
+	Import      *ImportRule      `json:"import,omitempty" yaml:"import,omitempty"`
+}
+
+// PeerRule matches the credentials of the process connected to the socket.
+// Users and groups are names or numeric ids and are resolved when the policy
+// is compiled. Groups match the process's effective group id. A rule with a
+// peer selector on an allow rule never matches a connection whose
+// credentials are unknown; one on a deny rule always does, so that a
+// client cannot escape a deny rule by connecting without credentials.
+type PeerRule struct {
+	Users  []string `json:"users,omitempty" yaml:"users,omitempty"`
+	Groups []string `json:"groups,omitempty" yaml:"groups,omitempty"`
+}
+
+// AQLRule constrains the AQL query in a cursor request body.
+type AQLRule struct {
+	// DenyWrites rejects queries containing any of ForbiddenAQLKeywords.
+	DenyWrites bool `json:"deny_writes,omitempty" yaml:"deny_writes,omitempty"`
+	// DenyKeywords rejects queries containing any of these additional keywords.
+	DenyKeywords []string `json:"deny_keywords,omitempty" yaml:"deny_keywords,omitempty"`
+	// MaxBodyBytes bounds how much of the body is inspected. Larger bodies
+	// are rejected. Defaults to 128 KB.
+	MaxBodyBytes int64 `json:"max_body_bytes,omitempty" yaml:"max_body_bytes,omitempty"`
+}
+
+// TransactionRule constrains the collections a stream transaction declares
+// in a POST /_api/transaction/begin body.
+type TransactionRule struct {
+	// DenyWrites rejects transactions declaring write or exclusive
+	// collections. ArangoDB refuses writes to collections a stream
+	// transaction did not declare for writing, so such a transaction is
+	// read-only.
+	DenyWrites bool `json:"deny_writes,omitempty" yaml:"deny_writes,omitempty"`
+}
+
+const (
+	policyEffectAllow = "allow"
+	policyEffectDeny  = "deny"
+)
+
+// LoadPolicy loads a policy by reference: either a bundled policy named with
+// BuiltinPolicyPrefix or a path to a YAML or JSON policy file.
+func LoadPolicy(ref string) (*Policy, error) {
+	if name, ok := strings.CutPrefix(ref, BuiltinPolicyPrefix); ok {
+		return BuiltinPolicy(name)
+	}
+	return LoadPolicyFile(ref)
+}
+
+// LoadPolicyFile reads a policy file. Files ending in .json are decoded as
+// JSON; anything else is decoded as YAML.
+func LoadPolicyFile(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy %s: %w", path, err)
+	}
+	format := "yaml"
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		format = "json"
+	}
+	policy, err := ParsePolicy(data, format)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy %s: %w", path, err)
+	}
+	return policy, nil
+}
+
+// BuiltinPolicy returns one of the policies bundled with the proxy,
+// "read-only" or "read-write".
+func BuiltinPolicy(name string) (*Policy, error) {
+	data, err := builtinPolicyFS.ReadFile("policies/" + name + ".yaml")
+	if err != nil {
+		return nil, fmt.Errorf("unknown built-in policy %q", name)
+	}
+	return ParsePolicy(data, "yaml")
+}
+
+// ParsePolicy decodes a policy in the given format ("json" or "yaml").
+// Unknown fields are rejected so that typos do not silently widen access.
+func ParsePolicy(data []byte, format string) (*Policy, error) {
+	var policy Policy
+	switch format {
+	case "json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&policy); err != nil {
+			return nil, err
+		}
+	case "yaml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(&policy); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported policy format %q", format)
+	}
+	return &policy, nil
+}
+
+// PolicyFromEnv returns the AllowFunc compiled from POLICY_FILE, or fallback
+// when POLICY_FILE is unset.
+func PolicyFromEnv(fallback AllowFunc) (AllowFunc, error) {
+	ref := GetEnv("POLICY_FILE", "")
+	if ref == "" {
+		return fallback, nil
+	}
+	return compilePolicyRef(ref)
+}
+
+// compilePolicyRef loads the policy named by ref (see LoadPolicy) and
+// compiles it.
+func compilePolicyRef(ref string) (AllowFunc, error) {
+	policy, err := LoadPolicy(ref)
+	if err != nil {
+		return nil, err
+	}
+	allow, err := policy.Compile()
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy %s: %w", ref, err)
+	}
+	log.Printf("using policy %q from %s", policy.Name, ref)
+	return allow, nil
+}
+
+// mustCompileBuiltinPolicy compiles a bundled policy, panicking on error.
+// The bundled policies are covered by tests, so a failure is a build defect.
+func mustCompileBuiltinPolicy(name string) AllowFunc {
+	policy, err := BuiltinPolicy(name)
+	if err != nil {
+		panic(err)
+	}
+	allow, err := policy.Compile()
+	if err != nil {
+		panic(fmt.Sprintf("built-in policy %q: %v", name, err))
+	}
+	return allow
+}
+
+// Compile validates the policy and returns an AllowFunc enforcing it.
+func (p *Policy) Compile() (AllowFunc, error) {
+	if len(p.Rules) == 0 {
+		return nil, fmt.Errorf("policy has no rules")
+	}
+	rules := make([]*compiledRule, 0, len(p.Rules))
+	for i := range p.Rules {
+		rule, err := compileRule(&p.Rules[i])
+		if err != nil {
+			label := p.Rules[i].Name
+			if label == "" {
+				label = fmt.Sprintf("#%d", i+1)
+			}
+			return nil, fmt.Errorf("rule %s: %w", label, err)
+		}
+		rules = append(rules, rule)
+	}
+	return func(r *http.Request, peek BodyPeeker) error {
+		return evaluateRules(rules, r, peek)
+	}, nil
+}
+
+// evaluateRules applies rules in order. When no allow rule admits the
+// request, the error from the first allow rule whose selectors matched but
+// whose checks failed is returned, since it is the most specific reason.
+func evaluateRules(rules []*compiledRule, r *http.Request, peek BodyPeeker) error {
+	reqPath, pathOK := parseRequestPath(r.URL.Path)
+	var firstErr error
+	var firstRule string
+	for _, rule := range rules {
+		if !rule.matches(r, reqPath, pathOK) {
+			continue
+		}
+		if rule.deny {
+			noteRule(r, rule.name)
+			return fmt.Errorf("%s %s denied by policy rule %q", r.Method, r.URL.Path, rule.name)
+		}
+		if err := rule.check(r, peek); err != nil {
+			if firstErr == nil {
+				firstErr = err
+				firstRule = rule.name
+			}
+			continue
+		}
+		noteRule(r, rule.name)
+		if rule.aql != nil && rule.aql.denyWrites {
+			noteReadOnlyQuery(r)
+		}
+		return nil
+	}
+	noteRule(r, firstRule)
+	if firstErr != nil {
+		return firstErr
+	}
+	return fmt.Errorf("method %s not permitted on %s", r.Method, r.URL.Path)
+}
+
+type compiledRule struct {
+	name        string
+	deny        bool
+	methods     map[string]struct{}
+	paths       []pathPattern
+	databases   []string
+	collections []string
+	categories  map[EndpointCategory]struct{}
+	peer        *compiledPeerRule
+	aql         *compiledAQLRule
+	transaction *TransactionRule
+	imports     *compiledImportRule
+}
+
+type compiledPeerRule struct {
+	uids map[uint32]struct{}
+	gids map[uint32]struct{}
+}
+
+type compiledAQLRule struct {
+	keywords   map[string]struct{}
+	limit      int64
+	denyWrites bool
+}
+
+func compileRule(rule *PolicyRule) (*compiledRule, error) {
+	compiled := &compiledRule{name: rule.Name}
+
+	switch strings.ToLower(rule.Effect) {
+	case "", policyEffectAllow:
+	case policyEffectDeny:
+		compiled.deny = true
+	default:
+		return nil, fmt.Errorf("unknown effect %q", rule.Effect)
+	}
+
+	if len(rule.Methods) > 0 {
+		compiled.methods = make(map[string]struct{}, len(rule.Methods))
+		for _, method := range rule.Methods {
+			compiled.methods[strings.ToUpper(method)] = struct{}{}
+		}
+	}
+
+	capturesCollection := false
+	for _, raw := range rule.Paths {
+		pattern, err := parsePathPattern(raw)
+		if err != nil {
+			return nil, err
+		}
+		if pattern.capturesCollection() {
+			capturesCollection = true
+		}
+		compiled.paths = append(compiled.paths, pattern)
+	}
+
+	for _, pattern := range append(append([]string(nil), rule.Databases...), rule.Collections...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	compiled.databases = rule.Databases
+	if len(rule.Collections) > 0 && !capturesCollection {
+		return nil, fmt.Errorf("collections require a path with a {collection} segment")
+	}
+	compiled.collections = rule.Collections
+
+	if len(rule.Categories) > 0 {
+		compiled.categories = make(map[EndpointCategory]struct{}, len(rule.Categories))
+		for _, name := range rule.Categories {
+			category, err := parseEndpointCategory(name)
+			if err != nil {
+				return nil, err
+			}
+			compiled.categories[category] = struct{}{}
+		}
+	}
+
+	if rule.Peer != nil {
+		peer, err := compilePeerRule(rule.Peer)
+		if err != nil {
+			return nil, err
+		}
+		compiled.peer = peer
+	}
+
+	if rule.AQL != nil {
+		if compiled.deny {
+			return nil, fmt.Errorf("aql checks are not supported on deny rules")
+		}
+		aql := &compiledAQLRule{
+			keywords:   make(map[string]struct{}),
+			limit:      rule.AQL.MaxBodyBytes,
+			denyWrites: rule.AQL.DenyWrites,
+		}
+		if aql.limit <= 0 {
+			aql.limit = cursorBodyPeekLimit
+		}
+		if aql.limit > MaxBodyPeekSize {
+			return nil, fmt.Errorf("max_body_bytes %d exceeds %d", aql.limit, MaxBodyPeekSize)
+		}
+		if rule.AQL.DenyWrites {
+			for keyword := range ForbiddenAQLKeywords {
+				aql.keywords[keyword] = struct{}{}
+			}
+		}
+		for _, keyword := range rule.AQL.DenyKeywords {
+			aql.keywords[strings.ToUpper(keyword)] = struct{}{}
+		}
+		compiled.aql = aql
+	}
+
+	if rule.Transaction != nil {
+		if compiled.deny {
+			return nil, fmt.Errorf("transaction checks are not supported on deny rules")
+		}
+		compiled.transaction = rule.Transaction
+	}
+
+	if rule.Import != nil {
+		if compiled.deny {
+			return nil, fmt.Errorf("import checks are not supported on deny rules")
+		}
+		imports, err := compileImportRule(rule.Import)
+		if err != nil {
+			return nil, err
+		}
+		compiled.imports = imports
+	}
+
+	return compiled, nil
+}
+
+func compilePeerRule(rule *PeerRule) (*compiledPeerRule, error) {
+	if len(rule.Users) == 0 && len(rule.Groups) == 0 {
+		return nil, fmt.Errorf("peer selector needs users or groups")
+	}
+	peer := &compiledPeerRule{}
+	if len(rule.Users) > 0 {
+		peer.uids = make(map[uint32]struct{}, len(rule.Users))
+		for _, name := range rule.Users {
+			uid, err := LookupUserID(name)
+			if err != nil {
+				return nil, err
+			}
+			peer.uids[uid] = struct{}{}
+		}
+	}
+	if len(rule.Groups) > 0 {
+		peer.gids = make(map[uint32]struct{}, len(rule.Groups))
+		for _, name := range rule.Groups {
+			gid, err := LookupGroupID(name)
+			if err != nil {
+				return nil, err
+			}
+			peer.gids[gid] = struct{}{}
+		}
+	}
+	return peer, nil
+}
+
+func (p *compiledPeerRule) matches(cred PeerCred) bool {
+	if p.uids != nil {
+		if _, found := p.uids[cred.UID]; !found {
+			return false
+		}
+	}
+	if p.gids != nil {
+		if _, found := p.gids[cred.GID]; !found {
+			return false
+		}
+	}
+	return true
+}
+
+// LookupUserID resolves a user name or numeric uid.
+func LookupUserID(name string) (uint32, error) {
+	if id, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(id), nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, fmt.Errorf("unknown user %q: %w", name, err)
+	}
+	id, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("user %q has non-numeric uid %q", name, u.Uid)
+	}
+	return uint32(id), nil
+}
+
+// LookupGroupID resolves a group name or numeric gid.
+func LookupGroupID(name string) (uint32, error) {
+	if id, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(id), nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, fmt.Errorf("unknown group %q: %w", name, err)
+	}
+	id, err := strconv.ParseUint(g.Gid, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("group %q has non-numeric gid %q", name, g.Gid)
+	}
+	return uint32(id), nil
+}
+
+// LookupUserGroupIDs returns the ids of the groups the user with uid
+// belongs to according to the system's group database, primary group
+// included. Groups without a numeric id are left out.
+func LookupUserGroupIDs(uid uint32) ([]uint32, error) {
+	u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10))
+	if err != nil {
+		return nil, fmt.Errorf("unknown uid %d: %w", uid, err)
+	}
+	names, err := u.GroupIds()
+	if err != nil {
+		return nil, fmt.Errorf("groups of uid %d: %w", uid, err)
+	}
+	ids := make([]uint32, 0, len(names))
+	for _, name := range names {
+		if id, err := strconv.ParseUint(name, 10, 32); err == nil {
+			ids = append(ids, uint32(id))
+		}
+	}
+	return ids, nil
+}
+
+func (c *compiledRule) matches(r *http.Request, reqPath requestPath, pathOK bool) bool {
+	if c.methods != nil {
+		if _, ok := c.methods[r.Method]; !ok {
+			return false
+		}
+	}
+
+	if c.peer != nil {
+		cred, ok := PeerCredFromContext(r.Context())
+		if !ok && !c.deny {
+			return false
+		}
+		if ok && !c.peer.matches(cred) {
+			return false
+		}
+	}
+
+	if len(c.databases) > 0 {
+		if !pathOK || !matchAny(c.databases, reqPath.database()) {
+			return false
+		}
+	}
+
+	if c.categories != nil {
+		if !pathOK {
+			return false
+		}
+		if _, ok := c.categories[classifyEndpoint(r.Method, reqPath)]; !ok {
+			return false
+		}
+	}
+
+	if len(c.paths) == 0 {
+		return true
+	}
+	if !pathOK {
+		return false
+	}
+	for _, pattern := range c.paths {
+		collection, ok := pattern.match(reqPath.segments)
+		if !ok {
+			continue
+		}
+		if len(c.collections) > 0 && (collection == "" || !matchAny(c.collections, collection)) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+func (c *compiledRule) check(r *http.Request, peek BodyPeeker) error {
+	if c.aql != nil {
+		body, err := peek(c.aql.limit)
+		if err != nil {
+			return err
+		}
+		if err := checkAQLKeywords(body, c.aql.keywords); err != nil {
+			return err
+		}
+	}
+	if c.transaction != nil {
+		body, err := peek(transactionBodyPeekLimit)
+		if err != nil {
+			return err
+		}
+		if err := checkTransactionWrites(body, c.transaction); err != nil {
+			return err
+		}
+	}
+	if c.imports != nil {
+		// Last, so that line checks are only registered once the rule
+		// has otherwise admitted the request.
+		if err := c.imports.check(r, peek); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkTransactionWrites(body []byte, rule *TransactionRule) error {
+	declared, err := parseTransactionCollections(body)
+	if err != nil {
+		return err
+	}
+	if rule.DenyWrites && (len(declared.Write) > 0 || len(declared.Exclusive) > 0) {
+		return fmt.Errorf("transaction declares write collections")
+	}
+	return nil
+}
+
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// requestPath is a request path split into its database and the segments
+// that follow the optional /_db/<name> prefix.
+type requestPath struct {
+	db       string
+	segments []string
+}
+
+// database returns the database the request targets. Requests without a
+// /_db/ prefix are served by ArangoDB from _system.
+func (p requestPath) database() string {
+	if p.db == "" {
+		return systemDatabase
+	}
+	return p.db
+}
+
+// isCursorCreate reports whether the path is the cursor creation endpoint,
+// /_api/cursor without a cursor id.
+func (p requestPath) isCursorCreate() bool {
+	return len(p.segments) == 2 && p.segments[0] == "_api" && p.segments[1] == "cursor"
+}
+
+// parseRequestPath splits a request path. Like HasAPIPathPrefix it refuses
+// paths containing ".." and database names outside [A-Za-z0-9_-].
+func parseRequestPath(fullPath string) (requestPath, bool) {
+	if strings.Contains(fullPath, "..") || !strings.HasPrefix(fullPath, "/") {
+		return requestPath{}, false
+	}
+	rest := fullPath
+	var db string
+	if after, ok := strings.CutPrefix(fullPath, "/_db/"); ok {
+		slashIdx := strings.Index(after, "/")
+		if slashIdx <= 0 || !isValidDatabaseName(after[:slashIdx]) {
+			return requestPath{}, false
+		}
+		db = after[:slashIdx]
+		rest = after[slashIdx:]
+	}
+	return requestPath{db: db, segments: strings.Split(rest[1:], "/")}, true
+}
+
+func isValidDatabaseName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+const (
+	segmentAny        = "*"
+	segmentRest       = "**"
+	segmentID         = "{id}"
+	segmentCollection = "{collection}"
+)
+
+// pathPattern is a parsed PolicyRule path.
+type pathPattern struct {
+	segments []string
+}
+
+func parsePathPattern(raw string) (pathPattern, error) {
+	if !strings.HasPrefix(raw, "/") {
+		return pathPattern{}, fmt.Errorf("path %q must start with /", raw)
+	}
+	if strings.HasPrefix(raw, "/_db/") {
+		return pathPattern{}, fmt.Errorf("path %q must not include /_db/; use databases instead", raw)
+	}
+	segments := strings.Split(raw[1:], "/")
+	for i, segment := range segments {
+		switch {
+		case segment == "":
+			return pathPattern{}, fmt.Errorf("path %q has an empty segment", raw)
+		case segment == segmentRest && i != len(segments)-1:
+			return pathPattern{}, fmt.Errorf("path %q: ** is only allowed as the last segment", raw)
+		case strings.HasPrefix(segment, "{") && segment != segmentID && segment != segmentCollection:
+			return pathPattern{}, fmt.Errorf("path %q: unknown placeholder %s", raw, segment)
+		}
+	}
+	return pathPattern{segments: segments}, nil
+}
+
+func (p pathPattern) capturesCollection() bool {
+	for _, segment := range p.segments {
+		if segment == segmentCollection {
+			return true
+		}
+	}
+	return false
+}
+
+// match reports whether the request segments satisfy the pattern, returning
+// the segment captured by {collection}, if any.
+func (p pathPattern) match(segments []string) (collection string, ok bool) {
+	for i, want := range p.segments {
+		if want == segmentRest {
+			return collection, true
+		}
+		if i >= len(segments) {
+			return "", false
+		}
+		got := segments[i]
+		switch want {
+		case segmentAny:
+			if got == "" {
+				return "", false
+			}
+		case segmentID:
+			if got == "" || strings.Trim(got, "0123456789") != "" {
+				return "", false
+			}
+		case segmentCollection:
+			if got == "" {
+				return "", false
+			}
+			collection = got
+		default:
+			if got != want {
+				return "", false
+			}
+		}
+	}
+	return collection, len(segments) == len(p.segments)
+}
@@ -0,0 +1,299 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func mustCompilePolicy(t *testing.T, data, format string) AllowFunc {
+	t.Helper()
+	policy, err := ParsePolicy([]byte(data), format)
+	if err != nil {
+		t.Fatalf("ParsePolicy() error = %v", err)
+	}
+	allow, err := policy.Compile()
+	if err != nil {
+		t.Fatalf("Compile() error = %v", err)
+	}
+	return allow
+}
+
+func TestBuiltinPolicies(t *testing.T) {
+	for _, name := range []string{"read-only", "read-write"} {
+		t.Run(name, func(t *testing.T) {
+			policy, err := BuiltinPolicy(name)
+			if err != nil {
+				t.Fatalf("BuiltinPolicy(%q) error = %v", name, err)
+			}
+			if policy.Name != name {
+				t.Errorf("policy name = %q, want %q", policy.Name, name)
+			}
+			if _, err := policy.Compile(); err != nil {
+				t.Errorf("Compile() error = %v", err)
+			}
+		})
+	}
+
+	if _, err := BuiltinPolicy("nope"); err == nil {
+		t.Error("unknown built-in policy should fail")
+	}
+}
+
+func TestBuiltinReadWritePolicy_CoversAllowedRWAPIPaths(t *testing.T) {
+	// The bundled read-write policy replaced the AllowedRWAPIPaths loop; keep
+	// the exported slice and the policy in step.
+	for _, apiPath := range AllowedRWAPIPaths {
+		for _, path := range []string{apiPath, "/_db/mydb" + apiPath + "/sub"} {
+			req := httptest.NewRequest(http.MethodPost, path, nil)
+			if err := AllowReadWrite(req, emptyBodyPeeker()); err != nil {
+				t.Errorf("POST %s should be allowed, got error: %v", path, err)
+			}
+		}
+	}
+}
+
+func TestLoadPolicy_Files(t *testing.T) {
+	dir := t.TempDir()
+	jsonPath := filepath.Join(dir, "policy.json")
+	yamlPath := filepath.Join(dir, "policy.yaml")
+	if err := os.WriteFile(jsonPath, []byte(`{"name": "j", "rules": [{"methods": ["GET"]}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(yamlPath, []byte("name: y\nrules:\n  - methods: [GET]\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for ref, want := range map[string]string{
+		jsonPath:             "j",
+		yamlPath:             "y",
+		"builtin:read-write": "read-write",
+	} {
+		policy, err := LoadPolicy(ref)
+		if err != nil {
+			t.Fatalf("LoadPolicy(%q) error = %v", ref, err)
+		}
+		if policy.Name != want {
+			t.Errorf("LoadPolicy(%q).Name = %q, want %q", ref, policy.Name, want)
+		}
+	}
+
+	if _, err := LoadPolicy(filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Error("missing policy file should fail")
+	}
+}
+
+func TestParsePolicy_RejectsUnknownFields(t *testing.T) {
+	if _, err := ParsePolicy([]byte(`{"rules": [{"method": ["GET"]}]}`), "json"); err == nil {
+		t.Error("unknown JSON field should be rejected")
+	}
+	if _, err := ParsePolicy([]byte("rules:\n  - method: [GET]\n"), "yaml"); err == nil {
+		t.Error("unknown YAML field should be rejected")
+	}
+}
+
+func TestPolicyCompile_Invalid(t *testing.T) {
+	cases := map[string]string{
+		"no rules":             `{"rules": []}`,
+		"bad effect":           `{"rules": [{"effect": "maybe"}]}`,
+		"relative path":        `{"rules": [{"paths": ["_api/cursor"]}]}`,
+		"db prefix in path":    `{"rules": [{"paths": ["/_db/x/_api/cursor"]}]}`,
+		"rest not last":        `{"rules": [{"paths": ["/_api/**/x"]}]}`,
+		"unknown placeholder":  `{"rules": [{"paths": ["/_api/{key}"]}]}`,
+		"empty segment":        `{"rules": [{"paths": ["/_api//x"]}]}`,
+		"collections no path":  `{"rules": [{"collections": ["c"]}]}`,
+		"bad glob":             `{"rules": [{"databases": ["["]}]}`,
+		"aql on deny":          `{"rules": [{"effect": "deny", "aql": {"deny_writes": true}}]}`,
+		"aql limit too large":  `{"rules": [{"aql": {"max_body_bytes": 999999999}}]}`,
+		"collections no match": `{"rules": [{"paths": ["/_api/document/*"], "collections": ["c"]}]}`,
+		"empty peer":           `{"rules": [{"peer": {}}]}`,
+		"unknown peer user":    `{"rules": [{"peer": {"users": ["no-such-user-for-proxy-tests"]}}]}`,
+		"unknown category":     `{"rules": [{"categories": ["foxx"]}]}`,
+		"transaction on deny":  `{"rules": [{"effect": "deny", "transaction": {"deny_writes": true}}]}`,
+	}
+
+	for name, data := range cases {
+		t.Run(name, func(t *testing.T) {
+			policy, err := ParsePolicy([]byte(data), "json")
+			if err != nil {
+				t.Fatalf("ParsePolicy() error = %v", err)
+			}
+			if _, err := policy.Compile(); err == nil {
+				t.Error("Compile() should fail")
+			}
+		})
+	}
+}
+
+func TestPolicy_Selectors(t *testing.T) {
+	allow := mustCompilePolicy(t, `
+name: ingest
+rules:
+  - name: no-users
+    effect: deny
+    paths: ["/_api/document/users/**"]
+  - methods: [POST, PUT]
+    paths: ["/_api/document/{collection}/**"]
+    databases: [knowledge]
+    collections: [chunks, "embed*"]
+  - methods: [DELETE]
+    paths: ["/_api/cursor/{id}"]
+  - methods: [GET]
+    paths: [/_api/version]
+`, "yaml")
+
+	tests := []struct {
+		method string
+		path   string
+		allow  bool
+	}{
+		{http.MethodPost, "/_db/knowledge/_api/document/chunks", true},
+		{http.MethodPut, "/_db/knowledge/_api/document/embeddings/key", true},
+		{http.MethodPost, "/_db/knowledge/_api/document/other", false},
+		{http.MethodPost, "/_db/other/_api/document/chunks", false},
+		{http.MethodPost, "/_api/document/chunks", false}, // _system
+		{http.MethodPatch, "/_db/knowledge/_api/document/chunks", false},
+		{http.MethodGet, "/_api/document/users/1", false},
+		{http.MethodDelete, "/_api/cursor/123", true},
+		{http.MethodDelete, "/_api/cursor/abc", false},
+		{http.MethodDelete, "/_api/cursor/", false},
+		{http.MethodGet, "/_api/version", true},
+		{http.MethodGet, "/_api/version/x", false},
+		{http.MethodGet, "/_db/../_api/version", false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.method+" "+tc.path, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, nil)
+			err := allow(req, emptyBodyPeeker())
+			if tc.allow && err != nil {
+				t.Errorf("should be allowed, got error: %v", err)
+			}
+			if !tc.allow && err == nil {
+				t.Error("should be denied")
+			}
+		})
+	}
+}
+
+func TestPolicy_CategorySelector(t *testing.T) {
+	allow := mustCompilePolicy(t, `
+rules:
+  - name: no-schema-changes
+    effect: deny
+    categories: [schema]
+  - methods: [GET, POST, DELETE]
+`, "yaml")
+
+	for path, want := range map[string]bool{
+		"/_api/document/chunks":    true,
+		"/_api/collection":         false,
+		"/_api/index?collection=c": false,
+	} {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		if err := allow(req, emptyBodyPeeker()); (err == nil) != want {
+			t.Errorf("POST %s: err = %v, want allowed %v", path, err, want)
+		}
+	}
+}
+
+func TestPolicy_DenyRuleReportsName(t *testing.T) {
+	allow := mustCompilePolicy(t, `{"rules": [
+		{"name": "no-admin", "effect": "deny", "paths": ["/_admin/**"]},
+		{"methods": ["GET"]}
+	]}`, "json")
+
+	req := httptest.NewRequest(http.MethodGet, "/_admin/log", nil)
+	err := allow(req, emptyBodyPeeker())
+	if err == nil || !strings.Contains(err.Error(), "no-admin") {
+		t.Errorf("error should name the deny rule, got: %v", err)
+	}
+}
+
+func TestPolicy_AQLRule(t *testing.T) {
+	allow := mustCompilePolicy(t, `{"rules": [
+		{"methods": ["POST"], "paths": ["/_api/cursor"], "aql": {"deny_keywords": ["collect"], "max_body_bytes": 64}}
+	]}`, "json")
+
+	req := httptest.NewRequest(http.MethodPost, "/_api/cursor", nil)
+	if err := allow(req, mockBodyPeeker(`{"query": "INSERT {} INTO c"}`)); err != nil {
+		t.Errorf("INSERT is not denied by this rule, got error: %v", err)
+	}
+	err := allow(req, mockBodyPeeker(`{"query": "FOR d IN c COLLECT x = d.x RETURN x"}`))
+	if err == nil || !strings.Contains(err.Error(), "COLLECT") {
+		t.Errorf("COLLECT should be denied, got: %v", err)
+	}
+
+	var gotLimit int64
+	_ = allow(req, func(limit int64) ([]byte, error) {
+		gotLimit = limit
+		return nil, nil
+	})
+	if gotLimit != 64 {
+		t.Errorf("peek limit = %d, want 64", gotLimit)
+	}
+}
+
+func TestPolicyFromEnv(t *testing.T) {
+	fallback := func(*http.Request, BodyPeeker) error { return nil }
+
+	t.Setenv("POLICY_FILE", "")
+	allow, err := PolicyFromEnv(fallback)
+	if err != nil || allow == nil {
+		t.Fatalf("PolicyFromEnv() without POLICY_FILE = %v, %v", allow, err)
+	}
+
+	t.Setenv("POLICY_FILE", "builtin:read-only")
+	allow, err = PolicyFromEnv(fallback)
+	if err != nil {
+		t.Fatalf("PolicyFromEnv() error = %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPut, "/_api/document/c/k", nil)
+	if err := allow(req, emptyBodyPeeker()); err == nil {
+		t.Error("builtin:read-only should deny PUT")
+	}
+
+	t.Setenv("POLICY_FILE", "builtin:missing")
+	if _, err := PolicyFromEnv(fallback); err == nil {
+		t.Error("unknown policy should fail")
+	}
+}
+
+func TestParseRequestPath(t *testing.T) {
+	tests := []struct {
+		path     string
+		database string
+		segments string
+		ok       bool
+	}{
+		{"/_api/version", "_system", "_api/version", true},
+		{"/_db/mydb/_api/cursor/1", "mydb", "_api/cursor/1", true},
+		{"/_db/my-db_2/_api", "my-db_2", "_api", true},
+		{"/_db/my.db/_api", "", "", false},
+		{"/_db//_api", "", "", false},
+		{"/_db/mydb", "", "", false},
+		{"/_api/../_admin", "", "", false},
+		{"relative", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, ok := parseRequestPath(tt.path)
+			if ok != tt.ok {
+				t.Fatalf("parseRequestPath(%q) ok = %v, want %v", tt.path, ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if got.database() != tt.database {
+				t.Errorf("database = %q, want %q", got.database(), tt.database)
+			}
+			if joined := strings.Join(got.segments, "/"); joined != tt.segments {
+				t.Errorf("segments = %q, want %q", joined, tt.segments)
+			}
+		})
+	}
+}
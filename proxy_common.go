@@ -3,8 +3,9 @@
 package proxy
 
 import (
-	"bytes"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -13,7 +14,10 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/http2"
@@ -37,6 +41,8 @@ const (
 
 	// MaxBodyPeekSize is the maximum number of bytes that can be read from a
 	// request body for inspection. This prevents memory exhaustion attacks.
+	// Bodies inspected line by line (see RequestBody.CheckLines) may be of
+	// any size; only a line at a time is held.
 	MaxBodyPeekSize = 16 * 1024 * 1024 // 16 MB
 
 	// DefaultReadTimeout is the maximum duration for reading the entire request.
@@ -47,6 +53,22 @@ const (
 
 	// DefaultIdleTimeout is the maximum amount of time to wait for the next request.
 	DefaultIdleTimeout = 120 * time.Second
+
+	// DefaultClientTimeout bounds an upstream request, including reading
+	// the response.
+	DefaultClientTimeout = 120 * time.Second
+
+	// DefaultDialTimeout bounds connecting to the upstream socket.
+	DefaultDialTimeout = 10 * time.Second
+
+	// upstreamIdleConnTimeout closes upstream connections left idle this
+	// long.
+	upstreamIdleConnTimeout = 90 * time.Second
+
+	// upstreamBaseURL is the scheme and host used for upstream requests. The
+	// host is ignored by the Unix socket transport, and replaced by the
+	// endpoint's by the TCP one.
+	upstreamBaseURL = "http://arangodb"
 )
 
 // cursorPathRegexp matches ArangoDB cursor API paths.
@@ -73,54 +95,254 @@ type AllowFunc func(*http.Request, BodyPeeker) error
 
 // UnixReverseProxy forwards HTTP requests to an upstream server exposed via Unix socket.
 type UnixReverseProxy struct {
-	upstreamSocket string
-	allowFunc      AllowFunc
-	client         *http.Client
+	// mu serializes updates of state; requests load it without locking.
+	mu           sync.Mutex
+	state        atomic.Pointer[proxyState]
+	transactions *TransactionTracker
+	metrics      *Metrics
+	audit        *AuditLog
+	health       *HealthChecker
+	// logger receives warnings about requests; nil means log.Default().
+	logger *log.Logger
+	// name is the daemon listener the proxy serves, labelling its metrics;
+	// empty for the single-socket binaries.
+	name string
+}
+
+// proxyState is the configuration requests are served with. It is
+// replaced as a whole, never modified, so a request is served entirely
+// with the configuration it started with, even across a reload.
+type proxyState struct {
+	upstream    string
+	allowFunc   AllowFunc
+	databases   *DatabaseAccess
+	categories  *CategoryAccess
+	collections *CollectionAccess
+	client      *http.Client
+	// dirtyReads lets followers of an active failover deployment serve
+	// reads.
+	dirtyReads bool
+	// credentials, if set, replace the clients' Authorization header.
+	credentials *Credentials
 }
 
 // NewUnixReverseProxy creates a new reverse proxy that forwards requests to the
 // upstream Unix socket, applying the given allow function to each request.
+// It uses DefaultUpstreamSettings; see New for a configurable proxy server.
 func NewUnixReverseProxy(upstreamSocket string, allowFunc AllowFunc) *UnixReverseProxy {
-	transport := newUnixTransport(upstreamSocket)
-	timeoutSec := GetEnv("PROXY_CLIENT_TIMEOUT_SECONDS", GetEnv("CLIENT_TIMEOUT_SECONDS", "120"))
-	timeout := 120 * time.Second
+	p := &UnixReverseProxy{transactions: NewTransactionTracker()}
+	p.state.Store(&proxyState{
+		upstream:   upstreamSocket,
+		allowFunc:  allowFunc,
+		categories: defaultCategoryAccess,
+		client: &http.Client{
+			Transport: newUnixTransport(upstreamSocket, DefaultDialTimeout),
+			Timeout:   DefaultClientTimeout,
+		},
+	})
+	return p
+}
+
+// UpstreamSettings describe how the proxy reaches ArangoDB.
+type UpstreamSettings struct {
+	// Socket is the path of ArangoDB's Unix socket, used when Endpoints is
+	// empty.
+	Socket string
+	// Endpoints, if set, are used instead of Socket; see
+	// ParseUpstreamEndpoint. Requests are spread over several endpoints,
+	// such as the coordinators of a cluster, according to Balance.
+	Endpoints []string
+	// Balance chooses among Endpoints; empty means BalanceRoundRobin.
+	Balance BalancePolicy
+	// ClientTimeout bounds each upstream request; zero disables it.
+	ClientTimeout time.Duration
+	DialTimeout   time.Duration
+	// TLS configures ssl:// and https:// endpoints.
+	TLS UpstreamTLS
+	// HealthCheck configures the health checker and circuit breaker;
+	// the zero value disables them.
+	HealthCheck HealthCheckSettings
+
+	// tlsFiles describes the TLS files as they were when the settings
+	// were loaded, so that a reload notices when they change.
+	tlsFiles string
+}
+
+// DefaultUpstreamSettings returns the settings for socket with the default
+// timeouts and health check.
+func DefaultUpstreamSettings(socket string) UpstreamSettings {
+	return UpstreamSettings{
+		Socket:        socket,
+		ClientTimeout: DefaultClientTimeout,
+		DialTimeout:   DefaultDialTimeout,
+		HealthCheck:   DefaultHealthCheckSettings(),
+	}
+}
+
+// UpstreamSettingsFromEnv reads the endpoints from UPSTREAM, separated by
+// commas, and how to balance them from UPSTREAM_BALANCE, with TLS options
+// from UPSTREAM_CA_FILE, UPSTREAM_CERT_FILE, UPSTREAM_KEY_FILE and
+// UPSTREAM_SERVER_NAME, and the client and dial timeouts from
+// PROXY_CLIENT_TIMEOUT_SECONDS and PROXY_DIAL_TIMEOUT_SECONDS. Without
+// UPSTREAM the proxy connects to socket.
+func UpstreamSettingsFromEnv(socket string) UpstreamSettings {
+	settings := DefaultUpstreamSettings(socket)
+	for _, endpoint := range strings.Split(GetEnv("UPSTREAM", ""), ",") {
+		if endpoint = strings.TrimSpace(endpoint); endpoint != "" {
+			settings.Endpoints = append(settings.Endpoints, endpoint)
+		}
+	}
+	settings.Balance = BalancePolicy(GetEnv("UPSTREAM_BALANCE", ""))
+	settings.TLS = UpstreamTLS{
+		CAFile:     GetEnv("UPSTREAM_CA_FILE", ""),
+		CertFile:   GetEnv("UPSTREAM_CERT_FILE", ""),
+		KeyFile:    GetEnv("UPSTREAM_KEY_FILE", ""),
+		ServerName: GetEnv("UPSTREAM_SERVER_NAME", ""),
+	}
+	timeoutSec := GetEnv("PROXY_CLIENT_TIMEOUT_SECONDS", GetEnv("CLIENT_TIMEOUT_SECONDS", ""))
 	if d, err := time.ParseDuration(timeoutSec + "s"); err == nil {
-		timeout = d
-	}
-	if timeoutSec == "0" {
-		log.Printf("proxy client timeout: disabled (0s)")
-		return &UnixReverseProxy{
-			upstreamSocket: upstreamSocket,
-			allowFunc:      allowFunc,
-			client: &http.Client{
-				Transport: transport,
-				Timeout:   0,
-			},
+		settings.ClientTimeout = d
+	}
+	if d, err := time.ParseDuration(GetEnv("PROXY_DIAL_TIMEOUT_SECONDS", "") + "s"); err == nil {
+		settings.DialTimeout = d
+	}
+	return settings
+}
+
+// endpoints returns where ArangoDB listens.
+func (u UpstreamSettings) endpoints() ([]UpstreamEndpoint, error) {
+	if len(u.Endpoints) == 0 {
+		if u.Socket == "" {
+			return nil, errors.New("no upstream configured")
 		}
+		return []UpstreamEndpoint{{Network: "unix", Address: u.Socket}}, nil
 	}
-	log.Printf("proxy client timeout: %s", timeout)
-	return &UnixReverseProxy{
-		upstreamSocket: upstreamSocket,
-		allowFunc:      allowFunc,
-		client: &http.Client{
-			Transport: transport,
-			Timeout:   timeout,
-		},
+	endpoints := make([]UpstreamEndpoint, 0, len(u.Endpoints))
+	seen := make(map[UpstreamEndpoint]bool)
+	for _, s := range u.Endpoints {
+		endpoint, err := ParseUpstreamEndpoint(s)
+		if err != nil {
+			return nil, err
+		}
+		if seen[endpoint] {
+			return nil, fmt.Errorf("duplicate upstream %s", endpoint)
+		}
+		seen[endpoint] = true
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints, nil
+}
+
+// String names the upstream endpoints for logs.
+func (u UpstreamSettings) String() string {
+	endpoints, err := u.endpoints()
+	if err != nil {
+		return "invalid"
+	}
+	names := make([]string, len(endpoints))
+	for i, endpoint := range endpoints {
+		names[i] = endpoint.String()
+	}
+	return strings.Join(names, ",")
+}
+
+// Validate checks the endpoints and the health check and loads the TLS
+// files.
+func (u UpstreamSettings) Validate() error {
+	if err := u.HealthCheck.validate(); err != nil {
+		return err
 	}
+	_, err := u.newClient()
+	return err
 }
 
-func newUnixTransport(socketPath string) *http.Transport {
-	dialTimeoutSec := GetEnv("PROXY_DIAL_TIMEOUT_SECONDS", "10")
-	dialTimeout := 10 * time.Second
-	if d, err := time.ParseDuration(dialTimeoutSec + "s"); err == nil {
-		dialTimeout = d
+// load validates the settings, recording the contents of the TLS files.
+func (u *UpstreamSettings) load() error {
+	u.tlsFiles = u.TLS.describe()
+	return u.Validate()
+}
+
+// settings describes the upstream as named values, for logging and for
+// diffing against a reloaded configuration.
+func (u UpstreamSettings) settings() map[string]string {
+	clientTimeout := u.ClientTimeout.String()
+	if u.ClientTimeout == 0 {
+		clientTimeout = "disabled"
+	}
+	settings := map[string]string{
+		"upstream":              u.String(),
+		"proxy client timeout":  clientTimeout,
+		"proxy dial timeout":    u.DialTimeout.String(),
+		"upstream health check": u.HealthCheck.String(),
+	}
+	endpoints, _ := u.endpoints()
+	if len(endpoints) > 1 {
+		balance, err := ParseBalancePolicy(string(u.Balance))
+		if err != nil {
+			balance = "invalid"
+		}
+		settings["upstream balance"] = string(balance)
+	}
+	for _, endpoint := range endpoints {
+		if endpoint.TLS {
+			settings["upstream tls"] = u.tlsFiles
+			if u.tlsFiles == "" {
+				settings["upstream tls"] = u.TLS.describe()
+			}
+			break
+		}
+	}
+	return settings
+}
+
+// newClient returns a client for the upstream. A Unix socket is dialled
+// directly; TCP endpoints are reached through an endpointTransport. Several
+// endpoints are balanced.
+func (u UpstreamSettings) newClient() (*http.Client, error) {
+	endpoints, err := u.endpoints()
+	if err != nil {
+		return nil, err
+	}
+	policy, err := ParseBalancePolicy(string(u.Balance))
+	if err != nil {
+		return nil, err
+	}
+	targets := make([]*upstreamTarget, len(endpoints))
+	for i, endpoint := range endpoints {
+		if !endpoint.TLS && !u.TLS.IsZero() {
+			return nil, fmt.Errorf("upstream TLS options require an ssl:// or https:// endpoint, not %s", endpoint)
+		}
+		targets[i] = &upstreamTarget{endpoint: endpoint}
+		if endpoint.Network == "unix" {
+			targets[i].transport = newUnixTransport(endpoint.Address, u.DialTimeout)
+			continue
+		}
+		var tlsConfig *tls.Config
+		if endpoint.TLS {
+			host, _, _ := net.SplitHostPort(endpoint.Address)
+			if tlsConfig, err = u.TLS.config(host); err != nil {
+				return nil, err
+			}
+		}
+		targets[i].transport = newTCPTransport(endpoint, u.DialTimeout, tlsConfig)
+	}
+	transport := targets[0].transport
+	if len(targets) > 1 {
+		transport = newBalancer(targets, policy)
 	}
+	return &http.Client{Transport: transport, Timeout: u.ClientTimeout}, nil
+}
+
+func newUnixTransport(socketPath string, dialTimeout time.Duration) *http.Transport {
 	dialer := &net.Dialer{Timeout: dialTimeout}
 	transport := &http.Transport{
 		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
 			return dialer.DialContext(ctx, "unix", socketPath)
 		},
 		ForceAttemptHTTP2: true,
+		// Connections of a client replaced by a reload close themselves
+		// once their last request is done.
+		IdleConnTimeout: upstreamIdleConnTimeout,
 	}
 	if err := http2.ConfigureTransport(transport); err != nil {
 		log.Printf("warning: failed to configure HTTP/2 transport, falling back to HTTP/1.1: %v", err)
@@ -128,87 +350,286 @@ func newUnixTransport(socketPath string) *http.Transport {
 	return transport
 }
 
-// ServeHTTP implements the http.Handler interface.
-func (p *UnixReverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	var cachedBody []byte
-	bodyConsumed := false
+// update replaces the proxy's state with a copy changed by change.
+func (p *UnixReverseProxy) update(change func(*proxyState)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	next := *p.state.Load()
+	change(&next)
+	p.state.Store(&next)
+}
+
+// Client returns the HTTP client used for upstream requests, so that
+// policies needing their own upstream calls share its transport.
+func (p *UnixReverseProxy) Client() *http.Client {
+	return p.state.Load().client
+}
 
-	bodyReader := func(limit int64) ([]byte, error) {
-		if bodyConsumed {
-			return cachedBody, nil
+// SetAllowFunc replaces the function deciding which requests are allowed.
+func (p *UnixReverseProxy) SetAllowFunc(allowFunc AllowFunc) {
+	p.update(func(s *proxyState) { s.allowFunc = allowFunc })
+}
+
+// SetDatabaseAccess restricts the databases the proxy forwards to. A nil
+// value removes the restriction.
+func (p *UnixReverseProxy) SetDatabaseAccess(databases *DatabaseAccess) {
+	p.update(func(s *proxyState) { s.databases = databases })
+}
+
+// SetCategoryAccess sets the endpoint categories the proxy forwards. By
+// default only DefaultEndpointCategories are enabled; a nil value enables
+// every category, leaving the decision to the allow function.
+func (p *UnixReverseProxy) SetCategoryAccess(categories *CategoryAccess) {
+	p.update(func(s *proxyState) { s.categories = categories })
+}
+
+// SetMetrics makes the proxy record request statistics in metrics. A nil
+// value disables collection.
+func (p *UnixReverseProxy) SetMetrics(metrics *Metrics) {
+	p.metrics = metrics
+}
+
+// SetAuditLog makes the proxy record every allowed mutating request in
+// audit. A nil value disables auditing.
+func (p *UnixReverseProxy) SetAuditLog(audit *AuditLog) {
+	p.audit = audit
+}
+
+// SetCollectionAccess restricts the collections the proxy forwards requests
+// for. A nil value removes the restriction.
+func (p *UnixReverseProxy) SetCollectionAccess(collections *CollectionAccess) {
+	p.update(func(s *proxyState) { s.collections = collections })
+}
+
+// SetDirtyReads lets reads be served by followers of an active failover
+// deployment, which may lag behind the leader. A read is a GET or HEAD
+// request for data, or a cursor request whose AQL the policy checked for
+// write keywords; everything else goes to the leader. It has no effect
+// unless the upstream is balanced with BalanceActiveFailover.
+func (p *UnixReverseProxy) SetDirtyReads(dirtyReads bool) {
+	p.update(func(s *proxyState) { s.dirtyReads = dirtyReads })
+}
+
+// SetCredentials makes the proxy authenticate requests to ArangoDB with
+// credentials, replacing any Authorization header sent by clients. Nil
+// forwards the clients' own.
+func (p *UnixReverseProxy) SetCredentials(credentials *Credentials) {
+	p.update(func(s *proxyState) { s.credentials = credentials })
+}
+
+// SetHealthChecker makes the proxy fail fast with 503 while health's
+// circuit is open and report upstream connection errors to it. A nil value
+// forwards every request.
+func (p *UnixReverseProxy) SetHealthChecker(health *HealthChecker) {
+	p.health = health
+}
+
+// Transactions returns the tracker of stream transactions begun through the
+// proxy.
+func (p *UnixReverseProxy) Transactions() *TransactionTracker {
+	return p.transactions
+}
+
+// authenticate replaces the client's Authorization header of r, a copy of
+// the request being served, with the listener's credentials, if it has
+// any. It runs before authorize, so that query plan verification
+// authenticates as ArangoDB will see the request.
+func (p *UnixReverseProxy) authenticate(state *proxyState, r *http.Request) error {
+	if state.credentials == nil {
+		return nil
+	}
+	auth, err := state.credentials.authorization(r)
+	if err != nil {
+		return err
+	}
+	r.Header = r.Header.Clone()
+	r.Header.Set("Authorization", auth)
+	return nil
+}
+
+// authorize applies the database, endpoint category and collection
+// restrictions, the allow function and stream transaction ownership.
+func (p *UnixReverseProxy) authorize(state *proxyState, r *http.Request, peek BodyPeeker) error {
+	mode := DatabaseReadWrite
+	if state.databases != nil {
+		var err error
+		if mode, err = state.databases.resolve(r); err != nil {
+			noteRule(r, "database")
+			return err
 		}
-		if r.Body == nil {
-			bodyConsumed = true
-			return nil, nil
+	}
+	if state.categories != nil {
+		if err := state.categories.check(r); err != nil {
+			noteRule(r, "category")
+			return err
 		}
-		defer func() {
-			bodyConsumed = true
-		}()
-
-		// Enforce maximum body size limit to prevent memory exhaustion
-		effectiveLimit := limit
-		if effectiveLimit <= 0 || effectiveLimit > MaxBodyPeekSize {
-			effectiveLimit = MaxBodyPeekSize
+	}
+	if state.collections != nil {
+		if err := state.collections.check(r, peek); err != nil {
+			noteRule(r, "collection")
+			return err
 		}
-
-		var buf bytes.Buffer
-		lr := &io.LimitedReader{R: r.Body, N: effectiveLimit + 1}
-		if _, err := buf.ReadFrom(lr); err != nil {
-			_ = r.Body.Close()
-			return nil, err
+	}
+	if err := state.allowFunc(r, peek); err != nil {
+		return err
+	}
+	if mode == DatabaseReadOnly {
+		// The socket's categories have been checked; apply only the
+		// read-only policy itself.
+		if err := builtinReadOnly(r, peek); err != nil {
+			if decision, ok := DecisionFromContext(r.Context()); ok {
+				decision.Rule = "read-only-database"
+			}
+			return err
 		}
-		if lr.N <= 0 {
-			_ = r.Body.Close()
-			return nil, fmt.Errorf("request body exceeds inspection limit (%d bytes)", effectiveLimit)
+	}
+	if p.transactions != nil {
+		if err := p.transactions.check(r); err != nil {
+			if decision, ok := DecisionFromContext(r.Context()); ok {
+				decision.Rule = "transaction"
+			}
+			return err
 		}
+	}
+	return nil
+}
 
-		if err := r.Body.Close(); err != nil {
-			log.Printf("warning: failed to close request body: %v", err)
-		}
-		cachedBody = append([]byte(nil), buf.Bytes()...)
-		return cachedBody, nil
+// ServeHTTP implements the http.Handler interface.
+func (p *UnixReverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body := newRequestBody(r.Body)
+	decision, r := decisionFor(r)
+	r = r.WithContext(withRequestBody(r.Context(), body))
+
+	var forwarded *countingReader
+	var written int64
+	if p.metrics != nil {
+		p.metrics.requestStarted()
+		defer func() {
+			var read int64
+			if forwarded != nil {
+				read = forwarded.n.Load()
+			}
+			p.metrics.requestFinished(r.Method, decision, read, written)
+		}()
 	}
 
-	if err := p.allowFunc(r, bodyReader); err != nil {
+	state := p.state.Load()
+	err := p.authenticate(state, r)
+	if err == nil {
+		err = p.authorize(state, r, body.Peek)
+	}
+	decision.noteTarget(r)
+	if err != nil {
+		decision.Err = err
 		// Ensure body is closed on early return to prevent resource leaks
-		if r.Body != nil && !bodyConsumed {
-			_ = r.Body.Close()
-		}
+		body.close()
 		http.Error(w, err.Error(), http.StatusForbidden)
 		return
 	}
-
-	var upstreamBody io.ReadCloser
-	if bodyConsumed {
-		upstreamBody = io.NopCloser(bytes.NewReader(cachedBody))
-	} else {
-		upstreamBody = r.Body
+	decision.Allowed = true
+	if retry, open := p.health.retryAfter(); open {
+		body.close()
+		if p.metrics != nil {
+			p.metrics.upstreamUnavailable()
+		}
+		w.Header().Set("Retry-After", retryAfterSeconds(retry))
+		http.Error(w, "upstream unavailable, retry later", http.StatusServiceUnavailable)
+		return
+	}
+	var audit *AuditRecord
+	if p.audit != nil {
+		audit = p.audit.prepare(r, body, decision)
 	}
 
+	upstreamBody, contentLength := body.reader(r.ContentLength)
+	if upstreamBody != http.NoBody {
+		forwarded = &countingReader{ReadCloser: upstreamBody}
+		upstreamBody = forwarded
+	}
 	upstreamURL := buildUpstreamURL(r)
-	upstreamReq, err := http.NewRequestWithContext(r.Context(), r.Method, upstreamURL, upstreamBody)
+	ctx := r.Context()
+	if state.dirtyReads && mayReadDirty(r, decision) {
+		ctx = withDirtyRead(ctx)
+	}
+	upstreamReq, err := http.NewRequestWithContext(ctx, r.Method, upstreamURL, upstreamBody)
 	if err != nil {
 		http.Error(w, "failed to build upstream request", http.StatusInternalServerError)
 		return
 	}
+	upstreamReq.GetBody = body.replay()
 
 	copyHeaders(upstreamReq.Header, r.Header)
-	if bodyConsumed {
-		upstreamReq.ContentLength = int64(len(cachedBody))
-	}
+	upstreamReq.ContentLength = contentLength
 
-	resp, err := p.client.Do(upstreamReq)
+	start := time.Now()
+	resp, err := state.client.Do(upstreamReq)
 	if err != nil {
+		if streamErr := body.StreamErr(); streamErr != nil {
+			decision.Allowed = false
+			decision.Err = streamErr
+			p.finishAudit(audit, http.StatusForbidden, nil)
+			http.Error(w, streamErr.Error(), http.StatusForbidden)
+			return
+		}
+		if p.metrics != nil {
+			p.metrics.upstreamError()
+		}
+		p.health.observe(state.client, err)
+		// ArangoDB may have applied the change before its response was
+		// lost, so the attempt is recorded without a status.
+		p.finishAudit(audit, 0, nil)
 		http.Error(w, fmt.Sprintf("upstream error: %v", err), http.StatusBadGateway)
 		return
 	}
 	defer resp.Body.Close()
+	decision.Upstream = time.Since(start)
+	if p.metrics != nil {
+		p.metrics.observeUpstream(decision.Category, decision.Upstream)
+	}
+
+	if p.transactions != nil {
+		if err := p.transactions.observe(r, resp); err != nil {
+			p.logf("warning: %v", err)
+		}
+	}
+
+	var responseBody io.Reader = resp.Body
+	var captured *cappedBuffer
+	if audit != nil && audit.captureKeys {
+		captured = &cappedBuffer{limit: auditResponseLimit}
+		responseBody = io.TeeReader(resp.Body, captured)
+	}
 
 	copyHeaders(w.Header(), resp.Header)
 	w.WriteHeader(resp.StatusCode)
-	if _, err := io.Copy(w, resp.Body); err != nil {
-		log.Printf("warning: failed to copy upstream response: %v", err)
+	if written, err = io.Copy(w, responseBody); err != nil {
+		p.logf("warning: failed to copy upstream response: %v", err)
 	}
+
+	p.finishAudit(audit, resp.StatusCode, captured.Bytes())
+}
+
+// finishAudit appends record, if there is one, with the status of the
+// request.
+func (p *UnixReverseProxy) finishAudit(record *AuditRecord, status int, response []byte) {
+	if record == nil {
+		return
+	}
+	if err := p.audit.finish(record, status, response); err != nil {
+		p.logf("error: %v", err)
+		if p.metrics != nil {
+			p.metrics.auditWriteFailed()
+		}
+	}
+}
+
+// logf logs to the proxy's logger.
+func (p *UnixReverseProxy) logf(format string, args ...any) {
+	logger := p.logger
+	if logger == nil {
+		logger = log.Default()
+	}
+	logger.Printf(format, args...)
 }
 
 func copyHeaders(dst, src http.Header) {
@@ -255,7 +676,7 @@ func cloneHeader(src http.Header) http.Header {
 
 func buildUpstreamURL(r *http.Request) string {
 	var builder strings.Builder
-	builder.WriteString("http://arangodb")
+	builder.WriteString(upstreamBaseURL)
 	builder.WriteString(r.URL.Path)
 	if raw := r.URL.RawQuery; raw != "" {
 		builder.WriteByte('?')
@@ -264,11 +685,12 @@ func buildUpstreamURL(r *http.Request) string {
 	return builder.String()
 }
 
-// RemoveIfExists removes a file if it exists, fatally logging on other errors.
-func RemoveIfExists(path string) {
+// RemoveIfExists removes a file if it exists.
+func RemoveIfExists(path string) error {
 	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
-		log.Fatalf("failed to remove existing socket %s: %v", path, err)
+		return fmt.Errorf("failed to remove existing socket %s: %w", path, err)
 	}
+	return nil
 }
 
 // EnsureParentDir creates parent directories for the given path if needed.
@@ -281,10 +703,11 @@ func EnsureParentDir(path string) error {
 }
 
 // EnsureSocketMode sets the permissions on a socket file.
-func EnsureSocketMode(path string, mode os.FileMode) {
+func EnsureSocketMode(path string, mode os.FileMode) error {
 	if err := os.Chmod(path, mode); err != nil {
-		log.Fatalf("failed to chmod %s: %v", path, err)
+		return fmt.Errorf("failed to chmod %s: %w", path, err)
 	}
+	return nil
 }
 
 // GetEnv returns the value of an environment variable or a fallback default.
@@ -295,14 +718,35 @@ func GetEnv(key, fallback string) string {
 	return fallback
 }
 
-// LogRequests wraps an http.Handler to log each request's method and path.
+// GetEnvBool parses a boolean environment variable, returning fallback when
+// it is unset. Invalid values are an error rather than silently ignored.
+func GetEnvBool(key string, fallback bool) (bool, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q: %w", key, value, err)
+	}
+	return parsed, nil
+}
+
+// LogRequests wraps an http.Handler to log each request's method and path,
+// and the connecting process's credentials when they are known.
+//
+// Deprecated: Use AccessLog, which also records the outcome of each request.
 func LogRequests(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		loggedPath := r.URL.Path
 		if r.URL.RawQuery != "" {
 			loggedPath += "?<redacted>"
 		}
-		log.Printf("%s %s", r.Method, loggedPath)
+		if cred, ok := PeerCredFromContext(r.Context()); ok {
+			log.Printf("%s %s (%s)", r.Method, loggedPath, cred)
+		} else {
+			log.Printf("%s %s", r.Method, loggedPath)
+		}
 		handler.ServeHTTP(w, r)
 	})
 }
@@ -313,12 +757,14 @@ func IsCursorPath(path string) bool {
 }
 
 // NewServerWithTimeouts creates an HTTP server with sensible timeout defaults.
+// Each connection's peer credentials are captured via PeerCredConnContext.
 func NewServerWithTimeouts(handler http.Handler) *http.Server {
 	return &http.Server{
 		Handler:      handler,
 		ReadTimeout:  DefaultReadTimeout,
 		WriteTimeout: DefaultWriteTimeout,
 		IdleTimeout:  DefaultIdleTimeout,
+		ConnContext:  PeerCredConnContext,
 	}
 }
 
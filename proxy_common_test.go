@@ -1,15 +1,31 @@
 package proxy
 
 import (
-	"bytes"
-	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
 
+// startFakeUpstream serves handler on a Unix socket in a temporary directory
+// and returns the socket path. The server is closed when the test ends.
+func startFakeUpstream(t *testing.T, handler http.Handler) string {
+	t.Helper()
+	socketPath := filepath.Join(t.TempDir(), "upstream.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("listen on fake upstream: %v", err)
+	}
+	server := httptest.NewUnstartedServer(handler)
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+	return socketPath
+}
+
 func TestBuildUpstreamURL(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -242,105 +258,37 @@ func TestGetEnv(t *testing.T) {
 }
 
 func TestBodyPeeker(t *testing.T) {
-	// Create a mock request with body
 	body := `{"query": "FOR doc IN collection RETURN doc"}`
 	req := httptest.NewRequest(http.MethodPost, "/_api/cursor", strings.NewReader(body))
-
-	// Create the proxy's internal body reader simulation
-	var cachedBody []byte
-	bodyConsumed := false
-
-	bodyReader := func(limit int64) ([]byte, error) {
-		if bodyConsumed {
-			return cachedBody, nil
-		}
-		if req.Body == nil {
-			bodyConsumed = true
-			return nil, nil
-		}
-		defer func() {
-			bodyConsumed = true
-		}()
-
-		effectiveLimit := limit
-		if effectiveLimit <= 0 || effectiveLimit > MaxBodyPeekSize {
-			effectiveLimit = MaxBodyPeekSize
-		}
-
-		var buf bytes.Buffer
-		lr := &io.LimitedReader{R: req.Body, N: effectiveLimit + 1}
-		if _, err := buf.ReadFrom(lr); err != nil {
-			return nil, err
-		}
-		if lr.N <= 0 {
-			return nil, io.ErrUnexpectedEOF
-		}
-
-		cachedBody = buf.Bytes()
-		return cachedBody, nil
-	}
+	peek := BodyPeeker(newRequestBody(req.Body).Peek)
 
 	// First read
-	data, err := bodyReader(1024)
+	data, err := peek(1024)
 	if err != nil {
-		t.Fatalf("bodyReader() error = %v", err)
+		t.Fatalf("peek() error = %v", err)
 	}
 	if string(data) != body {
-		t.Errorf("bodyReader() = %q, want %q", string(data), body)
+		t.Errorf("peek() = %q, want %q", string(data), body)
 	}
 
 	// Second read should return cached data
-	data2, err := bodyReader(1024)
+	data2, err := peek(1024)
 	if err != nil {
-		t.Fatalf("second bodyReader() error = %v", err)
+		t.Fatalf("second peek() error = %v", err)
 	}
 	if string(data2) != body {
-		t.Errorf("second bodyReader() = %q, want %q", string(data2), body)
+		t.Errorf("second peek() = %q, want %q", string(data2), body)
 	}
 }
 
 func TestBodyPeekerExceedsLimit(t *testing.T) {
-	// Create a request with body larger than limit
 	largeBody := strings.Repeat("x", 1000)
 	req := httptest.NewRequest(http.MethodPost, "/_api/cursor", strings.NewReader(largeBody))
-
-	var cachedBody []byte
-	bodyConsumed := false
-
-	bodyReader := func(limit int64) ([]byte, error) {
-		if bodyConsumed {
-			return cachedBody, nil
-		}
-		if req.Body == nil {
-			bodyConsumed = true
-			return nil, nil
-		}
-		defer func() {
-			bodyConsumed = true
-		}()
-
-		effectiveLimit := limit
-		if effectiveLimit <= 0 || effectiveLimit > MaxBodyPeekSize {
-			effectiveLimit = MaxBodyPeekSize
-		}
-
-		var buf bytes.Buffer
-		lr := &io.LimitedReader{R: req.Body, N: effectiveLimit + 1}
-		if _, err := buf.ReadFrom(lr); err != nil {
-			return nil, err
-		}
-		if lr.N <= 0 {
-			return nil, io.ErrUnexpectedEOF
-		}
-
-		cachedBody = buf.Bytes()
-		return cachedBody, nil
-	}
+	peek := BodyPeeker(newRequestBody(req.Body).Peek)
 
 	// Should fail with small limit
-	_, err := bodyReader(100)
-	if err == nil {
-		t.Error("bodyReader() should have failed with small limit")
+	if _, err := peek(100); err == nil {
+		t.Error("peek() should have failed with small limit")
 	}
 }
 
@@ -369,6 +317,23 @@ func TestCloneHeader(t *testing.T) {
 	}
 }
 
+func TestGetEnvBool(t *testing.T) {
+	t.Setenv("TEST_BOOL", "")
+	if got, err := GetEnvBool("TEST_BOOL", true); err != nil || !got {
+		t.Errorf("GetEnvBool() unset = %v, %v; want true, nil", got, err)
+	}
+
+	t.Setenv("TEST_BOOL", "false")
+	if got, err := GetEnvBool("TEST_BOOL", true); err != nil || got {
+		t.Errorf("GetEnvBool() = %v, %v; want false, nil", got, err)
+	}
+
+	t.Setenv("TEST_BOOL", "maybe")
+	if _, err := GetEnvBool("TEST_BOOL", true); err == nil {
+		t.Error("GetEnvBool() should reject invalid values")
+	}
+}
+
 func TestNewServerWithTimeouts(t *testing.T) {
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
 	server := NewServerWithTimeouts(handler)
@@ -383,3 +348,20 @@ func TestNewServerWithTimeouts(t *testing.T) {
 		t.Errorf("IdleTimeout = %v, want %v", server.IdleTimeout, DefaultIdleTimeout)
 	}
 }
+
+func TestSocketHelpers_ReturnErrors(t *testing.T) {
+	dir := t.TempDir()
+	if err := RemoveIfExists(filepath.Join(dir, "missing.sock")); err != nil {
+		t.Errorf("RemoveIfExists() of a missing file = %v", err)
+	}
+	nonEmpty := filepath.Join(dir, "dir")
+	if err := os.MkdirAll(filepath.Join(nonEmpty, "child"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveIfExists(nonEmpty); err == nil {
+		t.Error("RemoveIfExists() of a non-empty directory should fail")
+	}
+	if err := EnsureSocketMode(filepath.Join(dir, "missing.sock"), 0o600); err == nil {
+		t.Error("EnsureSocketMode() of a missing file should fail")
+	}
+}
@@ -0,0 +1,419 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// restartOnlySettings are environment variables read once at startup. A
+// reload reports changes to them but cannot apply them. The same holds for
+// a listener's socket and audit log settings.
+var restartOnlySettings = []string{
+	"ADMIN_LISTEN",
+	"ACCESS_LOG_FORMAT",
+	"ACCESS_LOG_QUERY",
+	"SHUTDOWN_TIMEOUT_SECONDS",
+}
+
+// proxyVariant describes what differs between the proxy binaries.
+type proxyVariant struct {
+	// name starts the "listening" log line, e.g. "Read-only proxy".
+	name         string
+	listenSocket string
+	socketMode   os.FileMode
+	builtin      AllowFunc
+	// verifyQueryPlan enables VERIFY_QUERY_PLAN.
+	verifyQueryPlan bool
+	// audit enables AUDIT_LOG.
+	audit bool
+	// dirtyReads enables DIRTY_READS.
+	dirtyReads bool
+}
+
+// proxyConfig is the reloadable configuration of a listener's proxy.
+type proxyConfig struct {
+	// policy is the policy reference, empty for the variant's built-in
+	// policy, and policyDigest identifies the policy file's contents.
+	policy          string
+	policyDigest    string
+	allow           AllowFunc
+	databases       *DatabaseAccess
+	categories      *CategoryAccess
+	collections     *CollectionAccess
+	verifyQueryPlan bool
+	dirtyReads      bool
+	credentials     *Credentials
+}
+
+// presetConfig reads and validates the configuration of roproxy or rwproxy
+// from the environment: a single listener.
+func presetConfig(v proxyVariant) (*daemonConfig, error) {
+	options, err := SocketOptionsFromEnv(v.socketMode)
+	if err != nil {
+		return nil, err
+	}
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	listener := &listenerConfig{
+		socket:  GetEnv("LISTEN_SOCKET", v.listenSocket),
+		options: options,
+		proxy:   &proxyConfig{},
+	}
+	cfg := &daemonConfig{
+		upstream:  UpstreamSettingsFromEnv(GetEnv("UPSTREAM_SOCKET", DefaultUpstreamSocket)),
+		listeners: []*listenerConfig{listener},
+	}
+	if cfg.upstream.HealthCheck, err = HealthCheckSettingsFromEnv(); err != nil {
+		return nil, err
+	}
+	if err := cfg.upstream.load(); err != nil {
+		return nil, err
+	}
+	proxy := listener.proxy
+	if err = proxy.loadPolicy(GetEnv("POLICY_FILE", ""), v.builtin); err != nil {
+		return nil, err
+	}
+	if proxy.databases, err = DatabaseAccessFromEnv(); err != nil {
+		return nil, err
+	}
+	if proxy.categories, err = CategoryAccessFromEnv(); err != nil {
+		return nil, err
+	}
+	if proxy.collections, err = CollectionAccessFromEnv(); err != nil {
+		return nil, err
+	}
+	if v.verifyQueryPlan {
+		if proxy.verifyQueryPlan, err = GetEnvBool("VERIFY_QUERY_PLAN", false); err != nil {
+			return nil, err
+		}
+	}
+	credentials, err := CredentialSettingsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if err = proxy.loadCredentials(credentials); err != nil {
+		return nil, err
+	}
+	if v.dirtyReads {
+		if proxy.dirtyReads, err = GetEnvBool("DIRTY_READS", false); err != nil {
+			return nil, err
+		}
+	}
+	if v.audit {
+		listener.audit = os.Getenv("AUDIT_LOG")
+		listener.auditKey = os.Getenv("AUDIT_LOG_KEY_FILE")
+		if err := listener.checkAudit(); err != nil {
+			return nil, err
+		}
+		if listener.hashBindValues, err = GetEnvBool("AUDIT_HASH_BIND_VALUES", false); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// loadPolicy compiles the policy named by ref, or uses fallback when ref is
+// empty.
+func (c *proxyConfig) loadPolicy(ref string, fallback AllowFunc) error {
+	c.policy, c.allow = ref, fallback
+	if ref == "" {
+		return nil
+	}
+	var err error
+	if c.allow, err = compilePolicyRef(ref); err != nil {
+		return err
+	}
+	c.policyDigest, err = policyDigest(ref)
+	return err
+}
+
+// loadCredentials reads the credentials to inject.
+func (c *proxyConfig) loadCredentials(settings CredentialSettings) error {
+	credentials, err := settings.Load()
+	if err != nil {
+		return err
+	}
+	c.credentials = credentials
+	return nil
+}
+
+// policyDigest identifies the contents of a policy file, so that a reload
+// notices edits to a file whose name did not change.
+func policyDigest(ref string) (string, error) {
+	if ref == "" || strings.HasPrefix(ref, BuiltinPolicyPrefix) {
+		return "", nil
+	}
+	digest, err := fileDigest(ref)
+	if err != nil {
+		return "", fmt.Errorf("failed to read policy %s: %w", ref, err)
+	}
+	return digest, nil
+}
+
+// state builds the proxy state for the configuration, forwarding with
+// client.
+func (c *proxyConfig) state(upstream UpstreamSettings, client *http.Client) *proxyState {
+	allow := c.allow
+	if c.verifyQueryPlan {
+		allow = NewExplainVerifier(client).Wrap(allow)
+	}
+	return &proxyState{
+		upstream:    upstream.String(),
+		allowFunc:   allow,
+		databases:   c.databases,
+		categories:  c.categories,
+		collections: c.collections,
+		client:      client,
+		dirtyReads:  c.dirtyReads,
+		credentials: c.credentials,
+	}
+}
+
+// settings describes the configuration as named values, for logging and
+// for diffing against a reloaded configuration.
+func (c *proxyConfig) settings() map[string]string {
+	policy := "built-in"
+	if c.policy != "" {
+		policy = c.policy
+		if c.policyDigest != "" {
+			policy += " (sha256:" + c.policyDigest + ")"
+		}
+	}
+	databases := "all"
+	if c.databases != nil {
+		databases = c.databases.String()
+	}
+	collections := "all"
+	if c.collections != nil {
+		collections = c.collections.String()
+	}
+	categories := "all"
+	if c.categories != nil {
+		categories = c.categories.String()
+	}
+	return map[string]string{
+		"policy":                  policy,
+		"database access":         databases,
+		"endpoint categories":     categories,
+		"collection access":       collections,
+		"query plan verification": fmt.Sprint(c.verifyQueryPlan),
+		"dirty reads":             fmt.Sprint(c.dirtyReads),
+		"credentials":             c.credentials.String(),
+	}
+}
+
+// diffSettings lists the settings that differ, as "name: old -> new".
+func diffSettings(old, updated map[string]string) []string {
+	var changes []string
+	for name, value := range updated {
+		if old[name] != value {
+			changes = append(changes, fmt.Sprintf("%s: %s -> %s", name, old[name], value))
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+func logSettings(settings map[string]string) {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		log.Printf("%s: %s", name, settings[name])
+	}
+}
+
+// envFile applies the KEY=VALUE lines of the file named by PROXY_ENV_FILE
+// to the environment, so that settings can be changed for a reload. Blank
+// lines and lines starting with # are ignored. A key removed from the file
+// gets back the value it had when the process started.
+type envFile struct {
+	path     string
+	original map[string]*string
+}
+
+func newEnvFile(path string) *envFile {
+	return &envFile{path: path, original: make(map[string]*string)}
+}
+
+// apply reads the file and updates the environment. Nothing is changed if
+// the file cannot be read or parsed.
+func (e *envFile) apply() error {
+	if e.path == "" {
+		return nil
+	}
+	f, err := os.Open(e.path)
+	if err != nil {
+		return fmt.Errorf("failed to read environment file: %w", err)
+	}
+	defer f.Close()
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(text, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" || strings.ContainsAny(key, " \t") {
+			return fmt.Errorf("%s:%d: want KEY=VALUE", e.path, line)
+		}
+		values[key] = strings.Trim(strings.TrimSpace(value), `"`)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read environment file: %w", err)
+	}
+
+	for key := range e.original {
+		if _, ok := values[key]; !ok {
+			if original := e.original[key]; original != nil {
+				os.Setenv(key, *original)
+			} else {
+				os.Unsetenv(key)
+			}
+			delete(e.original, key)
+		}
+	}
+	for key, value := range values {
+		if _, seen := e.original[key]; !seen {
+			if original, ok := os.LookupEnv(key); ok {
+				e.original[key] = &original
+			} else {
+				e.original[key] = nil
+			}
+		}
+		os.Setenv(key, value)
+	}
+	return nil
+}
+
+// reloader re-reads the configuration of running listeners and swaps it
+// in.
+type reloader struct {
+	load    func() (*daemonConfig, error)
+	env     *envFile
+	current *daemonConfig
+	// client is shared by the proxies, which serve current.listeners in
+	// order.
+	client *http.Client
+	// health, if set, checks the upstream of client.
+	health      *HealthChecker
+	proxies     []*UnixReverseProxy
+	restartOnly map[string]string
+}
+
+func newReloader(load func() (*daemonConfig, error), env *envFile, current *daemonConfig, client *http.Client, health *HealthChecker, proxies []*UnixReverseProxy) *reloader {
+	r := &reloader{load: load, env: env, current: current, client: client, health: health, proxies: proxies, restartOnly: make(map[string]string)}
+	for _, name := range restartOnlySettings {
+		r.restartOnly[name] = os.Getenv(name)
+	}
+	return r
+}
+
+// reload re-reads the configuration. If it is valid it replaces the
+// proxies' state; otherwise they keep serving with the current one.
+// Requests already in progress finish with the state they started with.
+// Listeners cannot be added, removed or moved without a restart.
+func (r *reloader) reload() error {
+	if err := r.env.apply(); err != nil {
+		return err
+	}
+	cfg, err := r.load()
+	if err != nil {
+		return err
+	}
+	for _, name := range restartOnlySettings {
+		if value := os.Getenv(name); value != r.restartOnly[name] {
+			log.Printf("warning: %s changed to %q; restart to apply", name, value)
+		}
+	}
+
+	// Apply what can be applied to the listeners being served.
+	applied := &daemonConfig{upstream: cfg.upstream}
+	for _, l := range r.current.listeners {
+		next := cfg.listener(l.name)
+		if next == nil {
+			log.Printf("warning: %s removed from the configuration; restart to apply", l.label("listener"))
+			applied.listeners = append(applied.listeners, l)
+			continue
+		}
+		if next.endpoint() != l.endpoint() {
+			log.Printf("warning: %s socket or audit settings changed; restart to apply", l.label("listener"))
+		}
+		kept := *l
+		kept.proxy = next.proxy
+		applied.listeners = append(applied.listeners, &kept)
+	}
+	for _, l := range cfg.listeners {
+		if r.current.listener(l.name) == nil {
+			log.Printf("warning: %s added to the configuration; restart to apply", l.label("listener"))
+		}
+	}
+
+	changes := diffSettings(r.current.settings(), applied.settings())
+	if len(changes) == 0 {
+		log.Printf("config reload: no changes")
+		return nil
+	}
+	previous := r.client
+	if len(diffSettings(r.current.upstream.settings(), applied.upstream.settings())) > 0 {
+		client, err := applied.upstream.newClient()
+		if err != nil {
+			return err
+		}
+		r.client = client
+	}
+	for i, l := range applied.listeners {
+		state := l.proxy.state(applied.upstream, r.client)
+		p := r.proxies[i]
+		p.mu.Lock()
+		p.state.Store(state)
+		p.mu.Unlock()
+	}
+	if r.client != previous {
+		if r.health != nil {
+			r.health.SetUpstream(applied.upstream.HealthCheck, r.client)
+		}
+		previous.CloseIdleConnections()
+	}
+	r.current = applied
+	for _, change := range changes {
+		log.Printf("config reload: %s", change)
+	}
+	return nil
+}
+
+// watch reloads on SIGHUP until ctx is cancelled.
+func (r *reloader) watch(ctx context.Context) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hangup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hangup:
+				sdNotify("RELOADING=1")
+				log.Printf("SIGHUP: reloading configuration")
+				if err := r.reload(); err != nil {
+					log.Printf("error: config reload failed, keeping current configuration: %v", err)
+				}
+				sdNotify("READY=1")
+			}
+		}
+	}()
+}
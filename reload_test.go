@@ -0,0 +1,205 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestEnvFile_Apply(t *testing.T) {
+	t.Setenv("PROXY_TEST_ORIGINAL", "original")
+	t.Setenv("PROXY_TEST_ADDED", "")
+	os.Unsetenv("PROXY_TEST_ADDED")
+	path := filepath.Join(t.TempDir(), "proxy.env")
+	env := newEnvFile(path)
+
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("# comment\n\nPROXY_TEST_ORIGINAL=changed\nPROXY_TEST_ADDED = \"a b\"\n")
+	if err := env.apply(); err != nil {
+		t.Fatalf("apply() error = %v", err)
+	}
+	if got := os.Getenv("PROXY_TEST_ORIGINAL"); got != "changed" {
+		t.Errorf("PROXY_TEST_ORIGINAL = %q", got)
+	}
+	if got := os.Getenv("PROXY_TEST_ADDED"); got != "a b" {
+		t.Errorf("PROXY_TEST_ADDED = %q", got)
+	}
+
+	write("PROXY_TEST_ORIGINAL=changed\nnot a setting\n")
+	if err := env.apply(); err == nil {
+		t.Error("apply() of an invalid file should fail")
+	}
+	if got := os.Getenv("PROXY_TEST_ADDED"); got != "a b" {
+		t.Errorf("failed apply changed PROXY_TEST_ADDED to %q", got)
+	}
+
+	write("")
+	if err := env.apply(); err != nil {
+		t.Fatalf("apply() error = %v", err)
+	}
+	if got := os.Getenv("PROXY_TEST_ORIGINAL"); got != "original" {
+		t.Errorf("PROXY_TEST_ORIGINAL not restored: %q", got)
+	}
+	if _, ok := os.LookupEnv("PROXY_TEST_ADDED"); ok {
+		t.Error("PROXY_TEST_ADDED not unset")
+	}
+}
+
+func TestDiffSettings(t *testing.T) {
+	old := map[string]string{"policy": "a.yaml (sha256:1)", "upstream socket": "/a.sock", "database access": "all"}
+	updated := map[string]string{"policy": "a.yaml (sha256:2)", "upstream socket": "/a.sock", "database access": "allowed=kg"}
+	want := []string{"database access: all -> allowed=kg", "policy: a.yaml (sha256:1) -> a.yaml (sha256:2)"}
+	if got := diffSettings(old, updated); !reflect.DeepEqual(got, want) {
+		t.Errorf("diffSettings() = %q, want %q", got, want)
+	}
+	if got := diffSettings(old, old); len(got) != 0 {
+		t.Errorf("diffSettings() of equal settings = %q", got)
+	}
+}
+
+func TestReloader_Reload(t *testing.T) {
+	release := make(chan struct{})
+	arrived := make(chan struct{}, 1)
+	first := startFakeUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_api/collection" {
+			arrived <- struct{}{}
+			<-release
+		}
+		w.Write([]byte("first"))
+	}))
+	second := startFakeUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("second"))
+	}))
+
+	dir := t.TempDir()
+	policyPath := filepath.Join(dir, "policy.yaml")
+	envPath := filepath.Join(dir, "proxy.env")
+	writeFile := func(path, content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(policyPath, "rules:\n  - methods: [GET]\n")
+	writeFile(envPath, "UPSTREAM_SOCKET="+first+"\nPOLICY_FILE="+policyPath+"\n")
+	for _, name := range []string{"UPSTREAM_SOCKET", "POLICY_FILE", "ALLOWED_DATABASES", "ENDPOINT_CATEGORIES"} {
+		t.Setenv(name, "")
+	}
+
+	variant := proxyVariant{name: "Test proxy", builtin: builtinReadOnly}
+	env := newEnvFile(envPath)
+	if err := env.apply(); err != nil {
+		t.Fatal(err)
+	}
+	load := func() (*daemonConfig, error) { return presetConfig(variant) }
+	cfg, err := load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := cfg.upstream.newClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := &UnixReverseProxy{transactions: NewTransactionTracker()}
+	proxy.state.Store(cfg.listeners[0].proxy.state(cfg.upstream, client))
+	r := newReloader(load, env, cfg, client, nil, []*UnixReverseProxy{proxy})
+
+	get := func(path string) (int, string) {
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code, rec.Body.String()
+	}
+	if code, body := get("/_api/version"); code != http.StatusOK || body != "first" {
+		t.Fatalf("before reload: %d %q", code, body)
+	}
+
+	// A request in flight during the reload finishes with the old state.
+	inFlight := make(chan string, 1)
+	go func() {
+		_, body := get("/_api/collection")
+		inFlight <- body
+	}()
+	<-arrived
+
+	writeFile(policyPath, "rules:\n  - methods: [GET]\n    paths: [/_api/version]\n")
+	writeFile(envPath, "UPSTREAM_SOCKET="+second+"\nPOLICY_FILE="+policyPath+"\nALLOWED_DATABASES=kg\n")
+	if err := r.reload(); err != nil {
+		t.Fatalf("reload() error = %v", err)
+	}
+	close(release)
+	if body := <-inFlight; body != "first" {
+		t.Errorf("in-flight request answered by %q, want the old upstream", body)
+	}
+	if code, body := get("/_db/kg/_api/version"); code != http.StatusOK || body != "second" {
+		t.Errorf("after reload: %d %q, want the new upstream", code, body)
+	}
+	if code, _ := get("/_db/kg/_api/collection"); code != http.StatusForbidden {
+		t.Errorf("after reload: policy not applied, status %d", code)
+	}
+	if code, _ := get("/_db/other/_api/version"); code != http.StatusForbidden {
+		t.Errorf("after reload: database access not applied, status %d", code)
+	}
+
+	// An invalid configuration is rejected and the current one kept.
+	writeFile(policyPath, "rules: []\n")
+	if err := r.reload(); err == nil {
+		t.Error("reload() of an invalid policy should fail")
+	}
+	if code, body := get("/_db/kg/_api/version"); code != http.StatusOK || body != "second" {
+		t.Errorf("after failed reload: %d %q", code, body)
+	}
+}
+
+func TestReloader_Credentials(t *testing.T) {
+	seen := make(chan string, 1)
+	socket := startFakeUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen <- r.Header.Get("Authorization")
+	}))
+	basic := writeSecret(t, "basic", "svc:one\n")
+	for _, name := range []string{"POLICY_FILE", "ALLOWED_DATABASES", "ENDPOINT_CATEGORIES", "AUTH_JWT_SECRET_FILE", "AUTH_JWT_USERNAME"} {
+		t.Setenv(name, "")
+	}
+	t.Setenv("UPSTREAM_SOCKET", socket)
+	t.Setenv("AUTH_BASIC_FILE", basic)
+
+	load := func() (*daemonConfig, error) {
+		return presetConfig(proxyVariant{name: "Test proxy", builtin: builtinReadOnly})
+	}
+	cfg, err := load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := cfg.upstream.newClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := &UnixReverseProxy{}
+	proxy.state.Store(cfg.listeners[0].proxy.state(cfg.upstream, client))
+	r := newReloader(load, newEnvFile(""), cfg, client, nil, []*UnixReverseProxy{proxy})
+
+	get := func() string {
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/_api/version", nil))
+		return <-seen
+	}
+	if got := get(); got != "Basic c3ZjOm9uZQ==" {
+		t.Fatalf("before reload: Authorization = %q", got)
+	}
+	if err := os.WriteFile(basic, []byte("svc:two\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := get(); got != "Basic c3ZjOnR3bw==" {
+		t.Errorf("after reload: Authorization = %q, want the new password", got)
+	}
+}
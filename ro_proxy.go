@@ -4,16 +4,15 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"log"
-	"net"
 	"net/http"
 	"strings"
+	"unicode"
 )
 
 // ForbiddenAQLKeywords are AQL keywords that indicate write operations.
 // These are blocked in read-only mode. It is the single source of truth for
 // the blocklist: both the tokenized JSON-path check and the raw-body fallback
-// scan iterate this map.
+// scan iterate this map, and policy rules with deny_writes apply it.
 var ForbiddenAQLKeywords = map[string]struct{}{
 	"INSERT":   {},
 	"UPDATE":   {},
@@ -27,84 +26,73 @@ var ForbiddenAQLKeywords = map[string]struct{}{
 // RunReadOnlyProxy starts the read-only proxy server.
 // It blocks until the server stops or encounters a fatal error.
 func RunReadOnlyProxy() error {
-	listenSocket := GetEnv("LISTEN_SOCKET", DefaultROListenSocket)
-	upstreamSocket := GetEnv("UPSTREAM_SOCKET", DefaultUpstreamSocket)
-
-	if err := EnsureParentDir(listenSocket); err != nil {
-		return fmt.Errorf("failed to prepare directory for %s: %w", listenSocket, err)
-	}
-	RemoveIfExists(listenSocket)
-
-	proxy := NewUnixReverseProxy(upstreamSocket, AllowReadOnly)
-
-	listener, err := net.Listen("unix", listenSocket)
-	if err != nil {
-		return fmt.Errorf("failed to listen on %s: %w", listenSocket, err)
-	}
-	EnsureSocketMode(listenSocket, ROSocketPermissions)
-
-	server := NewServerWithTimeouts(LogRequests(proxy))
-
-	log.Printf("Read-only proxy listening on %s -> %s", listenSocket, upstreamSocket)
-	if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
-		return fmt.Errorf("proxy server error: %w", err)
-	}
-	return nil
+	return runProxy(proxyVariant{
+		name:            "Read-only proxy",
+		listenSocket:    DefaultROListenSocket,
+		socketMode:      ROSocketPermissions,
+		builtin:         builtinReadOnly,
+		verifyQueryPlan: true,
+		dirtyReads:      true,
+	})
 }
 
+// builtinReadOnly is the compiled bundled read-only policy.
+var builtinReadOnly = mustCompileBuiltinPolicy("read-only")
+
 // AllowReadOnly is an AllowFunc that permits only read operations.
 // It allows GET, HEAD, OPTIONS unconditionally, and POST requests to
 // the cursor API only if they don't contain write-operation keywords.
-// DELETE is allowed on cursor paths to permit cursor cleanup.
+// DELETE is allowed on cursor paths to permit cursor cleanup. Stream
+// transactions may be begun if they declare no write or exclusive
+// collections, and committed or aborted.
+//
+// It enforces the bundled "read-only" policy (policies/read-only.yaml), after
+// denying endpoints outside DefaultEndpointCategories: administration, code
+// execution, replication and user management are refused even for GET.
 func AllowReadOnly(r *http.Request, peek BodyPeeker) error {
-	switch r.Method {
-	case http.MethodGet, http.MethodHead, http.MethodOptions:
-		return nil
-	case http.MethodPost:
-		if IsCursorPath(r.URL.Path) {
-			body, err := peek(128 * 1024)
-			if err != nil {
-				return err
-			}
-			// Reject ambiguous bodies with more than one top-level "query"
-			// field. Go's encoding/json keeps the last duplicate key, but
-			// ArangoDB may resolve duplicates differently; inspecting one
-			// value while the upstream executes the other would bypass the
-			// keyword scan below. Refuse rather than guess.
-			if count, ok := countTopLevelQueryKeys(body); ok && count > 1 {
-				return fmt.Errorf("ambiguous request: multiple %q fields in cursor body", "query")
-			}
-			var payload struct {
-				Query string `json:"query"`
-			}
-			if err := json.Unmarshal(body, &payload); err == nil && payload.Query != "" {
-				upper := strings.ToUpper(payload.Query)
-				tokens := strings.FieldsFunc(upper, func(r rune) bool {
-					return r < 'A' || r > 'Z'
-				})
-				for _, token := range tokens {
-					if _, forbidden := ForbiddenAQLKeywords[token]; forbidden {
-						return fmt.Errorf("forbidden keyword %q detected in AQL", token)
-					}
-				}
-				return nil
-			}
-			// Fallback: conservative scan of raw body
-			upper := strings.ToUpper(string(body))
-			for keyword := range ForbiddenAQLKeywords {
-				if strings.Contains(upper, keyword) {
-					return fmt.Errorf("forbidden keyword %q detected in request body", keyword)
-				}
-			}
-			return nil
+	if err := defaultCategoryAccess.check(r); err != nil {
+		return err
+	}
+	return builtinReadOnly(r, peek)
+}
+
+// checkAQLKeywords inspects a cursor request body and rejects it if the AQL
+// query it carries contains any of the given (upper-case) keywords.
+func checkAQLKeywords(body []byte, keywords map[string]struct{}) error {
+	// Reject ambiguous bodies with more than one top-level "query"
+	// field. Go's encoding/json keeps the last duplicate key, but
+	// ArangoDB may resolve duplicates differently; inspecting one
+	// value while the upstream executes the other would bypass the
+	// keyword scan below. Refuse rather than guess.
+	if count, ok := countTopLevelQueryKeys(body); ok && count > 1 {
+		return fmt.Errorf("ambiguous request: multiple %q fields in cursor body", "query")
+	}
+	var payload struct {
+		Query string `json:"query"`
+	}
+	if err := json.Unmarshal(body, &payload); err == nil && payload.Query != "" {
+		keyword, err := findAQLKeyword(payload.Query, keywords)
+		if err != nil {
+			return fmt.Errorf("unable to analyse AQL: %w", err)
+		}
+		if keyword != "" {
+			return &ForbiddenKeywordError{Keyword: keyword, Where: "AQL"}
 		}
-	case http.MethodDelete:
-		// DELETE on cursor paths is allowed for cursor cleanup
-		if IsCursorPath(r.URL.Path) {
-			return nil
+		return nil
+	}
+	// Fallback: conservative scan of raw body. Without a parsable query the
+	// body cannot be lexed as AQL, so every whole word is treated as a
+	// potential keyword, but words merely containing one (e.g. "DROPDOWN")
+	// are not.
+	words := strings.FieldsFunc(strings.ToUpper(string(body)), func(r rune) bool {
+		return r > unicode.MaxASCII || !isAQLNameByte(byte(r))
+	})
+	for _, word := range words {
+		if _, forbidden := keywords[word]; forbidden {
+			return &ForbiddenKeywordError{Keyword: word, Where: "request body"}
 		}
 	}
-	return fmt.Errorf("method %s not permitted on %s", r.Method, r.URL.Path)
+	return nil
 }
 
 // countTopLevelQueryKeys reports how many top-level keys of the JSON object in
@@ -117,6 +105,13 @@ func AllowReadOnly(r *http.Request, peek BodyPeeker) error {
 // options) are not counted. ok is false when body is not a JSON object, in which
 // case the caller's fallback scanning applies.
 func countTopLevelQueryKeys(body []byte) (count int, ok bool) {
+	return countTopLevelKeys(body, "query")
+}
+
+// countTopLevelKeys reports how many top-level keys of the JSON object in
+// body fold to key, and whether body is a JSON object at all. See
+// countTopLevelQueryKeys.
+func countTopLevelKeys(body []byte, key string) (count int, ok bool) {
 	dec := json.NewDecoder(bytes.NewReader(body))
 	tok, err := dec.Token()
 	if err != nil {
@@ -150,7 +145,7 @@ func countTopLevelQueryKeys(body []byte) (count int, ok bool) {
 		}
 		if depth == 1 {
 			if expectKey {
-				if s, isStr := t.(string); isStr && strings.EqualFold(s, "query") {
+				if s, isStr := t.(string); isStr && strings.EqualFold(s, key) {
 					count++
 				}
 			}
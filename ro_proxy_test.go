@@ -267,6 +267,47 @@ func TestAllowReadOnly_KeywordInIdentifier(t *testing.T) {
 	}
 }
 
+func TestAllowReadOnly_KeywordOutsideKeywordPosition(t *testing.T) {
+	// Keywords inside string literals, comments, or used as attribute names
+	// are not write statements and must not be blocked.
+	queries := []string{
+		`{"query": "FOR doc IN c FILTER doc.status == \"update\" RETURN doc"}`,
+		`{"query": "FOR doc IN c FILTER doc.status == 'remove' RETURN doc"}`,
+		"{\"query\": \"FOR doc IN c RETURN doc.`remove`\"}",
+		`{"query": "FOR doc IN c /* INSERT later */ RETURN doc"}`,
+		`{"query": "FOR doc IN c // REMOVE later\nRETURN doc"}`,
+		`{"query": "FOR doc IN c RETURN {insert: doc.insert}"}`,
+	}
+
+	for _, body := range queries {
+		t.Run(body, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/_api/cursor", nil)
+			err := AllowReadOnly(req, mockBodyPeeker(body))
+			if err != nil {
+				t.Errorf("keyword outside keyword position should be allowed, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestAllowReadOnly_POST_Cursor_UnterminatedLiteral(t *testing.T) {
+	// A query the lexer cannot analyse is refused rather than guessed at.
+	body := `{"query": "RETURN 'open REMOVE d IN c"}`
+	req := httptest.NewRequest(http.MethodPost, "/_api/cursor", nil)
+	if err := AllowReadOnly(req, mockBodyPeeker(body)); err == nil {
+		t.Error("unterminated string literal should be blocked")
+	}
+}
+
+func TestAllowReadOnly_POST_Cursor_FallbackWholeWords(t *testing.T) {
+	// The raw-body fallback matches whole words only.
+	body := `not json: DROPDOWN INSERTED`
+	req := httptest.NewRequest(http.MethodPost, "/_api/cursor", nil)
+	if err := AllowReadOnly(req, mockBodyPeeker(body)); err != nil {
+		t.Errorf("words containing keywords should be allowed, got: %v", err)
+	}
+}
+
 func TestAllowReadOnly_DatabasePrefix(t *testing.T) {
 	// Test cursor operations with database prefix
 	t.Run("POST cursor with db prefix", func(t *testing.T) {
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"os"
+)
+
+// runProxy starts roproxy or rwproxy, configured from the environment. It
+// blocks until the server stops or encounters a fatal error.
+func runProxy(v proxyVariant) error {
+	ctx, stop := ShutdownSignalContext()
+	defer stop()
+	return serveListeners(ctx, v.name, func() (*daemonConfig, error) { return presetConfig(v) })
+}
+
+// RunDaemon starts the listeners configured in the file at path (see
+// DaemonConfig), which share one upstream connection pool. It blocks until
+// the daemon stops or encounters a fatal error.
+func RunDaemon(path string) error {
+	ctx, stop := ShutdownSignalContext()
+	defer stop()
+	return serveListeners(ctx, "arango-proxy", func() (*daemonConfig, error) { return loadDaemonConfig(path) })
+}
+
+// serveListeners serves the listeners of the configuration returned by
+// load, which is called again to reload on SIGHUP, until ctx is cancelled.
+// name starts the "listening" log line of an unnamed listener.
+func serveListeners(ctx context.Context, name string, load func() (*daemonConfig, error)) error {
+	env := newEnvFile(os.Getenv("PROXY_ENV_FILE"))
+	if err := env.apply(); err != nil {
+		return err
+	}
+	activated, err := SystemdListeners()
+	if err != nil {
+		return err
+	}
+
+	cfg, err := load()
+	if err != nil {
+		return err
+	}
+	logSettings(cfg.settings())
+	client, err := cfg.upstream.newClient()
+	if err != nil {
+		return err
+	}
+	health := NewHealthChecker(cfg.upstream.HealthCheck, client)
+	proxies := make([]*UnixReverseProxy, len(cfg.listeners))
+	for i, l := range cfg.listeners {
+		proxy := &UnixReverseProxy{transactions: NewTransactionTracker(), health: health, name: l.name}
+		proxy.state.Store(l.proxy.state(cfg.upstream, client))
+		audit, err := l.openAudit()
+		if err != nil {
+			return err
+		}
+		if audit != nil {
+			defer audit.Close()
+			proxy.SetAuditLog(audit)
+			records, head := audit.Head()
+			log.Printf("audit log: %s (%d records, head %s)", l.audit, records, head)
+		}
+		proxies[i] = proxy
+	}
+
+	accessLog, err := AccessLogFromEnv()
+	if err != nil {
+		return err
+	}
+	log.Printf("access log: %s", accessLog)
+	shutdownTimeout, err := ShutdownTimeoutFromEnv()
+	if err != nil {
+		return err
+	}
+	var drainAlso []drainer
+	admin, err := StartAdminFromEnv(activated, health, proxies...)
+	if err != nil {
+		return err
+	}
+	if admin != nil {
+		drainAlso = append(drainAlso, admin)
+	}
+
+	served := make([]servedListener, 0, len(cfg.listeners))
+	for i, l := range cfg.listeners {
+		listener, socketPath, err := listenProxy(l, activated)
+		if err != nil {
+			for _, s := range served {
+				s.listener.Close()
+				if s.socketPath != "" {
+					os.Remove(s.socketPath)
+				}
+			}
+			return err
+		}
+		served = append(served, servedListener{
+			proxy:      proxies[i],
+			server:     NewServerWithTimeouts(accessLog.Wrap(proxies[i])),
+			listener:   listener,
+			socketPath: socketPath,
+		})
+		log.Printf("%s listening on %s -> %s", l.label(name), listener.Addr(), cfg.upstream)
+	}
+
+	go health.Run(ctx)
+	newReloader(load, env, cfg, client, health, proxies).watch(ctx)
+	return serveUntilDone(ctx, served, serveOptions{timeout: shutdownTimeout, notify: true, also: drainAlso})
+}
@@ -1,14 +1,12 @@
 package proxy
 
 import (
-	"fmt"
-	"log"
-	"net"
 	"net/http"
 )
 
 // AllowedRWAPIPaths are the API paths that the read-write proxy allows
-// for write operations (POST, PUT, PATCH, DELETE).
+// for write operations (POST, PUT, PATCH, DELETE). The bundled read-write
+// policy must list the same paths.
 var AllowedRWAPIPaths = []string{
 	"/_api/document",
 	"/_api/collection",
@@ -19,62 +17,28 @@ var AllowedRWAPIPaths = []string{
 // RunReadWriteProxy starts the read-write proxy server.
 // It blocks until the server stops or encounters a fatal error.
 func RunReadWriteProxy() error {
-	listenSocket := GetEnv("LISTEN_SOCKET", DefaultRWListenSocket)
-	upstreamSocket := GetEnv("UPSTREAM_SOCKET", DefaultUpstreamSocket)
-
-	if err := EnsureParentDir(listenSocket); err != nil {
-		return fmt.Errorf("failed to prepare directory for %s: %w", listenSocket, err)
-	}
-	RemoveIfExists(listenSocket)
-
-	proxy := NewUnixReverseProxy(upstreamSocket, AllowReadWrite)
-
-	listener, err := net.Listen("unix", listenSocket)
-	if err != nil {
-		return fmt.Errorf("failed to listen on %s: %w", listenSocket, err)
-	}
-	EnsureSocketMode(listenSocket, RWSocketPermissions)
-
-	server := NewServerWithTimeouts(LogRequests(proxy))
-
-	log.Printf("Read-write proxy listening on %s -> %s", listenSocket, upstreamSocket)
-	if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
-		return fmt.Errorf("proxy server error: %w", err)
-	}
-	return nil
+	return runProxy(proxyVariant{
+		name:         "Read-write proxy",
+		listenSocket: DefaultRWListenSocket,
+		socketMode:   RWSocketPermissions,
+		builtin:      builtinReadWrite,
+		audit:        true,
+	})
 }
 
+// builtinReadWrite is the compiled bundled read-write policy.
+var builtinReadWrite = mustCompileBuiltinPolicy("read-write")
+
 // AllowReadWrite is an AllowFunc that permits read and write operations.
 // It allows all read-only operations plus document CRUD, import, collection,
-// and index management operations.
+// and index management operations, and stream transactions.
+//
+// It enforces the bundled "read-write" policy (policies/read-write.yaml), after
+// denying endpoints outside DefaultEndpointCategories: administration, code
+// execution, replication and user management are refused even for GET.
 func AllowReadWrite(r *http.Request, peek BodyPeeker) error {
-	// First check if the read-only policy allows it
-	if err := AllowReadOnly(r, peek); err == nil {
-		return nil
-	}
-
-	path := r.URL.Path
-
-	switch r.Method {
-	case http.MethodPost:
-		// POST is allowed on cursor paths (for AQL queries that may write)
-		// and on document/collection/index/import paths
-		if IsCursorPath(path) {
-			return nil
-		}
-		for _, apiPath := range AllowedRWAPIPaths {
-			if HasAPIPathPrefix(path, apiPath) {
-				return nil
-			}
-		}
-	case http.MethodPut, http.MethodPatch, http.MethodDelete:
-		// PUT/PATCH/DELETE are allowed on document/collection/index paths
-		for _, apiPath := range []string{"/_api/document", "/_api/collection", "/_api/index"} {
-			if HasAPIPathPrefix(path, apiPath) {
-				return nil
-			}
-		}
+	if err := defaultCategoryAccess.check(r); err != nil {
+		return err
 	}
-
-	return fmt.Errorf("method %s not permitted on %s", r.Method, path)
+	return builtinReadWrite(r, peek)
 }
@@ -193,7 +193,8 @@ func TestAllowReadWrite_PathTraversal(t *testing.T) {
 }
 
 func TestAllowReadWrite_AdminEndpoints(t *testing.T) {
-	// Admin endpoints should NOT be allowed
+	// Admin endpoints should NOT be allowed, not even for GET: they leak far
+	// more than data reads.
 	adminPaths := []string{
 		"/_admin/echo",
 		"/_admin/log",
@@ -212,17 +213,8 @@ func TestAllowReadWrite_AdminEndpoints(t *testing.T) {
 		for _, method := range methods {
 			t.Run(method+" "+path, func(t *testing.T) {
 				req := httptest.NewRequest(method, path, nil)
-				err := AllowReadWrite(req, emptyBodyPeeker())
-				// GET should be allowed (read-only allows it)
-				if method == http.MethodGet {
-					if err != nil {
-						t.Errorf("GET %s should be allowed (read-only), got error: %v", path, err)
-					}
-				} else {
-					// Other methods should be blocked on admin paths
-					if err == nil {
-						t.Errorf("%s %s should be blocked", method, path)
-					}
+				if err := AllowReadWrite(req, emptyBodyPeeker()); err == nil {
+					t.Errorf("%s %s should be blocked", method, path)
 				}
 			})
 		}
@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Config configures a proxy Server embedded in another program. Unlike
+// roproxy and rwproxy, which read the environment, a Server is configured
+// only through Config.
+type Config struct {
+	// Listen is the path of the Unix socket to create. It is ignored when
+	// Listener is set.
+	Listen string
+	// Listener, if set, is served instead of a socket at Listen. It is
+	// closed when the server stops.
+	Listener net.Listener
+	// SocketMode is the permission of the socket at Listen, 0600 if zero.
+	// SocketOwner and SocketGroup, names or numeric ids, are given the
+	// socket (see ParseSocketOptions); empty leaves those of the process.
+	SocketMode  os.FileMode
+	SocketOwner string
+	SocketGroup string
+
+	// Upstream is how ArangoDB is reached, over its Unix socket or TCP;
+	// see DefaultUpstreamSettings. Only its HealthCheck is used when Client
+	// is set.
+	Upstream UpstreamSettings
+	// Client, if set, forwards requests instead of a client built from
+	// Upstream, so that several servers can share one connection pool.
+	Client *http.Client
+
+	// Policy decides which requests are allowed, e.g. AllowReadOnly or a
+	// compiled Policy. It is required.
+	Policy AllowFunc
+	// Databases, Categories and Collections further restrict requests.
+	// Nil Databases and Collections allow all; nil Categories allows
+	// DefaultEndpointCategories.
+	Databases   *DatabaseAccess
+	Categories  *CategoryAccess
+	Collections *CollectionAccess
+	// VerifyQueryPlan checks cursor queries with /_api/explain.
+	VerifyQueryPlan bool
+	// Credentials, if set, are sent to ArangoDB instead of the clients'
+	// Authorization header.
+	Credentials CredentialSettings
+	// DirtyReads lets followers serve reads when Upstream is balanced
+	// with BalanceActiveFailover; see UnixReverseProxy.SetDirtyReads.
+	DirtyReads bool
+
+	// AccessLog, AuditLog and Metrics are optional. Servers sharing one
+	// collector should each be given their own Metrics.Listener.
+	AccessLog *AccessLog
+	AuditLog  *AuditLog
+	Metrics   *Metrics
+
+	// ShutdownTimeout bounds the drain of in-flight requests when Serve's
+	// context is cancelled, DefaultShutdownTimeout if zero.
+	ShutdownTimeout time.Duration
+	// Logger receives the server's log lines, log.Default() if nil.
+	Logger *log.Logger
+}
+
+// Server is a proxy listening on one socket. Create it with New and run it
+// with Serve.
+type Server struct {
+	proxy      *UnixReverseProxy
+	health     *HealthChecker
+	http       *http.Server
+	listener   net.Listener
+	socketPath string
+	timeout    time.Duration
+	logger     *log.Logger
+}
+
+// New validates cfg and creates the server's socket. The server does not
+// accept connections until Serve is called.
+func New(cfg Config) (*Server, error) {
+	if cfg.Policy == nil {
+		return nil, errors.New("proxy config: Policy is required")
+	}
+	if cfg.Client == nil && cfg.Upstream.Socket == "" && len(cfg.Upstream.Endpoints) == 0 {
+		return nil, errors.New("proxy config: Upstream or Client is required")
+	}
+	if cfg.Listener == nil && cfg.Listen == "" {
+		return nil, errors.New("proxy config: Listen or Listener is required")
+	}
+	if cfg.ShutdownTimeout < 0 {
+		return nil, errors.New("proxy config: ShutdownTimeout must not be negative")
+	}
+	if err := cfg.Upstream.HealthCheck.validate(); err != nil {
+		return nil, fmt.Errorf("proxy config: %w", err)
+	}
+	logger := cfg.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
+	timeout := cfg.ShutdownTimeout
+	if timeout == 0 {
+		timeout = DefaultShutdownTimeout
+	}
+	mode := cfg.SocketMode
+	if mode == 0 {
+		mode = RWSocketPermissions
+	}
+	if mode&^os.ModePerm != 0 {
+		return nil, fmt.Errorf("proxy config: invalid socket mode %#o", mode)
+	}
+	options, err := ParseSocketOptions("", cfg.SocketOwner, cfg.SocketGroup, mode)
+	if err != nil {
+		return nil, fmt.Errorf("proxy config: %w", err)
+	}
+	if cfg.Listener == nil {
+		if err := options.Validate(); err != nil {
+			return nil, fmt.Errorf("proxy config: %w", err)
+		}
+	}
+
+	client := cfg.Client
+	if client == nil {
+		if client, err = cfg.Upstream.newClient(); err != nil {
+			return nil, fmt.Errorf("proxy config: %w", err)
+		}
+	}
+	categories := cfg.Categories
+	if categories == nil {
+		categories = defaultCategoryAccess
+	}
+	settings := &proxyConfig{
+		allow:           cfg.Policy,
+		databases:       cfg.Databases,
+		categories:      categories,
+		collections:     cfg.Collections,
+		verifyQueryPlan: cfg.VerifyQueryPlan,
+		dirtyReads:      cfg.DirtyReads,
+	}
+	if err := settings.loadCredentials(cfg.Credentials); err != nil {
+		return nil, fmt.Errorf("proxy config: %w", err)
+	}
+	health := NewHealthChecker(cfg.Upstream.HealthCheck, client)
+	health.logger = logger
+	proxy := &UnixReverseProxy{
+		transactions: NewTransactionTracker(),
+		metrics:      cfg.Metrics,
+		audit:        cfg.AuditLog,
+		health:       health,
+		logger:       logger,
+	}
+	proxy.state.Store(settings.state(cfg.Upstream, client))
+
+	var handler http.Handler = proxy
+	if cfg.AccessLog != nil {
+		handler = cfg.AccessLog.Wrap(proxy)
+	}
+	s := &Server{proxy: proxy, health: health, listener: cfg.Listener, timeout: timeout, logger: logger}
+	s.http = NewServerWithTimeouts(handler)
+	s.http.ErrorLog = logger
+	if s.listener == nil {
+		if s.listener, err = listenUnix(cfg.Listen, options); err != nil {
+			return nil, err
+		}
+		s.socketPath = cfg.Listen
+	}
+	return s, nil
+}
+
+// Proxy returns the server's proxy, e.g. to change its policy while it
+// runs.
+func (s *Server) Proxy() *UnixReverseProxy {
+	return s.proxy
+}
+
+// Health returns the server's upstream health checker, e.g. to serve its
+// readiness with NewAdminHandler.
+func (s *Server) Health() *HealthChecker {
+	return s.health
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Serve accepts connections and checks the upstream until ctx is
+// cancelled, then drains in-flight requests for up to the shutdown timeout,
+// closes idle upstream connections and removes the socket it created. It
+// returns nil after a clean shutdown. A Server can be served only once.
+func (s *Server) Serve(ctx context.Context) error {
+	go s.health.Run(ctx)
+	return serveUntilDone(ctx, []servedListener{{
+		proxy:      s.proxy,
+		server:     s.http,
+		listener:   s.listener,
+		socketPath: s.socketPath,
+	}}, serveOptions{timeout: s.timeout, logger: s.logger})
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNew_Validation(t *testing.T) {
+	valid := func() Config {
+		return Config{
+			Listen:   filepath.Join(t.TempDir(), "proxy.sock"),
+			Upstream: DefaultUpstreamSettings("/run/arangodb3/arangodb.sock"),
+			Policy:   AllowReadOnly,
+		}
+	}
+	tests := []struct {
+		name    string
+		change  func(*Config)
+		wantErr string
+	}{
+		{name: "no policy", change: func(c *Config) { c.Policy = nil }, wantErr: "Policy is required"},
+		{name: "no upstream", change: func(c *Config) { c.Upstream = UpstreamSettings{} }, wantErr: "Upstream or Client"},
+		{name: "no listener", change: func(c *Config) { c.Listen = "" }, wantErr: "Listen or Listener"},
+		{name: "negative timeout", change: func(c *Config) { c.ShutdownTimeout = -1 }, wantErr: "ShutdownTimeout"},
+		{name: "setuid mode", change: func(c *Config) { c.SocketMode = os.ModeSetuid | 0o600 }, wantErr: "invalid socket mode"},
+		{name: "unknown group", change: func(c *Config) { c.SocketGroup = "no-such-group-arango-proxy" }, wantErr: "invalid socket group"},
+		{name: "socket path is a file", change: func(c *Config) {
+			if err := os.WriteFile(c.Listen, nil, 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}, wantErr: "not a socket"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := valid()
+			tc.change(&cfg)
+			if _, err := New(cfg); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("New() error = %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestServer_Serve(t *testing.T) {
+	upstream := startFakeUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"version": "3.12"}`))
+	}))
+	var logs bytes.Buffer
+	socket := filepath.Join(t.TempDir(), "proxy.sock")
+	server, err := New(Config{
+		Listen:     socket,
+		SocketMode: 0o640,
+		Upstream:   DefaultUpstreamSettings(upstream),
+		Policy:     AllowReadOnly,
+		Logger:     log.New(&logs, "", 0),
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if info, err := os.Stat(socket); err != nil || info.Mode().Perm() != 0o640 {
+		t.Errorf("socket mode = %v, %v; want 0640", info.Mode().Perm(), err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(ctx)
+	}()
+
+	client := unixClient(socket)
+	resp, err := client.Get("http://proxy/_api/version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET status = %d, want 200", resp.StatusCode)
+	}
+	resp, err = client.Post("http://proxy/_api/document/docs", "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("POST status = %d, want 403", resp.StatusCode)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Serve() = %v", err)
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("socket not removed: %v", err)
+	}
+	if !strings.Contains(logs.String(), "shutdown complete") {
+		t.Errorf("injected logger did not receive the shutdown log, got %q", logs.String())
+	}
+}
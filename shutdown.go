@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// DefaultShutdownTimeout is how long in-flight requests may run after a
+// shutdown signal before their connections are closed.
+const DefaultShutdownTimeout = 30 * time.Second
+
+// ShutdownTimeoutFromEnv reads SHUTDOWN_TIMEOUT_SECONDS, defaulting to
+// DefaultShutdownTimeout.
+func ShutdownTimeoutFromEnv() (time.Duration, error) {
+	value := os.Getenv("SHUTDOWN_TIMEOUT_SECONDS")
+	if value == "" {
+		return DefaultShutdownTimeout, nil
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0, fmt.Errorf("invalid SHUTDOWN_TIMEOUT_SECONDS %q: must be a non-negative integer", value)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// ShutdownSignalContext returns a context cancelled on SIGTERM or SIGINT.
+// Once it is cancelled the signals are restored to their default action,
+// so a second signal terminates the process without waiting for drain.
+func ShutdownSignalContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx, stop
+}
+
+// drainer is stopped along with the proxy server; *http.Server is one.
+type drainer interface {
+	Shutdown(ctx context.Context) error
+	Close() error
+}
+
+// servedListener is a proxy socket and the server handling it.
+type servedListener struct {
+	proxy    *UnixReverseProxy
+	server   *http.Server
+	listener net.Listener
+	// socketPath is removed on shutdown, unless it is empty.
+	socketPath string
+}
+
+// serveOptions control serveUntilDone.
+type serveOptions struct {
+	// timeout bounds the drain of in-flight requests.
+	timeout time.Duration
+	logger  *log.Logger
+	// notify tells the service manager when the proxy is ready and when it
+	// is stopping, and feeds its watchdog. An embedded proxy leaves that
+	// to its host process.
+	notify bool
+	// also are stopped along with the listeners.
+	also []drainer
+}
+
+// serveUntilDone serves the listeners until ctx is cancelled, then stops
+// accepting connections and waits up to opts.timeout for in-flight
+// requests, together with the servers in opts.also, before closing
+// whatever remains. It then closes the proxies' idle upstream connections
+// and removes the socket files.
+func serveUntilDone(ctx context.Context, listeners []servedListener, opts serveOptions) error {
+	logger := opts.logger
+	if logger == nil {
+		logger = log.Default()
+	}
+	notify := func(state string) {
+		if opts.notify {
+			sdNotify(state)
+		}
+	}
+	served := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func() {
+			served <- l.server.Serve(l.listener)
+		}()
+	}
+	if opts.notify {
+		startWatchdog(ctx)
+	}
+	notify("READY=1")
+
+	// A listener failing stops the others too.
+	var serveErr error
+	remaining := len(listeners)
+	select {
+	case serveErr = <-served:
+		remaining--
+		notify("STOPPING=1")
+		for _, l := range listeners {
+			l.server.Close()
+		}
+		for _, s := range opts.also {
+			s.Close()
+		}
+	case <-ctx.Done():
+		notify("STOPPING=1")
+		logger.Printf("shutting down: draining in-flight requests for up to %s", opts.timeout)
+		drainCtx, cancel := context.WithTimeout(context.Background(), opts.timeout)
+		servers := make([]drainer, 0, len(listeners)+len(opts.also))
+		for _, l := range listeners {
+			servers = append(servers, l.server)
+		}
+		servers = append(servers, opts.also...)
+		for _, s := range servers {
+			if err := s.Shutdown(drainCtx); err != nil {
+				if errors.Is(err, context.DeadlineExceeded) {
+					logger.Printf("shutdown deadline exceeded, closing remaining connections")
+				} else {
+					logger.Printf("warning: shutdown: %v", err)
+				}
+				s.Close()
+			}
+		}
+		cancel()
+	}
+	for ; remaining > 0; remaining-- {
+		if err := <-served; serveErr == nil || serveErr == http.ErrServerClosed {
+			serveErr = err
+		}
+	}
+
+	for _, l := range listeners {
+		l.proxy.Client().CloseIdleConnections()
+		if l.socketPath != "" {
+			if err := os.Remove(l.socketPath); err != nil && !os.IsNotExist(err) {
+				logger.Printf("warning: failed to remove socket %s: %v", l.socketPath, err)
+			}
+		}
+	}
+	if serveErr != nil && serveErr != http.ErrServerClosed {
+		return fmt.Errorf("proxy server error: %w", serveErr)
+	}
+	logger.Printf("shutdown complete")
+	return nil
+}
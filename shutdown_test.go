@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestShutdownTimeoutFromEnv(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"", DefaultShutdownTimeout, false},
+		{"0", 0, false},
+		{"5", 5 * time.Second, false},
+		{"-1", 0, true},
+		{"5s", 0, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.value, func(t *testing.T) {
+			t.Setenv("SHUTDOWN_TIMEOUT_SECONDS", tc.value)
+			got, err := ShutdownTimeoutFromEnv()
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ShutdownTimeoutFromEnv() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("ShutdownTimeoutFromEnv() = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+// startDrainTest serves a proxy, whose upstream answers once release is
+// closed, until the returned cancel is called. It returns the client socket
+// and a channel receiving serveUntilDone's result.
+func startDrainTest(t *testing.T, release <-chan struct{}, timeout time.Duration) (string, context.CancelFunc, <-chan error, <-chan struct{}) {
+	t.Helper()
+	arrived := make(chan struct{}, 1)
+	upstream := startFakeUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			return
+		}
+		w.Write([]byte(`{"version": "3.12"}`))
+	}))
+	proxy := NewUnixReverseProxy(upstream, AllowReadOnly)
+
+	socket := filepath.Join(t.TempDir(), "proxy.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	done := make(chan error, 1)
+	go func() {
+		done <- serveUntilDone(ctx, []servedListener{{proxy: proxy, server: NewServerWithTimeouts(proxy), listener: listener, socketPath: socket}}, serveOptions{timeout: timeout, notify: true})
+	}()
+	return socket, cancel, done, arrived
+}
+
+func unixClient(socket string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+}
+
+func TestServeUntilDone_DrainsInFlightRequests(t *testing.T) {
+	release := make(chan struct{})
+	socket, cancel, done, arrived := startDrainTest(t, release, 5*time.Second)
+
+	type result struct {
+		status int
+		body   string
+		err    error
+	}
+	responses := make(chan result, 1)
+	go func() {
+		resp, err := unixClient(socket).Get("http://proxy/_api/version")
+		if err != nil {
+			responses <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		responses <- result{resp.StatusCode, string(body), err}
+	}()
+	<-arrived
+
+	cancel()
+	select {
+	case err := <-done:
+		t.Fatalf("serveUntilDone returned %v before the request finished", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err := net.Dial("unix", socket); err == nil {
+		t.Error("new connections accepted while draining")
+	}
+
+	close(release)
+	res := <-responses
+	if res.err != nil || res.status != http.StatusOK || res.body != `{"version": "3.12"}` {
+		t.Errorf("in-flight request = %d %q, %v", res.status, res.body, res.err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("serveUntilDone() = %v", err)
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("socket file left behind: %v", err)
+	}
+}
+
+func TestServeUntilDone_DeadlineClosesConnections(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	socket, cancel, done, arrived := startDrainTest(t, release, 50*time.Millisecond)
+
+	failed := make(chan error, 1)
+	go func() {
+		resp, err := unixClient(socket).Get("http://proxy/_api/version")
+		if err == nil {
+			resp.Body.Close()
+		}
+		failed <- err
+	}()
+	<-arrived
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("serveUntilDone() = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serveUntilDone did not give up after the deadline")
+	}
+	if err := <-failed; err == nil {
+		t.Error("request outliving the deadline should fail")
+	}
+}
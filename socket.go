@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+)
+
+// SocketOptions are the permissions and ownership given to a socket the
+// proxy creates.
+type SocketOptions struct {
+	Mode os.FileMode
+	// UID and GID are -1 to leave the owner or group as the process's.
+	UID, GID int
+}
+
+// ParseSocketOptions builds SocketOptions from an octal mode, defaulting to
+// defaultMode when empty, and an owner and group given by name or numeric
+// id, unchanged when empty.
+func ParseSocketOptions(mode, owner, group string, defaultMode os.FileMode) (SocketOptions, error) {
+	opts := SocketOptions{Mode: defaultMode, UID: -1, GID: -1}
+	if mode != "" {
+		bits, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || bits&^0o777 != 0 {
+			return SocketOptions{}, fmt.Errorf("invalid socket mode %q: want octal permission bits such as 0640", mode)
+		}
+		opts.Mode = os.FileMode(bits)
+	}
+	if owner != "" {
+		uid, err := LookupUserID(owner)
+		if err != nil {
+			return SocketOptions{}, fmt.Errorf("invalid socket owner: %w", err)
+		}
+		opts.UID = int(uid)
+	}
+	if group != "" {
+		gid, err := LookupGroupID(group)
+		if err != nil {
+			return SocketOptions{}, fmt.Errorf("invalid socket group: %w", err)
+		}
+		opts.GID = int(gid)
+	}
+	return opts, nil
+}
+
+// SocketOptionsFromEnv reads SOCKET_MODE, SOCKET_OWNER and SOCKET_GROUP.
+func SocketOptionsFromEnv(defaultMode os.FileMode) (SocketOptions, error) {
+	return ParseSocketOptions(GetEnv("SOCKET_MODE", ""), GetEnv("SOCKET_OWNER", ""), GetEnv("SOCKET_GROUP", ""), defaultMode)
+}
+
+// String summarizes the options for startup logs.
+func (o SocketOptions) String() string {
+	s := fmt.Sprintf("mode %#o", o.Mode)
+	if o.UID >= 0 {
+		s += fmt.Sprintf(", owner %d", o.UID)
+	}
+	if o.GID >= 0 {
+		s += fmt.Sprintf(", group %d", o.GID)
+	}
+	return s
+}
+
+// Validate reports whether the process may apply the options: only root
+// can give a socket to another user, and other users can only give it to a
+// group they belong to.
+func (o SocketOptions) Validate() error {
+	if o.UID < 0 && o.GID < 0 {
+		return nil
+	}
+	euid := os.Geteuid()
+	if euid == -1 {
+		return errors.New("socket owner and group are not supported on this platform")
+	}
+	if euid == 0 {
+		return nil
+	}
+	if o.UID >= 0 && o.UID != euid {
+		return fmt.Errorf("cannot give socket to uid %d: the proxy runs as uid %d, not root", o.UID, euid)
+	}
+	if o.GID >= 0 && o.GID != os.Getegid() {
+		groups, err := os.Getgroups()
+		if err != nil {
+			return fmt.Errorf("cannot check membership of gid %d: %w", o.GID, err)
+		}
+		if !slices.Contains(groups, o.GID) {
+			return fmt.Errorf("cannot give socket to gid %d: the proxy (uid %d) is not a member", o.GID, euid)
+		}
+	}
+	return nil
+}
+
+// apply sets the ownership, then the mode, of the socket at path.
+func (o SocketOptions) apply(path string) error {
+	if o.UID >= 0 || o.GID >= 0 {
+		if err := os.Chown(path, o.UID, o.GID); err != nil {
+			return fmt.Errorf("failed to set owner of socket %s: %w", path, err)
+		}
+	}
+	if err := os.Chmod(path, o.Mode); err != nil {
+		return fmt.Errorf("failed to set mode of socket %s: %w", path, err)
+	}
+	return nil
+}
+
+// listenUnix creates a Unix socket at path with the given options. A stale
+// socket left at path is replaced; any other file there is an error.
+func listenUnix(path string, opts SocketOptions) (net.Listener, error) {
+	if err := EnsureParentDir(path); err != nil {
+		return nil, fmt.Errorf("failed to prepare directory for %s: %w", path, err)
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", path, err)
+	}
+	if err := opts.apply(path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// removeStaleSocket removes the socket at path, if any. It refuses to
+// remove anything that is not a socket, such as a mistyped path to a file.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check existing socket %s: %w", path, err)
+	}
+	if info.Mode().Type() != os.ModeSocket {
+		return fmt.Errorf("refusing to replace %s: it exists and is not a socket", path)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove existing socket %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseSocketOptions(t *testing.T) {
+	uid := strconv.Itoa(os.Geteuid())
+	gid := strconv.Itoa(os.Getegid())
+	tests := []struct {
+		name         string
+		mode         string
+		owner, group string
+		want         SocketOptions
+		wantErr      string
+	}{
+		{name: "defaults", want: SocketOptions{Mode: 0o600, UID: -1, GID: -1}},
+		{name: "mode", mode: "0660", want: SocketOptions{Mode: 0o660, UID: -1, GID: -1}},
+		{name: "mode without leading zero", mode: "640", want: SocketOptions{Mode: 0o640, UID: -1, GID: -1}},
+		{name: "numeric ids", owner: uid, group: gid, want: SocketOptions{Mode: 0o600, UID: os.Geteuid(), GID: os.Getegid()}},
+		{name: "setuid bit", mode: "4660", wantErr: "invalid socket mode"},
+		{name: "not octal", mode: "0689", wantErr: "invalid socket mode"},
+		{name: "unknown owner", owner: "no-such-user-arango-proxy", wantErr: "invalid socket owner"},
+		{name: "unknown group", group: "no-such-group-arango-proxy", wantErr: "invalid socket group"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseSocketOptions(tc.mode, tc.owner, tc.group, 0o600)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("ParseSocketOptions() error = %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseSocketOptions() error = %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("ParseSocketOptions() = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSocketOptions_Validate(t *testing.T) {
+	if os.Geteuid() == -1 {
+		t.Skip("no user ids on this platform")
+	}
+	own := SocketOptions{Mode: 0o640, UID: os.Geteuid(), GID: os.Getegid()}
+	if err := own.Validate(); err != nil {
+		t.Errorf("Validate() of the process's own ids = %v", err)
+	}
+	if os.Geteuid() == 0 {
+		t.Skip("root may give sockets to anyone")
+	}
+	other := SocketOptions{Mode: 0o640, UID: os.Geteuid() + 1, GID: -1}
+	if err := other.Validate(); err == nil {
+		t.Error("Validate() of another user's uid should fail without root")
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "sub", "proxy.sock")
+	opts := SocketOptions{Mode: 0o640, UID: os.Geteuid(), GID: os.Getegid()}
+	if os.Geteuid() == -1 {
+		opts.UID, opts.GID = -1, -1
+	}
+
+	listener, err := listenUnix(path, opts)
+	if err != nil {
+		t.Fatalf("listenUnix() error = %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o640 {
+		t.Errorf("socket mode = %v, %v; want 0640", info.Mode().Perm(), err)
+	}
+
+	// A socket left behind by a previous run is replaced.
+	if l, ok := listener.(*net.UnixListener); ok {
+		l.SetUnlinkOnClose(false)
+	}
+	listener.Close()
+	listener, err = listenUnix(path, opts)
+	if err != nil {
+		t.Fatalf("listenUnix() over a stale socket: %v", err)
+	}
+	listener.Close()
+
+	// Anything else is left alone.
+	file := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(file, []byte("listeners: []\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenUnix(file, opts); err == nil || !strings.Contains(err.Error(), "not a socket") {
+		t.Errorf("listenUnix() over a regular file: error = %v", err)
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("regular file removed: %v", err)
+	}
+}
@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// sdListenFDsStart is the first file descriptor systemd passes.
+	sdListenFDsStart = 3
+
+	// AdminListenerName is the FileDescriptorName= of an activated socket
+	// to serve the admin endpoint on. Other activated sockets serve the
+	// proxy.
+	AdminListenerName = "admin"
+)
+
+// ActivatedListener is a listening socket passed by systemd socket
+// activation.
+type ActivatedListener struct {
+	// Name is the socket's FileDescriptorName=, "unknown" if unset.
+	Name     string
+	Listener net.Listener
+}
+
+// SystemdListeners returns the listeners passed by systemd in LISTEN_FDS
+// and LISTEN_FDNAMES, or none if the process was not socket activated. The
+// variables are unset so that child processes do not inherit them.
+func SystemdListeners() ([]ActivatedListener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	count := os.Getenv("LISTEN_FDS")
+	if count == "" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", count)
+	}
+	var names []string
+	if value := os.Getenv("LISTEN_FDNAMES"); value != "" {
+		names = strings.Split(value, ":")
+	}
+	return listenersFromFDs(sdListenFDsStart, n, names)
+}
+
+// listenersFromFDs wraps count listening sockets starting at descriptor
+// start.
+func listenersFromFDs(start, count int, names []string) ([]ActivatedListener, error) {
+	listeners := make([]ActivatedListener, 0, count)
+	for i := 0; i < count; i++ {
+		fd := start + i
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		// FileListener duplicates the descriptor; closing the original
+		// keeps it from leaking into child processes.
+		f := os.NewFile(uintptr(fd), name)
+		listener, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Listener.Close()
+			}
+			return nil, fmt.Errorf("activated socket %d (%s): %w", fd, name, err)
+		}
+		listeners = append(listeners, ActivatedListener{Name: name, Listener: listener})
+	}
+	return listeners, nil
+}
+
+// activatedListener returns the first activated listener for which match
+// is true.
+func activatedListener(activated []ActivatedListener, match func(name string) bool) (net.Listener, bool) {
+	for _, a := range activated {
+		if match(a.Name) {
+			return a.Listener, true
+		}
+	}
+	return nil, false
+}
+
+// listenProxy returns the listener for l: the activated socket named
+// after it if systemd passed one, else a new socket at l.socket with l's
+// mode, owner and group. A listener without a name, that of roproxy or
+// rwproxy, takes any activated socket but the admin one. socketPath is the
+// file to remove on shutdown, empty when the socket belongs to systemd.
+func listenProxy(l *listenerConfig, activated []ActivatedListener) (listener net.Listener, socketPath string, err error) {
+	match := func(name string) bool { return name == l.name }
+	if l.name == "" {
+		match = func(name string) bool { return name != AdminListenerName }
+	}
+	if listener, ok := activatedListener(activated, match); ok {
+		log.Printf("using socket-activated listener %s", listener.Addr())
+		return listener, "", nil
+	}
+	listener, err = listenUnix(l.socket, l.options)
+	if err != nil {
+		return nil, "", err
+	}
+	log.Printf("created socket %s (%s)", l.socket, l.options)
+	return listener, l.socket, nil
+}
+
+// SdNotify sends state to the service manager over NOTIFY_SOCKET. It
+// reports false, without error, when the process was not started with
+// Type=notify.
+func SdNotify(state string) (bool, error) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return false, nil
+	}
+	if strings.HasPrefix(addr, "@") {
+		// Abstract socket namespace.
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return false, fmt.Errorf("sd_notify: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, fmt.Errorf("sd_notify: %w", err)
+	}
+	return true, nil
+}
+
+// sdNotify sends state, logging failures: the proxy works without the
+// service manager hearing from it, if not under Type=notify.
+func sdNotify(state string) {
+	if _, err := SdNotify(state); err != nil {
+		log.Printf("warning: %v", err)
+	}
+}
+
+// watchdogInterval returns how often to send WATCHDOG=1: half the
+// WATCHDOG_USEC systemd asked for, or zero if the watchdog is off.
+func watchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// startWatchdog pings the systemd watchdog until ctx is cancelled.
+func startWatchdog(ctx context.Context) {
+	interval := watchdogInterval()
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				sdNotify("WATCHDOG=1")
+			}
+		}
+	}()
+}
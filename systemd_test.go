@@ -0,0 +1,209 @@
+//go:build linux
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// listenNotifySocket starts a fake service manager notify socket and
+// points NOTIFY_SOCKET at it.
+func listenNotifySocket(t *testing.T) *net.UnixConn {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+	return conn
+}
+
+func readNotification(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 256)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("no notification: %v", err)
+	}
+	return string(buf[:n])
+}
+
+func TestSdNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if sent, err := SdNotify("READY=1"); sent || err != nil {
+		t.Errorf("SdNotify() without NOTIFY_SOCKET = %v, %v", sent, err)
+	}
+
+	conn := listenNotifySocket(t)
+	if sent, err := SdNotify("READY=1"); !sent || err != nil {
+		t.Fatalf("SdNotify() = %v, %v", sent, err)
+	}
+	if got := readNotification(t, conn); got != "READY=1" {
+		t.Errorf("notification = %q", got)
+	}
+
+	t.Setenv("NOTIFY_SOCKET", filepath.Join(t.TempDir(), "missing.sock"))
+	if _, err := SdNotify("READY=1"); err == nil {
+		t.Error("SdNotify() to a missing socket should fail")
+	}
+}
+
+func TestSdNotify_AbstractSocket(t *testing.T) {
+	name := "arango-proxy-test-" + strconv.Itoa(os.Getpid())
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: "\x00" + name, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", "@"+name)
+	if sent, err := SdNotify("STOPPING=1"); !sent || err != nil {
+		t.Fatalf("SdNotify() = %v, %v", sent, err)
+	}
+	if got := readNotification(t, conn); got != "STOPPING=1" {
+		t.Errorf("notification = %q", got)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_PID", "")
+	t.Setenv("WATCHDOG_USEC", "")
+	if got := watchdogInterval(); got != 0 {
+		t.Errorf("watchdogInterval() without WATCHDOG_USEC = %s", got)
+	}
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	if got := watchdogInterval(); got != 15*time.Second {
+		t.Errorf("watchdogInterval() = %s, want 15s", got)
+	}
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	if got := watchdogInterval(); got != 0 {
+		t.Errorf("watchdogInterval() for another process = %s", got)
+	}
+}
+
+func TestListenersFromFDs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "activated.sock")
+	original, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer original.Close()
+	f, err := original.(*net.UnixListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	activated, err := listenersFromFDs(fd, 1, []string{"proxy"})
+	if err != nil {
+		t.Fatalf("listenersFromFDs() error = %v", err)
+	}
+	if len(activated) != 1 || activated[0].Name != "proxy" {
+		t.Fatalf("listenersFromFDs() = %+v", activated)
+	}
+	listener := activated[0].Listener
+	defer listener.Close()
+
+	go func() {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept() on activated listener: %v", err)
+	}
+	conn.Close()
+
+	if _, err := listenersFromFDs(fd, 1, nil); err == nil {
+		t.Error("listenersFromFDs() on a closed descriptor should fail")
+	}
+}
+
+func TestSystemdListeners_OtherProcess(t *testing.T) {
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_FDNAMES", "proxy")
+	activated, err := SystemdListeners()
+	if err != nil || activated != nil {
+		t.Errorf("SystemdListeners() = %v, %v", activated, err)
+	}
+	for _, name := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		if _, ok := os.LookupEnv(name); ok {
+			t.Errorf("%s not unset", name)
+		}
+	}
+}
+
+func TestListenProxy_Activated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "activated.sock")
+	proxyListener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxyListener.Close()
+	adminListener, err := net.Listen("unix", filepath.Join(t.TempDir(), "admin.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer adminListener.Close()
+	activated := []ActivatedListener{{Name: AdminListenerName, Listener: adminListener}, {Name: "unknown", Listener: proxyListener}}
+
+	listener, socketPath, err := listenProxy(&listenerConfig{socket: filepath.Join(t.TempDir(), "unused.sock"), options: SocketOptions{Mode: ROSocketPermissions, UID: -1, GID: -1}}, activated)
+	if err != nil || listener != proxyListener || socketPath != "" {
+		t.Errorf("listenProxy() = %v, %q, %v; want the activated proxy listener", listener.Addr(), socketPath, err)
+	}
+}
+
+func TestServeUntilDone_NotifiesServiceManager(t *testing.T) {
+	notify := listenNotifySocket(t)
+	t.Setenv("WATCHDOG_PID", "")
+	t.Setenv("WATCHDOG_USEC", "20000")
+
+	upstream := startFakeUpstream(t, http.NotFoundHandler())
+	proxy := NewUnixReverseProxy(upstream, AllowReadOnly)
+	socket := filepath.Join(t.TempDir(), "proxy.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- serveUntilDone(ctx, []servedListener{{proxy: proxy, server: NewServerWithTimeouts(proxy), listener: listener, socketPath: socket}}, serveOptions{timeout: time.Second, notify: true})
+	}()
+
+	if got := readNotification(t, notify); got != "READY=1" {
+		t.Fatalf("first notification = %q, want READY=1", got)
+	}
+	if got := readNotification(t, notify); got != "WATCHDOG=1" {
+		t.Fatalf("notification = %q, want WATCHDOG=1", got)
+	}
+	cancel()
+	for {
+		got := readNotification(t, notify)
+		if got == "STOPPING=1" {
+			break
+		}
+		if got != "WATCHDOG=1" {
+			t.Fatalf("unexpected notification %q", got)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Errorf("serveUntilDone() = %v", err)
+	}
+}
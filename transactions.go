@@ -0,0 +1,287 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TransactionIDHeader carries the id of the stream transaction a request
+// runs in.
+const TransactionIDHeader = "x-arango-trx-id"
+
+const (
+	// transactionBodyPeekLimit bounds the body read to find the collections
+	// a stream transaction declares.
+	transactionBodyPeekLimit = 64 * 1024
+
+	// maxTransactionResponseSize bounds how much of a begin response is read
+	// to learn the new transaction's id.
+	maxTransactionResponseSize = 64 * 1024
+
+	// DefaultTransactionIdleTimeout is how long an unused transaction is
+	// tracked. ArangoDB aborts idle stream transactions well before this
+	// (--transaction.streaming-idle-timeout, at most 120s).
+	DefaultTransactionIdleTimeout = 10 * time.Minute
+)
+
+// TransactionCollections are the collections a stream transaction declares
+// in the body of POST /_api/transaction/begin.
+type TransactionCollections struct {
+	Read      []string
+	Write     []string
+	Exclusive []string
+}
+
+// All returns every declared collection.
+func (c *TransactionCollections) All() []string {
+	all := append(append([]string(nil), c.Read...), c.Write...)
+	return append(all, c.Exclusive...)
+}
+
+// parseTransactionCollections extracts the declared collections from a
+// begin request body. Each of read, write and exclusive may be a single name
+// or a list of names.
+func parseTransactionCollections(body []byte) (*TransactionCollections, error) {
+	if n, ok := countTopLevelKeys(body, "collections"); ok && n > 1 {
+		return nil, fmt.Errorf("ambiguous request: multiple %q fields", "collections")
+	}
+	var payload struct {
+		Collections json.RawMessage `json:"collections"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("unable to determine transaction collections: %w", err)
+	}
+	if len(payload.Collections) == 0 {
+		return nil, fmt.Errorf("transaction declares no collections")
+	}
+	for _, key := range []string{"read", "write", "exclusive"} {
+		if n, ok := countTopLevelKeys(payload.Collections, key); ok && n > 1 {
+			return nil, fmt.Errorf("ambiguous request: multiple %q fields", key)
+		}
+	}
+	var declared struct {
+		Read      json.RawMessage `json:"read"`
+		Write     json.RawMessage `json:"write"`
+		Exclusive json.RawMessage `json:"exclusive"`
+	}
+	if err := json.Unmarshal(payload.Collections, &declared); err != nil {
+		return nil, fmt.Errorf("unable to determine transaction collections: %w", err)
+	}
+	collections := &TransactionCollections{}
+	for _, field := range []struct {
+		raw  json.RawMessage
+		dst  *[]string
+		name string
+	}{
+		{declared.Read, &collections.Read, "read"},
+		{declared.Write, &collections.Write, "write"},
+		{declared.Exclusive, &collections.Exclusive, "exclusive"},
+	} {
+		names, err := collectionNames(field.raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s collections: %w", field.name, err)
+		}
+		*field.dst = names
+	}
+	return collections, nil
+}
+
+// collectionNames decodes a collection name or a list of names.
+func collectionNames(raw json.RawMessage) ([]string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var one string
+	if err := json.Unmarshal(raw, &one); err == nil {
+		return []string{one}, nil
+	}
+	var many []string
+	if err := json.Unmarshal(raw, &many); err != nil {
+		return nil, err
+	}
+	return many, nil
+}
+
+// isTransactionBegin reports whether the path is the stream transaction
+// begin endpoint.
+func (p requestPath) isTransactionBegin() bool {
+	return len(p.segments) == 3 && p.segments[0] == "_api" && p.segments[1] == "transaction" &&
+		p.segments[2] == "begin"
+}
+
+// transactionID returns the transaction id addressed by
+// /_api/transaction/<id>, if the path is one.
+func (p requestPath) transactionID() (string, bool) {
+	if len(p.segments) != 3 || p.segments[0] != "_api" || p.segments[1] != "transaction" ||
+		p.segments[2] == "begin" || p.segments[2] == "" {
+		return "", false
+	}
+	return p.segments[2], true
+}
+
+// openTransaction is a stream transaction begun through the proxy.
+type openTransaction struct {
+	db       string
+	owner    PeerCred
+	known    bool
+	lastUsed time.Time
+}
+
+// TransactionTracker remembers the stream transactions begun through a
+// proxy and who began them, so that a client can only use, commit or abort
+// its own transactions. The owner is the connecting process as identified
+// by PeerCred; where credentials are unavailable, all clients of the socket
+// share one identity and the tracker only stops the use of transactions not
+// begun through the socket.
+type TransactionTracker struct {
+	// IdleTimeout is how long a transaction is remembered after it was
+	// last used. Zero means DefaultTransactionIdleTimeout.
+	IdleTimeout time.Duration
+
+	mu   sync.Mutex
+	open map[string]*openTransaction
+	now  func() time.Time
+}
+
+// NewTransactionTracker returns an empty tracker.
+func NewTransactionTracker() *TransactionTracker {
+	return &TransactionTracker{open: make(map[string]*openTransaction), now: time.Now}
+}
+
+func (t *TransactionTracker) idleTimeout() time.Duration {
+	if t.IdleTimeout > 0 {
+		return t.IdleTimeout
+	}
+	return DefaultTransactionIdleTimeout
+}
+
+// check rejects requests that use a transaction the client did not begin
+// through this proxy, either via the x-arango-trx-id header or by
+// addressing /_api/transaction/<id>. A path that cannot be parsed is
+// rejected, since the transaction it uses cannot be told.
+func (t *TransactionTracker) check(r *http.Request) error {
+	reqPath, ok := parseRequestPath(r.URL.Path)
+	if !ok {
+		return fmt.Errorf("invalid path %s", r.URL.Path)
+	}
+	values := r.Header.Values(TransactionIDHeader)
+	if len(values) > 1 {
+		return fmt.Errorf("ambiguous request: multiple %s headers", TransactionIDHeader)
+	}
+	if len(values) == 1 {
+		if err := t.use(r, reqPath, values[0]); err != nil {
+			return err
+		}
+	}
+	if id, ok := reqPath.transactionID(); ok {
+		return t.use(r, reqPath, id)
+	}
+	return nil
+}
+
+func (t *TransactionTracker) use(r *http.Request, reqPath requestPath, id string) error {
+	cred, known := PeerCredFromContext(r.Context())
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	trx, ok := t.open[id]
+	if ok && t.now().Sub(trx.lastUsed) > t.idleTimeout() {
+		delete(t.open, id)
+		ok = false
+	}
+	if !ok || trx.known != known || (known && trx.owner != cred) {
+		return fmt.Errorf("transaction %s was not begun by this client", id)
+	}
+	if trx.db != reqPath.database() {
+		return fmt.Errorf("transaction %s belongs to database %s", id, trx.db)
+	}
+	trx.lastUsed = t.now()
+	return nil
+}
+
+// observe updates the tracker from the upstream response to r: it records
+// transactions that were begun and forgets those committed, aborted or no
+// longer known to ArangoDB. A begin response's body is read and replaced.
+func (t *TransactionTracker) observe(r *http.Request, resp *http.Response) error {
+	reqPath, ok := parseRequestPath(r.URL.Path)
+	if !ok {
+		return nil
+	}
+	if r.Method == http.MethodPost && reqPath.isTransactionBegin() {
+		if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+			return nil
+		}
+		return t.begin(r, reqPath, resp)
+	}
+	id, ok := reqPath.transactionID()
+	if !ok {
+		return nil
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		t.forget(id)
+	case (r.Method == http.MethodPut || r.Method == http.MethodDelete) && resp.StatusCode == http.StatusOK:
+		t.forget(id)
+	}
+	return nil
+}
+
+func (t *TransactionTracker) begin(r *http.Request, reqPath requestPath, resp *http.Response) error {
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxTransactionResponseSize))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(data), resp.Body), resp.Body}
+	if err != nil {
+		return fmt.Errorf("unable to read transaction begin response: %w", err)
+	}
+	var result struct {
+		Result struct {
+			ID string `json:"id"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil || result.Result.ID == "" {
+		return fmt.Errorf("unable to determine id of begun transaction")
+	}
+	cred, known := PeerCredFromContext(r.Context())
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.prune()
+	t.open[result.Result.ID] = &openTransaction{
+		db:       reqPath.database(),
+		owner:    cred,
+		known:    known,
+		lastUsed: t.now(),
+	}
+	return nil
+}
+
+func (t *TransactionTracker) forget(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.open, id)
+}
+
+// prune drops transactions idle for longer than the idle timeout. The
+// caller holds t.mu.
+func (t *TransactionTracker) prune() {
+	now := t.now()
+	for id, trx := range t.open {
+		if now.Sub(trx.lastUsed) > t.idleTimeout() {
+			delete(t.open, id)
+		}
+	}
+}
+
+// Len returns the number of transactions being tracked.
+func (t *TransactionTracker) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.open)
+}
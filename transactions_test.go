@@ -0,0 +1,224 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseTransactionCollections(t *testing.T) {
+	tests := []struct {
+		body    string
+		want    *TransactionCollections
+		wantErr bool
+	}{
+		{`{"collections": {"read": ["a", "b"]}}`, &TransactionCollections{Read: []string{"a", "b"}}, false},
+		{`{"collections": {"read": "a", "write": "b", "exclusive": ["c"]}}`,
+			&TransactionCollections{Read: []string{"a"}, Write: []string{"b"}, Exclusive: []string{"c"}}, false},
+		{`{"collections": {"write": null}}`, &TransactionCollections{}, false},
+		{`{}`, nil, true},
+		{`not json`, nil, true},
+		{`{"collections": {"read": 1}}`, nil, true},
+		{`{"collections": {"write": [], "write": ["b"]}}`, nil, true},
+		{`{"collections": {"read": ["a"]}, "Collections": {"write": ["b"]}}`, nil, true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.body, func(t *testing.T) {
+			got, err := parseTransactionCollections([]byte(tc.body))
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("expected error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseTransactionCollections() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAllowReadOnly_StreamTransactions(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		allow  bool
+	}{
+		{http.MethodPost, "/_api/transaction/begin", `{"collections": {"read": ["chunks"]}}`, true},
+		{http.MethodPost, "/_db/kb/_api/transaction/begin", `{"collections": {"read": "chunks"}}`, true},
+		{http.MethodPost, "/_api/transaction/begin", `{"collections": {"read": ["chunks"], "write": ["chunks"]}}`, false},
+		{http.MethodPost, "/_api/transaction/begin", `{"collections": {"exclusive": "chunks"}}`, false},
+		{http.MethodPost, "/_api/transaction/begin", `{}`, false},
+		{http.MethodPut, "/_api/transaction/12345", "", true},
+		{http.MethodDelete, "/_api/transaction/12345", "", true},
+		{http.MethodGet, "/_api/transaction/12345", "", true},
+		{http.MethodPost, "/_api/transaction", `{"action": "function () {}"}`, false},
+		{http.MethodPatch, "/_api/transaction/12345", "", false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.method+" "+tc.path+" "+tc.body, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, nil)
+			err := AllowReadOnly(req, mockBodyPeeker(tc.body))
+			if tc.allow && err != nil {
+				t.Errorf("should be allowed, got error: %v", err)
+			}
+			if !tc.allow && err == nil {
+				t.Error("should be denied")
+			}
+		})
+	}
+}
+
+func TestAllowReadWrite_StreamTransactions(t *testing.T) {
+	body := `{"collections": {"read": ["a"], "write": ["b"]}}`
+	req := httptest.NewRequest(http.MethodPost, "/_api/transaction/begin", nil)
+	if err := AllowReadWrite(req, mockBodyPeeker(body)); err != nil {
+		t.Errorf("write transaction should be allowed, got error: %v", err)
+	}
+	req = httptest.NewRequest(http.MethodPost, "/_api/transaction", nil)
+	if err := AllowReadWrite(req, mockBodyPeeker(`{"action": "function () {}"}`)); err == nil {
+		t.Error("JavaScript transactions should be denied")
+	}
+}
+
+func TestCollectionAccess_CheckTransaction(t *testing.T) {
+	access := &CollectionAccess{Allow: []string{"chunks", "embeddings"}}
+	for body, allow := range map[string]bool{
+		`{"collections": {"read": ["chunks"], "write": "embeddings"}}`: true,
+		`{"collections": {"read": ["chunks", "users"]}}`:               false,
+		`{"collections": {"write": ["users"]}}`:                        false,
+		`{"collections": {"exclusive": "users"}}`:                      false,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/_api/transaction/begin", nil)
+		err := access.check(req, mockBodyPeeker(body))
+		if allow && err != nil {
+			t.Errorf("%s should be allowed, got error: %v", body, err)
+		}
+		if !allow && err == nil {
+			t.Errorf("%s should be denied", body)
+		}
+	}
+}
+
+// fakeTransactionUpstream begins transactions with increasing ids and
+// accepts every other request.
+func fakeTransactionUpstream(t *testing.T) string {
+	t.Helper()
+	var nextID atomic.Int64
+	return startFakeUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/_api/transaction/begin") {
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, `{"error": false, "code": 201, "result": {"id": "%d", "status": "running"}}`, nextID.Add(1))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = io.WriteString(w, `{"error": false}`)
+	}))
+}
+
+func TestUnixReverseProxy_TransactionOwnership(t *testing.T) {
+	proxy := NewUnixReverseProxy(fakeTransactionUpstream(t), AllowReadWrite)
+	alice := PeerCred{UID: 1000, GID: 1000, PID: 10}
+	bob := PeerCred{UID: 1001, GID: 1001, PID: 20}
+
+	do := func(cred PeerCred, method, path, trxID string) *httptest.ResponseRecorder {
+		t.Helper()
+		var body io.Reader
+		if method == http.MethodPost {
+			body = strings.NewReader(`{"collections": {"write": ["chunks"]}}`)
+		}
+		req := httptest.NewRequest(method, path, body)
+		req = req.WithContext(WithPeerCred(req.Context(), cred))
+		if trxID != "" {
+			req.Header.Set(TransactionIDHeader, trxID)
+		}
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(alice, http.MethodPost, "/_api/transaction/begin", "")
+	if rec.Code != http.StatusCreated || !strings.Contains(rec.Body.String(), `"id": "1"`) {
+		t.Fatalf("begin: status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	if proxy.Transactions().Len() != 1 {
+		t.Fatalf("tracked transactions = %d, want 1", proxy.Transactions().Len())
+	}
+
+	if rec := do(alice, http.MethodGet, "/_api/document/chunks/k", "1"); rec.Code != http.StatusOK {
+		t.Errorf("owner using transaction: status = %d, want 200", rec.Code)
+	}
+	if rec := do(bob, http.MethodGet, "/_api/document/chunks/k", "1"); rec.Code != http.StatusForbidden {
+		t.Errorf("other client using transaction: status = %d, want 403", rec.Code)
+	}
+	if rec := do(bob, http.MethodPut, "/_api/transaction/1", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("other client committing transaction: status = %d, want 403", rec.Code)
+	}
+	if rec := do(alice, http.MethodGet, "/_db/other/_api/document/chunks/k", "1"); rec.Code != http.StatusForbidden {
+		t.Errorf("transaction used in another database: status = %d, want 403", rec.Code)
+	}
+	if rec := do(alice, http.MethodGet, "/_api/document/chunks/k", "999"); rec.Code != http.StatusForbidden {
+		t.Errorf("unknown transaction: status = %d, want 403", rec.Code)
+	}
+
+	if rec := do(alice, http.MethodPut, "/_api/transaction/1", ""); rec.Code != http.StatusOK {
+		t.Errorf("owner committing transaction: status = %d, want 200", rec.Code)
+	}
+	if proxy.Transactions().Len() != 0 {
+		t.Errorf("committed transaction still tracked")
+	}
+	if rec := do(alice, http.MethodGet, "/_api/document/chunks/k", "1"); rec.Code != http.StatusForbidden {
+		t.Errorf("committed transaction reused: status = %d, want 403", rec.Code)
+	}
+}
+
+func TestTransactionTracker_InvalidPath(t *testing.T) {
+	tracker := NewTransactionTracker()
+	for _, header := range []string{"", "1"} {
+		req := httptest.NewRequest(http.MethodGet, "/_api/../_api/document/chunks/k", nil)
+		if header != "" {
+			req.Header.Set(TransactionIDHeader, header)
+		}
+		if err := tracker.check(req); err == nil {
+			t.Errorf("check() with %s %q allowed an unparseable path", TransactionIDHeader, header)
+		}
+	}
+}
+
+func TestTransactionTracker_IdleTimeout(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tracker := NewTransactionTracker()
+	tracker.now = func() time.Time { return now }
+	tracker.open["1"] = &openTransaction{db: systemDatabase, lastUsed: now}
+
+	req := httptest.NewRequest(http.MethodGet, "/_api/document/c/k", nil)
+	req.Header.Set(TransactionIDHeader, "1")
+	if err := tracker.check(req); err != nil {
+		t.Fatalf("fresh transaction: %v", err)
+	}
+
+	now = now.Add(DefaultTransactionIdleTimeout + time.Second)
+	if err := tracker.check(req); err == nil {
+		t.Error("idle transaction should no longer be usable")
+	}
+	if tracker.Len() != 0 {
+		t.Error("idle transaction should be forgotten")
+	}
+
+	req.Header.Add(TransactionIDHeader, "2")
+	if err := tracker.check(req); err == nil || !strings.Contains(err.Error(), "ambiguous") {
+		t.Errorf("repeated header: got %v", err)
+	}
+}
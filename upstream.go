@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// UpstreamEndpoint is an address ArangoDB listens on.
+type UpstreamEndpoint struct {
+	// Network is "unix" or "tcp".
+	Network string
+	// Address is a socket path or host:port.
+	Address string
+	// TLS is set for ssl:// and https:// endpoints.
+	TLS bool
+}
+
+// ParseUpstreamEndpoint parses an endpoint in ArangoDB's notation,
+// unix:///path, tcp://host:port or ssl://host:port, or as an http:// or
+// https:// URL. An absolute path is a Unix socket.
+func ParseUpstreamEndpoint(s string) (UpstreamEndpoint, error) {
+	if strings.HasPrefix(s, "/") {
+		return UpstreamEndpoint{Network: "unix", Address: s}, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return UpstreamEndpoint{}, fmt.Errorf("invalid upstream %q: %w", s, err)
+	}
+	if u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return UpstreamEndpoint{}, fmt.Errorf("invalid upstream %q: credentials, query and fragment are not supported", s)
+	}
+	scheme := strings.ToLower(u.Scheme)
+	if scheme == "unix" {
+		if u.Host != "" || !strings.HasPrefix(u.Path, "/") {
+			return UpstreamEndpoint{}, fmt.Errorf("invalid upstream %q: want unix:///absolute/path", s)
+		}
+		return UpstreamEndpoint{Network: "unix", Address: u.Path}, nil
+	}
+
+	endpoint := UpstreamEndpoint{Network: "tcp"}
+	var defaultPort string
+	switch scheme {
+	case "tcp":
+	case "ssl":
+		endpoint.TLS = true
+	case "http":
+		defaultPort = "80"
+	case "https":
+		endpoint.TLS = true
+		defaultPort = "443"
+	default:
+		return UpstreamEndpoint{}, fmt.Errorf("invalid upstream %q: scheme must be unix, tcp, ssl, http or https", s)
+	}
+	if u.Path != "" && u.Path != "/" {
+		return UpstreamEndpoint{}, fmt.Errorf("invalid upstream %q: a path is not supported", s)
+	}
+	if u.Hostname() == "" {
+		return UpstreamEndpoint{}, fmt.Errorf("invalid upstream %q: missing host", s)
+	}
+	port := u.Port()
+	if port == "" {
+		if defaultPort == "" {
+			return UpstreamEndpoint{}, fmt.Errorf("invalid upstream %q: missing port", s)
+		}
+		port = defaultPort
+	}
+	endpoint.Address = net.JoinHostPort(u.Hostname(), port)
+	return endpoint, nil
+}
+
+// String returns the endpoint in ArangoDB's notation.
+func (e UpstreamEndpoint) String() string {
+	switch {
+	case e.Network == "unix":
+		return "unix://" + e.Address
+	case e.TLS:
+		return "ssl://" + e.Address
+	default:
+		return "tcp://" + e.Address
+	}
+}
+
+// UpstreamTLS configures TLS for ssl:// and https:// upstream endpoints.
+type UpstreamTLS struct {
+	// CAFile is a PEM bundle of the certificate authorities to trust
+	// instead of the system's.
+	CAFile string
+	// CertFile and KeyFile are a PEM client certificate and its key.
+	CertFile string
+	KeyFile  string
+	// ServerName is sent as SNI and verified against the server's
+	// certificate instead of the endpoint's host.
+	ServerName string
+}
+
+// IsZero reports whether no TLS option is set.
+func (t UpstreamTLS) IsZero() bool {
+	return t == UpstreamTLS{}
+}
+
+// config builds the TLS client configuration for a connection to host.
+func (t UpstreamTLS) config(host string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: t.ServerName}
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read upstream CA bundle: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("upstream CA bundle %s contains no certificates", t.CAFile)
+		}
+	}
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return nil, errors.New("upstream client certificate and key must be given together")
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load upstream client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// describe summarizes the options for logs. Files are identified by a
+// digest of their contents, so that a reload notices rotated certificates.
+func (t UpstreamTLS) describe() string {
+	parts := []string{"ca=system"}
+	if t.CAFile != "" {
+		parts[0] = "ca=" + describeFile(t.CAFile)
+	}
+	if t.CertFile != "" {
+		parts = append(parts, "cert="+describeFile(t.CertFile), "key="+describeFile(t.KeyFile))
+	}
+	if t.ServerName != "" {
+		parts = append(parts, "server_name="+t.ServerName)
+	}
+	return strings.Join(parts, " ")
+}
+
+func describeFile(path string) string {
+	digest, err := fileDigest(path)
+	if err != nil {
+		return path + " (unreadable)"
+	}
+	return path + " (sha256:" + digest + ")"
+}
+
+// fileDigest identifies the contents of a file.
+func fileDigest(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:6]), nil
+}
+
+// newTCPTransport returns a transport that sends requests, whatever their
+// URL, to endpoint over TCP, with TLS if the endpoint requires it.
+func newTCPTransport(endpoint UpstreamEndpoint, dialTimeout time.Duration, tlsConfig *tls.Config) http.RoundTripper {
+	transport := &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: dialTimeout}).DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: dialTimeout,
+		// HTTP/2 is negotiated with ALPN over TLS.
+		ForceAttemptHTTP2: true,
+		IdleConnTimeout:   upstreamIdleConnTimeout,
+	}
+	scheme := "http"
+	if endpoint.TLS {
+		scheme = "https"
+	}
+	return &endpointTransport{Transport: transport, scheme: scheme, host: endpoint.Address}
+}
+
+// endpointTransport directs requests addressed to upstreamBaseURL to a
+// TCP endpoint, so that the proxy and the clients sharing its transport
+// need not know where ArangoDB is.
+type endpointTransport struct {
+	*http.Transport
+	scheme string
+	host   string
+}
+
+func (t *endpointTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	out := *req
+	target := *req.URL
+	target.Scheme, target.Host = t.scheme, t.host
+	out.URL = &target
+	out.Host = ""
+	return t.Transport.RoundTrip(&out)
+}